@@ -1428,7 +1428,7 @@ func (sp *sstWriter) Run(ctx context.Context, wg *sync.WaitGroup) {
 		// Sort incoming KVs, which will be from multiple spans, into a single
 		// RocksDB instance.
 		types := sp.input.Types()
-		input := distsqlrun.MakeNoMetadataRowSource(sp.input, sp.output)
+		input := distsqlrun.MakeNoMetadataRowSource(sp.input, distsqlrun.ForwardMetadata(sp.output))
 		alloc := &sqlbase.DatumAlloc{}
 		store := engine.NewRocksDBMultiMap(sp.tempStorage)
 		defer store.Close(ctx)
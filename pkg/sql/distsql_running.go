@@ -281,6 +281,7 @@ type rowResultWriter interface {
 
 var _ distsqlrun.RowReceiver = &distSQLReceiver{}
 var _ distsqlrun.CancellableRowReceiver = &distSQLReceiver{}
+var _ distsqlrun.RowCopyingReceiver = &distSQLReceiver{}
 
 // makeDistSQLReceiver creates a distSQLReceiver.
 //
@@ -398,6 +399,10 @@ func (r *distSQLReceiver) ProducerDone() {
 	r.closed = true
 }
 
+// CopiesRows is part of the RowCopyingReceiver interface. The rows are decoded
+// into r.row, whose datums AddRow copies, so they are not retained.
+func (r *distSQLReceiver) CopiesRows() {}
+
 // SetCanceled is part of the CancellableRowReceiver interface.
 func (r *distSQLReceiver) SetCanceled() {
 	atomic.StoreInt32(&r.canceled, 1)
@@ -82,6 +82,78 @@ func GetAggregateInfo(
 	)
 }
 
+// getAggregationInfos validates the given aggregations against the types of
+// the input columns and returns, for each of them, the constructor of the
+// aggregate function and its result type.
+func getAggregationInfos(
+	aggregations []AggregatorSpec_Aggregation, inputTypes []sqlbase.ColumnType,
+) ([]func(*tree.EvalContext) tree.AggregateFunc, []sqlbase.ColumnType, error) {
+	constructors := make([]func(*tree.EvalContext) tree.AggregateFunc, len(aggregations))
+	outputTypes := make([]sqlbase.ColumnType, len(aggregations))
+	for i, aggInfo := range aggregations {
+		if aggInfo.FilterColIdx != nil {
+			col := *aggInfo.FilterColIdx
+			if col >= uint32(len(inputTypes)) {
+				return nil, nil, errors.Errorf("FilterColIdx out of range (%d)", col)
+			}
+			t := inputTypes[col].SemanticType
+			if t != sqlbase.ColumnType_BOOL && t != sqlbase.ColumnType_NULL {
+				return nil, nil, errors.Errorf(
+					"filter column %d must be of boolean type, not %s", *aggInfo.FilterColIdx, t,
+				)
+			}
+		}
+		argTypes := make([]sqlbase.ColumnType, len(aggInfo.ColIdx))
+		for j, c := range aggInfo.ColIdx {
+			if c >= uint32(len(inputTypes)) {
+				return nil, nil, errors.Errorf("ColIdx out of range (%d)", aggInfo.ColIdx)
+			}
+			argTypes[j] = inputTypes[c]
+		}
+		aggConstructor, retType, err := GetAggregateInfo(aggInfo.Func, argTypes...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if aggInfo.EmptyInput == AggregatorSpec_Aggregation_EMPTY_ZERO && zeroDatum(retType) == nil {
+			return nil, nil, errors.Errorf(
+				"%s aggregation can't result in zero on empty input: %s result", aggInfo.Func, retType.SQLString(),
+			)
+		}
+		constructors[i] = aggConstructor
+		outputTypes[i] = retType
+	}
+	return constructors, outputTypes, nil
+}
+
+// zeroDatum returns the zero value of a numeric type, or nil if the type isn't
+// numeric.
+func zeroDatum(typ sqlbase.ColumnType) tree.Datum {
+	switch typ.SemanticType {
+	case sqlbase.ColumnType_INT:
+		return tree.DZero
+	case sqlbase.ColumnType_FLOAT:
+		return tree.NewDFloat(0)
+	case sqlbase.ColumnType_DECIMAL:
+		return &tree.DDecimal{}
+	}
+	return nil
+}
+
+// setEmptyInputResults overrides the results of the aggregations in row, which
+// were computed over an empty input, according to their EmptyInput behavior.
+func setEmptyInputResults(
+	aggregations []AggregatorSpec_Aggregation, types []sqlbase.ColumnType, row sqlbase.EncDatumRow,
+) {
+	for i, a := range aggregations {
+		switch a.EmptyInput {
+		case AggregatorSpec_Aggregation_EMPTY_NULL:
+			row[i] = sqlbase.DatumToEncDatum(types[i], tree.DNull)
+		case AggregatorSpec_Aggregation_EMPTY_ZERO:
+			row[i] = sqlbase.DatumToEncDatum(types[i], zeroDatum(types[i]))
+		}
+	}
+}
+
 // aggregator is the processor core type that does "aggregation" in the SQL
 // sense. It groups rows and computes an aggregate for each group. The group is
 // configured using the group key and the aggregator can be configured with one
@@ -116,6 +188,12 @@ func newAggregator(
 	post *PostProcessSpec,
 	output RowReceiver,
 ) (*aggregator, error) {
+	if len(spec.ResultOrdering.Columns) > 0 {
+		return nil, errors.Errorf("a result ordering requires an input ordering")
+	}
+	if len(spec.CaseInsensitiveCols) > 0 {
+		return nil, errors.Errorf("case-insensitive group columns require an input ordering")
+	}
 	ag := &aggregator{
 		flowCtx:      flowCtx,
 		input:        input,
@@ -133,37 +211,16 @@ func newAggregator(
 	// grouped-by values for each bucket.  ag.funcs is updated to contain all
 	// the functions which need to be fed values.
 	ag.inputTypes = input.Types()
+	constructors, outputTypes, err := getAggregationInfos(spec.Aggregations, ag.inputTypes)
+	if err != nil {
+		return nil, err
+	}
 	for i, aggInfo := range spec.Aggregations {
-		if aggInfo.FilterColIdx != nil {
-			col := *aggInfo.FilterColIdx
-			if col >= uint32(len(ag.inputTypes)) {
-				return nil, errors.Errorf("FilterColIdx out of range (%d)", col)
-			}
-			t := ag.inputTypes[col].SemanticType
-			if t != sqlbase.ColumnType_BOOL && t != sqlbase.ColumnType_NULL {
-				return nil, errors.Errorf(
-					"filter column %d must be of boolean type, not %s", *aggInfo.FilterColIdx, t,
-				)
-			}
-		}
-		argTypes := make([]sqlbase.ColumnType, len(aggInfo.ColIdx))
-		for i, c := range aggInfo.ColIdx {
-			if c >= uint32(len(ag.inputTypes)) {
-				return nil, errors.Errorf("ColIdx out of range (%d)", aggInfo.ColIdx)
-			}
-			argTypes[i] = ag.inputTypes[c]
-		}
-		aggConstructor, retType, err := GetAggregateInfo(aggInfo.Func, argTypes...)
-		if err != nil {
-			return nil, err
-		}
-
-		ag.funcs[i] = ag.newAggregateFuncHolder(aggConstructor)
+		ag.funcs[i] = ag.newAggregateFuncHolder(constructors[i])
 		if aggInfo.Distinct {
 			ag.funcs[i].seen = make(map[string]struct{})
 		}
-
-		ag.outputTypes[i] = retType
+		ag.outputTypes[i] = outputTypes[i]
 	}
 	if err := ag.init(post, ag.outputTypes, flowCtx, output); err != nil {
 		return nil, err
@@ -189,6 +246,7 @@ func (ag *aggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTag(ctx, "Agg", nil)
 	ctx, span := processorSpan(ctx, "aggregator")
 	defer tracing.FinishSpan(span)
+	defer ag.recoverPanic(ctx, ag.input)
 
 	if log.V(2) {
 		log.Infof(ctx, "starting aggregation process")
@@ -204,7 +262,8 @@ func (ag *aggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	// Queries like `SELECT MAX(n) FROM t` expect a row of NULLs if nothing was
 	// aggregated.
-	if len(ag.buckets) < 1 && len(ag.groupCols) == 0 {
+	emptyInput := len(ag.buckets) < 1 && len(ag.groupCols) == 0
+	if emptyInput {
 		ag.buckets[""] = struct{}{}
 	}
 
@@ -225,6 +284,9 @@ func (ag *aggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
 			}
 			row[i] = sqlbase.DatumToEncDatum(ag.outputTypes[i], result)
 		}
+		if emptyInput {
+			setEmptyInputResults(ag.aggregations, ag.outputTypes, row)
+		}
 
 		consumerDone = !emitHelper(ctx, &ag.out, row, ProducerMetadata{})
 		if consumerDone {
@@ -388,6 +388,68 @@ func TestAggregator(t *testing.T) {
 	}
 }
 
+// TestAggregatorInputOrder verifies that the aggregator produces the same
+// results when its input rows are shuffled with different seeds.
+func TestAggregatorInputOrder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	input := make(sqlbase.EncDatumRows, 100)
+	for i := range input {
+		input[i] = sqlbase.EncDatumRow{intEncDatum(i % 7), intEncDatum(i)}
+	}
+	input[42][1] = nullEncDatum()
+
+	// SELECT @1, SUM(@2), COUNT(@2), MAX(@2) GROUP BY @1.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_SUM_INT, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_COUNT, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_MAX, ColIdx: []uint32{1}},
+		},
+	}
+	outputTypes := []sqlbase.ColumnType{intType, intType, intType, intType}
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	run := func(seed int64) sqlbase.EncDatumRows {
+		in := newShuffleRowSource(NewRowBuffer(twoIntCols, input, RowBufferArgs{}), seed)
+		out := NewRowBuffer(outputTypes, nil /* rows */, RowBufferArgs{})
+		ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ag.Run(context.Background(), nil)
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		return out.GetRowsNoMeta(t)
+	}
+
+	var a sqlbase.DatumAlloc
+	expected := run(1)
+	if len(expected) != 7 {
+		t.Fatalf("expected 7 groups, got %d", len(expected))
+	}
+	for _, seed := range []int64{2, 3} {
+		result := run(seed)
+		eq, err := expected.Equal(result, outputTypes, true /* orderless */, &a, &evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !eq {
+			t.Errorf("seed %d: expected %s, got %s",
+				seed, expected.String(outputTypes), result.String(outputTypes))
+		}
+	}
+}
+
 func BenchmarkAggregation(b *testing.B) {
 	const numCols = 1
 	const numRows = 1000
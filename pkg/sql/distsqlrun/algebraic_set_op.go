@@ -97,6 +97,7 @@ func (e *algebraicSetOp) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTag(ctx, "ExceptAll", nil)
 	ctx, span := processorSpan(ctx, "exceptAll")
 	defer tracing.FinishSpan(span)
+	defer e.recoverPanic(ctx, e.leftSource, e.rightSource)
 
 	log.VEventf(ctx, 2, "starting exceptAll set process")
 	defer log.VEventf(ctx, 2, "exiting exceptAll")
@@ -120,14 +121,18 @@ func (e *algebraicSetOp) Run(ctx context.Context, wg *sync.WaitGroup) {
 // right stream. It does not remove duplicates.
 func (e *algebraicSetOp) exceptAll(ctx context.Context) error {
 	leftGroup := makeStreamGroupAccumulator(
-		MakeNoMetadataRowSource(e.leftSource, e.out.output),
-		convertToColumnOrdering(e.ordering),
+		MakeNoMetadataRowSource(e.leftSource, ForwardMetadata(e.out.output)),
+		convertToColumnOrdering(e.ordering), true, /* nullsAreEqual */
 	)
 
 	rightGroup := makeStreamGroupAccumulator(
-		MakeNoMetadataRowSource(e.rightSource, e.out.output),
-		convertToColumnOrdering(e.ordering),
+		MakeNoMetadataRowSource(e.rightSource, ForwardMetadata(e.out.output)),
+		convertToColumnOrdering(e.ordering), true, /* nullsAreEqual */
 	)
+	leftGroup.setMaxBufferedRows(e.flowCtx.maxBufferedGroupRows(), nil /* spill */)
+	rightGroup.setMaxBufferedRows(e.flowCtx.maxBufferedGroupRows(), nil /* spill */)
+	defer leftGroup.close(ctx)
+	defer rightGroup.close(ctx)
 
 	leftRows, err := leftGroup.advanceGroup(e.evalCtx)
 	if err != nil {
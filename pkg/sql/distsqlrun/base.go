@@ -19,12 +19,15 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
@@ -37,6 +40,8 @@ const (
 	leftOuter
 	rightOuter
 	fullOuter
+	leftSemi
+	leftAnti
 )
 
 const rowChannelBufSize = 16
@@ -102,6 +107,18 @@ type CancellableRowReceiver interface {
 	SetCanceled()
 }
 
+// RowCopyingReceiver is a special type of RowReceiver that doesn't retain the
+// rows pushed to it: by the time Push() returns, the row has been copied or
+// fully consumed. Producers pushing to such a receiver are free to reuse the
+// memory of a row after pushing it (see ProcOutputHelper.enableOutputRowReuse).
+// Implemented by distSQLReceiver, which decodes the rows into datums.
+type RowCopyingReceiver interface {
+	RowReceiver
+
+	// CopiesRows is a marker method.
+	CopiesRows()
+}
+
 // RowSource is any component of a flow that produces rows that cam be consumed
 // by another component.
 type RowSource interface {
@@ -201,7 +218,12 @@ func sendTraceData(ctx context.Context, dst RowReceiver) {
 //
 // If cause is specified, it is forwarded to the consumer before all the drain
 // metadata. This is intended to have been the error, if any, that caused the
-// draining.
+// draining. Consumers like the DistSQLReceiver only keep the first error they
+// receive, so the cause must precede any (possibly derivative) errors drained
+// from srcs.
+//
+// Processors call DrainAndClose from Run once they're done emitting rows, so
+// any data rows they push to dst are received before the trailing metadata.
 //
 // srcs can be nil.
 //
@@ -229,20 +251,41 @@ func DrainAndClose(ctx context.Context, dst RowReceiver, cause error, srcs ...Ro
 }
 
 // NoMetadataRowSource is a wrapper on top of a RowSource that automatically
-// forwards metadata to a RowReceiver. Data rows are returned through an
-// interface similar to RowSource, except that, since metadata is taken care of,
-// only the data rows are returned.
+// forwards metadata to a sink. Data rows are returned through an interface
+// similar to RowSource, except that, since metadata is taken care of, only the
+// data rows are returned.
 //
 // The point of this struct is that it'd be burdensome for some row consumers to
 // have to deal with metadata.
 type NoMetadataRowSource struct {
 	src          RowSource
-	metadataSink RowReceiver
+	metadataSink func(ProducerMetadata)
+	// numMeta counts the metadata records passed to metadataSink.
+	numMeta int
+}
+
+// MakeNoMetadataRowSource builds a NoMetadataRowSource. All the metadata
+// records coming from src, including errors, are passed to metaSink. Errors are
+// also returned by NextRow(); see there.
+func MakeNoMetadataRowSource(src RowSource, metaSink func(ProducerMetadata)) NoMetadataRowSource {
+	return NoMetadataRowSource{src: src, metadataSink: metaSink}
 }
 
-// MakeNoMetadataRowSource builds a NoMetadataRowSource.
-func MakeNoMetadataRowSource(src RowSource, sink RowReceiver) NoMetadataRowSource {
-	return NoMetadataRowSource{src: src, metadataSink: sink}
+// ForwardMetadata returns a metadata sink for a NoMetadataRowSource that pushes
+// all the non-error metadata to dst. Errors are skipped since they are returned
+// by NextRow() and the consumer is expected to forward them itself when it
+// drains.
+func ForwardMetadata(dst RowReceiver) func(ProducerMetadata) {
+	return func(meta ProducerMetadata) {
+		if meta.Err != nil {
+			return
+		}
+		// We ignore the returned ConsumerStatus. There's no good way to use that
+		// status here; eventually the consumer of the NoMetadataRowSource will
+		// figure out the same status and act on it as soon as a non-metadata row
+		// is received.
+		_ = dst.Push(nil /* row */, meta)
+	}
 }
 
 // Types returns the source types.
@@ -253,25 +296,29 @@ func (rs *NoMetadataRowSource) Types() []sqlbase.ColumnType {
 // NextRow is analogous to RowSource.Next. If the producer sends an error, we
 // can't just forward it to metadataSink. We need to let the consumer know so
 // that it's not under the impression that everything is hunky-dory and it can
-// continue consuming rows. So, this interface returns the error. Just like with
-// a raw RowSource, the consumer should generally call ConsumerDone() and drain.
+// continue consuming rows. So, this interface returns the error (after having
+// passed it to the sink). Just like with a raw RowSource, the consumer should
+// generally call ConsumerDone() and drain.
 func (rs *NoMetadataRowSource) NextRow() (sqlbase.EncDatumRow, error) {
 	for {
 		row, meta := rs.src.Next()
-		if meta.Err != nil {
-			return nil, meta.Err
-		}
 		if meta.Empty() {
 			return row, nil
 		}
-		// We forward the metadata and ignore the returned ConsumerStatus. There's
-		// no good way to use that status here; eventually the consumer of this
-		// NoMetadataRowSource will figure out the same status and act on it as soon
-		// as a non-metadata row is received.
-		_ = rs.metadataSink.Push(nil /* row */, meta)
+		rs.numMeta++
+		rs.metadataSink(meta)
+		if meta.Err != nil {
+			return nil, meta.Err
+		}
 	}
 }
 
+// MetadataCount returns the number of metadata records that have been passed to
+// the sink so far.
+func (rs *NoMetadataRowSource) MetadataCount() int {
+	return rs.numMeta
+}
+
 // RowChannelMsg is the message used in the channels that implement
 // local physical streams (i.e. the RowChannel's).
 type RowChannelMsg struct {
@@ -290,11 +337,39 @@ type ProducerMetadata struct {
 	Err error
 	// TraceData is sent if snowball tracing is enabled.
 	TraceData []tracing.RecordedSpan
+	// ScannedSpans contains the key spans read by a processor. It is only sent
+	// if FlowCtx.Verbose is set.
+	ScannedSpans roachpb.Spans
+	// DecodeErr is an error encountered decoding a row that the processor
+	// skipped. Unlike Err, it does not fail the flow.
+	DecodeErr error
+	// NumSkippedRows is the number of rows a processor skipped because of
+	// decoding errors. It is sent once the processor is done.
+	NumSkippedRows uint64
+	// JoinReaderStats is sent by joinReaders once they're done, if
+	// FlowCtx.Verbose is set.
+	JoinReaderStats *JoinReaderStats
+	// GroupSizeStats is sent by processors that group their input through a
+	// streamGroupAccumulator once they're done, if FlowCtx.Verbose is set.
+	GroupSizeStats *GroupSizeStats
+	// Progress is sent periodically by long-running processors that know the
+	// estimated size of their input.
+	Progress *ProcessorProgress
+	// ReadTimestamp is sent by processors that picked the timestamp of their
+	// reads themselves under a bounded-staleness read (see
+	// FlowCtx.MaxStaleness), once they're done.
+	ReadTimestamp *hlc.Timestamp
+	// UnmatchedRows is sent by joinReaders that report the input rows without a
+	// match; see JoinReaderSpec.ReportUnmatchedRows.
+	UnmatchedRows *UnmatchedRows
 }
 
 // Empty returns true if none of the fields in metadata are populated.
 func (meta ProducerMetadata) Empty() bool {
-	return meta.Ranges == nil && meta.Err == nil && meta.TraceData == nil
+	return meta.Ranges == nil && meta.Err == nil && meta.TraceData == nil &&
+		meta.ScannedSpans == nil && meta.DecodeErr == nil && meta.NumSkippedRows == 0 &&
+		meta.JoinReaderStats == nil && meta.GroupSizeStats == nil && meta.Progress == nil &&
+		meta.ReadTimestamp == nil && meta.UnmatchedRows == nil
 }
 
 // RowChannel is a thin layer over a RowChannelMsg channel, which can be used to
@@ -483,6 +558,16 @@ type RowBuffer struct {
 		// records represent the data that has been buffered. Push appends a row
 		// to the back, Next removes a row from the front.
 		records []BufferedRecord
+
+		// pushLog contains all the records pushed to the RowBuffer, in order,
+		// if RowBufferArgs.RecordPushLog is set. Unlike records, it is not
+		// affected by Next() or by the consumer status.
+		pushLog []BufferedRecord
+
+		// lastRow is (a copy of) the last row pushed, and orderingErrs are the
+		// ordering violations detected, if RowBufferArgs.CompareRows is set.
+		lastRow      sqlbase.EncDatumRow
+		orderingErrs []error
 	}
 
 	// ProducerClosed is used when the RowBuffer is used as a RowReceiver; it is
@@ -521,6 +606,22 @@ type RowBufferArgs struct {
 	// If it returns an empty row and metadata, then RowBuffer.Next() is allowed
 	// to run normally. Otherwise, the values are returned from RowBuffer.Next().
 	OnNext func(*RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata)
+	// OnPush, if specified, is called as the first thing in the Push() method.
+	// The status it returns is applied to the RowBuffer as if ConsumerDone() or
+	// ConsumerClosed() had been called: it only replaces the ConsumerStatus if
+	// it is further along (e.g. NeedMoreRows doesn't undo a DrainRequested).
+	// This allows tests to decide the consumer's behavior per push.
+	OnPush func(row sqlbase.EncDatumRow, meta *ProducerMetadata) ConsumerStatus
+	// RecordPushLog, if set, makes the RowBuffer keep a log of every row and
+	// metadata record pushed to it, in order, regardless of the consumer's
+	// status. The log can be inspected with PushLog().
+	RecordPushLog bool
+	// CompareRows, if specified, makes the RowBuffer verify that the rows pushed
+	// to it are ordered: each row is compared with the previous one, and a
+	// failure is recorded if it is smaller. The function returns a negative
+	// value, zero or a positive value if a is respectively smaller than, equal
+	// to or larger than b. The failures can be inspected with OrderingErrors().
+	CompareRows func(a, b sqlbase.EncDatumRow) (int, error)
 }
 
 // NewRowBuffer creates a RowBuffer with the given schema and initial rows.
@@ -544,9 +645,28 @@ func (rb *RowBuffer) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) Consum
 	if rb.ProducerClosed {
 		panic("Push called after ProducerDone")
 	}
+	if rb.args.OnPush != nil {
+		status := rb.args.OnPush(row, &meta)
+		for {
+			cur := atomic.LoadUint32((*uint32)(&rb.ConsumerStatus))
+			if uint32(status) <= cur ||
+				atomic.CompareAndSwapUint32((*uint32)(&rb.ConsumerStatus), cur, uint32(status)) {
+				break
+			}
+		}
+	}
+	if rb.args.RecordPushLog {
+		rowCopy := row.Copy()
+		rb.mu.Lock()
+		rb.mu.pushLog = append(rb.mu.pushLog, BufferedRecord{Row: rowCopy, Meta: meta})
+		rb.mu.Unlock()
+	}
+	if rb.args.CompareRows != nil && row != nil {
+		rb.checkOrdering(row)
+	}
 	// We mimic the behavior of RowChannel.
 	storeRow := func() {
-		rowCopy := append(sqlbase.EncDatumRow(nil), row...)
+		rowCopy := row.Copy()
 		rb.mu.Lock()
 		rb.mu.records = append(rb.mu.records, BufferedRecord{Row: rowCopy, Meta: meta})
 		rb.mu.Unlock()
@@ -576,6 +696,47 @@ func (rb *RowBuffer) ProducerDone() {
 	rb.ProducerClosed = true
 }
 
+// PushLog returns all the records pushed to the RowBuffer so far, in order.
+// RowBufferArgs.RecordPushLog needs to be set.
+func (rb *RowBuffer) PushLog() []BufferedRecord {
+	if !rb.args.RecordPushLog {
+		panic("push log not recorded")
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.mu.pushLog
+}
+
+// checkOrdering compares a row pushed to the RowBuffer with the previous one
+// and records an error if they are out of order; see RowBufferArgs.CompareRows.
+func (rb *RowBuffer) checkOrdering(row sqlbase.EncDatumRow) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if prev := rb.mu.lastRow; prev != nil {
+		cmp, err := rb.args.CompareRows(row, prev)
+		if err != nil {
+			rb.mu.orderingErrs = append(rb.mu.orderingErrs, err)
+		} else if cmp < 0 {
+			rb.mu.orderingErrs = append(rb.mu.orderingErrs, fmt.Errorf(
+				"rows out of order: %s pushed after %s", row.String(rb.types), prev.String(rb.types),
+			))
+		}
+	}
+	rb.mu.lastRow = append(rb.mu.lastRow[:0], row...)
+}
+
+// OrderingErrors returns the ordering violations detected among the rows
+// pushed so far. The RowBuffer must have been created with
+// RowBufferArgs.CompareRows.
+func (rb *RowBuffer) OrderingErrors() []error {
+	if rb.args.CompareRows == nil {
+		panic("ordering not checked")
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.mu.orderingErrs
+}
+
 // Types is part of the RowSource interface.
 func (rb *RowBuffer) Types() []sqlbase.ColumnType {
 	if rb.types == nil {
@@ -628,6 +789,32 @@ func (e *Error) String() string {
 	return "<nil>"
 }
 
+// isRetryableKVError returns true if err is a KV error after which the
+// transaction (and with it the flow) can be retried, as opposed to a fatal
+// error. Retryable errors must be passed to the consumer as they are, so that
+// they reach the gateway as RetryableTxnErrors (see NewError).
+func isRetryableKVError(err error) bool {
+	switch err.(type) {
+	case *roachpb.UnhandledRetryableError, *roachpb.HandledRetryableTxnError:
+		return true
+	default:
+		return false
+	}
+}
+
+// isTransientKVError returns true if err is a KV error caused by a change in
+// the range topology (e.g. a range split or a lease transfer), after which the
+// same reads can be retried within the same transaction.
+func isTransientKVError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *roachpb.RangeKeyMismatchError, *roachpb.NotLeaseHolderError,
+		*roachpb.RangeNotFoundError, *roachpb.SendError:
+		return true
+	default:
+		return false
+	}
+}
+
 // NewError creates an Error from an error, to be sent on the wire. It will
 // recognize certain errors and marshall them accordingly, and everything
 // unrecognized is turned into a PGError with code "internal".
@@ -648,6 +835,45 @@ func NewError(err error) *Error {
 	}
 }
 
+// newMemoryBudgetError returns the error produced when an operation (op) of a
+// processor needs more memory than the limit it was given. All processors use
+// it so that clients can detect these errors uniformly through their SQLSTATE
+// (53200, out of memory).
+func newMemoryBudgetError(op string, limit int64) error {
+	return pgerror.NewErrorf(
+		pgerror.CodeOutOfMemoryError,
+		"%s: memory budget exceeded: limit of %d bytes", op, limit,
+	)
+}
+
+// newRowTooLargeError returns the error produced when a processor emits a row
+// larger than FlowCtx.MaxRowBytes. It has SQLSTATE 54000 (program limit
+// exceeded).
+func newRowTooLargeError(size, limit int64) error {
+	return pgerror.NewErrorf(
+		pgerror.CodeProgramLimitExceededError,
+		"row of %d bytes exceeds the maximum row size of %d bytes", size, limit,
+	)
+}
+
+// newProcessorPanicError returns the error reported when a processor panics;
+// see processorBase.recoverPanic. It has SQLSTATE XX000 (internal error), and
+// the stack trace of the panic as detail.
+func newProcessorPanicError(r interface{}, stack []byte) error {
+	return pgerror.NewErrorf(
+		pgerror.CodeInternalError, "internal error: processor panicked: %v", r,
+	).SetDetailf("stack trace:\n%s", stack)
+}
+
+// newDeadlineExceededError returns the error produced when a processor finds
+// that the deadline of its flow has passed (see FlowCtx.Deadline). Like
+// statement timeouts, it has SQLSTATE 57014 (query canceled).
+func newDeadlineExceededError(deadline time.Time) error {
+	return pgerror.NewErrorf(
+		pgerror.CodeQueryCanceledError, "flow deadline exceeded (deadline was %s)", deadline,
+	)
+}
+
 // ErrorDetail returns the payload as a Go error.
 func (e *Error) ErrorDetail() error {
 	if e == nil {
@@ -15,15 +15,69 @@
 package distsqlrun
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
 	"unsafe"
 
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
+// TestNoMetadataRowSource verifies that a NoMetadataRowSource passes the
+// metadata (including trailing errors) to its sink while the data rows flow
+// through a streamGroupAccumulator.
+func TestNoMetadataRowSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	expectedErr := errors.New("dummy")
+	in := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
+	rows := genEncDatumRowsInt([][]int{{1}, {1}, {2}})
+	in.Push(rows[0], ProducerMetadata{})
+	in.Push(nil /* row */, ProducerMetadata{TraceData: []tracing.RecordedSpan{{}}})
+	in.Push(rows[1], ProducerMetadata{})
+	in.Push(rows[2], ProducerMetadata{})
+	in.Push(nil /* row */, ProducerMetadata{Err: expectedErr})
+
+	var sunk []ProducerMetadata
+	src := MakeNoMetadataRowSource(in, func(meta ProducerMetadata) {
+		sunk = append(sunk, meta)
+	})
+	acc := makeStreamGroupAccumulator(
+		src, sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}},
+		true, /* nullsAreEqual */
+	)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	group, err := acc.advanceGroup(&evalCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := sqlbase.EncDatumRows(group).String(oneIntCol); res != "[[1] [1]]" {
+		t.Fatalf("unexpected first group %s", res)
+	}
+	if len(sunk) != 1 || sunk[0].TraceData == nil {
+		t.Fatalf("expected the trace data to be sunk, got %+v", sunk)
+	}
+
+	if _, err := acc.advanceGroup(&evalCtx); err != expectedErr {
+		t.Fatalf("expected error %v, got %v", expectedErr, err)
+	}
+	if len(sunk) != 2 || sunk[1].Err != expectedErr {
+		t.Fatalf("expected the error to be sunk, got %+v", sunk)
+	}
+	if n := acc.src.MetadataCount(); n != 2 {
+		t.Fatalf("expected 2 metadata records, got %d", n)
+	}
+}
+
 // Benchmark a pipeline of RowChannels.
 func BenchmarkRowChannelPipeline(b *testing.B) {
 	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
@@ -71,3 +125,136 @@ func BenchmarkRowChannelPipeline(b *testing.B) {
 		})
 	}
 }
+
+// TestDrainAndCloseOrdering verifies that, when a processor fails after having
+// emitted rows, the consumer receives the rows first, then the error that caused
+// the draining and, last, the metadata drained from the inputs. The
+// DistSQLReceiver reports the first error it gets to the user, so the cause must
+// come before the input errors.
+func TestDrainAndCloseOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	inputErr := errors.New("input error")
+	causeErr := errors.New("processor error")
+
+	in := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
+	in.Push(genEncDatumRowsInt([][]int{{2}})[0], ProducerMetadata{})
+	in.Push(nil /* row */, ProducerMetadata{Err: inputErr})
+	in.Push(genEncDatumRowsInt([][]int{{3}})[0], ProducerMetadata{})
+	in.ProducerDone()
+
+	out := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{RecordPushLog: true})
+	// The processor emits a row and then encounters an error.
+	out.Push(genEncDatumRowsInt([][]int{{1}})[0], ProducerMetadata{})
+	DrainAndClose(ctx, out, causeErr, in)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	if !in.Done {
+		t.Fatalf("input not drained")
+	}
+	log := out.PushLog()
+	if len(log) != 3 {
+		t.Fatalf("expected 3 records, got %d: %v", len(log), log)
+	}
+	if str, expected := log[0].Row.String(oneIntCol), "[1]"; str != expected {
+		t.Errorf("expected row %s first, got %s", expected, str)
+	}
+	// The first error is the one the user sees.
+	if log[1].Row != nil || log[1].Meta.Err != causeErr {
+		t.Errorf("expected cause %v, got row %v meta %+v", causeErr, log[1].Row, log[1].Meta)
+	}
+	// Rows left in the input are discarded; only its metadata is forwarded.
+	if log[2].Row != nil || log[2].Meta.Err != inputErr {
+		t.Errorf("expected input error %v, got row %v meta %+v", inputErr, log[2].Row, log[2].Meta)
+	}
+}
+
+// TestRowBufferCompareRows verifies that a RowBuffer with a row comparison
+// function detects the rows pushed out of order by a processor.
+func TestRowBufferCompareRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	var alloc sqlbase.DatumAlloc
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	compare := func(a, b sqlbase.EncDatumRow) (int, error) {
+		return a.Compare(twoIntCols, &alloc, ordering, &evalCtx, b)
+	}
+
+	testCases := []struct {
+		input    [][]int
+		expected []string
+	}{
+		{
+			input: [][]int{{1, 5}, {2, 0}, {2, 1}, {3, 0}},
+		},
+		{
+			// The noop processor passes its (misordered) input through.
+			input: [][]int{{1, 5}, {3, 0}, {2, 1}, {4, 0}, {0, 0}},
+			expected: []string{
+				"rows out of order: [2 1] pushed after [3 0]",
+				"rows out of order: [0 0] pushed after [4 0]",
+			},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%v", c.input), func(t *testing.T) {
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(c.input), RowBufferArgs{})
+			out := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{CompareRows: compare})
+			n, err := newNoopProcessor(&flowCtx, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			errs := out.OrderingErrors()
+			if len(errs) != len(c.expected) {
+				t.Fatalf("expected %d ordering errors, got %v", len(c.expected), errs)
+			}
+			for i, err := range errs {
+				if err.Error() != c.expected[i] {
+					t.Errorf("expected %q, got %q", c.expected[i], err)
+				}
+			}
+		})
+	}
+}
+
+// TestRowBufferOnPushStatus verifies that the status returned by
+// RowBufferArgs.OnPush doesn't undo a status set by the consumer.
+func TestRowBufferOnPushStatus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var status ConsumerStatus
+	rb := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{
+		OnPush: func(sqlbase.EncDatumRow, *ProducerMetadata) ConsumerStatus {
+			return status
+		},
+	})
+	row := sqlbase.EncDatumRow{intEncDatum(1)}
+	push := func(s ConsumerStatus, expected ConsumerStatus) {
+		t.Helper()
+		status = s
+		if res := rb.Push(row, ProducerMetadata{}); res != expected {
+			t.Fatalf("expected status %d, got %d", expected, res)
+		}
+	}
+
+	push(NeedMoreRows, NeedMoreRows)
+	rb.ConsumerDone()
+	push(NeedMoreRows, DrainRequested)
+	push(ConsumerClosed, ConsumerClosed)
+	push(DrainRequested, ConsumerClosed)
+}
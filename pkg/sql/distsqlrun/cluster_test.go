@@ -179,7 +179,7 @@ func TestClusterFlow(t *testing.T) {
 				{
 					Input: []InputSyncSpec{{
 						Type:     InputSyncSpec_ORDERED,
-						Ordering: Ordering{Columns: []Ordering_Column{{1, Ordering_Column_ASC}}},
+						Ordering: Ordering{Columns: []Ordering_Column{{ColIdx: 1, Direction: Ordering_Column_ASC}}},
 						Streams: []StreamEndpointSpec{
 							{Type: StreamEndpointSpec_REMOTE, StreamID: 0},
 							{Type: StreamEndpointSpec_REMOTE, StreamID: 1},
@@ -443,7 +443,7 @@ func TestLimitedBufferingDeadlock(t *testing.T) {
 				{
 					Input: []InputSyncSpec{{
 						Type:     InputSyncSpec_ORDERED,
-						Ordering: Ordering{Columns: []Ordering_Column{{0, Ordering_Column_ASC}}},
+						Ordering: Ordering{Columns: []Ordering_Column{{ColIdx: 0, Direction: Ordering_Column_ASC}}},
 						Streams: []StreamEndpointSpec{
 							{Type: StreamEndpointSpec_LOCAL, StreamID: 4},
 							{Type: StreamEndpointSpec_LOCAL, StreamID: 3},
@@ -667,7 +667,7 @@ func BenchmarkInfrastructure(b *testing.B) {
 					lastProc := ProcessorSpec{
 						Input: []InputSyncSpec{{
 							Type:        InputSyncSpec_ORDERED,
-							Ordering:    Ordering{Columns: []Ordering_Column{{0, Ordering_Column_ASC}}},
+							Ordering:    Ordering{Columns: []Ordering_Column{{ColIdx: 0, Direction: Ordering_Column_ASC}}},
 							Streams:     inStreams,
 							ColumnTypes: threeIntCols,
 						}},
@@ -0,0 +1,207 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// csvReader is a processor that parses the CSV text contained in the rows of
+// its input and emits a row for each record; see CSVReaderSpec.
+type csvReader struct {
+	processorBase
+
+	flowCtx *FlowCtx
+	input   RowSource
+	types   []sqlbase.ColumnType
+	options roachpb.CSVOptions
+
+	skipRecords   int
+	skipMalformed bool
+
+	// numSkippedRows is the number of malformed records that were skipped.
+	numSkippedRows uint64
+}
+
+var _ Processor = &csvReader{}
+
+func newCSVReader(
+	flowCtx *FlowCtx, spec *CSVReaderSpec, input RowSource, post *PostProcessSpec, output RowReceiver,
+) (*csvReader, error) {
+	inputTypes := input.Types()
+	if len(inputTypes) != 1 ||
+		(inputTypes[0].SemanticType != sqlbase.ColumnType_BYTES &&
+			inputTypes[0].SemanticType != sqlbase.ColumnType_STRING) {
+		return nil, errors.Errorf(
+			"CSVReader input must have a single BYTES or STRING column, got %v", inputTypes,
+		)
+	}
+	c := &csvReader{
+		flowCtx:       flowCtx,
+		input:         input,
+		types:         spec.ColumnTypes,
+		options:       spec.Options,
+		skipRecords:   int(spec.SkipRecords),
+		skipMalformed: spec.SkipMalformed,
+	}
+	if c.options.Comma == 0 {
+		c.options.Comma = ','
+	}
+	if err := c.init(post, c.types, flowCtx, output); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// csvChunkReader is an io.Reader over the text in the rows of a csvReader's
+// input. Metadata is forwarded to the csvReader's output as it is read.
+type csvChunkReader struct {
+	input NoMetadataRowSource
+	typ   sqlbase.ColumnType
+	alloc sqlbase.DatumAlloc
+	// buf is the part of the current chunk that hasn't been read yet.
+	buf []byte
+	// err is the error encountered reading the input, if any. It is kept
+	// separately so that it isn't confused with a parsing error.
+	err error
+}
+
+// Read is part of the io.Reader interface.
+func (r *csvChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		row, err := r.input.NextRow()
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		if row == nil {
+			return 0, io.EOF
+		}
+		if err := row[0].EnsureDecoded(&r.typ, &r.alloc); err != nil {
+			r.err = err
+			return 0, err
+		}
+		switch d := row[0].Datum.(type) {
+		case *tree.DBytes:
+			r.buf = []byte(*d)
+		case *tree.DString:
+			r.buf = []byte(*d)
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Run is part of the processor interface.
+func (c *csvReader) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "CSVReader", nil)
+	ctx, span := processorSpan(ctx, "csv reader")
+	defer tracing.FinishSpan(span)
+	defer c.recoverPanic(ctx, c.input)
+
+	if err := c.mainLoop(ctx); err != nil {
+		DrainAndClose(ctx, c.out.output, err /* cause */, c.input)
+	}
+}
+
+// mainLoop parses the input and emits the rows. If no error is returned, the
+// input has been drained and the output has been closed. If an error is
+// returned, the caller should drain the input and pass the error to the
+// consumer.
+func (c *csvReader) mainLoop(ctx context.Context) error {
+	in := &csvChunkReader{
+		input: MakeNoMetadataRowSource(c.input, ForwardMetadata(c.out.output)),
+		typ:   c.input.Types()[0],
+	}
+	cr := csv.NewReader(in)
+	cr.Comma = rune(c.options.Comma)
+	cr.Comment = rune(c.options.Comment)
+	cr.FieldsPerRecord = len(c.types)
+	cr.ReuseRecord = true
+
+	evalCtx := c.flowCtx.NewEvalCtx()
+	row := make(sqlbase.EncDatumRow, len(c.types))
+	for recordNum := 1; ; recordNum++ {
+		record, err := cr.Read()
+		if in.err != nil {
+			return in.err
+		}
+		if err == io.EOF {
+			break
+		}
+		if recordNum <= c.skipRecords {
+			// Skipped records don't need to be well formed.
+			continue
+		}
+		if err == nil {
+			err = c.parseRecord(record, evalCtx, row)
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "row %d", recordNum)
+			if !c.skipMalformed {
+				return err
+			}
+			log.VEventf(ctx, 1, "skipping malformed record: %s", err)
+			c.numSkippedRows++
+			_ = c.out.output.Push(nil /* row */, ProducerMetadata{DecodeErr: err})
+			continue
+		}
+		if !emitHelper(ctx, &c.out, row, ProducerMetadata{}, c.input) {
+			return nil
+		}
+	}
+
+	if c.numSkippedRows > 0 {
+		_ = c.out.output.Push(nil /* row */, ProducerMetadata{NumSkippedRows: c.numSkippedRows})
+	}
+	sendTraceData(ctx, c.out.output)
+	c.out.Close()
+	return nil
+}
+
+// parseRecord converts the fields of a record into the datums of row.
+func (c *csvReader) parseRecord(
+	record []string, evalCtx *tree.EvalContext, row sqlbase.EncDatumRow,
+) error {
+	for i, field := range record {
+		if c.options.Nullif != nil && field == *c.options.Nullif {
+			row[i] = sqlbase.DatumToEncDatum(c.types[i], tree.DNull)
+			continue
+		}
+		d, err := parser.ParseStringAs(c.types[i].ToDatumType(), field, evalCtx)
+		if err != nil {
+			return errors.Wrapf(err, "column %d", i+1)
+		}
+		row[i] = sqlbase.DatumToEncDatum(c.types[i], d)
+	}
+	return nil
+}
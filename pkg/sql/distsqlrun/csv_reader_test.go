@@ -0,0 +1,199 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// csvFixtureTypes is the schema of the table used in TestJoinReader:
+// (a INT, b INT, sum INT, s STRING).
+var csvFixtureTypes = []sqlbase.ColumnType{intType, intType, intType, strType}
+
+// runCSVReader runs a csvReader over the given chunks of text and returns the
+// rows it produced and the metadata it sent, in order.
+func runCSVReader(
+	t *testing.T, spec *CSVReaderSpec, chunks []string,
+) (sqlbase.EncDatumRows, []ProducerMetadata) {
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	bytesType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_BYTES}
+	input := make(sqlbase.EncDatumRows, len(chunks))
+	for i, chunk := range chunks {
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(bytesType, tree.NewDBytes(tree.DBytes(chunk))),
+		}
+	}
+	in := NewRowBuffer([]sqlbase.ColumnType{bytesType}, input, RowBufferArgs{})
+	out := &RowBuffer{}
+	c, err := newCSVReader(&flowCtx, spec, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+
+	var rows sqlbase.EncDatumRows
+	var metas []ProducerMetadata
+	for {
+		row, meta := out.Next()
+		if row == nil && meta.Empty() {
+			return rows, metas
+		}
+		if row != nil {
+			rows = append(rows, row)
+		} else {
+			metas = append(metas, meta)
+		}
+	}
+}
+
+// splitChunks splits text into chunks of at most n bytes.
+func splitChunks(text string, n int) []string {
+	var chunks []string
+	for len(text) > n {
+		chunks = append(chunks, text[:n])
+		text = text[n:]
+	}
+	return append(chunks, text)
+}
+
+func TestCSVReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Generate the rows of the fixture table, with a header, quoting the
+	// strings.
+	var buf bytes.Buffer
+	var expected sqlbase.EncDatumRows
+	buf.WriteString("a,b,sum,s\n")
+	for i, row := range makeJoinReaderFixtureRows() {
+		s := sqlutils.RowEnglishFn(i + 1)
+		fmt.Fprintf(
+			&buf, "%s,%s,%s,%q\n", row[0].Datum, row[1].Datum, row[2].Datum, string(*s.(*tree.DString)),
+		)
+		expected = append(expected, append(row, sqlbase.DatumToEncDatum(strType, s)))
+	}
+
+	for _, chunkSize := range []int{7, 1 << 20} {
+		t.Run(fmt.Sprintf("ChunkSize=%d", chunkSize), func(t *testing.T) {
+			spec := CSVReaderSpec{ColumnTypes: csvFixtureTypes, SkipRecords: 1}
+			rows, metas := runCSVReader(t, &spec, splitChunks(buf.String(), chunkSize))
+			if len(metas) != 0 {
+				t.Fatalf("unexpected metadata: %+v", metas)
+			}
+			if res, exp := rows.String(csvFixtureTypes), expected.String(csvFixtureTypes); res != exp {
+				t.Errorf("expected %s, got %s", exp, res)
+			}
+		})
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		nullif := "NULL"
+		spec := CSVReaderSpec{
+			Options: roachpb.CSVOptions{
+				Comma:   '|',
+				Comment: '#',
+				Nullif:  &nullif,
+			},
+			ColumnTypes: csvFixtureTypes,
+		}
+		text := "# A comment.\n" +
+			"1|2|3|\"one|two\"\n" +
+			"4|5|NULL|\"three \"\"four\"\"\"\n" +
+			"6|7|13|NULL\n"
+		rows, metas := runCSVReader(t, &spec, []string{text})
+		if len(metas) != 0 {
+			t.Fatalf("unexpected metadata: %+v", metas)
+		}
+		expected := `[[1 2 3 'one|two'] [4 5 NULL 'three "four"'] [6 7 13 NULL]]`
+		if res := rows.String(csvFixtureTypes); res != expected {
+			t.Errorf("expected %s, got %s", expected, res)
+		}
+	})
+}
+
+func TestCSVReaderMalformed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	text := "1,2,3,one\n" +
+		"x,2,3,two\n" + // INT column that isn't an integer.
+		"1,2\n" + // Missing fields.
+		"1,2,3,\"bad\"quote\n" + // Bad quoting.
+		"3,4,7,ok\n"
+
+	t.Run("Skip", func(t *testing.T) {
+		spec := CSVReaderSpec{ColumnTypes: csvFixtureTypes, SkipMalformed: true}
+		rows, metas := runCSVReader(t, &spec, []string{text})
+		expected := "[[1 2 3 'one'] [3 4 7 'ok']]"
+		if res := rows.String(csvFixtureTypes); res != expected {
+			t.Errorf("expected %s, got %s", expected, res)
+		}
+		var decodeErrs []string
+		var numSkipped uint64
+		for _, meta := range metas {
+			if meta.Err != nil {
+				t.Fatal(meta.Err)
+			}
+			if meta.DecodeErr != nil {
+				decodeErrs = append(decodeErrs, meta.DecodeErr.Error())
+			}
+			numSkipped += meta.NumSkippedRows
+		}
+		if len(decodeErrs) != 3 {
+			t.Fatalf("expected 3 decoding errors, got %v", decodeErrs)
+		}
+		for i, prefix := range []string{"row 2: column 1", "row 3", "row 4"} {
+			if !strings.HasPrefix(decodeErrs[i], prefix) {
+				t.Errorf("expected error starting with %q, got %q", prefix, decodeErrs[i])
+			}
+		}
+		if numSkipped != 3 {
+			t.Errorf("expected 3 skipped rows, got %d", numSkipped)
+		}
+	})
+
+	t.Run("Fail", func(t *testing.T) {
+		spec := CSVReaderSpec{ColumnTypes: csvFixtureTypes}
+		_, metas := runCSVReader(t, &spec, []string{text})
+		var err error
+		for _, meta := range metas {
+			if meta.Err != nil {
+				err = meta.Err
+			}
+		}
+		if !testutils.IsError(err, "^row 2: column 1") {
+			t.Fatalf("expected error for row 2, got %v", err)
+		}
+	})
+}
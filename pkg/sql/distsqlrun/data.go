@@ -15,6 +15,8 @@
 package distsqlrun
 
 import (
+	"github.com/pkg/errors"
+
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 )
@@ -30,6 +32,12 @@ func convertToColumnOrdering(specOrdering Ordering) sqlbase.ColumnOrdering {
 		} else {
 			ordering[i].Direction = encoding.Descending
 		}
+		switch c.NullsOrder {
+		case Ordering_Column_NULLS_FIRST:
+			ordering[i].NullsOrder = sqlbase.NullsFirst
+		case Ordering_Column_NULLS_LAST:
+			ordering[i].NullsOrder = sqlbase.NullsLast
+		}
 	}
 	return ordering
 }
@@ -46,6 +54,67 @@ func convertToSpecOrdering(columnOrdering sqlbase.ColumnOrdering) Ordering {
 		} else {
 			specOrdering.Columns[i].Direction = Ordering_Column_DESC
 		}
+		switch c.NullsOrder {
+		case sqlbase.NullsFirst:
+			specOrdering.Columns[i].NullsOrder = Ordering_Column_NULLS_FIRST
+		case sqlbase.NullsLast:
+			specOrdering.Columns[i].NullsOrder = Ordering_Column_NULLS_LAST
+		}
 	}
 	return specOrdering
 }
+
+// add records a group with the given number of rows.
+func (s *GroupSizeStats) add(size uint64) {
+	if s.NumGroups == 0 || size < s.MinSize {
+		s.MinSize = size
+	}
+	if size > s.MaxSize {
+		s.MaxSize = size
+	}
+	s.NumGroups++
+	s.TotalRows += size
+}
+
+// MeanSize returns the average number of rows in a group.
+func (s *GroupSizeStats) MeanSize() float64 {
+	if s.NumGroups == 0 {
+		return 0
+	}
+	return float64(s.TotalRows) / float64(s.NumGroups)
+}
+
+// addRow appends a row to the batch.
+func (u *UnmatchedRows) addRow(row sqlbase.EncDatumRow, alloc *sqlbase.DatumAlloc) error {
+	var buf []byte
+	for i := range row {
+		var err error
+		buf, err = row[i].Encode(&u.Types[i], alloc, sqlbase.DatumEncoding_VALUE, buf)
+		if err != nil {
+			return err
+		}
+	}
+	u.Rows = append(u.Rows, buf)
+	return nil
+}
+
+// DecodeRows decodes the rows of the batch.
+func (u *UnmatchedRows) DecodeRows() (sqlbase.EncDatumRows, error) {
+	rows := make(sqlbase.EncDatumRows, len(u.Rows))
+	for i, buf := range u.Rows {
+		rows[i] = make(sqlbase.EncDatumRow, len(u.Types))
+		for j := range u.Types {
+			var err error
+			rows[i][j], buf, err = sqlbase.EncDatumFromBuffer(
+				&u.Types[j], sqlbase.DatumEncoding_VALUE, buf,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(buf) != 0 {
+			return nil, errors.Errorf("%d trailing bytes in unmatched row %d", len(buf), i)
+		}
+	}
+	return rows, nil
+}
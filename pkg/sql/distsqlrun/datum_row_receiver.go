@@ -0,0 +1,108 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// DatumRowReceiver is an implementation of RowReceiver that decodes each row
+// pushed to it into datums, according to the schema of the rows, and
+// accumulates them in memory. It allows tools and tests to get at the native
+// values of the output of processors. The metadata pushed to it is accumulated
+// as well; an error encountered decoding a row is recorded as metadata
+// carrying the error, after which the DatumRowReceiver asks the producer to
+// drain.
+type DatumRowReceiver struct {
+	types []sqlbase.ColumnType
+
+	mu struct {
+		syncutil.Mutex
+		rows  []tree.Datums
+		meta  []ProducerMetadata
+		alloc sqlbase.DatumAlloc
+		// decodeErr is set once a row could not be decoded; rows pushed
+		// afterwards are ignored.
+		decodeErr bool
+	}
+
+	// ProducerClosed is set to true when the sender calls ProducerDone().
+	ProducerClosed bool
+}
+
+var _ RowCopyingReceiver = &DatumRowReceiver{}
+
+// NewDatumRowReceiver creates a DatumRowReceiver for rows with the given
+// schema.
+func NewDatumRowReceiver(types []sqlbase.ColumnType) *DatumRowReceiver {
+	return &DatumRowReceiver{types: types}
+}
+
+// Push is part of the RowReceiver interface.
+func (r *DatumRowReceiver) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	if r.ProducerClosed {
+		panic("Push called after ProducerDone")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !meta.Empty() {
+		r.mu.meta = append(r.mu.meta, meta)
+	} else if !r.mu.decodeErr {
+		datums := make(tree.Datums, len(row))
+		for i := range row {
+			if err := row[i].EnsureDecoded(&r.types[i], &r.mu.alloc); err != nil {
+				r.mu.meta = append(r.mu.meta, ProducerMetadata{Err: err})
+				r.mu.decodeErr = true
+				break
+			}
+			datums[i] = row[i].Datum
+		}
+		if !r.mu.decodeErr {
+			r.mu.rows = append(r.mu.rows, datums)
+		}
+	}
+	if r.mu.decodeErr {
+		return DrainRequested
+	}
+	return NeedMoreRows
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (r *DatumRowReceiver) ProducerDone() {
+	if r.ProducerClosed {
+		panic("DatumRowReceiver already closed")
+	}
+	r.ProducerClosed = true
+}
+
+// Rows returns the decoded rows pushed so far, in order.
+func (r *DatumRowReceiver) Rows() []tree.Datums {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.rows
+}
+
+// Meta returns the metadata pushed so far, in order, including the errors
+// encountered decoding rows.
+func (r *DatumRowReceiver) Meta() []ProducerMetadata {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.meta
+}
+
+// CopiesRows is part of the RowCopyingReceiver interface.
+func (r *DatumRowReceiver) CopiesRows() {}
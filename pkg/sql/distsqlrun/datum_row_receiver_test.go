@@ -0,0 +1,113 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestDatumRowReceiver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT, b INT, sum INT, s STRING, PRIMARY KEY (a,b)",
+		99,
+		sqlutils.ToRowFn(
+			func(row int) tree.Datum { return tree.NewDInt(tree.DInt(row / 10)) },
+			func(row int) tree.Datum { return tree.NewDInt(tree.DInt(row % 10)) },
+			func(row int) tree.Datum { return tree.NewDInt(tree.DInt(row/10 + row%10)) },
+			sqlutils.RowEnglishFn,
+		))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt([][]int{{0, 2}, {1, 5}, {3, 4}}), RowBufferArgs{})
+	out := NewDatumRowReceiver(threeIntCols)
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 2}}
+	jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &post, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	for _, meta := range out.Meta() {
+		if meta.Err != nil {
+			t.Fatal(meta.Err)
+		}
+	}
+	expected := [][]int64{{0, 2, 2}, {1, 5, 6}, {3, 4, 7}}
+	rows := out.Rows()
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %d rows, got %d", len(expected), len(rows))
+	}
+	for i, row := range rows {
+		for j, d := range row {
+			if v, ok := d.(*tree.DInt); !ok || int64(*v) != expected[i][j] {
+				t.Errorf("row %d, column %d: expected %d, got %s", i, j, expected[i][j], d)
+			}
+		}
+	}
+
+	// Metadata is accumulated, and decoding errors are reported as metadata.
+	out = NewDatumRowReceiver(oneIntCol)
+	bad := sqlbase.EncDatumFromEncoded(&intType, sqlbase.DatumEncoding_ASCENDING_KEY, []byte{0xff})
+	pushes := []struct {
+		row      sqlbase.EncDatumRow
+		meta     ProducerMetadata
+		expected ConsumerStatus
+	}{
+		{row: sqlbase.EncDatumRow{intEncDatum(1)}, expected: NeedMoreRows},
+		{meta: ProducerMetadata{Err: errors.New("producer error")}, expected: NeedMoreRows},
+		{row: sqlbase.EncDatumRow{nullEncDatum()}, expected: NeedMoreRows},
+		{row: sqlbase.EncDatumRow{bad}, expected: DrainRequested},
+		{row: sqlbase.EncDatumRow{intEncDatum(2)}, expected: DrainRequested},
+	}
+	for i, p := range pushes {
+		if status := out.Push(p.row, p.meta); status != p.expected {
+			t.Errorf("push %d: expected status %d, got %d", i, p.expected, status)
+		}
+	}
+	out.ProducerDone()
+	if rows := out.Rows(); len(rows) != 2 || rows[0][0].Compare(&evalCtx, tree.NewDInt(1)) != 0 ||
+		rows[1][0] != tree.DNull {
+		t.Errorf("unexpected rows %v", rows)
+	}
+	meta := out.Meta()
+	if len(meta) != 2 || meta[0].Err.Error() != "producer error" || meta[1].Err == nil {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+}
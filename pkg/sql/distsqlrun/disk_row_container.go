@@ -16,6 +16,7 @@ package distsqlrun
 
 import (
 	"context"
+	"math"
 
 	"github.com/pkg/errors"
 
@@ -26,6 +27,27 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
 )
 
+// diskRowEncoding is the format in which a diskRowContainer stores its rows;
+// see diskRowContainer.setEncoding. In both formats, the ordering columns are
+// key-encoded at the start of the keys, so that the rows are sorted according to
+// the ordering of the container.
+type diskRowEncoding int
+
+const (
+	// diskRowValueEncoding is the default, compact format: the columns that are
+	// not part of the ordering are value-encoded in the values. Rows that are
+	// equal on the ordering columns are stored in the order they were added.
+	diskRowValueEncoding diskRowEncoding = iota
+	// diskRowKeyEncoding stores the columns that are not part of the ordering
+	// in the keys too, after the ordering columns (in ascending order), except
+	// for the columns with composite key encodings, which are still stored in
+	// the values. The rows are then sorted on all these columns, and decoding
+	// them doesn't involve the values in most cases, at the cost of the larger
+	// size of key encodings. All the columns must have types that can be
+	// key-encoded.
+	diskRowKeyEncoding
+)
+
 // diskRowContainer is a sortableRowContainer that stores rows on disk according
 // to the ordering specified in diskRowContainer.ordering. The underlying store
 // is a SortedDiskMap so the sorting itself is delegated. Use an iterator
@@ -40,6 +62,12 @@ type diskRowContainer struct {
 	scratchVal    []byte
 	scratchEncRow sqlbase.EncDatumRow
 
+	// If bufferAcc is set, the memory used by the rows buffered in bufferedRows
+	// is accounted for in it; see initBufferAccounting. bufferedBytes is the
+	// size of these rows.
+	bufferAcc     *mon.BoundAccount
+	bufferedBytes int64
+
 	// rowID is used as a key suffix to prevent duplicate rows from overwriting
 	// each other.
 	rowID uint64
@@ -51,6 +79,12 @@ type diskRowContainer struct {
 	// encodings keeps around the DatumEncoding equivalents of the encoding
 	// directions in ordering to avoid conversions in hot paths.
 	encodings []sqlbase.DatumEncoding
+	// rowEncoding is the format of the rows; see setEncoding.
+	rowEncoding diskRowEncoding
+	// keyIdxs holds the indexes of the columns that are not part of the ordering
+	// but that we encode in the keys, after the ordering columns (with the
+	// diskRowKeyEncoding only).
+	keyIdxs []int
 	// valueIdxs holds the indexes of the columns that we encode as values. The
 	// columns described by ordering will be encoded as keys. See
 	// makeDiskRowContainer() for more encoding specifics.
@@ -61,6 +95,10 @@ type diskRowContainer struct {
 
 var _ sortableRowContainer = &diskRowContainer{}
 
+// diskRowContainerBufferBytes is the maximum size of the rows a diskRowContainer
+// that accounts for its buffered rows buffers before flushing them to disk.
+const diskRowContainerBufferBytes = 64 << 10
+
 // makeDiskRowContainer creates a diskRowContainer with the given engine as the
 // underlying store that rows are stored on.
 // Arguments:
@@ -90,31 +128,55 @@ func makeDiskRowContainer(
 	// that the sorting can be delegated to the underlying SortedDiskMap. To
 	// avoid converting encoding.Direction to sqlbase.DatumEncoding we do this
 	// once at initialization and store the conversions in d.encodings.
-	// We encode the other columns as values. The indexes of these columns are
-	// kept around in d.valueIdxs to have them ready in hot paths.
+	// We encode the other columns as values (or, with the diskRowKeyEncoding,
+	// as keys following the ordering columns). The indexes of these columns are
+	// kept around in d.keyIdxs and d.valueIdxs to have them ready in hot paths.
 	// For composite columns that are specified in d.ordering, the Datum is
 	// encoded both in the key for comparison and in the value for decoding.
+	d.initColumnIdxs()
+
+	d.encodings = make([]sqlbase.DatumEncoding, len(d.ordering))
+	for i, orderInfo := range ordering {
+		d.encodings[i] = sqlbase.EncodingDirToDatumEncoding(orderInfo.Direction)
+	}
+
+	return d
+}
+
+// initColumnIdxs computes keyIdxs and valueIdxs according to the ordering and
+// the row encoding.
+func (d *diskRowContainer) initColumnIdxs() {
 	orderingIdxs := make(map[int]struct{})
 	for _, orderInfo := range d.ordering {
 		orderingIdxs[orderInfo.ColIdx] = struct{}{}
 	}
+	d.keyIdxs = d.keyIdxs[:0]
 	d.valueIdxs = make([]int, 0, len(d.types))
 	for i := range d.types {
+		_, inOrdering := orderingIdxs[i]
 		// TODO(asubiotto): A datum of a type for with HasCompositeKeyEncoding
 		// returns true may not necessarily need to be encoded in the value, so
 		// make this more fine-grained. See IsComposite() methods in
 		// pkg/sql/parser/datum.go.
-		if _, ok := orderingIdxs[i]; !ok || sqlbase.HasCompositeKeyEncoding(d.types[i].SemanticType) {
+		composite := sqlbase.HasCompositeKeyEncoding(d.types[i].SemanticType)
+		switch {
+		case inOrdering && !composite:
+		case !inOrdering && !composite && d.rowEncoding == diskRowKeyEncoding:
+			d.keyIdxs = append(d.keyIdxs, i)
+		default:
 			d.valueIdxs = append(d.valueIdxs, i)
 		}
 	}
+}
 
-	d.encodings = make([]sqlbase.DatumEncoding, len(d.ordering))
-	for i, orderInfo := range ordering {
-		d.encodings[i] = sqlbase.EncodingDirToDatumEncoding(orderInfo.Direction)
+// setEncoding sets the format in which the rows are stored. The default is
+// diskRowValueEncoding. Must be called before any row is added.
+func (d *diskRowContainer) setEncoding(enc diskRowEncoding) {
+	if d.rowID != 0 {
+		panic("cannot change the encoding of a diskRowContainer with rows")
 	}
-
-	return d
+	d.rowEncoding = enc
+	d.initColumnIdxs()
 }
 
 func (d *diskRowContainer) AddRow(ctx context.Context, row sqlbase.EncDatumRow) error {
@@ -130,6 +192,13 @@ func (d *diskRowContainer) AddRow(ctx context.Context, row sqlbase.EncDatumRow)
 			return err
 		}
 	}
+	for _, i := range d.keyIdxs {
+		var err error
+		d.scratchKey, err = row[i].Encode(&d.types[i], &d.datumAlloc, sqlbase.DatumEncoding_ASCENDING_KEY, d.scratchKey)
+		if err != nil {
+			return err
+		}
+	}
 	for _, i := range d.valueIdxs {
 		var err error
 		d.scratchVal, err = row[i].Encode(&d.types[i], &d.datumAlloc, sqlbase.DatumEncoding_VALUE, d.scratchVal)
@@ -141,9 +210,21 @@ func (d *diskRowContainer) AddRow(ctx context.Context, row sqlbase.EncDatumRow)
 	// Put a unique row to keep track of duplicates. Note that this will not
 	// mess with key decoding.
 	d.scratchKey = encoding.EncodeUvarintAscending(d.scratchKey, d.rowID)
-	if err := d.diskAcc.Grow(ctx, int64(len(d.scratchKey)+len(d.scratchVal))); err != nil {
+	size := int64(len(d.scratchKey) + len(d.scratchVal))
+	if err := d.diskAcc.Grow(ctx, size); err != nil {
 		return errors.Wrapf(err, "this query requires additional disk space")
 	}
+	if d.bufferAcc != nil {
+		if d.bufferedBytes+size > diskRowContainerBufferBytes {
+			if err := d.flush(ctx); err != nil {
+				return err
+			}
+		}
+		if err := d.bufferAcc.Grow(ctx, size); err != nil {
+			return err
+		}
+		d.bufferedBytes += size
+	}
 	if err := d.bufferedRows.Put(d.scratchKey, d.scratchVal); err != nil {
 		return err
 	}
@@ -153,6 +234,30 @@ func (d *diskRowContainer) AddRow(ctx context.Context, row sqlbase.EncDatumRow)
 	return nil
 }
 
+// initBufferAccounting makes the container account for the memory used by the
+// rows that are buffered before being written to disk in acc. The rows are then
+// flushed once they use diskRowContainerBufferBytes. Must be called before any
+// row is added.
+func (d *diskRowContainer) initBufferAccounting(acc *mon.BoundAccount) {
+	// The batch writer must not flush on its own, or we would lose track of the
+	// buffered rows.
+	d.bufferedRows = d.diskMap.NewBatchWriterCapacity(math.MaxInt32)
+	d.bufferAcc = acc
+}
+
+// flush writes the buffered rows to disk and releases the memory accounted for
+// them.
+func (d *diskRowContainer) flush(ctx context.Context) error {
+	if err := d.bufferedRows.Flush(); err != nil {
+		return err
+	}
+	if d.bufferAcc != nil {
+		d.bufferAcc.Shrink(ctx, d.bufferedBytes)
+		d.bufferedBytes = 0
+	}
+	return nil
+}
+
 // Sort is a noop because the use of a SortedDiskMap as the underlying store
 // keeps the rows in sorted order.
 func (d *diskRowContainer) Sort(context.Context) {}
@@ -163,6 +268,10 @@ func (d *diskRowContainer) Close(ctx context.Context) {
 	_ = d.bufferedRows.Close(ctx)
 	d.diskMap.Close(ctx)
 	d.diskAcc.Close(ctx)
+	if d.bufferAcc != nil {
+		d.bufferAcc.Shrink(ctx, d.bufferedBytes)
+		d.bufferedBytes = 0
+	}
 }
 
 // keyValToRow decodes a key and a value byte slice stored with AddRow() into
@@ -187,6 +296,13 @@ func (d *diskRowContainer) keyValToRow(k []byte, v []byte) (sqlbase.EncDatumRow,
 			return nil, errors.Wrap(err, "unable to decode row")
 		}
 	}
+	for _, i := range d.keyIdxs {
+		var err error
+		d.scratchEncRow[i], k, err = sqlbase.EncDatumFromBuffer(&d.types[i], sqlbase.DatumEncoding_ASCENDING_KEY, k)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to decode row")
+		}
+	}
 	for _, i := range d.valueIdxs {
 		var err error
 		d.scratchEncRow[i], v, err = sqlbase.EncDatumFromBuffer(&d.types[i], sqlbase.DatumEncoding_VALUE, v)
@@ -206,7 +322,7 @@ type diskRowIterator struct {
 var _ rowIterator = diskRowIterator{}
 
 func (d *diskRowContainer) NewIterator(ctx context.Context) rowIterator {
-	if err := d.bufferedRows.Flush(); err != nil {
+	if err := d.flush(ctx); err != nil {
 		log.Fatal(ctx, err)
 	}
 	return diskRowIterator{rowContainer: d, SortedDiskMapIterator: d.diskMap.NewIterator()}
@@ -112,56 +112,60 @@ func TestDiskRowContainer(t *testing.T) {
 	)
 	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
 	defer diskMonitor.Stop(ctx)
+	rowEncodings := []diskRowEncoding{diskRowValueEncoding, diskRowKeyEncoding}
 	t.Run("EncodeDecode", func(t *testing.T) {
 		for i := 0; i < 100; i++ {
-			// Test with different orderings so that we have a mix of key and
-			// value encodings.
+			// Test with different orderings and row encodings so that we have a
+			// mix of key and value encodings.
 			for _, ordering := range orderings {
 				types := make([]sqlbase.ColumnType, numCols)
 				for i := range types {
 					types[i] = sqlbase.RandSortingColumnType(rng)
 				}
 				row := sqlbase.RandEncDatumRowOfTypes(rng, types)
-				func() {
-					d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine)
-					defer d.Close(ctx)
-					if err := d.AddRow(ctx, row); err != nil {
-						t.Fatal(err)
-					}
-
-					i := d.NewIterator(ctx)
-					defer i.Close()
-					i.Rewind()
-					if ok, err := i.Valid(); err != nil {
-						t.Fatal(err)
-					} else if !ok {
-						t.Fatal("unexpectedly invalid")
-					}
-					readRow := make(sqlbase.EncDatumRow, len(row))
-
-					temp, err := i.Row()
-					if err != nil {
-						t.Fatal(err)
-					}
-					copy(readRow, temp)
+				for _, rowEncoding := range rowEncodings {
+					func() {
+						d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine)
+						defer d.Close(ctx)
+						d.setEncoding(rowEncoding)
+						if err := d.AddRow(ctx, row); err != nil {
+							t.Fatal(err)
+						}
 
-					// Ensure the datum fields are set and no errors occur when
-					// decoding.
-					for i, encDatum := range readRow {
-						if err := encDatum.EnsureDecoded(&types[i], &d.datumAlloc); err != nil {
+						i := d.NewIterator(ctx)
+						defer i.Close()
+						i.Rewind()
+						if ok, err := i.Valid(); err != nil {
 							t.Fatal(err)
+						} else if !ok {
+							t.Fatal("unexpectedly invalid")
 						}
-					}
+						readRow := make(sqlbase.EncDatumRow, len(row))
 
-					// Check equality of the row we wrote and the row we read.
-					for i := range row {
-						if cmp, err := readRow[i].Compare(&types[i], &d.datumAlloc, &evalCtx, &row[i]); err != nil {
+						temp, err := i.Row()
+						if err != nil {
 							t.Fatal(err)
-						} else if cmp != 0 {
-							t.Fatalf("encoded %s but decoded %s", row.String(types), readRow.String(types))
 						}
-					}
-				}()
+						copy(readRow, temp)
+
+						// Ensure the datum fields are set and no errors occur when
+						// decoding.
+						for i, encDatum := range readRow {
+							if err := encDatum.EnsureDecoded(&types[i], &d.datumAlloc); err != nil {
+								t.Fatal(err)
+							}
+						}
+
+						// Check equality of the row we wrote and the row we read.
+						for i := range row {
+							if cmp, err := readRow[i].Compare(&types[i], &d.datumAlloc, &evalCtx, &row[i]); err != nil {
+								t.Fatal(err)
+							} else if cmp != 0 {
+								t.Fatalf("encoded %s but decoded %s", row.String(types), readRow.String(types))
+							}
+						}
+					}()
+				}
 			}
 		}
 	})
@@ -169,71 +173,106 @@ func TestDiskRowContainer(t *testing.T) {
 	t.Run("SortedOrder", func(t *testing.T) {
 		numRows := 1024
 		for _, ordering := range orderings {
-			// numRows rows with numCols columns of random types.
-			types := sqlbase.RandSortingColumnTypes(rng, numCols)
-			rows := sqlbase.RandEncDatumRowsOfTypes(rng, numRows, types)
-			func() {
-				d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine)
-				defer d.Close(ctx)
-				for i := 0; i < len(rows); i++ {
-					if err := d.AddRow(ctx, rows[i]); err != nil {
-						t.Fatal(err)
+			for _, rowEncoding := range rowEncodings {
+				// numRows rows with numCols columns of random types.
+				types := sqlbase.RandSortingColumnTypes(rng, numCols)
+				rows := sqlbase.RandEncDatumRowsOfTypes(rng, numRows, types)
+				func() {
+					d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine)
+					defer d.Close(ctx)
+					d.setEncoding(rowEncoding)
+					for i := 0; i < len(rows); i++ {
+						if err := d.AddRow(ctx, rows[i]); err != nil {
+							t.Fatal(err)
+						}
 					}
-				}
 
-				// Make another row container that stores all the rows then sort
-				// it to compare equality.
-				var sortedRows memRowContainer
-				sortedRows.init(ordering, types, &evalCtx)
-				defer sortedRows.Close(ctx)
-				for _, row := range rows {
-					if err := sortedRows.AddRow(ctx, row); err != nil {
-						t.Fatal(err)
+					// Make another row container that stores all the rows then sort
+					// it to compare equality.
+					var sortedRows memRowContainer
+					sortedRows.init(ordering, types, &evalCtx)
+					defer sortedRows.Close(ctx)
+					for _, row := range rows {
+						if err := sortedRows.AddRow(ctx, row); err != nil {
+							t.Fatal(err)
+						}
 					}
-				}
-				sortedRows.Sort(ctx)
+					sortedRows.Sort(ctx)
 
-				i := d.NewIterator(ctx)
-				defer i.Close()
-
-				numKeysRead := 0
-				for i.Rewind(); ; i.Next() {
-					if ok, err := i.Valid(); err != nil {
-						t.Fatal(err)
-					} else if !ok {
-						break
-					}
-					row, err := i.Row()
-					if err != nil {
-						t.Fatal(err)
+					// With the key encoding, the rows that are equal on the
+					// ordering columns are also sorted on the columns encoded in
+					// the keys after them.
+					fullOrdering := append(sqlbase.ColumnOrdering(nil), ordering...)
+					for _, col := range d.keyIdxs {
+						fullOrdering = append(fullOrdering, sqlbase.ColumnOrderInfo{
+							ColIdx: col, Direction: encoding.Ascending,
+						})
 					}
+					var prevRow sqlbase.EncDatumRow
+
+					i := d.NewIterator(ctx)
+					defer i.Close()
 
-					// Ensure datum fields are set and no errors occur when
-					// decoding.
-					for i, encDatum := range row {
-						if err := encDatum.EnsureDecoded(&types[i], &d.datumAlloc); err != nil {
+					numKeysRead := 0
+					for i.Rewind(); ; i.Next() {
+						if ok, err := i.Valid(); err != nil {
 							t.Fatal(err)
+						} else if !ok {
+							break
+						}
+						row, err := i.Row()
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						// Ensure datum fields are set and no errors occur when
+						// decoding.
+						for i, encDatum := range row {
+							if err := encDatum.EnsureDecoded(&types[i], &d.datumAlloc); err != nil {
+								t.Fatal(err)
+							}
 						}
-					}
 
-					// Check sorted order.
-					if cmp, err := compareRows(
-						types, sortedRows.EncRow(numKeysRead), row, &evalCtx, &d.datumAlloc, ordering,
-					); err != nil {
-						t.Fatal(err)
-					} else if cmp != 0 {
-						t.Fatalf(
-							"expected %s to be equal to %s",
-							row.String(types),
-							sortedRows.EncRow(numKeysRead).String(types),
-						)
+						// Check sorted order.
+						if cmp, err := compareRows(
+							types, sortedRows.EncRow(numKeysRead), row, &evalCtx, &d.datumAlloc, ordering,
+						); err != nil {
+							t.Fatal(err)
+						} else if cmp != 0 {
+							t.Fatalf(
+								"expected %s to be equal to %s",
+								row.String(types),
+								sortedRows.EncRow(numKeysRead).String(types),
+							)
+						}
+						if prevRow != nil {
+							if cmp, err := compareRows(
+								types, prevRow, row, &evalCtx, &d.datumAlloc, fullOrdering,
+							); err != nil {
+								t.Fatal(err)
+							} else if cmp > 0 {
+								t.Fatalf(
+									"%s returned after %s with ordering %v",
+									row.String(types), prevRow.String(types), fullOrdering,
+								)
+							}
+						}
+						// The encoded datums of row are only valid until the iterator
+						// moves, so we keep the decoded ones.
+						prevRow = prevRow[:0]
+						for j := range row {
+							if err := row[j].EnsureDecoded(&types[j], &d.datumAlloc); err != nil {
+								t.Fatal(err)
+							}
+							prevRow = append(prevRow, sqlbase.DatumToEncDatum(types[j], row[j].Datum))
+						}
+						numKeysRead++
 					}
-					numKeysRead++
-				}
-				if numKeysRead != numRows {
-					t.Fatalf("expected to read %d keys but only read %d", numRows, numKeysRead)
-				}
-			}()
+					if numKeysRead != numRows {
+						t.Fatalf("expected to read %d keys but only read %d", numRows, numKeysRead)
+					}
+				}()
+			}
 		}
 	})
 }
@@ -275,3 +314,104 @@ func TestDiskRowContainerDiskFull(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+// TestDiskRowContainerRoundTrip verifies that a diskRowContainer without an
+// ordering returns the rows in the order in which they were added, and that
+// it accounts for the memory of the rows it buffers before flushing them.
+func TestDiskRowContainerRoundTrip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(base.DefaultTestTempStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	// The budget only allows buffering diskRowContainerBufferBytes. Stop()
+	// panics if the container didn't release all the memory.
+	memMonitor := mon.MakeMonitor(
+		"test-mem",
+		mon.MemoryResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		1,   /* increment */
+		math.MaxInt64,
+	)
+	memMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(diskRowContainerBufferBytes))
+	defer memMonitor.Stop(ctx)
+
+	rng := rand.New(rand.NewSource(timeutil.Now().UnixNano()))
+	const numRows, numCols = 3000, 5
+	types := sqlbase.RandSortingColumnTypes(rng, numCols)
+	rows := sqlbase.RandEncDatumRowsOfTypes(rng, numRows, types)
+	for i := 0; i < numRows; i += 7 {
+		// Make sure that there are NULLs in every column.
+		rows[i][i%numCols] = sqlbase.DatumToEncDatum(types[i%numCols], tree.DNull)
+	}
+
+	memAcc := memMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	d := makeDiskRowContainer(ctx, &diskMonitor, types, nil /* ordering */, tempEngine)
+	defer d.Close(ctx)
+	d.initBufferAccounting(&memAcc)
+	for _, row := range rows {
+		if err := d.AddRow(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		if d.bufferedBytes > diskRowContainerBufferBytes {
+			t.Fatalf("%d bytes buffered", d.bufferedBytes)
+		}
+	}
+	if d.bufferedBytes == 0 {
+		t.Fatal("no rows buffered")
+	}
+
+	i := d.NewIterator(ctx)
+	defer i.Close()
+	// Creating the iterator flushed the buffered rows.
+	if d.bufferedBytes != 0 {
+		t.Fatalf("%d bytes still buffered", d.bufferedBytes)
+	}
+	numRead := 0
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			break
+		}
+		row, err := i.Row()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numRead >= numRows {
+			t.Fatalf("read more than %d rows", numRows)
+		}
+		expected := rows[numRead]
+		for j := range row {
+			if cmp, err := row[j].Compare(&types[j], &d.datumAlloc, &evalCtx, &expected[j]); err != nil {
+				t.Fatal(err)
+			} else if cmp != 0 {
+				t.Fatalf(
+					"row %d: expected %s, got %s", numRead, expected.String(types), row.String(types),
+				)
+			}
+		}
+		numRead++
+	}
+	if numRead != numRows {
+		t.Fatalf("expected to read %d rows, read %d", numRows, numRead)
+	}
+}
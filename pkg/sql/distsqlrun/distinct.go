@@ -74,6 +74,7 @@ func (d *distinct) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTag(ctx, "Evaluator", nil)
 	ctx, span := processorSpan(ctx, "distinct")
 	defer tracing.FinishSpan(span)
+	defer d.recoverPanic(ctx, d.input)
 
 	if log.V(2) {
 		log.Infof(ctx, "starting distinct process")
@@ -0,0 +1,317 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// externalDistinct is the processor that removes the duplicate rows of an
+// unsorted input using sorted runs; see ExternalDistinctSpec.
+//
+// The rows are buffered in memory until they use more than the memory limit
+// (COCKROACH_WORK_MEM, unless overridden by a testing knob). The buffered rows
+// are then sorted on the distinct columns and, with their duplicates dropped,
+// written to a diskRowContainer as a run. Once the input is exhausted, the runs
+// are merged by a streamGroupAccumulator, which groups the duplicates across
+// runs together, and the first row of each group is emitted. If the input fits
+// in memory, no run is written and the buffered rows are emitted directly.
+type externalDistinct struct {
+	processorBase
+
+	flowCtx *FlowCtx
+	// rawInput is the input; input reads it (without the metadata, which is
+	// directed straight to out.output).
+	rawInput RowSource
+	input    NoMetadataRowSource
+	types    []sqlbase.ColumnType
+	// ordering sorts the rows on the distinct columns, in ascending order.
+	ordering sqlbase.ColumnOrdering
+
+	// rows are the (copies of the) rows of the current run. memAcc accounts for
+	// their memory.
+	rows       sqlbase.EncDatumRows
+	rowAlloc   sqlbase.EncDatumRowAlloc
+	memAcc     boundAccount
+	datumAlloc sqlbase.DatumAlloc
+	// runs are the runs written to disk so far.
+	runs []*diskRowContainer
+}
+
+var _ Processor = &externalDistinct{}
+
+func newExternalDistinct(
+	flowCtx *FlowCtx,
+	spec *ExternalDistinctSpec,
+	input RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*externalDistinct, error) {
+	types := input.Types()
+	ordering := make(sqlbase.ColumnOrdering, len(spec.DistinctColumns))
+	for i, col := range spec.DistinctColumns {
+		if int(col) >= len(types) {
+			return nil, errors.Errorf(
+				"invalid distinct column %d (input has %d columns)", col, len(types),
+			)
+		}
+		ordering[i] = sqlbase.ColumnOrderInfo{ColIdx: int(col), Direction: encoding.Ascending}
+	}
+	d := &externalDistinct{
+		flowCtx:  flowCtx,
+		rawInput: input,
+		input:    MakeNoMetadataRowSource(input, ForwardMetadata(output)),
+		types:    types,
+		ordering: ordering,
+	}
+	if err := d.init(post, types, flowCtx, output); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Run is part of the processor interface.
+func (d *externalDistinct) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "ExternalDistinct", nil)
+	ctx, span := processorSpan(ctx, "external distinct")
+	defer tracing.FinishSpan(span)
+	defer d.recoverPanic(ctx, d.rawInput)
+
+	if log.V(2) {
+		log.Infof(ctx, "starting external distinct run")
+		defer log.Infof(ctx, "exiting external distinct run")
+	}
+
+	err := d.mainLoop(ctx)
+	if err != nil {
+		log.Errorf(ctx, "error removing duplicates: %s", err)
+	}
+	DrainAndClose(ctx, d.out.output, err, d.rawInput)
+}
+
+// mainLoop reads the input, writing runs to disk as needed, and emits the
+// distinct rows until they are exhausted or the consumer doesn't need more
+// rows. In any case, the caller is responsible for draining and closing the
+// producer and the consumer.
+func (d *externalDistinct) mainLoop(ctx context.Context) error {
+	evalCtx := d.flowCtx.NewEvalCtx()
+
+	st := d.flowCtx.Settings
+	useTempStorage := settingUseTempStorageSorts.Get(&st.SV) ||
+		d.flowCtx.testingKnobs.MemoryLimitBytes > 0
+	var memLimit int64
+	if useTempStorage {
+		memLimit = d.flowCtx.testingKnobs.MemoryLimitBytes
+		if memLimit <= 0 {
+			memLimit = settingWorkMemBytes.Get(&st.SV)
+		}
+	}
+	d.memAcc = d.flowCtx.makeBoundAccount(d.flowCtx.EvalCtx.Mon)
+	defer d.memAcc.Close(ctx)
+	defer d.closeRuns(ctx)
+
+	for {
+		row, err := d.input.NextRow()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		size := row.MemorySize()
+		if memLimit > 0 && d.memAcc.Used()+size > memLimit && len(d.rows) > 0 {
+			if err := d.writeRun(ctx, evalCtx); err != nil {
+				return err
+			}
+		}
+		if err := d.memAcc.Grow(ctx, size); err != nil {
+			if memLimit <= 0 {
+				return errors.Wrap(err, "external storage for large queries disabled")
+			}
+			return err
+		}
+		d.rows = append(d.rows, d.rowAlloc.CopyRow(row))
+	}
+
+	if len(d.runs) == 0 {
+		if err := d.sortRun(evalCtx); err != nil {
+			return err
+		}
+		for _, row := range d.rows {
+			consumerStatus, err := d.out.EmitRow(ctx, row)
+			if err != nil || consumerStatus != NeedMoreRows {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(d.rows) > 0 {
+		if err := d.writeRun(ctx, evalCtx); err != nil {
+			return err
+		}
+	}
+	return d.mergeRuns(ctx, evalCtx)
+}
+
+// sortRun sorts the rows of the current run on the distinct columns and drops
+// their duplicates.
+func (d *externalDistinct) sortRun(evalCtx *tree.EvalContext) error {
+	var sortErr error
+	sort.SliceStable(d.rows, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		var cmp int
+		cmp, sortErr = d.rows[i].Compare(d.types, &d.datumAlloc, d.ordering, evalCtx, d.rows[j])
+		return cmp < 0
+	})
+	if sortErr != nil {
+		return sortErr
+	}
+	n := 0
+	for i, row := range d.rows {
+		if i > 0 {
+			cmp, err := d.rows[n-1].Compare(d.types, &d.datumAlloc, d.ordering, evalCtx, row)
+			if err != nil {
+				return err
+			}
+			if cmp == 0 {
+				continue
+			}
+		}
+		d.rows[n] = row
+		n++
+	}
+	d.rows = d.rows[:n]
+	return nil
+}
+
+// writeRun sorts the rows of the current run, drops their duplicates and moves
+// them to a new diskRowContainer, freeing up their memory.
+func (d *externalDistinct) writeRun(ctx context.Context, evalCtx *tree.EvalContext) error {
+	if len(d.runs) == 0 {
+		if m := d.flowCtx.Metrics; m != nil {
+			m.DiskSpill()
+		}
+	}
+	if err := d.sortRun(evalCtx); err != nil {
+		return err
+	}
+	log.VEventf(ctx, 2, "writing run %d of %d distinct rows to disk", len(d.runs), len(d.rows))
+	disk := makeDiskRowContainer(
+		ctx, d.flowCtx.diskMonitor, d.types, d.ordering, d.flowCtx.TempStorage,
+	)
+	d.runs = append(d.runs, &disk)
+	for _, row := range d.rows {
+		if err := disk.AddRow(ctx, row); err != nil {
+			return err
+		}
+	}
+	d.rows = d.rows[:0]
+	d.memAcc.Clear(ctx)
+	return nil
+}
+
+// mergeRuns merges the runs written to disk and emits the first row of each
+// group of rows that are equal on the distinct columns. Since the runs have no
+// duplicates of their own, the groups have at most one row per run.
+func (d *externalDistinct) mergeRuns(ctx context.Context, evalCtx *tree.EvalContext) error {
+	srcs := make([]NoMetadataRowSource, len(d.runs))
+	for i, run := range d.runs {
+		it := run.NewIterator(ctx)
+		defer it.Close()
+		srcs[i] = MakeNoMetadataRowSource(
+			&rowIteratorSource{it: it, types: d.types}, func(ProducerMetadata) {},
+		)
+	}
+	acc := makeMergingStreamGroupAccumulator(srcs, d.ordering, true /* nullsAreEqual */, evalCtx)
+	acc.setCancellation(ctx)
+	acc.setDeadline(d.flowCtx.Deadline)
+	defer acc.close(ctx)
+	for {
+		group, err := acc.advanceGroup(evalCtx)
+		if err != nil || len(group) == 0 {
+			return err
+		}
+		consumerStatus, err := d.out.EmitRow(ctx, group[0])
+		if err != nil || consumerStatus != NeedMoreRows {
+			return err
+		}
+	}
+}
+
+// closeRuns closes the runs written to disk.
+func (d *externalDistinct) closeRuns(ctx context.Context) {
+	for _, run := range d.runs {
+		run.Close(ctx)
+	}
+	d.runs = nil
+}
+
+// rowIteratorSource is a RowSource over the rows of a rowIterator. The rows are
+// copied, so that they remain valid after the iterator moves on.
+type rowIteratorSource struct {
+	it      rowIterator
+	types   []sqlbase.ColumnType
+	started bool
+	alloc   sqlbase.EncDatumRowAlloc
+}
+
+var _ RowSource = &rowIteratorSource{}
+
+// Types is part of the RowSource interface.
+func (s *rowIteratorSource) Types() []sqlbase.ColumnType {
+	return s.types
+}
+
+// Next is part of the RowSource interface.
+func (s *rowIteratorSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	if !s.started {
+		s.started = true
+		s.it.Rewind()
+	} else {
+		s.it.Next()
+	}
+	if ok, err := s.it.Valid(); err != nil {
+		return nil, ProducerMetadata{Err: err}
+	} else if !ok {
+		return nil, ProducerMetadata{}
+	}
+	row, err := s.it.Row()
+	if err != nil {
+		return nil, ProducerMetadata{Err: err}
+	}
+	return s.alloc.CopyRow(row), ProducerMetadata{}
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (s *rowIteratorSource) ConsumerDone() {}
+
+// ConsumerClosed is part of the RowSource interface.
+func (s *rowIteratorSource) ConsumerClosed() {}
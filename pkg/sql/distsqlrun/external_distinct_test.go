@@ -0,0 +1,135 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestExternalDistinct(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(base.DefaultTestTempStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	metrics := MakeDistSQLMetrics(time.Hour /* histogramWindow */)
+	flowCtx := FlowCtx{
+		EvalCtx:     evalCtx,
+		Settings:    cluster.MakeTestingClusterSettings(),
+		TempStorage: tempEngine,
+		diskMonitor: &diskMonitor,
+		Metrics:     &metrics,
+	}
+
+	// SELECT DISTINCT a, b over rows with many duplicates, in random order. The
+	// third column is not part of the distinct columns, and is projected out.
+	rng, _ := randutil.NewPseudoRand()
+	const numRows = 200
+	input := make([][]int, numRows)
+	seen := make(map[[2]int]struct{})
+	for i := range input {
+		a, b := rng.Intn(10), rng.Intn(5)
+		input[i] = []int{a, b, i}
+		seen[[2]int{a, b}] = struct{}{}
+	}
+	// The reference is the (sorted) set of distinct rows, computed in memory.
+	var reference [][]int
+	for k := range seen {
+		reference = append(reference, []int{k[0], k[1]})
+	}
+	sort.Slice(reference, func(i, j int) bool {
+		if reference[i][0] != reference[j][0] {
+			return reference[i][0] < reference[j][0]
+		}
+		return reference[i][1] < reference[j][1]
+	})
+	expected := genEncDatumRowsInt(reference).String(twoIntCols)
+
+	spec := ExternalDistinctSpec{DistinctColumns: []uint32{0, 1}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+
+	// Test with several memory limits:
+	// 0: Use the default limit, so that the rows are not written to disk.
+	// 1: Write a run for every row.
+	// 2048: Write runs of several rows.
+	for _, memLimit := range []int64{0, 1, 2048} {
+		t.Run(fmt.Sprintf("MemLimit=%d", memLimit), func(t *testing.T) {
+			flowCtx.testingKnobs.MemoryLimitBytes = memLimit
+			defer func() { flowCtx.testingKnobs.MemoryLimitBytes = 0 }()
+			spills := metrics.DiskSpills.Count()
+
+			in := NewRowBuffer(threeIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			d, err := newExternalDistinct(&flowCtx, &spec, in, &post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.Run(ctx, nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(twoIntCols); res != expected {
+				t.Errorf("expected:\n   %s\ngot:\n   %s", expected, res)
+			}
+			if spilled := metrics.DiskSpills.Count() > spills; spilled != (memLimit > 0) {
+				t.Errorf("expected spilled to be %t, got %t", memLimit > 0, spilled)
+			}
+			if n := diskMonitor.AllocBytes(); n != 0 {
+				t.Errorf("expected all the disk to be released, %d bytes still allocated", n)
+			}
+		})
+	}
+
+	t.Run("InvalidColumn", func(t *testing.T) {
+		spec := ExternalDistinctSpec{DistinctColumns: []uint32{3}}
+		in := NewRowBuffer(threeIntCols, nil /* rows */, RowBufferArgs{})
+		if _, err := newExternalDistinct(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+		); !testutils.IsError(err, "invalid distinct column 3") {
+			t.Fatalf("expected an invalid distinct column error, got %v", err)
+		}
+	})
+}
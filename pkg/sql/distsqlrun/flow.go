@@ -17,6 +17,7 @@ package distsqlrun
 import (
 	"context"
 	"sync"
+	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -31,9 +32,11 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlutil"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
 
@@ -80,6 +83,11 @@ type FlowCtx struct {
 	nodeID       roachpb.NodeID
 	testingKnobs TestingKnobs
 
+	// Verbose is set if processors should collect additional statistics about
+	// their execution (e.g. the spans read by joinReaders) and report them as
+	// metadata. Collecting them has a cost, so this is off by default.
+	Verbose bool
+
 	// TempStorage is used by some DistSQL processors to store Rows when the
 	// working set is larger than can be stored in memory.
 	// This is not supposed to be used as a general engine.Engine and thus
@@ -90,6 +98,36 @@ type FlowCtx struct {
 
 	// JobRegistry is used during backfill to load jobs which keep state.
 	JobRegistry *jobs.Registry
+
+	// Metrics, if set, are the metrics of the server, which some processors
+	// update when they finish.
+	Metrics *DistSQLMetrics
+
+	// Deadline, if set, is the time after which the processors of the flow
+	// abort with an error (e.g. to enforce a statement timeout). Processors check
+	// it with checkDeadline at regular points of their execution, such as
+	// between lookup batches or every few rows read.
+	Deadline time.Time
+
+	// MaxRowBytes, if positive, is the maximum size (as per
+	// EncDatumRow.MemorySize) of the rows emitted by the processors of the
+	// flow. A processor emitting a larger row fails with an error instead,
+	// protecting its consumers from pathologically wide rows.
+	MaxRowBytes int64
+
+	// MaxStaleness, if positive, allows bounded-staleness reads: the lookups of
+	// the flow's joinReaders can be performed at any timestamp up to this much
+	// older than the timestamp of the flow's transaction, instead of at that
+	// timestamp, which makes them less likely to contend with ongoing writes.
+	// The lookups then don't see the writes of the transaction, and they are
+	// performed in a separate transaction, so this is only meant for read-only
+	// (or historical) queries in implicit transactions; the joinReaders fail if
+	// the transaction has written or ImplicitTxn isn't set.
+	MaxStaleness time.Duration
+
+	// ImplicitTxn is set if the flow's transaction is implicit, i.e. it was
+	// started for the flow's statement alone and is committed along with it.
+	ImplicitTxn bool
 }
 
 // NewEvalCtx returns a modifiable copy of the FlowCtx's EvalContext.
@@ -104,6 +142,98 @@ func (ctx *FlowCtx) NewEvalCtx() *tree.EvalContext {
 	return &evalCtx
 }
 
+// checkDeadline returns an error if the deadline of the flow has passed.
+func (ctx *FlowCtx) checkDeadline() error {
+	return checkFlowDeadline(ctx.Deadline)
+}
+
+// checkFlowDeadline returns an error if deadline is set and has passed.
+func checkFlowDeadline(deadline time.Time) error {
+	if !deadline.IsZero() && timeutil.Now().After(deadline) {
+		return newDeadlineExceededError(deadline)
+	}
+	return nil
+}
+
+// maxBufferedGroupRows returns the maximum number of rows of a group that the
+// streamGroupAccumulators of the flow's processors can buffer (0 for no limit);
+// see streamGroupAccumulator.setMaxBufferedRows.
+func (ctx *FlowCtx) maxBufferedGroupRows() int {
+	if ctx.Settings == nil {
+		return 0
+	}
+	return int(settingMaxBufferedGroupRows.Get(&ctx.Settings.SV))
+}
+
+// readTimestamp returns the timestamp at which the KV reads performed by the
+// flow's processors are evaluated. For historical queries (AS OF SYSTEM TIME),
+// the gateway fixes the timestamp of the flow's transaction and this is the
+// timestamp that was requested.
+func (ctx *FlowCtx) readTimestamp() hlc.Timestamp {
+	return ctx.txn.OrigTimestamp()
+}
+
+// makeBoundAccount returns an account of the given monitor for the memory used
+// by a processor of the flow. The account is subject to the
+// MemoryFailAfterBytes testing knob.
+func (ctx *FlowCtx) makeBoundAccount(monitor *mon.BytesMonitor) boundAccount {
+	return boundAccount{
+		BoundAccount: monitor.MakeBoundAccount(),
+		failAfter:    ctx.testingKnobs.MemoryFailAfterBytes,
+	}
+}
+
+// boundAccount is a mon.BoundAccount that can be made to refuse allocations
+// past a fixed number of bytes, regardless of the budget of its monitor, so that
+// tests can trigger memory errors at a precise point; see
+// TestingKnobs.MemoryFailAfterBytes.
+type boundAccount struct {
+	mon.BoundAccount
+	// failAfter, if positive, is the number of bytes past which Grow fails.
+	failAfter int64
+}
+
+// Grow is like mon.BoundAccount.Grow, but fails if the account would use more
+// than failAfter bytes.
+func (b *boundAccount) Grow(ctx context.Context, x int64) error {
+	if b.failAfter > 0 && b.Used()+x > b.failAfter {
+		return newMemoryBudgetError("memory account (testing knob)", b.failAfter)
+	}
+	return b.BoundAccount.Grow(ctx, x)
+}
+
+// rowBufPool recycles the buffers in which processors build their output rows;
+// see FlowCtx.getRowBuf.
+var rowBufPool = sync.Pool{
+	New: func() interface{} {
+		return new(sqlbase.EncDatumRow)
+	},
+}
+
+// getRowBuf returns a buffer of n EncDatums in which a processor can build its
+// output rows, instead of allocating a new row for each of them. The buffer
+// should be returned with putRowBuf once the processor is done with it.
+func (ctx *FlowCtx) getRowBuf(n int) *sqlbase.EncDatumRow {
+	buf := rowBufPool.Get().(*sqlbase.EncDatumRow)
+	if cap(*buf) < n {
+		*buf = make(sqlbase.EncDatumRow, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// putRowBuf releases a buffer obtained with getRowBuf. The rows built in it
+// must not be referenced anymore: ProcOutputHelper only uses these buffers for
+// RowCopyingReceivers, and releases them once the output is closed. A buffer
+// that isn't released is simply not recycled.
+func (ctx *FlowCtx) putRowBuf(buf *sqlbase.EncDatumRow) {
+	// Don't hold on to the datums of the last row.
+	for i := range *buf {
+		(*buf)[i] = sqlbase.EncDatum{}
+	}
+	rowBufPool.Put(buf)
+}
+
 type flowStatus int
 
 // Flow status indicators.
@@ -360,6 +490,9 @@ func (f *Flow) setup(ctx context.Context, spec *FlowSpec) error {
 			default:
 				return errors.Errorf("unsupported input sync type %s", is.Type)
 			}
+			if f.testingKnobs.CheckRowTypes {
+				sync = newTypeCheckingRowSource(sync, is.ColumnTypes)
+			}
 			inputSyncs[pIdx] = append(inputSyncs[pIdx], sync)
 		}
 	}
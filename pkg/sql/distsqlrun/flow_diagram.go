@@ -50,6 +50,12 @@ func (ord *Ordering) diagramString() string {
 		} else {
 			buf.WriteByte('+')
 		}
+		switch c.NullsOrder {
+		case Ordering_Column_NULLS_FIRST:
+			buf.WriteString(" NULLS FIRST")
+		case Ordering_Column_NULLS_LAST:
+			buf.WriteString(" NULLS LAST")
+		}
 	}
 	return buf.String()
 }
@@ -83,6 +89,15 @@ func (a *AggregatorSpec) summary() (string, []string) {
 	if len(a.GroupCols) > 0 {
 		details = append(details, colListStr(a.GroupCols))
 	}
+	if len(a.Ordering.Columns) > 0 {
+		details = append(details, fmt.Sprintf("Ordered: %s", a.Ordering.diagramString()))
+	}
+	if len(a.ResultOrdering.Columns) > 0 {
+		details = append(details, fmt.Sprintf("Sorted: %s", a.ResultOrdering.diagramString()))
+	}
+	if len(a.CaseInsensitiveCols) > 0 {
+		details = append(details, fmt.Sprintf("Case-insensitive: %s", colListStr(a.CaseInsensitiveCols)))
+	}
 	for _, agg := range a.Aggregations {
 		var buf bytes.Buffer
 		buf.WriteString(agg.Func.String())
@@ -124,9 +139,76 @@ func (jr *JoinReaderSpec) summary() (string, []string) {
 	details := []string{
 		fmt.Sprintf("%s@%s", index, jr.Table.Name),
 	}
+	if len(jr.LookupColumns) > 0 {
+		details = append(details, fmt.Sprintf("Lookup columns: %s", colListStr(jr.LookupColumns)))
+	}
+	if len(jr.LookupExprs) > 0 {
+		exprs := make([]string, len(jr.LookupExprs))
+		for i, expr := range jr.LookupExprs {
+			exprs[i] = strings.Replace(expr.Expr, " ", "", -1)
+		}
+		details = append(details, "Lookup expressions: "+strings.Join(exprs, ", "))
+	}
+	if r := jr.LookupRange; r != nil {
+		details = append(details, fmt.Sprintf("Lookup range: @%d-@%d", r.LowColumn+1, r.HighColumn+1))
+	}
+	if jr.Type != JoinType_INNER {
+		details = append(details, fmt.Sprintf("Type: %s", jr.Type))
+	}
+	if jr.Interleaved {
+		details = append(details, "Interleaved")
+	}
+	if jr.Parallelism > 1 {
+		details = append(details, fmt.Sprintf("Parallelism: %d", jr.Parallelism))
+	}
+	if jr.MaxInFlightBatches > 0 {
+		details = append(details, fmt.Sprintf("Batches in flight: %d", jr.MaxInFlightBatches))
+	}
+	if jr.LookupCacheSize > 0 {
+		details = append(details, fmt.Sprintf("Lookup cache: %d", jr.LookupCacheSize))
+	}
+	if jr.MinLookupBatchSize != 0 || jr.MaxLookupBatchSize != 0 {
+		details = append(details, fmt.Sprintf(
+			"Lookup batch size: %d-%d", jr.MinLookupBatchSize, jr.MaxLookupBatchSize,
+		))
+	}
+	if len(jr.BatchOutputOrdering.Columns) > 0 {
+		details = append(details, "Batch ordering: "+jr.BatchOutputOrdering.diagramString())
+	}
+	if jr.OutputIndexEntries {
+		details = append(details, "Output index entries")
+	}
+	if jr.EmitMatchedFlag {
+		details = append(details, "Emit matched flag")
+	}
+	if jr.CountOnly {
+		details = append(details, "Count only")
+	}
+	if jr.EmitLookupKey {
+		details = append(details, "Emit lookup key")
+	}
+	if jr.ReportUnmatchedRows {
+		details = append(details, "Report unmatched rows")
+	}
+	if jr.MatchMode != JoinReaderSpec_AUTO_MATCH {
+		details = append(details, fmt.Sprintf("Match mode: %s", jr.MatchMode))
+	}
+	if jr.MaxLookupRetries > 0 {
+		details = append(details, fmt.Sprintf("Lookup retries: %d", jr.MaxLookupRetries))
+	}
 	return "JoinReader", details
 }
 
+func (zj *ZigzagJoinerSpec) summary() (string, []string) {
+	details := make([]string, len(zj.Sides))
+	for i, side := range zj.Sides {
+		details[i] = fmt.Sprintf(
+			"%s (%d fixed values)", indexDetails(side.IndexIdx, &zj.Table)[0], len(side.FixedValues),
+		)
+	}
+	return "ZigzagJoiner", details
+}
+
 func (hj *HashJoinerSpec) summary() (string, []string) {
 	details := make([]string, 0, 3)
 
@@ -196,6 +278,22 @@ func (s *SorterSpec) summary() (string, []string) {
 	return "Sorter", details
 }
 
+func (s *PartitionSorterSpec) summary() (string, []string) {
+	details := []string{
+		fmt.Sprintf("Partition: %s", s.PartitionOrdering.diagramString()),
+		s.Ordering.diagramString(),
+	}
+	return "PartitionSorter", details
+}
+
+func (*UnionAllSpec) summary() (string, []string) {
+	return "UnionAll", []string{}
+}
+
+func (s *OrderingEnforcerSpec) summary() (string, []string) {
+	return "OrderingEnforcer", []string{s.Ordering.diagramString()}
+}
+
 func (bf *BackfillerSpec) summary() (string, []string) {
 	details := []string{
 		bf.Table.Name,
@@ -204,6 +302,10 @@ func (bf *BackfillerSpec) summary() (string, []string) {
 	return "Backfiller", details
 }
 
+func (d *ExternalDistinctSpec) summary() (string, []string) {
+	return "ExternalDistinct", []string{colListStr(d.DistinctColumns)}
+}
+
 func (d *DistinctSpec) summary() (string, []string) {
 	details := []string{
 		colListStr(d.DistinctColumns),
@@ -307,6 +409,20 @@ func (post *PostProcessSpec) summaryWithPrefix(prefix string) []string {
 	return res
 }
 
+func (c *CSVReaderSpec) summary() (string, []string) {
+	var res []string
+	if c.Options.Comma != 0 && c.Options.Comma != ',' {
+		res = append(res, fmt.Sprintf("Delimiter: %q", rune(c.Options.Comma)))
+	}
+	if c.SkipRecords > 0 {
+		res = append(res, fmt.Sprintf("Skip records: %d", c.SkipRecords))
+	}
+	if c.SkipMalformed {
+		res = append(res, "Skip malformed")
+	}
+	return "CSVReader", res
+}
+
 func (c *ReadCSVSpec) summary() (string, []string) {
 	return "ReadCSV", []string{c.Uri}
 }
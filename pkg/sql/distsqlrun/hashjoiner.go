@@ -156,6 +156,7 @@ func (h *hashJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTag(ctx, "HashJoiner", nil)
 	ctx, span := processorSpan(ctx, "hash joiner")
 	defer tracing.FinishSpan(span)
+	defer h.recoverPanic(ctx, h.leftSource, h.rightSource)
 
 	h.cancelChecker = sqlbase.NewCancelChecker(ctx)
 
@@ -361,6 +362,9 @@ func (h *hashJoiner) buildPhase(
 	}
 
 	log.VEventf(ctx, 2, "build phase falling back to disk")
+	if m := h.flowCtx.Metrics; m != nil {
+		m.DiskSpill()
+	}
 
 	storedDiskRows := makeHashDiskRowContainer(h.flowCtx.diskMonitor, h.flowCtx.TempStorage)
 	if err := storedDiskRows.Init(
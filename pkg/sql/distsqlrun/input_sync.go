@@ -356,3 +356,95 @@ func makeOrderedSync(
 	}
 	return s, nil
 }
+
+// roundRobinRowSource receives rows from multiple streams and produces a single
+// stream of rows, taking one row from each source in turn. Unlike the
+// orderedSynchronizer, it doesn't maintain any ordering; it is meant for
+// unordered unions of equivalent streams that are read by the same goroutine.
+//
+// Sources are skipped once they are exhausted. Metadata records are
+// accumulated and returned, one by one, after all the rows.
+type roundRobinRowSource struct {
+	types []sqlbase.ColumnType
+
+	// sources are the sources that haven't been exhausted yet, in rotation
+	// order; next is the index of the source that produces the next row.
+	sources []RowSource
+	next    int
+
+	// draining is set by ConsumerDone(); from then on, the rows of the sources
+	// are discarded.
+	draining bool
+
+	// metadata is accumulated from all the sources and is passed on once the
+	// sources have been exhausted.
+	metadata []*ProducerMetadata
+}
+
+var _ RowSource = &roundRobinRowSource{}
+
+// Types is part of the RowSource interface.
+func (s *roundRobinRowSource) Types() []sqlbase.ColumnType {
+	return s.types
+}
+
+// Next is part of the RowSource interface.
+func (s *roundRobinRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	for len(s.sources) > 0 {
+		if s.next >= len(s.sources) {
+			s.next = 0
+		}
+		row, meta := s.sources[s.next].Next()
+		if !meta.Empty() {
+			s.metadata = append(s.metadata, &meta)
+			continue
+		}
+		if row == nil {
+			// The source is exhausted; the next one moves into its slot.
+			s.sources = append(s.sources[:s.next], s.sources[s.next+1:]...)
+			continue
+		}
+		if s.draining {
+			continue
+		}
+		s.next++
+		return row, ProducerMetadata{}
+	}
+
+	if len(s.metadata) != 0 {
+		var meta *ProducerMetadata
+		meta, s.metadata = s.metadata[0], s.metadata[1:]
+		return nil, *meta
+	}
+	return nil, ProducerMetadata{}
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (s *roundRobinRowSource) ConsumerDone() {
+	if !s.draining {
+		s.draining = true
+		for _, src := range s.sources {
+			src.ConsumerDone()
+		}
+	}
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (s *roundRobinRowSource) ConsumerClosed() {
+	for _, src := range s.sources {
+		src.ConsumerClosed()
+	}
+	// No further methods should be called.
+	s.sources = nil
+	s.metadata = nil
+}
+
+func makeRoundRobinRowSource(sources []RowSource) (RowSource, error) {
+	if len(sources) == 0 {
+		return nil, errors.Errorf("no sources for round-robin row source")
+	}
+	return &roundRobinRowSource{
+		types:   sources[0].Types(),
+		sources: append([]RowSource(nil), sources...),
+	}, nil
+}
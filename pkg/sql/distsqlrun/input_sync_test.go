@@ -233,3 +233,127 @@ func TestUnorderedSync(t *testing.T) {
 		t.Error("Did not receive expected error")
 	}
 }
+
+func TestRoundRobinRowSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The rows are (source, idx); the sources have different lengths and the
+	// second one produces a metadata record among its rows.
+	lengths := []int{5, 2, 8}
+	makeSources := func() ([]*RowBuffer, []RowSource) {
+		var bufs []*RowBuffer
+		var sources []RowSource
+		for i, n := range lengths {
+			var input [][]int
+			for j := 0; j < n; j++ {
+				input = append(input, []int{i, j})
+			}
+			buf := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			if i == 1 {
+				buf.Push(nil /* row */, ProducerMetadata{Err: errors.New("test error")})
+				buf.Push(sqlbase.EncDatumRow{intEncDatum(i), intEncDatum(n)}, ProducerMetadata{})
+			}
+			bufs = append(bufs, buf)
+			sources = append(sources, buf)
+		}
+		return bufs, sources
+	}
+
+	t.Run("AllRows", func(t *testing.T) {
+		_, sources := makeSources()
+		src, err := makeRoundRobinRowSource(sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[[2]int]int)
+		var order []int
+		var metas []ProducerMetadata
+		for {
+			row, meta := src.Next()
+			if !meta.Empty() {
+				metas = append(metas, meta)
+				continue
+			}
+			if row == nil {
+				break
+			}
+			if len(metas) != 0 {
+				t.Fatalf("row %s returned after metadata", row.String(twoIntCols))
+			}
+			s := int(tree.MustBeDInt(row[0].Datum))
+			seen[[2]int{s, int(tree.MustBeDInt(row[1].Datum))}]++
+			order = append(order, s)
+		}
+
+		expLengths := []int{5, 3, 8}
+		numRows := 0
+		for i, n := range expLengths {
+			numRows += n
+			for j := 0; j < n; j++ {
+				if c := seen[[2]int{i, j}]; c != 1 {
+					t.Errorf("row [%d %d] returned %d times", i, j, c)
+				}
+			}
+		}
+		if len(order) != numRows {
+			t.Errorf("expected %d rows, got %d", numRows, len(order))
+		}
+		// The first rows are taken from each source in turn.
+		if exp := []int{0, 1, 2, 0, 1, 2}; fmt.Sprint(order[:len(exp)]) != fmt.Sprint(exp) {
+			t.Errorf("expected the rows to start with sources %v, got %v", exp, order)
+		}
+		if len(metas) != 1 || metas[0].Err == nil || metas[0].Err.Error() != "test error" {
+			t.Errorf("expected the test error as the only metadata, got %v", metas)
+		}
+	})
+
+	t.Run("ConsumerDone", func(t *testing.T) {
+		bufs, sources := makeSources()
+		src, err := makeRoundRobinRowSource(sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row, meta := src.Next(); row == nil || !meta.Empty() {
+			t.Fatalf("expected a row, got %s %v", row.String(twoIntCols), meta)
+		}
+		src.ConsumerDone()
+		for i, buf := range bufs {
+			if buf.ConsumerStatus != DrainRequested {
+				t.Errorf("source %d: expected DrainRequested, got %d", i, buf.ConsumerStatus)
+			}
+		}
+		var metas []ProducerMetadata
+		for {
+			row, meta := src.Next()
+			if row != nil {
+				t.Fatalf("unexpected row while draining: %s", row.String(twoIntCols))
+			}
+			if meta.Empty() {
+				break
+			}
+			metas = append(metas, meta)
+		}
+		if len(metas) != 1 || metas[0].Err == nil {
+			t.Errorf("expected the test error as the only metadata, got %v", metas)
+		}
+		for i, buf := range bufs {
+			if !buf.Done {
+				t.Errorf("source %d not drained", i)
+			}
+		}
+	})
+
+	t.Run("ConsumerClosed", func(t *testing.T) {
+		bufs, sources := makeSources()
+		src, err := makeRoundRobinRowSource(sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.ConsumerClosed()
+		for i, buf := range bufs {
+			if buf.ConsumerStatus != ConsumerClosed {
+				t.Errorf("source %d: expected ConsumerClosed, got %d", i, buf.ConsumerStatus)
+			}
+		}
+	})
+}
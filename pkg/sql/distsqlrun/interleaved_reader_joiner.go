@@ -238,6 +238,7 @@ func (irj *interleavedReaderJoiner) Run(ctx context.Context, wg *sync.WaitGroup)
 	ctx = log.WithLogTag(ctx, "InterleaveReaderJoiner", tableIDs)
 	ctx, span := processorSpan(ctx, "interleaved reader joiner")
 	defer tracing.FinishSpan(span)
+	defer irj.recoverPanic(ctx)
 
 	txn := irj.flowCtx.txn
 	if txn == nil {
@@ -19,6 +19,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/pkg/errors"
 )
 
 type joinerBase struct {
@@ -54,6 +55,9 @@ func (jb *joinerBase) init(
 	output RowReceiver,
 ) error {
 	jb.joinType = joinType(jType)
+	if jb.joinType == leftSemi || jb.joinType == leftAnti {
+		return errors.Errorf("%s join not supported", jType)
+	}
 
 	jb.emptyLeft = make(sqlbase.EncDatumRow, len(leftTypes))
 	for i := range jb.emptyLeft {
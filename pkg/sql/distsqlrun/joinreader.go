@@ -16,14 +16,29 @@ package distsqlrun
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
+	"unsafe"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/sql/scrub"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/types"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
@@ -32,6 +47,155 @@ import (
 // nodes that "own" the respective ranges, and send out flows on those nodes.
 const joinReaderBatchSize = 100
 
+// defaultLookupBatchLatencyThreshold is the latency of the lookups of a batch
+// above which an adaptive joinReader uses larger batches, when the spec doesn't
+// specify one.
+const defaultLookupBatchLatencyThreshold = time.Millisecond
+
+// joinReaderSlowBatchThreshold is the duration of the lookups of a batch above
+// which the batch is logged, to help diagnose hotspots.
+var joinReaderSlowBatchThreshold = settings.RegisterDurationSetting(
+	"sql.distsql.join_reader.slow_batch_threshold",
+	"if positive, the lookup batches of join readers that take longer than this are logged",
+	0,
+)
+
+// joinReaderProgressInterval is the minimum interval between two reports of the
+// progress of a joinReader; see JoinReaderSpec.EstimatedInputRows.
+const joinReaderProgressInterval = time.Second
+
+// joinReaderUnmatchedRowsBatchSize is the maximum number of rows of the batches
+// of unmatched input rows; see JoinReaderSpec.ReportUnmatchedRows.
+const joinReaderUnmatchedRowsBatchSize = 100
+
+// lookupBatchSizer determines the number of lookups in each batch of a
+// joinReader; see JoinReaderSpec.MaxLookupBatchSize. Batches start small and
+// grow geometrically as long as their round trips take long (larger batches
+// amortize the latency better), up to a cap.
+type lookupBatchSizer struct {
+	min, max         int
+	latencyThreshold time.Duration
+	// cur is the size of the next batch.
+	cur int
+}
+
+func makeLookupBatchSizer(spec *JoinReaderSpec) (lookupBatchSizer, error) {
+	b := lookupBatchSizer{
+		min:              int(spec.MinLookupBatchSize),
+		max:              int(spec.MaxLookupBatchSize),
+		latencyThreshold: spec.LookupBatchLatencyThreshold,
+	}
+	if b.min == 0 && b.max == 0 {
+		b.min, b.max = joinReaderBatchSize, joinReaderBatchSize
+	}
+	if b.min == 0 {
+		b.min = 1
+	}
+	if b.max == 0 {
+		b.max = b.min
+	}
+	if b.min > b.max {
+		return lookupBatchSizer{}, errors.Errorf(
+			"min lookup batch size %d is greater than max lookup batch size %d", b.min, b.max,
+		)
+	}
+	if b.latencyThreshold == 0 {
+		b.latencyThreshold = defaultLookupBatchLatencyThreshold
+	}
+	b.cur = b.min
+	return b, nil
+}
+
+// size returns the number of lookups the next batch should have.
+func (b *lookupBatchSizer) size() int {
+	return b.cur
+}
+
+// update adjusts the size of the next batches after a batch of n lookups that
+// took the given time. If memPressure is set, the memory of the batch couldn't
+// be accounted for and the size is halved.
+func (b *lookupBatchSizer) update(n int, latency time.Duration, memPressure bool) {
+	switch {
+	case memPressure:
+		b.cur /= 2
+		if b.cur < b.min {
+			b.cur = b.min
+		}
+	case n >= b.cur && latency >= b.latencyThreshold:
+		// Only full batches are evidence that the input could use larger ones.
+		b.cur *= 2
+		if b.cur > b.max {
+			b.cur = b.max
+		}
+	}
+}
+
+// kvScanner is the interface through which a joinReader reads from the KV
+// store. It allows tests to serve the lookups from memory.
+type kvScanner interface {
+	// startScan starts a scan of the given spans with the fetcher. It can be
+	// called concurrently with different fetchers.
+	startScan(
+		ctx context.Context,
+		fetcher *sqlbase.MultiRowFetcher,
+		spans roachpb.Spans,
+		limitBatches bool,
+		limitHint int64,
+	) error
+}
+
+// txnKVScanner is the kvScanner that reads through a transaction.
+type txnKVScanner struct {
+	txn *client.Txn
+}
+
+var _ kvScanner = txnKVScanner{}
+
+// startScan is part of the kvScanner interface.
+func (s txnKVScanner) startScan(
+	ctx context.Context,
+	fetcher *sqlbase.MultiRowFetcher,
+	spans roachpb.Spans,
+	limitBatches bool,
+	limitHint int64,
+) error {
+	// TODO(radu,andrei,knz): set the traceKV flag when requested by the session.
+	return fetcher.StartScan(ctx, s.txn, spans, limitBatches, limitHint, false /* traceKV */)
+}
+
+// joinReaderStrategy describes how a joinReader finds the rows of the table
+// matching its lookups; see joinReader.strategy().
+type joinReaderStrategy int
+
+const (
+	// joinReaderPrimaryLookup performs point lookups in the primary index.
+	joinReaderPrimaryLookup joinReaderStrategy = iota
+	// joinReaderInterleavedScan scans the keys of the interleave parent rows in
+	// the primary index.
+	joinReaderInterleavedScan
+	// joinReaderIndexOnly scans a secondary index that contains all the needed
+	// columns.
+	joinReaderIndexOnly
+	// joinReaderIndexJoin scans a secondary index and looks up the matching
+	// rows in the primary index.
+	joinReaderIndexJoin
+)
+
+func (s joinReaderStrategy) String() string {
+	switch s {
+	case joinReaderPrimaryLookup:
+		return "primary lookup"
+	case joinReaderInterleavedScan:
+		return "interleaved parent scan"
+	case joinReaderIndexOnly:
+		return "index-only scan"
+	case joinReaderIndexJoin:
+		return "index scan with primary lookup"
+	default:
+		panic(fmt.Sprintf("invalid joinReader strategy %d", s))
+	}
+}
+
 type joinReader struct {
 	processorBase
 
@@ -40,73 +204,746 @@ type joinReader struct {
 	desc  sqlbase.TableDescriptor
 	index *sqlbase.IndexDescriptor
 
+	kv      kvScanner
 	fetcher sqlbase.MultiRowFetcher
 	alloc   sqlbase.DatumAlloc
 
 	input      RowSource
 	inputTypes []sqlbase.ColumnType
+
+	// If set, the input rows contain the primary key of the interleave parent
+	// of the table and we look up the parent row's key; see
+	// JoinReaderSpec.Interleaved. numLookupCols is the number of input columns
+	// used for the lookup.
+	interleaved   bool
+	numLookupCols int
+
+	// lookupCols, if set, are the input columns that form the lookup key; see
+	// JoinReaderSpec.LookupColumns. Alternatively, lookupExprs, if set, are the
+	// expressions that compute the lookup key; see JoinReaderSpec.LookupExprs.
+	// lookupTypes are the types of the values of the lookup key and lookupRow is
+	// used to assemble them.
+	lookupCols  []uint32
+	lookupExprs []exprHelper
+	lookupTypes []sqlbase.ColumnType
+	lookupRow   sqlbase.EncDatumRow
+	// lookupRange, if set, designates the input columns that delimit the range
+	// of values of the leading index column looked up by each input row; see
+	// JoinReaderSpec.LookupRange. rangeType is the type of that column and
+	// rangeEncoding its key encoding.
+	lookupRange   *JoinReaderSpec_LookupRange
+	rangeType     sqlbase.ColumnType
+	rangeEncoding sqlbase.DatumEncoding
+
+	// indexIdx and parallelism are copied from the spec; see
+	// JoinReaderSpec.Parallelism.
+	indexIdx    int
+	parallelism int
+	// If maxInFlightBatches is positive, the lookups are pipelined; see
+	// JoinReaderSpec.MaxInFlightBatches and pipelinedLoop.
+	maxInFlightBatches int
+
+	// joinType is one of innerJoin, leftSemi or leftAnti.
+	joinType joinType
+	// If firstMatchOnly is set, the lookups of semi and anti joins are scanned
+	// one at a time, stopping at their first match; see
+	// JoinReaderSpec.MatchMode.
+	firstMatchOnly bool
+	// fetcherCols are the columns of the table decoded by the fetcher.
+	fetcherCols util.FastIntSet
+	// batchOrdering, if set, is the ordering according to which the rows
+	// matched by each batch are sorted; see JoinReaderSpec.BatchOutputOrdering.
+	// tableTypes are the types of the columns of the table.
+	batchOrdering sqlbase.ColumnOrdering
+	tableTypes    []sqlbase.ColumnType
+
+	// If the lookups are in a secondary index that doesn't contain all the
+	// needed columns, the fetcher only decodes the primary keys of the matching
+	// index entries and primaryFetcher fetches the corresponding rows from the
+	// primary index. pkColIdxs are the indexes of the primary key columns,
+	// pkTypes their types and pkVals is scratch space for their values.
+	primaryFetcher *sqlbase.MultiRowFetcher
+	primaryAlloc   sqlbase.DatumAlloc
+	pkColIdxs      []int
+	pkTypes        []sqlbase.ColumnType
+	pkVals         sqlbase.EncDatumRow
+	// If outputIndexEntries is set, each output row is made of an input row, the
+	// key columns of an index entry matched by its lookup and the corresponding
+	// row of the table; see JoinReaderSpec.OutputIndexEntries. keyColIdxs are
+	// the indexes of the table columns that form the key of the index.
+	outputIndexEntries bool
+	keyColIdxs         []int
+	// If emitMatchedFlag is set, the join is a left outer join whose output rows
+	// are made of an input row, the matching row of the table (or NULLs) and a
+	// flag indicating whether there was a match; see
+	// JoinReaderSpec.EmitMatchedFlag. nullRow is the table row output for input
+	// rows without a match, which is also the table row of the output rows of
+	// anti joins.
+	emitMatchedFlag bool
+	nullRow         sqlbase.EncDatumRow
+	// If countOnly is set, the matched rows are counted in numMatches instead of
+	// being emitted, and a single row with the count is emitted at the end; see
+	// JoinReaderSpec.CountOnly.
+	countOnly  bool
+	numMatches int64
+	// If emitLookupKey is set, the hex-encoded lookup key of each emitted row
+	// follows the table columns; see JoinReaderSpec.EmitLookupKey.
+	emitLookupKey bool
+	// If reportUnmatchedRows is set, the input rows without a match are reported
+	// as metadata; see JoinReaderSpec.ReportUnmatchedRows. unmatchedRows is the
+	// batch of such rows that hasn't been pushed yet.
+	reportUnmatchedRows bool
+	unmatchedRows       *UnmatchedRows
+
+	// maxLookupRetries and lookupRetryBackoff control the retries of the
+	// lookups that fail with transient errors; see
+	// JoinReaderSpec.MaxLookupRetries.
+	maxLookupRetries   int
+	lookupRetryBackoff time.Duration
+	// lookupColIdxs are the indexes of the table columns corresponding to the
+	// lookup columns, and lookupColTypes their types. They are used to find the
+	// lookups matched by fetched rows, for semi and anti joins or to collect
+	// stats. lookupVals is scratch space for the values of these columns.
+	lookupColIdxs  []int
+	lookupColTypes []sqlbase.ColumnType
+	lookupVals     sqlbase.EncDatumRow
+
+	// stats are reported once the joinReader is done, if the flow is verbose.
+	stats JoinReaderStats
+
+	// batchSizer determines the number of lookups in each batch. batchAcc
+	// accounts for the memory of the current batch.
+	batchSizer lookupBatchSizer
+	batchAcc   boundAccount
+
+	// cache, if set, caches the rows fetched for each lookup key; see
+	// JoinReaderSpec.LookupCacheSize.
+	cache *lookupCache
+
+	// If skipDecodeErrors is set, rows that fail to decode are skipped; see
+	// JoinReaderSpec.SkipDecodeErrors. decodeErrs are the decoding errors of the
+	// rows skipped by the lookups of the current batch; they are pushed to the
+	// consumer by the main loop once these lookups are done. Pipelined batches
+	// keep theirs in pipelinedBatch.decodeErrs instead.
+	skipDecodeErrors bool
+	decodeErrs       []error
+	numSkippedRows   uint64
+
+	// If estimatedInputRows is set, the fraction of the input consumed is
+	// reported periodically; see JoinReaderSpec.EstimatedInputRows.
+	// numInputRows is the number of input rows consumed so far, and
+	// lastProgress the time of the last report.
+	estimatedInputRows uint64
+	numInputRows       uint64
+	lastProgress       time.Time
+
+	// staleReadTimestamp, if set, is the timestamp picked for the lookups under
+	// a bounded-staleness read; see pickStaleReadTimestamp.
+	staleReadTimestamp hlc.Timestamp
 }
 
 var _ Processor = &joinReader{}
 
+// newJoinReader creates a joinReader that performs its lookups through kv. If kv
+// is nil, the lookups are performed through the flow's transaction.
 func newJoinReader(
 	flowCtx *FlowCtx,
 	spec *JoinReaderSpec,
 	input RowSource,
 	post *PostProcessSpec,
 	output RowReceiver,
+	kv kvScanner,
 ) (*joinReader, error) {
-	if spec.IndexIdx != 0 {
-		// TODO(radu): for now we only support joining with the primary index
-		return nil, errors.Errorf("join with index not implemented")
+	jr := &joinReader{
+		flowCtx:     flowCtx,
+		desc:        spec.Table,
+		input:       input,
+		inputTypes:  input.Types(),
+		interleaved: spec.Interleaved,
+		indexIdx:    int(spec.IndexIdx),
+		parallelism: int(spec.Parallelism),
+
+		maxInFlightBatches: int(spec.MaxInFlightBatches),
+
+		skipDecodeErrors:   spec.SkipDecodeErrors,
+		estimatedInputRows: spec.EstimatedInputRows,
+		outputIndexEntries: spec.OutputIndexEntries,
+		emitMatchedFlag:    spec.EmitMatchedFlag,
+		countOnly:          spec.CountOnly,
+		emitLookupKey:      spec.EmitLookupKey,
+
+		reportUnmatchedRows: spec.ReportUnmatchedRows,
+
+		maxLookupRetries:   int(spec.MaxLookupRetries),
+		lookupRetryBackoff: spec.LookupRetryBackoff,
+	}
+	if kv == nil {
+		jr.kv = txnKVScanner{txn: flowCtx.txn}
+	} else {
+		jr.kv = kv
 	}
 
-	jr := &joinReader{
-		flowCtx:    flowCtx,
-		desc:       spec.Table,
-		input:      input,
-		inputTypes: input.Types(),
+	var err error
+	jr.index, _, err = jr.desc.FindIndexByIndexIdx(jr.indexIdx)
+	if err != nil {
+		return nil, err
+	}
+	if jr.batchSizer, err = makeLookupBatchSizer(spec); err != nil {
+		return nil, err
+	}
+
+	jr.numLookupCols = len(jr.index.ColumnIDs)
+	if jr.interleaved && jr.indexIdx != 0 {
+		return nil, errors.Errorf("interleaved join with index not implemented")
+	}
+	if jr.interleaved {
+		if len(jr.index.Interleave.Ancestors) == 0 {
+			return nil, errors.Errorf("table %s is not interleaved", jr.desc.Name)
+		}
+		// The key of the closest parent is made of the values of the columns
+		// shared with all the ancestors.
+		jr.numLookupCols = 0
+		for _, ancestor := range jr.index.Interleave.Ancestors {
+			jr.numLookupCols += int(ancestor.SharedPrefixLen)
+		}
+	}
+	if len(spec.LookupColumns) > 0 {
+		if len(spec.LookupColumns) != jr.numLookupCols {
+			return nil, errors.Errorf(
+				"%d lookup columns specified, expecting %d", len(spec.LookupColumns), jr.numLookupCols,
+			)
+		}
+		jr.lookupCols = spec.LookupColumns
+		jr.lookupTypes = make([]sqlbase.ColumnType, len(jr.lookupCols))
+		for i, c := range jr.lookupCols {
+			if int(c) >= len(jr.inputTypes) {
+				return nil, errors.Errorf(
+					"invalid lookup column %d (input has %d columns)", c, len(jr.inputTypes),
+				)
+			}
+			jr.lookupTypes[i] = jr.inputTypes[c]
+		}
+		jr.lookupRow = make(sqlbase.EncDatumRow, len(jr.lookupCols))
 	}
 
-	types := make([]sqlbase.ColumnType, len(spec.Table.Columns))
-	for i := range types {
-		types[i] = spec.Table.Columns[i].Type
+	colIdxMap := make(map[sqlbase.ColumnID]int, len(jr.desc.Columns))
+	for i, c := range jr.desc.Columns {
+		colIdxMap[c.ID] = i
+	}
+	if len(spec.LookupExprs) > 0 {
+		if len(spec.LookupColumns) > 0 {
+			return nil, errors.Errorf("lookup columns and lookup expressions both specified")
+		}
+		if len(spec.LookupExprs) != jr.numLookupCols {
+			return nil, errors.Errorf(
+				"%d lookup expressions specified, expecting %d", len(spec.LookupExprs), jr.numLookupCols,
+			)
+		}
+		evalCtx := flowCtx.NewEvalCtx()
+		jr.lookupExprs = make([]exprHelper, len(spec.LookupExprs))
+		jr.lookupTypes = make([]sqlbase.ColumnType, len(spec.LookupExprs))
+		for i, expr := range spec.LookupExprs {
+			if err := jr.lookupExprs[i].init(expr, jr.inputTypes, evalCtx); err != nil {
+				return nil, err
+			}
+			col := &jr.desc.Columns[colIdxMap[jr.index.ColumnIDs[i]]]
+			want := col.Type.ToDatumType()
+			if typ := jr.lookupExprs[i].expr.ResolvedType(); typ != types.Null && !typ.Equivalent(want) {
+				return nil, errors.Errorf(
+					"lookup expression %s has type %s, but index column %s has type %s",
+					&jr.lookupExprs[i], typ, col.Name, want,
+				)
+			}
+			jr.lookupTypes[i] = col.Type
+		}
+		jr.lookupRow = make(sqlbase.EncDatumRow, len(jr.lookupExprs))
+	}
+	if r := spec.LookupRange; r != nil {
+		if len(spec.LookupColumns) > 0 || len(spec.LookupExprs) > 0 {
+			return nil, errors.Errorf("range lookups not supported with lookup columns or expressions")
+		}
+		if jr.interleaved || len(jr.index.Interleave.Ancestors) > 0 {
+			return nil, errors.Errorf("range lookups not supported on interleaved index %s", jr.index.Name)
+		}
+		col := &jr.desc.Columns[colIdxMap[jr.index.ColumnIDs[0]]]
+		for _, c := range []uint32{r.LowColumn, r.HighColumn} {
+			if int(c) >= len(jr.inputTypes) {
+				return nil, errors.Errorf(
+					"invalid range lookup column %d (input has %d columns)", c, len(jr.inputTypes),
+				)
+			}
+			if typ := jr.inputTypes[c]; !typ.ToDatumType().Equivalent(col.Type.ToDatumType()) {
+				return nil, errors.Errorf(
+					"range lookup column %d has type %s, but index column %s has type %s",
+					c, typ.SQLString(), col.Name, col.Type.SQLString(),
+				)
+			}
+		}
+		jr.lookupRange = r
+		jr.rangeType = col.Type
+		jr.rangeEncoding = sqlbase.DatumEncoding_ASCENDING_KEY
+		if jr.index.ColumnDirections[0] == sqlbase.IndexDescriptor_DESC {
+			jr.rangeEncoding = sqlbase.DatumEncoding_DESCENDING_KEY
+		}
+	}
+	jr.tableTypes = make([]sqlbase.ColumnType, len(jr.desc.Columns))
+	for i := range jr.tableTypes {
+		jr.tableTypes[i] = jr.desc.Columns[i].Type
+	}
+	var types []sqlbase.ColumnType
+	switch spec.Type {
+	case JoinType_INNER:
+		types = jr.tableTypes
+		if jr.outputIndexEntries {
+			if jr.indexIdx == 0 {
+				return nil, errors.Errorf("outputting index entries requires a secondary index")
+			}
+			if spec.LookupCacheSize > 0 || len(spec.BatchOutputOrdering.Columns) > 0 {
+				return nil, errors.Errorf(
+					"outputting index entries not supported with a lookup cache or a batch output ordering",
+				)
+			}
+			// The output rows are made of the input columns, the index key
+			// columns and the table columns, in this order.
+			types = append([]sqlbase.ColumnType(nil), jr.inputTypes...)
+			for _, id := range jr.index.ColumnIDs {
+				idx := colIdxMap[id]
+				jr.keyColIdxs = append(jr.keyColIdxs, idx)
+				types = append(types, jr.tableTypes[idx])
+			}
+			types = append(types, jr.tableTypes...)
+		}
+		if jr.emitMatchedFlag {
+			if spec.LookupCacheSize > 0 || len(spec.BatchOutputOrdering.Columns) > 0 ||
+				jr.outputIndexEntries {
+				return nil, errors.Errorf(
+					"emitting a matched flag not supported with a lookup cache, " +
+						"a batch output ordering or index entries in the output",
+				)
+			}
+			// The output rows are made of the input columns, the table columns and
+			// the flag, in this order.
+			types = make([]sqlbase.ColumnType, 0, len(jr.inputTypes)+len(jr.tableTypes)+1)
+			types = append(types, jr.inputTypes...)
+			types = append(types, jr.tableTypes...)
+			types = append(types, sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_BOOL})
+			jr.nullRow = jr.makeNullRow()
+		}
+		if jr.countOnly {
+			if spec.LookupCacheSize > 0 || len(spec.BatchOutputOrdering.Columns) > 0 ||
+				jr.outputIndexEntries || jr.emitMatchedFlag {
+				return nil, errors.Errorf(
+					"counting matches not supported with a lookup cache, a batch output " +
+						"ordering, index entries in the output or a matched flag",
+				)
+			}
+			types = []sqlbase.ColumnType{{SemanticType: sqlbase.ColumnType_INT}}
+		}
+		if jr.emitLookupKey {
+			if jr.outputIndexEntries || jr.emitMatchedFlag || jr.countOnly {
+				return nil, errors.Errorf(
+					"emitting lookup keys not supported with index entries in the output, " +
+						"a matched flag or counting matches",
+				)
+			}
+			types = make([]sqlbase.ColumnType, 0, len(jr.tableTypes)+1)
+			types = append(types, jr.tableTypes...)
+			types = append(types, sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING})
+		}
+	case JoinType_LEFT_SEMI, JoinType_LEFT_ANTI:
+		if jr.outputIndexEntries {
+			return nil, errors.Errorf("outputting index entries not supported for %s joins", spec.Type)
+		}
+		if jr.emitMatchedFlag {
+			return nil, errors.Errorf("emitting a matched flag not supported for %s joins", spec.Type)
+		}
+		if jr.countOnly {
+			return nil, errors.Errorf("counting matches not supported for %s joins", spec.Type)
+		}
+		if jr.emitLookupKey {
+			return nil, errors.Errorf("emitting lookup keys not supported for %s joins", spec.Type)
+		}
+		switch spec.MatchMode {
+		case JoinReaderSpec_AUTO_MATCH:
+			jr.firstMatchOnly = jr.interleaved || !jr.index.Unique
+		case JoinReaderSpec_FIRST_MATCH:
+			jr.firstMatchOnly = true
+		}
+		// Only the input rows are emitted; for anti joins, they are followed by
+		// NULLs for the columns of the table, which don't have a matching row.
+		types = jr.inputTypes
+		if spec.Type == JoinType_LEFT_ANTI {
+			types = make([]sqlbase.ColumnType, 0, len(jr.inputTypes)+len(jr.tableTypes))
+			types = append(types, jr.inputTypes...)
+			types = append(types, jr.tableTypes...)
+			jr.nullRow = jr.makeNullRow()
+		}
+	default:
+		return nil, errors.Errorf("%s join not supported by joinReader", spec.Type)
+	}
+	if spec.MatchMode != JoinReaderSpec_AUTO_MATCH && spec.Type == JoinType_INNER {
+		return nil, errors.Errorf("match mode %s only applies to semi and anti joins", spec.MatchMode)
 	}
+	jr.joinType = joinType(spec.Type)
 
 	if err := jr.init(post, types, flowCtx, output); err != nil {
 		return nil, err
 	}
+	// Lookup joins can produce many output rows; avoid allocating a fresh one
+	// for each of them when the output doesn't hold on to them.
+	jr.out.enableOutputRowReuse()
 
-	var err error
-	jr.index, _, err = initRowFetcher(
-		&jr.fetcher, &jr.desc, int(spec.IndexIdx), false, /* reverse */
-		jr.out.neededColumns(), false /* isCheck */, &jr.alloc,
-	)
-	if err != nil {
+	jr.lookupColIdxs = make([]int, jr.numLookupCols)
+	jr.lookupColTypes = make([]sqlbase.ColumnType, jr.numLookupCols)
+	for i, id := range jr.index.ColumnIDs[:jr.numLookupCols] {
+		jr.lookupColIdxs[i] = colIdxMap[id]
+		jr.lookupColTypes[i] = jr.desc.Columns[colIdxMap[id]].Type
+	}
+	jr.lookupVals = make(sqlbase.EncDatumRow, jr.numLookupCols)
+
+	if jr.outputIndexEntries {
+		// The table columns needed by the post-processing follow the input and
+		// index key columns in the output rows.
+		offset := len(jr.inputTypes) + len(jr.keyColIdxs)
+		jr.out.neededColumns().ForEach(func(c int) {
+			if c >= offset {
+				jr.fetcherCols.Add(c - offset)
+			}
+		})
+	} else if jr.emitMatchedFlag {
+		// The table columns needed by the post-processing follow the input
+		// columns in the output rows. The lookup columns are needed to find the
+		// input rows matched by the fetched rows.
+		offset := len(jr.inputTypes)
+		jr.out.neededColumns().ForEach(func(c int) {
+			if c >= offset && c < offset+len(jr.tableTypes) {
+				jr.fetcherCols.Add(c - offset)
+			}
+		})
+		for _, idx := range jr.lookupColIdxs {
+			jr.fetcherCols.Add(idx)
+		}
+	} else if jr.joinType == innerJoin && !jr.countOnly {
+		jr.fetcherCols = jr.out.neededColumns()
+		if jr.emitLookupKey {
+			// The lookup key column isn't decoded; it is computed from the lookup
+			// columns.
+			jr.fetcherCols.Remove(len(jr.tableTypes))
+			for _, idx := range jr.lookupColIdxs {
+				jr.fetcherCols.Add(idx)
+			}
+		}
+	}
+	if len(spec.BatchOutputOrdering.Columns) > 0 {
+		if jr.joinType != innerJoin {
+			return nil, errors.Errorf("sorting the output of a %s join not supported", spec.Type)
+		}
+		jr.batchOrdering = convertToColumnOrdering(spec.BatchOutputOrdering)
+		for _, c := range jr.batchOrdering {
+			if c.ColIdx >= len(jr.tableTypes) {
+				return nil, errors.Errorf("invalid ordering column %d", c.ColIdx)
+			}
+			// The rows are sorted before the post-processing.
+			jr.fetcherCols.Add(c.ColIdx)
+		}
+	}
+	useCache := jr.joinType == innerJoin && spec.LookupCacheSize > 0
+	if jr.joinType != innerJoin || flowCtx.Verbose || useCache || jr.reportUnmatchedRows {
+		// To find the input rows that have a match (or the lookup key under which
+		// to cache a fetched row), we need the values of the lookup columns (and,
+		// for semi and anti joins, only them).
+		for _, idx := range jr.lookupColIdxs {
+			jr.fetcherCols.Add(idx)
+		}
+	}
+	if jr.indexIdx != 0 {
+		// If the secondary index contains all the columns we need, the rows are
+		// decoded from the index entries alone and the primary index is never
+		// read; the columns that aren't in the index are left unset in the fetched
+		// rows. Otherwise, the rows are fetched from the primary index using the
+		// primary keys decoded from the index entries. When outputting the index
+		// entries, the rows are always fetched from the primary index.
+		var indexCols util.FastIntSet
+		for _, ids := range [][]sqlbase.ColumnID{
+			jr.index.ColumnIDs, jr.index.ExtraColumnIDs, jr.index.StoreColumnIDs,
+		} {
+			for _, id := range ids {
+				indexCols.Add(colIdxMap[id])
+			}
+		}
+		if !jr.fetcherCols.SubsetOf(indexCols) || jr.outputIndexEntries {
+			var pkCols util.FastIntSet
+			for _, id := range jr.desc.PrimaryIndex.ColumnIDs {
+				idx := colIdxMap[id]
+				pkCols.Add(idx)
+				jr.pkColIdxs = append(jr.pkColIdxs, idx)
+				jr.pkTypes = append(jr.pkTypes, jr.desc.Columns[idx].Type)
+			}
+			jr.pkVals = make(sqlbase.EncDatumRow, len(jr.pkColIdxs))
+			jr.primaryFetcher = &sqlbase.MultiRowFetcher{}
+			if _, _, err := initRowFetcher(
+				jr.primaryFetcher, &jr.desc, 0 /* indexIdx */, false, /* reverse */
+				jr.fetcherCols.Union(pkCols), false /* isCheck */, &jr.primaryAlloc,
+			); err != nil {
+				return nil, err
+			}
+			jr.fetcherCols = pkCols
+			if jr.outputIndexEntries {
+				var keyCols util.FastIntSet
+				for _, idx := range jr.keyColIdxs {
+					keyCols.Add(idx)
+				}
+				jr.fetcherCols = pkCols.Union(keyCols)
+			}
+		}
+	}
+	if _, _, err := initRowFetcher(
+		&jr.fetcher, &jr.desc, jr.indexIdx, false, /* reverse */
+		jr.fetcherCols, false /* isCheck */, &jr.alloc,
+	); err != nil {
 		return nil, err
 	}
 
 	// TODO(radu): verify the input types match the index key types
 
+	if jr.lookupRange != nil {
+		// The rows matched by a range can't be traced back to an input row by
+		// their lookup key.
+		if jr.joinType != innerJoin {
+			return nil, errors.Errorf("range lookups not supported for %s joins", spec.Type)
+		}
+		if useCache || jr.outputIndexEntries || jr.emitMatchedFlag || jr.emitLookupKey {
+			return nil, errors.Errorf(
+				"range lookups not supported with a lookup cache, index entries in the " +
+					"output, a matched flag or lookup keys in the output",
+			)
+		}
+	}
+	if jr.maxInFlightBatches > 0 {
+		// The lookups of the pending batches run concurrently and emit nothing
+		// until the main loop gets to their batch, which only the plain lookups
+		// support.
+		if jr.joinType != innerJoin {
+			return nil, errors.Errorf("pipelined lookups not supported for %s joins", spec.Type)
+		}
+		if useCache || jr.outputIndexEntries || jr.emitMatchedFlag {
+			return nil, errors.Errorf(
+				"pipelined lookups not supported with a lookup cache, index entries in the " +
+					"output or a matched flag",
+			)
+		}
+		if jr.primaryFetcher != nil {
+			return nil, errors.Errorf(
+				"pipelined lookups not supported when the rows are fetched from the primary "+
+					"index after index %s", jr.index.Name,
+			)
+		}
+	}
+	if jr.reportUnmatchedRows {
+		// The input rows without a match are found by the plain lookups only.
+		if jr.joinType != innerJoin {
+			return nil, errors.Errorf("reporting unmatched rows not supported for %s joins", spec.Type)
+		}
+		if useCache || jr.outputIndexEntries || jr.emitMatchedFlag || jr.maxInFlightBatches > 0 {
+			return nil, errors.Errorf(
+				"reporting unmatched rows not supported with a lookup cache, index entries " +
+					"in the output, a matched flag or pipelined lookups",
+			)
+		}
+		// Finding the ranges without a match means checking every fetched row
+		// against every range of the batch.
+		if jr.lookupRange != nil {
+			return nil, errors.Errorf("reporting unmatched rows not supported with range lookups")
+		}
+	}
+	if err := jr.pickStaleReadTimestamp(); err != nil {
+		return nil, err
+	}
+	if useCache {
+		jr.cache = newLookupCache(int(spec.LookupCacheSize), flowCtx.makeBoundAccount(flowCtx.EvalCtx.Mon))
+	}
+	jr.batchAcc = flowCtx.makeBoundAccount(flowCtx.EvalCtx.Mon)
 	return jr, nil
 }
 
+// makeNullRow returns a row of the table with (properly typed) NULLs in all its
+// columns.
+func (jr *joinReader) makeNullRow() sqlbase.EncDatumRow {
+	row := make(sqlbase.EncDatumRow, len(jr.tableTypes))
+	for i := range row {
+		row[i] = sqlbase.DatumToEncDatum(jr.tableTypes[i], tree.DNull)
+	}
+	return row
+}
+
+// strategy returns the strategy the joinReader uses to find the rows matching
+// its lookups, which is determined when it is created.
+func (jr *joinReader) strategy() joinReaderStrategy {
+	switch {
+	case jr.interleaved:
+		return joinReaderInterleavedScan
+	case jr.indexIdx == 0:
+		return joinReaderPrimaryLookup
+	case jr.primaryFetcher != nil:
+		return joinReaderIndexJoin
+	default:
+		return joinReaderIndexOnly
+	}
+}
+
 func (jr *joinReader) generateKey(
 	row sqlbase.EncDatumRow, alloc *sqlbase.DatumAlloc, primaryKeyPrefix []byte,
 ) (roachpb.Key, error) {
 	index := jr.index
-	if len(row) < len(index.ColumnIDs) {
-		return nil, errors.Errorf("joinReader input has %d columns, expected at least %d",
-			len(row), len(jr.desc.PrimaryIndex.ColumnIDs))
+	var types []sqlbase.ColumnType
+	if jr.lookupCols != nil {
+		for i, c := range jr.lookupCols {
+			jr.lookupRow[i] = row[c]
+		}
+		row = jr.lookupRow
+		types = jr.lookupTypes
+	} else if jr.lookupExprs != nil {
+		for i := range jr.lookupExprs {
+			d, err := jr.lookupExprs[i].eval(row)
+			if err != nil {
+				return nil, err
+			}
+			jr.lookupRow[i] = sqlbase.DatumToEncDatum(jr.lookupTypes[i], d)
+		}
+		row = jr.lookupRow
+		types = jr.lookupTypes
+	} else {
+		if len(row) < jr.numLookupCols {
+			return nil, errors.Errorf("joinReader input has %d columns, expected at least %d",
+				len(row), jr.numLookupCols)
+		}
+		// There may be extra values on the row, e.g. to allow an ordered
+		// synchronizer to interleave multiple input streams.
+		row = row[:jr.numLookupCols]
+		types = jr.inputTypes[:jr.numLookupCols]
 	}
-	// There may be extra values on the row, e.g. to allow an ordered synchronizer
-	// to interleave multiple input streams.
-	row = row[:len(index.ColumnIDs)]
-	types := jr.inputTypes[:len(index.ColumnIDs)]
 
+	if jr.interleaved {
+		return jr.generateInterleaveParentKey(row, types, alloc, primaryKeyPrefix)
+	}
 	return sqlbase.MakeKeyFromEncDatums(types, row, &jr.desc, index, primaryKeyPrefix, alloc)
 }
 
+// lookupSpan returns the span scanned to look up the matches of an input row.
+// With range lookups, the span is empty (and isn't scanned) if the range is.
+func (jr *joinReader) lookupSpan(
+	row sqlbase.EncDatumRow, alloc *sqlbase.DatumAlloc, primaryKeyPrefix []byte,
+) (roachpb.Span, error) {
+	if jr.lookupRange != nil {
+		return jr.rangeLookupSpan(row, alloc, primaryKeyPrefix)
+	}
+	key, err := jr.generateKey(row, alloc, primaryKeyPrefix)
+	if err != nil {
+		return roachpb.Span{}, err
+	}
+	return roachpb.Span{Key: key, EndKey: key.PrefixEnd()}, nil
+}
+
+// rangeLookupSpan returns the span of the index holding the rows whose value
+// in the leading index column is within the range of an input row; see
+// JoinReaderSpec.LookupRange. An empty span is returned if the range has a
+// NULL bound or if its low bound is greater than its high bound.
+func (jr *joinReader) rangeLookupSpan(
+	row sqlbase.EncDatumRow, alloc *sqlbase.DatumAlloc, primaryKeyPrefix []byte,
+) (roachpb.Span, error) {
+	low, high := &row[jr.lookupRange.LowColumn], &row[jr.lookupRange.HighColumn]
+	for _, bound := range [...]*sqlbase.EncDatum{low, high} {
+		if err := bound.EnsureDecoded(&jr.rangeType, alloc); err != nil {
+			return roachpb.Span{}, err
+		}
+		if bound.IsNull() {
+			return roachpb.Span{}, nil
+		}
+	}
+	if jr.rangeEncoding == sqlbase.DatumEncoding_DESCENDING_KEY {
+		// The keys of a descending column are sorted in the reverse order of its
+		// values.
+		low, high = high, low
+	}
+	startKey, err := low.Encode(
+		&jr.rangeType, alloc, jr.rangeEncoding, append(roachpb.Key(nil), primaryKeyPrefix...),
+	)
+	if err != nil {
+		return roachpb.Span{}, err
+	}
+	endKey, err := high.Encode(
+		&jr.rangeType, alloc, jr.rangeEncoding, append(roachpb.Key(nil), primaryKeyPrefix...),
+	)
+	if err != nil {
+		return roachpb.Span{}, err
+	}
+	// The rows equal to the high bound have keys prefixed by its encoding.
+	span := roachpb.Span{Key: startKey, EndKey: roachpb.Key(endKey).PrefixEnd()}
+	if span.Key.Compare(span.EndKey) >= 0 {
+		return roachpb.Span{}, nil
+	}
+	return span, nil
+}
+
+// lookupSpans returns the spans the joinReader would scan to look up the given
+// input rows, one for each row (empty for empty ranges, which aren't scanned),
+// without reading anything. This allows tools to
+// estimate the reads performed by a lookup join. It doesn't account for the
+// lookup cache, which can save scanning some of the spans. It must not be
+// called while the joinReader is running.
+func (jr *joinReader) lookupSpans(rows sqlbase.EncDatumRows) (roachpb.Spans, error) {
+	primaryKeyPrefix := sqlbase.MakeIndexKeyPrefix(&jr.desc, jr.index.ID)
+	var alloc sqlbase.DatumAlloc
+	spans := make(roachpb.Spans, len(rows))
+	for i, row := range rows {
+		var err error
+		if spans[i], err = jr.lookupSpan(row, &alloc, primaryKeyPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return spans, nil
+}
+
+// generateInterleaveParentKey returns the key of the row of the (closest)
+// interleave parent with the given primary key values. This key is a prefix of
+// the keys of all the rows interleaved in the parent row, including the rows of
+// our table that share these values.
+//
+// See sqlbase.MakeKeyFromEncDatums for the layout of interleaved keys.
+func (jr *joinReader) generateInterleaveParentKey(
+	row sqlbase.EncDatumRow,
+	types []sqlbase.ColumnType,
+	alloc *sqlbase.DatumAlloc,
+	primaryKeyPrefix []byte,
+) (roachpb.Key, error) {
+	dirs := jr.index.ColumnDirections
+	key := make(roachpb.Key, len(primaryKeyPrefix), len(primaryKeyPrefix)*2)
+	copy(key, primaryKeyPrefix)
+	for i, ancestor := range jr.index.Interleave.Ancestors {
+		// The first ancestor is already encoded in primaryKeyPrefix.
+		if i != 0 {
+			// Each ancestor is separated by an interleaved sentinel.
+			key = encoding.EncodeInterleavedSentinel(key)
+			key = encoding.EncodeUvarintAscending(key, uint64(ancestor.TableID))
+			key = encoding.EncodeUvarintAscending(key, uint64(ancestor.IndexID))
+		}
+		for j := 0; j < int(ancestor.SharedPrefixLen); j++ {
+			enc := sqlbase.DatumEncoding_ASCENDING_KEY
+			if dirs[j] == sqlbase.IndexDescriptor_DESC {
+				enc = sqlbase.DatumEncoding_DESCENDING_KEY
+			}
+			var err error
+			key, err = row[j].Encode(&types[j], alloc, enc, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		row, types, dirs = row[ancestor.SharedPrefixLen:], types[ancestor.SharedPrefixLen:],
+			dirs[ancestor.SharedPrefixLen:]
+	}
+	return key, nil
+}
+
 // mainLoop runs the mainLoop and returns any error.
 //
 // If no error is returned, the input has been drained and the output has been
@@ -117,14 +954,27 @@ func (jr *joinReader) mainLoop(ctx context.Context) error {
 	primaryKeyPrefix := sqlbase.MakeIndexKeyPrefix(&jr.desc, jr.index.ID)
 
 	var alloc sqlbase.DatumAlloc
-	spans := make(roachpb.Spans, 0, joinReaderBatchSize)
+	spans := make(roachpb.Spans, 0, jr.batchSizer.size())
+	// For semi and anti joins (and inner joins that need them), inputRows
+	// contains the input rows corresponding to spans.
+	var inputRows sqlbase.EncDatumRows
+	var inputRowAlloc sqlbase.EncDatumRowAlloc
+	// outRowAlloc allocates the output rows of anti joins.
+	var outRowAlloc sqlbase.EncDatumRowAlloc
+	// scannedSpans accumulates the spans of all the batches if the flow is
+	// verbose.
+	var scannedSpans roachpb.Spans
 
-	txn := jr.flowCtx.txn
-	if txn == nil {
-		log.Fatalf(ctx, "joinReader outside of txn")
+	if s, ok := jr.kv.(txnKVScanner); ok {
+		if s.txn == nil {
+			log.Fatalf(ctx, "joinReader outside of txn")
+		}
+		// All the batches are sent through the flow's transaction, so they are
+		// evaluated at its (possibly historical) read timestamp.
+		log.VEventf(ctx, 1, "starting (reading at %s)", jr.readTimestamp())
+	} else {
+		log.VEventf(ctx, 1, "starting")
 	}
-
-	log.VEventf(ctx, 1, "starting")
 	if log.V(1) {
 		defer log.Infof(ctx, "exiting")
 	}
@@ -133,7 +983,15 @@ func (jr *joinReader) mainLoop(ctx context.Context) error {
 		// TODO(radu): figure out how to send smaller batches if the source has
 		// a soft limit (perhaps send the batch out if we don't get a result
 		// within a certain amount of time).
-		for spans = spans[:0]; len(spans) < joinReaderBatchSize; {
+		if err := jr.flowCtx.checkDeadline(); err != nil {
+			return err
+		}
+		inputRows = inputRows[:0]
+		jr.batchAcc.Clear(ctx)
+		// inputDone is set once the input is exhausted; memPressure is set if the
+		// batch was cut short because its memory couldn't be accounted for.
+		inputDone, memPressure := false, false
+		for spans = spans[:0]; len(spans) < jr.batchSizer.size() && !memPressure; {
 			row, meta := jr.input.Next()
 			if !meta.Empty() {
 				if meta.Err != nil {
@@ -148,57 +1006,1247 @@ func (jr *joinReader) mainLoop(ctx context.Context) error {
 				if len(spans) == 0 {
 					// No fetching needed since we have collected no spans and
 					// the input has signaled that no more records are coming.
+					jr.pushStats(scannedSpans)
+					if !jr.maybeEmitCount(ctx) {
+						return nil
+					}
 					jr.out.Close()
 					return nil
 				}
+				inputDone = true
 				break
 			}
 
-			key, err := jr.generateKey(row, &alloc, primaryKeyPrefix)
+			jr.numInputRows++
+			span, err := jr.lookupSpan(row, &alloc, primaryKeyPrefix)
 			if err != nil {
 				return err
 			}
+			if span.Key == nil {
+				// An empty range matches no rows; there's nothing to scan.
+				if jr.flowCtx.Verbose {
+					jr.updateMatchStats([]bool{false})
+				}
+				if jr.reportUnmatchedRows {
+					if ok, err := jr.addUnmatchedRow(ctx, row, &alloc); err != nil || !ok {
+						return err
+					}
+				}
+				continue
+			}
 
-			spans = append(spans, roachpb.Span{
-				Key:    key,
-				EndKey: key.PrefixEnd(),
-			})
+			spans = append(spans, span)
+			size := int64(unsafe.Sizeof(roachpb.Span{})) + int64(len(span.Key)+len(span.EndKey))
+			if jr.joinType != innerJoin || jr.outputIndexEntries || jr.emitMatchedFlag ||
+				jr.reportUnmatchedRows {
+				inputRows = append(inputRows, inputRowAlloc.CopyRow(row))
+				size += row.MemorySize()
+			}
+			if err := jr.batchAcc.Grow(ctx, size); err != nil {
+				// Send out what we have; the next batches will be smaller.
+				log.VEventf(ctx, 1, "cutting lookup batch short at %d lookups: %s", len(spans), err)
+				memPressure = true
+			}
 		}
 
-		// TODO(radu,andrei,knz): set the traceKV flag when requested by the session.
-		err := jr.fetcher.StartScan(ctx, txn, spans, false /* no batch limits */, 0, false /* traceKV */)
-		if err != nil {
-			log.Errorf(ctx, "scan error: %s", err)
-			return err
+		if jr.flowCtx.Verbose {
+			scannedSpans = append(scannedSpans, spans...)
 		}
 
-		// TODO(radu): we are consuming all results from a fetch before starting
-		// the next batch. We could start the next batch early while we are
-		// outputting rows.
-		for {
-			row, _, _, err := jr.fetcher.NextRow(ctx)
-			if err != nil {
-				err = scrub.UnwrapScrubError(err)
+		// latency is the time it took to get the results of the lookups (or, when
+		// the fetched rows are streamed, the first of them).
+		lookupStart := timeutil.Now()
+		var latency time.Duration
+		if jr.joinType != innerJoin {
+			var matched []bool
+			if ok, err := jr.performLookups(ctx, func() (err error) {
+				matched, err = jr.lookupMatches(ctx, spans, primaryKeyPrefix)
+				return err
+			}); err != nil || !ok {
 				return err
 			}
-			if row == nil {
-				// Done with this batch.
-				break
+			latency = timeutil.Since(lookupStart)
+			if jr.flowCtx.Verbose {
+				jr.updateMatchStats(matched)
 			}
-
-			// Emit the row; stop if no more rows are needed.
-			if !emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input) {
-				return nil
+			for i, row := range inputRows {
+				// Semi-joins emit the rows that have a match, anti-joins the ones that
+				// don't.
+				if matched[i] != (jr.joinType == leftSemi) {
+					continue
+				}
+				if jr.joinType == leftAnti {
+					outRow := outRowAlloc.AllocRow(len(row) + len(jr.nullRow))
+					copy(outRow, row)
+					copy(outRow[len(row):], jr.nullRow)
+					row = outRow
+				}
+				if !emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input) {
+					return nil
+				}
+			}
+		} else if jr.outputIndexEntries {
+			var rows []sqlbase.EncDatumRow
+			var matched []bool
+			if ok, err := jr.performLookups(ctx, func() (err error) {
+				rows, matched, err = jr.indexEntryRows(ctx, spans, inputRows, primaryKeyPrefix)
+				return err
+			}); err != nil || !ok {
+				return err
+			}
+			latency = timeutil.Since(lookupStart)
+			if jr.flowCtx.Verbose {
+				jr.updateMatchStats(matched)
+			}
+			for _, row := range rows {
+				if !emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input) {
+					return nil
+				}
+			}
+		} else if jr.emitMatchedFlag {
+			var rows []sqlbase.EncDatumRow
+			var matched []bool
+			if ok, err := jr.performLookups(ctx, func() (err error) {
+				rows, matched, err = jr.matchedFlagRows(ctx, spans, inputRows, primaryKeyPrefix)
+				return err
+			}); err != nil || !ok {
+				return err
+			}
+			latency = timeutil.Since(lookupStart)
+			if jr.flowCtx.Verbose {
+				jr.updateMatchStats(matched)
+			}
+			for _, row := range rows {
+				if !emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input) {
+					return nil
+				}
+			}
+		} else if jr.cache != nil {
+			var results [][]sqlbase.EncDatumRow
+			var hits int
+			var toScan roachpb.Spans
+			if ok, err := jr.performLookups(ctx, func() (err error) {
+				results, hits, toScan, err = jr.cachedLookup(ctx, spans, primaryKeyPrefix)
+				return err
+			}); err != nil || !ok {
+				return err
+			}
+			jr.cache.hits += hits
+			jr.cache.misses += len(spans) - hits
+			jr.stats.KVReads += uint64(len(toScan))
+			latency = timeutil.Since(lookupStart)
+			if jr.flowCtx.Verbose {
+				matched := make([]bool, len(results))
+				for i := range results {
+					matched[i] = len(results[i]) > 0
+				}
+				jr.updateMatchStats(matched)
+			}
+			var rows []sqlbase.EncDatumRow
+			for i := range results {
+				rows = append(rows, results[i]...)
+			}
+			if err := jr.sortBatch(rows); err != nil {
+				return err
+			}
+			if err := jr.maybeAppendLookupKeys(rows, primaryKeyPrefix); err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if !emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input) {
+					return nil
+				}
+			}
+		} else {
+			// All the rows of the batch are fetched before any of them is emitted,
+			// so that no rows of a batch are emitted if its lookups fail midway: on
+			// a retryable error, the flow is restarted and the rows would be
+			// emitted again.
+			var rows []sqlbase.EncDatumRow
+			if ok, err := jr.performLookups(ctx, func() (err error) {
+				rows, err = jr.fetchRows(ctx, spans)
+				return err
+			}); err != nil || !ok {
+				return err
+			}
+			latency = timeutil.Since(lookupStart)
+			if jr.flowCtx.Verbose || jr.reportUnmatchedRows {
+				found := make(map[string]struct{})
+				for _, row := range rows {
+					key, err := jr.fetchedRowLookupKey(row, primaryKeyPrefix)
+					if err != nil {
+						return err
+					}
+					found[string(key)] = struct{}{}
+				}
+				matched := jr.lookupsMatched(spans, found)
+				if jr.flowCtx.Verbose {
+					jr.updateMatchStats(matched)
+				}
+				if jr.reportUnmatchedRows {
+					for i, row := range inputRows {
+						if matched[i] {
+							continue
+						}
+						if ok, err := jr.addUnmatchedRow(ctx, row, &alloc); err != nil || !ok {
+							return err
+						}
+					}
+				}
+			}
+			if jr.countOnly {
+				// The rows are only counted; none are emitted.
+				jr.numMatches += int64(len(rows))
+				rows = nil
+			}
+			if err := jr.sortBatch(rows); err != nil {
+				return err
+			}
+			if err := jr.maybeAppendLookupKeys(rows, primaryKeyPrefix); err != nil {
+				return err
+			}
+			// TODO(radu): we are consuming all results from a fetch before starting
+			// the next batch. We could start the next batch early while we are
+			// outputting rows.
+			for _, row := range rows {
+				// Emit the row; stop if no more rows are needed. If the consumer
+				// requested draining, emitHelper drains the input's metadata (without
+				// performing any more lookups) and closes the output.
+				if !emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input) {
+					return nil
+				}
 			}
 		}
 
-		if len(spans) != joinReaderBatchSize {
-			// This was the last batch.
-			sendTraceData(ctx, jr.out.output)
-			jr.out.Close()
+		if jr.cache == nil {
+			// With a cache, only the scanned lookups are counted (see above).
+			jr.stats.KVReads += uint64(len(spans))
+		}
+		jr.maybeLogSlowBatch(ctx, spans, latency)
+		jr.batchSizer.update(len(spans), latency, memPressure)
+		if !jr.maybeEmitProgress(ctx) {
 			return nil
 		}
+		if inputDone {
+			// This was the last batch.
+			jr.pushStats(scannedSpans)
+			if !jr.maybeEmitCount(ctx) {
+				return nil
+			}
+			sendTraceData(ctx, jr.out.output)
+			jr.out.Close()
+			return nil
+		}
+	}
+}
+
+// pipelinedBatch is a batch of lookups of a joinReader with pipelined lookups;
+// see JoinReaderSpec.MaxInFlightBatches. Its lookups are performed in the
+// background, and done is closed once rows and decodeErrs (or err) and latency
+// are set. Until then, these fields are owned by the goroutine performing the
+// lookups.
+type pipelinedBatch struct {
+	spans roachpb.Spans
+	// memSize is the memory accounted for the spans in batchAcc; memPressure is
+	// set if the batch was cut short because its memory couldn't be accounted
+	// for.
+	memSize     int64
+	memPressure bool
+
+	done       chan struct{}
+	rows       []sqlbase.EncDatumRow
+	decodeErrs []error
+	latency    time.Duration
+	err        error
+}
+
+// pipelinedLoop is the counterpart of mainLoop for pipelined lookups. The
+// batches are formed as the input is read, and their lookups are started as
+// soon as they are full, as long as fewer than maxInFlightBatches batches are
+// pending. The rows of the pending batches are emitted in order, each batch as
+// soon as its lookups are done; the input is only waited on when no pending
+// batch is done. Like mainLoop, the caller is responsible for draining and
+// closing the producer and the consumer if an error is returned.
+func (jr *joinReader) pipelinedLoop(ctx context.Context) error {
+	primaryKeyPrefix := sqlbase.MakeIndexKeyPrefix(&jr.desc, jr.index.ID)
+
+	if s, ok := jr.kv.(txnKVScanner); ok && s.txn == nil {
+		log.Fatalf(ctx, "joinReader outside of txn")
+	}
+	log.VEventf(ctx, 1, "starting (up to %d batches in flight)", jr.maxInFlightBatches)
+	if log.V(1) {
+		defer log.Infof(ctx, "exiting")
+	}
+
+	// The lookups still in flight when we're done (because of an error or
+	// because the consumer doesn't need more rows) are canceled and waited for.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var alloc sqlbase.DatumAlloc
+	var pending []*pipelinedBatch
+	cur := &pipelinedBatch{}
+	// scannedSpans accumulates the spans of all the batches if the flow is
+	// verbose.
+	var scannedSpans roachpb.Spans
+	inputDone := false
+	for {
+		// Emit the pending batches whose lookups are done, in order. We have to
+		// wait for the oldest one if no more batches can be started.
+	emitLoop:
+		for len(pending) > 0 {
+			b := pending[0]
+			if !inputDone && len(pending) < jr.maxInFlightBatches {
+				select {
+				case <-b.done:
+				default:
+					break emitLoop
+				}
+			}
+			<-b.done
+			pending = pending[1:]
+			if more, err := jr.emitPipelinedBatch(ctx, b, primaryKeyPrefix); err != nil || !more {
+				return err
+			}
+		}
+		if inputDone && len(pending) == 0 {
+			jr.pushStats(scannedSpans)
+			if !jr.maybeEmitCount(ctx) {
+				return nil
+			}
+			sendTraceData(ctx, jr.out.output)
+			jr.out.Close()
+			return nil
+		}
+		if inputDone {
+			continue
+		}
+
+		row, meta := jr.input.Next()
+		if !meta.Empty() {
+			if meta.Err != nil {
+				return meta.Err
+			}
+			if !emitHelper(ctx, &jr.out, nil /* row */, meta, jr.input) {
+				return nil
+			}
+			continue
+		}
+		if row == nil {
+			inputDone = true
+		} else {
+			jr.numInputRows++
+			span, err := jr.lookupSpan(row, &alloc, primaryKeyPrefix)
+			if err != nil {
+				return err
+			}
+			if span.Key == nil {
+				// An empty range matches no rows; there's nothing to scan.
+				if jr.flowCtx.Verbose {
+					jr.updateMatchStats([]bool{false})
+				}
+				continue
+			}
+			cur.spans = append(cur.spans, span)
+			size := int64(unsafe.Sizeof(roachpb.Span{})) + int64(len(span.Key)+len(span.EndKey))
+			if err := jr.batchAcc.Grow(ctx, size); err != nil {
+				// Send out what we have; the next batches will be smaller.
+				log.VEventf(ctx, 1, "cutting lookup batch short at %d lookups: %s", len(cur.spans), err)
+				cur.memPressure = true
+			} else {
+				cur.memSize += size
+			}
+		}
+		if len(cur.spans) > 0 &&
+			(inputDone || cur.memPressure || len(cur.spans) >= jr.batchSizer.size()) {
+			if err := jr.flowCtx.checkDeadline(); err != nil {
+				return err
+			}
+			if jr.flowCtx.Verbose {
+				scannedSpans = append(scannedSpans, cur.spans...)
+			}
+			jr.startPipelinedBatch(ctx, &wg, cur)
+			pending = append(pending, cur)
+			cur = &pipelinedBatch{}
+		}
+	}
+}
+
+// startPipelinedBatch starts the lookups of a batch in the background. Since
+// the lookups of several batches can be in flight at once, they use their own
+// fetchers.
+func (jr *joinReader) startPipelinedBatch(
+	ctx context.Context, wg *sync.WaitGroup, b *pipelinedBatch,
+) {
+	b.done = make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(b.done)
+		lookupStart := timeutil.Now()
+		b.err = jr.withLookupRetries(ctx, &b.decodeErrs, func() (err error) {
+			if jr.parallelism > 1 && len(b.spans) > 1 {
+				b.rows, err = jr.parallelLookup(ctx, b.spans, &b.decodeErrs)
+				return err
+			}
+			var fetcher sqlbase.MultiRowFetcher
+			var alloc sqlbase.DatumAlloc
+			if _, _, err := initRowFetcher(
+				&fetcher, &jr.desc, jr.indexIdx, false, /* reverse */
+				jr.fetcherCols, false /* isCheck */, &alloc,
+			); err != nil {
+				return err
+			}
+			b.rows, err = jr.scanRows(ctx, &fetcher, b.spans, &b.decodeErrs)
+			return err
+		})
+		b.latency = timeutil.Since(lookupStart)
+	}()
+}
+
+// emitPipelinedBatch emits the rows of a pending batch whose lookups are done,
+// like mainLoop does for the plain lookups. It returns false if the consumer
+// doesn't need more rows, in which case the output has been closed.
+func (jr *joinReader) emitPipelinedBatch(
+	ctx context.Context, b *pipelinedBatch, primaryKeyPrefix []byte,
+) (bool, error) {
+	jr.batchAcc.Shrink(ctx, b.memSize)
+	if b.err != nil {
+		return false, b.err
+	}
+	jr.stats.KVReads += uint64(len(b.spans))
+	if !jr.pushDecodeErrs(ctx, b.decodeErrs) {
+		return false, nil
+	}
+	rows := b.rows
+	if jr.flowCtx.Verbose {
+		found := make(map[string]struct{})
+		for _, row := range rows {
+			key, err := jr.fetchedRowLookupKey(row, primaryKeyPrefix)
+			if err != nil {
+				return false, err
+			}
+			found[string(key)] = struct{}{}
+		}
+		jr.updateMatchStats(jr.lookupsMatched(b.spans, found))
+	}
+	if jr.countOnly {
+		// The rows are only counted; none are emitted.
+		jr.numMatches += int64(len(rows))
+		rows = nil
+	}
+	if err := jr.sortBatch(rows); err != nil {
+		return false, err
+	}
+	if err := jr.maybeAppendLookupKeys(rows, primaryKeyPrefix); err != nil {
+		return false, err
+	}
+	for _, row := range rows {
+		if !emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input) {
+			return false, nil
+		}
+	}
+	jr.maybeLogSlowBatch(ctx, b.spans, b.latency)
+	jr.batchSizer.update(len(b.spans), b.latency, b.memPressure)
+	return jr.maybeEmitProgress(ctx), nil
+}
+
+// maybeEmitCount emits the row with the number of matches, if countOnly is set.
+// It returns false if the output has been closed.
+func (jr *joinReader) maybeEmitCount(ctx context.Context) bool {
+	if !jr.countOnly {
+		return true
 	}
+	row := sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(
+		sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}, tree.NewDInt(tree.DInt(jr.numMatches)),
+	)}
+	return emitHelper(ctx, &jr.out, row, ProducerMetadata{}, jr.input)
+}
+
+// maybeLogSlowBatch logs the batch with the given spans if its lookups took
+// longer than the sql.distsql.join_reader.slow_batch_threshold setting.
+func (jr *joinReader) maybeLogSlowBatch(
+	ctx context.Context, spans roachpb.Spans, latency time.Duration,
+) {
+	threshold := joinReaderSlowBatchThreshold.Get(&jr.flowCtx.Settings.SV)
+	if threshold <= 0 || latency < threshold {
+		return
+	}
+	// Multiple input rows can look up the same key.
+	keys := make(map[string]struct{}, len(spans))
+	for _, span := range spans {
+		keys[string(span.Key)] = struct{}{}
+	}
+	log.Warningf(ctx, "slow lookup batch in index %s of table %s: %d lookups (%d distinct keys) took %s",
+		jr.index.Name, jr.desc.Name, len(spans), len(keys), latency)
+}
+
+// performLookups runs fn, which performs the lookups of a batch, with
+// withLookupRetries and then pushes the decoding errors of the rows skipped by
+// the successful attempt. It returns false if the consumer doesn't need more
+// records, in which case the output has been closed (see emitHelper).
+func (jr *joinReader) performLookups(ctx context.Context, fn func() error) (bool, error) {
+	if err := jr.withLookupRetries(ctx, &jr.decodeErrs, fn); err != nil {
+		return false, err
+	}
+	decodeErrs := jr.decodeErrs
+	jr.decodeErrs = nil
+	return jr.pushDecodeErrs(ctx, decodeErrs), nil
+}
+
+// pushDecodeErrs pushes the decoding errors of the rows skipped by the lookups
+// of a batch to the consumer. It must only be called by the main loop. It
+// returns false if the consumer doesn't need more records, in which case the
+// output has been closed (see emitHelper).
+func (jr *joinReader) pushDecodeErrs(ctx context.Context, decodeErrs []error) bool {
+	for _, err := range decodeErrs {
+		jr.numSkippedRows++
+		if !emitHelper(ctx, &jr.out, nil /* row */, ProducerMetadata{DecodeErr: err}, jr.input) {
+			return false
+		}
+	}
+	return true
+}
+
+// withLookupRetries runs fn, which performs the lookups of a batch (without
+// emitting anything), retrying it with an exponential backoff if it fails with
+// a transient KV error; see JoinReaderSpec.MaxLookupRetries.
+//
+// Since fn can run multiple times, it must not have side effects other than
+// adding to decodeErrs, which is reset before each attempt: the callers push
+// the metadata and update the counters once the lookups succeed. decodeErrs
+// belongs to the goroutine running withLookupRetries; pipelined batches each
+// have their own.
+func (jr *joinReader) withLookupRetries(
+	ctx context.Context, decodeErrs *[]error, fn func() error,
+) error {
+	if jr.maxLookupRetries == 0 {
+		return fn()
+	}
+	opts := retry.Options{InitialBackoff: jr.lookupRetryBackoff, MaxRetries: jr.maxLookupRetries}
+	var err error
+	for r := retry.StartWithCtx(ctx, opts); r.Next(); {
+		*decodeErrs = (*decodeErrs)[:0]
+		if err = fn(); err == nil || !isTransientKVError(err) {
+			return err
+		}
+		log.VEventf(ctx, 1, "transient error performing lookups: %s", err)
+	}
+	return err
+}
+
+// nextRow returns the next row from the fetcher. If skipDecodeErrors is set,
+// rows that fail to decode are skipped and the decoding errors are appended to
+// decodeErrs, to be pushed to the consumer as non-fatal metadata.
+func (jr *joinReader) nextRow(
+	ctx context.Context, fetcher *sqlbase.MultiRowFetcher, decodeErrs *[]error,
+) (sqlbase.EncDatumRow, error) {
+	for {
+		row, _, _, err := fetcher.NextRow(ctx)
+		if err == nil {
+			return row, nil
+		}
+		// The fetcher wraps all the errors decoding key/values in scrub errors.
+		if !jr.skipDecodeErrors || !scrub.IsScrubError(err) {
+			return nil, scrub.UnwrapScrubError(err)
+		}
+		err = scrub.UnwrapScrubError(err)
+		log.VEventf(ctx, 1, "skipping row: %s", err)
+		*decodeErrs = append(*decodeErrs, err)
+		if err := fetcher.SkipRow(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sortBatch sorts the rows matched by the lookups of a batch according to
+// batchOrdering, if set.
+func (jr *joinReader) sortBatch(rows []sqlbase.EncDatumRow) error {
+	if jr.batchOrdering == nil {
+		return nil
+	}
+	var err error
+	sort.SliceStable(rows, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		var cmp int
+		cmp, err = rows[i].Compare(
+			jr.tableTypes, &jr.alloc, jr.batchOrdering, &jr.flowCtx.EvalCtx, rows[j],
+		)
+		return cmp < 0
+	})
+	return err
+}
+
+// maybeAppendLookupKeys replaces each of the given table rows with a copy to
+// which the hex encoding of its lookup key is appended, if emitLookupKey is set.
+func (jr *joinReader) maybeAppendLookupKeys(
+	rows []sqlbase.EncDatumRow, primaryKeyPrefix []byte,
+) error {
+	if !jr.emitLookupKey {
+		return nil
+	}
+	keyType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	var rowAlloc sqlbase.EncDatumRowAlloc
+	for i, row := range rows {
+		key, err := jr.fetchedRowLookupKey(row, primaryKeyPrefix)
+		if err != nil {
+			return err
+		}
+		outRow := rowAlloc.AllocRow(len(row) + 1)
+		copy(outRow, row)
+		outRow[len(row)] = sqlbase.DatumToEncDatum(keyType, tree.NewDString(hex.EncodeToString(key)))
+		rows[i] = outRow
+	}
+	return nil
+}
+
+// maybeEmitProgress reports the fraction of the input consumed so far, if the
+// spec provided an estimate of the number of input rows and the progress wasn't
+// reported in the last joinReaderProgressInterval. It returns false if the
+// consumer doesn't need more records, in which case the output has been closed
+// (see emitHelper).
+func (jr *joinReader) maybeEmitProgress(ctx context.Context) bool {
+	if jr.estimatedInputRows == 0 || timeutil.Since(jr.lastProgress) < joinReaderProgressInterval {
+		return true
+	}
+	jr.lastProgress = timeutil.Now()
+	fraction := float64(jr.numInputRows) / float64(jr.estimatedInputRows)
+	if fraction > 1 {
+		// The estimate was too low.
+		fraction = 1
+	}
+	progress := &ProcessorProgress{
+		RowsConsumed:       jr.numInputRows,
+		EstimatedTotalRows: jr.estimatedInputRows,
+		FractionCompleted:  fraction,
+	}
+	return emitHelper(ctx, &jr.out, nil /* row */, ProducerMetadata{Progress: progress}, jr.input)
+}
+
+// pushStats reports the statistics collected by the joinReader to the
+// consumer: the spans it read and the JoinReaderStats, if the flow is verbose,
+// and the number of rows it skipped, if any.
+func (jr *joinReader) pushStats(spans roachpb.Spans) {
+	if jr.flowCtx.Verbose && len(spans) > 0 {
+		_ = jr.out.output.Push(nil /* row */, ProducerMetadata{ScannedSpans: spans})
+	}
+	if jr.flowCtx.Verbose {
+		stats := jr.stats
+		stats.LookupBatchSize = uint64(jr.batchSizer.size())
+		if jr.cache != nil {
+			stats.CacheHits = uint64(jr.cache.hits)
+			stats.CacheBytes = jr.cache.bytesUsed()
+		}
+		_ = jr.out.output.Push(nil /* row */, ProducerMetadata{JoinReaderStats: &stats})
+	}
+	if n := jr.numSkippedRows; n > 0 {
+		_ = jr.out.output.Push(nil /* row */, ProducerMetadata{NumSkippedRows: n})
+	}
+	if jr.unmatchedRows != nil {
+		_ = jr.out.output.Push(nil /* row */, ProducerMetadata{UnmatchedRows: jr.unmatchedRows})
+		jr.unmatchedRows = nil
+	}
+	if ts := jr.staleReadTimestamp; ts != (hlc.Timestamp{}) {
+		_ = jr.out.output.Push(nil /* row */, ProducerMetadata{ReadTimestamp: &ts})
+	}
+	if m := jr.flowCtx.Metrics; m != nil {
+		m.ProcessorDone(jr.numInputRows, jr.out.rowsEmitted())
+	}
+}
+
+// lookupMatches returns, for each span, whether the lookup has at least one
+// matching row. It is used for semi and anti joins.
+func (jr *joinReader) lookupMatches(
+	ctx context.Context, spans roachpb.Spans, primaryKeyPrefix []byte,
+) ([]bool, error) {
+	matched := make([]bool, len(spans))
+
+	if jr.firstMatchOnly {
+		// Each lookup can match many rows. Scan each span separately so that we
+		// can stop fetching at the first match.
+		for i := range spans {
+			if err := jr.kv.startScan(
+				ctx, &jr.fetcher, spans[i:i+1], true /* limitBatches */, 1, /* limitHint */
+			); err != nil {
+				return nil, err
+			}
+			row, err := jr.nextRow(ctx, &jr.fetcher, &jr.decodeErrs)
+			if err != nil {
+				return nil, err
+			}
+			matched[i] = row != nil
+		}
+		return matched, nil
+	}
+
+	// We scan all the spans together and regenerate the keys of the rows that
+	// were found to determine which lookups matched.
+	if err := jr.kv.startScan(
+		ctx, &jr.fetcher, spans, false /* no batch limits */, 0, /* limitHint */
+	); err != nil {
+		return nil, err
+	}
+	found := make(map[string]struct{})
+	for {
+		row, err := jr.nextRow(ctx, &jr.fetcher, &jr.decodeErrs)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		key, err := jr.fetchedRowLookupKey(row, primaryKeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		found[string(key)] = struct{}{}
+	}
+	return spansMatched(spans, found), nil
+}
+
+// fetchedRowLookupKey returns the lookup key (i.e. the start key of the lookup
+// span) matched by a fetched row.
+func (jr *joinReader) fetchedRowLookupKey(
+	row sqlbase.EncDatumRow, primaryKeyPrefix []byte,
+) (roachpb.Key, error) {
+	for i, idx := range jr.lookupColIdxs {
+		jr.lookupVals[i] = row[idx]
+	}
+	if jr.interleaved {
+		return jr.generateInterleaveParentKey(
+			jr.lookupVals, jr.lookupColTypes, &jr.alloc, primaryKeyPrefix,
+		)
+	}
+	return sqlbase.MakeKeyFromEncDatums(
+		jr.lookupColTypes, jr.lookupVals, &jr.desc, jr.index, primaryKeyPrefix, &jr.alloc,
+	)
+}
+
+// addUnmatchedRow adds an input row without a match to the current batch of
+// unmatched rows, which is pushed to the consumer once it is full. Like
+// emitHelper, it returns false if the consumer doesn't need more rows, in which
+// case the input has been drained and the output closed.
+func (jr *joinReader) addUnmatchedRow(
+	ctx context.Context, row sqlbase.EncDatumRow, alloc *sqlbase.DatumAlloc,
+) (bool, error) {
+	if jr.unmatchedRows == nil {
+		jr.unmatchedRows = &UnmatchedRows{Types: jr.inputTypes}
+	}
+	if err := jr.unmatchedRows.addRow(row, alloc); err != nil {
+		return false, err
+	}
+	if len(jr.unmatchedRows.Rows) < joinReaderUnmatchedRowsBatchSize {
+		return true, nil
+	}
+	meta := ProducerMetadata{UnmatchedRows: jr.unmatchedRows}
+	jr.unmatchedRows = nil
+	return emitHelper(ctx, &jr.out, nil /* row */, meta, jr.input), nil
+}
+
+// updateMatchStats updates the stats with the results of the lookups of a
+// batch; matched indicates whether each lookup matched any row.
+func (jr *joinReader) updateMatchStats(matched []bool) {
+	jr.stats.InputRows += uint64(len(matched))
+	for _, m := range matched {
+		if m {
+			jr.stats.MatchedInputRows++
+		} else {
+			jr.stats.UnmatchedInputRows++
+		}
+	}
+}
+
+// spansMatched returns, for each lookup span, whether its key is in found.
+func spansMatched(spans roachpb.Spans, found map[string]struct{}) []bool {
+	matched := make([]bool, len(spans))
+	for i, span := range spans {
+		_, matched[i] = found[string(span.Key)]
+	}
+	return matched
+}
+
+// lookupsMatched returns, for each lookup span of an inner join, whether it
+// matched any of the fetched rows, given the lookup keys of these rows in
+// found: a key lookup is matched by its own key, and a range lookup by any key
+// within its span.
+func (jr *joinReader) lookupsMatched(spans roachpb.Spans, found map[string]struct{}) []bool {
+	if jr.lookupRange == nil {
+		return spansMatched(spans, found)
+	}
+	matched := make([]bool, len(spans))
+	for i, span := range spans {
+		for key := range found {
+			if span.ContainsKey(roachpb.Key(key)) {
+				matched[i] = true
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// cachedLookup returns the rows matching each lookup span, serving the lookups
+// from the cache when possible. The spans of the other lookups are scanned
+// (once per distinct key) and their results are added to the cache. It also
+// returns the number of lookups served by the cache and the scanned spans, for
+// the caller to account for once the lookups succeed (see withLookupRetries).
+func (jr *joinReader) cachedLookup(
+	ctx context.Context, spans roachpb.Spans, primaryKeyPrefix []byte,
+) (results [][]sqlbase.EncDatumRow, hits int, toScan roachpb.Spans, _ error) {
+	jr.cache.setReadTimestamp(ctx, jr.readTimestamp())
+
+	results = make([][]sqlbase.EncDatumRow, len(spans))
+	// pending maps the keys that need to be scanned to the indexes of the
+	// spans looking them up.
+	pending := make(map[string][]int)
+	for i, span := range spans {
+		key := string(span.Key)
+		if rows, ok := jr.cache.get(key); ok {
+			results[i] = rows
+			hits++
+			continue
+		}
+		if _, ok := pending[key]; !ok {
+			toScan = append(toScan, span)
+		}
+		pending[key] = append(pending[key], i)
+	}
+	if len(toScan) == 0 {
+		return results, hits, nil, nil
+	}
+
+	rows, err := jr.fetchRows(ctx, toScan)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	fetched := make(map[string][]sqlbase.EncDatumRow, len(toScan))
+	for _, row := range rows {
+		key, err := jr.fetchedRowLookupKey(row, primaryKeyPrefix)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		fetched[string(key)] = append(fetched[string(key)], row)
+	}
+	for _, span := range toScan {
+		key := string(span.Key)
+		jr.cache.add(ctx, key, fetched[key])
+		for _, i := range pending[key] {
+			results[i] = fetched[key]
+		}
+	}
+	return results, hits, toScan, nil
+}
+
+// fetchRows returns (copies of) all the rows in the given spans, in the order of
+// the spans. If the spans are in a secondary index that doesn't contain all the
+// needed columns, the rows are fetched from the primary index.
+func (jr *joinReader) fetchRows(
+	ctx context.Context, spans roachpb.Spans,
+) ([]sqlbase.EncDatumRow, error) {
+	rows, err := jr.scanIndex(ctx, spans)
+	if err != nil || jr.primaryFetcher == nil {
+		return rows, err
+	}
+	return jr.primaryLookup(ctx, rows)
+}
+
+// scanIndex returns (copies of) all the rows in the given spans of the index
+// used for the lookups, in the order of the spans.
+func (jr *joinReader) scanIndex(
+	ctx context.Context, spans roachpb.Spans,
+) ([]sqlbase.EncDatumRow, error) {
+	if jr.parallelism > 1 && len(spans) > 1 {
+		return jr.parallelLookup(ctx, spans, &jr.decodeErrs)
+	}
+	return jr.scanRows(ctx, &jr.fetcher, spans, &jr.decodeErrs)
+}
+
+// indexEntryRows returns the output rows for the lookups of a batch when
+// outputIndexEntries is set: for each input row, in order, and for each index
+// entry matched by its lookup, the concatenation of the input row, the key
+// columns of the index entry and the corresponding row of the table. It also
+// returns whether each lookup matched any index entry.
+func (jr *joinReader) indexEntryRows(
+	ctx context.Context,
+	spans roachpb.Spans,
+	inputRows []sqlbase.EncDatumRow,
+	primaryKeyPrefix []byte,
+) ([]sqlbase.EncDatumRow, []bool, error) {
+	// Lookups of the same key are only performed once.
+	indexRows, err := jr.scanIndex(ctx, sortAndDedupSpans(append(roachpb.Spans(nil), spans...)))
+	if err != nil {
+		return nil, nil, err
+	}
+	tableRows, err := jr.primaryRows(ctx, indexRows)
+	if err != nil {
+		return nil, nil, err
+	}
+	// byKey maps each lookup key to the indexes of the index entries it matched.
+	byKey := make(map[string][]int)
+	for i, row := range indexRows {
+		key, err := jr.fetchedRowLookupKey(row, primaryKeyPrefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		byKey[string(key)] = append(byKey[string(key)], i)
+	}
+
+	width := len(jr.inputTypes) + len(jr.keyColIdxs) + len(jr.tableTypes)
+	var rows []sqlbase.EncDatumRow
+	matched := make([]bool, len(spans))
+	for i, inputRow := range inputRows {
+		for _, j := range byKey[string(spans[i].Key)] {
+			if tableRows[j] == nil {
+				// The row of the table failed to decode and was skipped.
+				continue
+			}
+			matched[i] = true
+			row := make(sqlbase.EncDatumRow, 0, width)
+			row = append(row, inputRow...)
+			for _, idx := range jr.keyColIdxs {
+				row = append(row, indexRows[j][idx])
+			}
+			rows = append(rows, append(row, tableRows[j]...))
+		}
+	}
+	return rows, matched, nil
+}
+
+// scanRows returns (copies of) all the rows in the given spans, scanned with
+// the given fetcher. The decoding errors of the skipped rows are appended to
+// decodeErrs.
+//
+// If the lookups are for interleave parent keys, the scanned KVs also contain
+// the rows of the parent and of any other tables interleaved in it. The fetcher
+// only knows about our table and always decodes the index keys of interleaved
+// tables, so it skips all of those.
+func (jr *joinReader) scanRows(
+	ctx context.Context, fetcher *sqlbase.MultiRowFetcher, spans roachpb.Spans, decodeErrs *[]error,
+) ([]sqlbase.EncDatumRow, error) {
+	if err := jr.kv.startScan(
+		ctx, fetcher, spans, false /* no batch limits */, 0, /* limitHint */
+	); err != nil {
+		logScanError(ctx, err)
+		return nil, err
+	}
+	var rows []sqlbase.EncDatumRow
+	var rowAlloc sqlbase.EncDatumRowAlloc
+	for {
+		row, err := jr.nextRow(ctx, fetcher, decodeErrs)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return rows, nil
+		}
+		// The fetcher reuses the memory of the row.
+		rows = append(rows, rowAlloc.CopyRow(row))
+	}
+}
+
+// matchedFlagRows returns the output rows for the lookups of a batch when
+// emitMatchedFlag is set: for each input row, in order, the concatenation of
+// the input row, a matching row of the table and a true flag for each match,
+// or of the input row, NULLs and a false flag if there is no match. It also
+// returns whether each lookup matched any row.
+func (jr *joinReader) matchedFlagRows(
+	ctx context.Context,
+	spans roachpb.Spans,
+	inputRows []sqlbase.EncDatumRow,
+	primaryKeyPrefix []byte,
+) ([]sqlbase.EncDatumRow, []bool, error) {
+	// Lookups of the same key are only performed once.
+	fetched, err := jr.fetchRows(ctx, sortAndDedupSpans(append(roachpb.Spans(nil), spans...)))
+	if err != nil {
+		return nil, nil, err
+	}
+	// byKey maps each lookup key to the rows it matched.
+	byKey := make(map[string][]sqlbase.EncDatumRow)
+	for _, row := range fetched {
+		key, err := jr.fetchedRowLookupKey(row, primaryKeyPrefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		byKey[string(key)] = append(byKey[string(key)], row)
+	}
+
+	width := len(jr.inputTypes) + len(jr.tableTypes) + 1
+	flagType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_BOOL}
+	var rows []sqlbase.EncDatumRow
+	appendRow := func(inputRow, tableRow sqlbase.EncDatumRow, matched bool) {
+		row := make(sqlbase.EncDatumRow, 0, width)
+		row = append(row, inputRow...)
+		row = append(row, tableRow...)
+		flag := sqlbase.DatumToEncDatum(flagType, tree.MakeDBool(tree.DBool(matched)))
+		rows = append(rows, append(row, flag))
+	}
+	matched := make([]bool, len(spans))
+	for i, inputRow := range inputRows {
+		tableRows := byKey[string(spans[i].Key)]
+		if len(tableRows) == 0 {
+			appendRow(inputRow, jr.nullRow, false /* matched */)
+			continue
+		}
+		matched[i] = true
+		for _, tableRow := range tableRows {
+			appendRow(inputRow, tableRow, true /* matched */)
+		}
+	}
+	return rows, matched, nil
+}
+
+// primaryLookup fetches from the primary index the rows with the primary keys
+// of the given index rows, and returns them in the order of the index rows.
+func (jr *joinReader) primaryLookup(
+	ctx context.Context, indexRows []sqlbase.EncDatumRow,
+) ([]sqlbase.EncDatumRow, error) {
+	tableRows, err := jr.primaryRows(ctx, indexRows)
+	if err != nil {
+		return nil, err
+	}
+	rows := tableRows[:0]
+	for _, row := range tableRows {
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// primaryRows fetches from the primary index the rows with the primary keys of
+// the given index rows. The i-th returned row corresponds to the i-th index
+// row; it is nil if the row failed to decode and was skipped (see
+// skipDecodeErrors).
+func (jr *joinReader) primaryRows(
+	ctx context.Context, indexRows []sqlbase.EncDatumRow,
+) ([]sqlbase.EncDatumRow, error) {
+	primaryKeyPrefix := sqlbase.MakeIndexKeyPrefix(&jr.desc, jr.desc.PrimaryIndex.ID)
+
+	// The same row can be found by multiple lookups; it is only fetched once.
+	keys := make([]string, len(indexRows))
+	spans := make(roachpb.Spans, 0, len(indexRows))
+	for i, row := range indexRows {
+		key, err := jr.primaryKey(row, primaryKeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = string(key)
+		spans = append(spans, roachpb.Span{Key: key, EndKey: key.PrefixEnd()})
+	}
+
+	fetched, err := jr.scanRows(ctx, jr.primaryFetcher, sortAndDedupSpans(spans), &jr.decodeErrs)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]sqlbase.EncDatumRow, len(fetched))
+	for _, row := range fetched {
+		key, err := jr.primaryKey(row, primaryKeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		byKey[string(key)] = row
+	}
+	rows := make([]sqlbase.EncDatumRow, 0, len(indexRows))
+	for _, key := range keys {
+		row, ok := byKey[key]
+		if !ok {
+			if !jr.skipDecodeErrors {
+				return nil, errors.Errorf(
+					"missing row in the primary index for an entry of index %s", jr.index.Name,
+				)
+			}
+			// The row failed to decode and was skipped.
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// sortAndDedupSpans sorts the given spans in place and removes the spans with
+// the same start key as a previous one.
+func sortAndDedupSpans(spans roachpb.Spans) roachpb.Spans {
+	sort.Sort(spans)
+	n := 0
+	for i := range spans {
+		if i == 0 || !spans[i].Key.Equal(spans[n-1].Key) {
+			spans[n] = spans[i]
+			n++
+		}
+	}
+	return spans[:n]
+}
+
+// primaryKey returns the key of the row in the primary index.
+func (jr *joinReader) primaryKey(
+	row sqlbase.EncDatumRow, primaryKeyPrefix []byte,
+) (roachpb.Key, error) {
+	for i, idx := range jr.pkColIdxs {
+		jr.pkVals[i] = row[idx]
+	}
+	return sqlbase.MakeKeyFromEncDatums(
+		jr.pkTypes, jr.pkVals, &jr.desc, &jr.desc.PrimaryIndex, primaryKeyPrefix, &jr.primaryAlloc,
+	)
+}
+
+// logScanError logs an error encountered while performing lookups. Retryable
+// errors are expected (the flow gets restarted), so they are only logged
+// verbosely.
+func logScanError(ctx context.Context, err error) {
+	if isRetryableKVError(err) {
+		log.VEventf(ctx, 1, "retryable scan error: %s", err)
+		return
+	}
+	log.Errorf(ctx, "scan error: %s", err)
+}
+
+// readTimestamp returns the timestamp at which the lookups are performed, or
+// the zero timestamp if they aren't performed through a transaction.
+func (jr *joinReader) readTimestamp() hlc.Timestamp {
+	if s, ok := jr.kv.(txnKVScanner); ok {
+		return s.txn.OrigTimestamp()
+	}
+	return hlc.Timestamp{}
+}
+
+// pickStaleReadTimestamp sets staleReadTimestamp to the timestamp picked by
+// boundedStalenessTimestamp, if the flow allows bounded-staleness reads (see
+// FlowCtx.MaxStaleness). Such lookups don't see the writes of the flow's
+// transaction and are performed in a separate transaction, so they are only
+// allowed if the flow's transaction is implicit and hasn't written, as is the
+// case for read-only and historical statements outside of a BEGIN block.
+func (jr *joinReader) pickStaleReadTimestamp() error {
+	s, ok := jr.kv.(txnKVScanner)
+	if !ok || s.txn == nil || jr.flowCtx.MaxStaleness <= 0 {
+		return nil
+	}
+	if !jr.flowCtx.ImplicitTxn {
+		return errors.Errorf("bounded-staleness reads not supported in an explicit transaction")
+	}
+	// The flow is being set up, so the transaction isn't in use.
+	if s.txn.Proto().Writing {
+		return errors.Errorf("bounded-staleness reads not supported in a transaction that has written")
+	}
+	var maxOffset time.Duration
+	if rpcCtx := jr.flowCtx.rpcCtx; rpcCtx != nil && rpcCtx.LocalClock != nil {
+		maxOffset = rpcCtx.LocalClock.MaxOffset()
+	}
+	jr.staleReadTimestamp = boundedStalenessTimestamp(
+		jr.flowCtx.readTimestamp(), jr.flowCtx.MaxStaleness, maxOffset, &jr.desc,
+	)
+	return nil
+}
+
+// useBoundedStaleness makes the lookups go through a read-only transaction at
+// staleReadTimestamp, if set, instead of through the flow's transaction. It
+// returns that transaction, which the caller finishes once the lookups are
+// done.
+func (jr *joinReader) useBoundedStaleness(ctx context.Context) *client.Txn {
+	ts := jr.staleReadTimestamp
+	if ts == (hlc.Timestamp{}) {
+		return nil
+	}
+	s := jr.kv.(txnKVScanner)
+	txn := client.NewTxn(s.txn.DB(), jr.flowCtx.nodeID)
+	txn.SetFixedTimestamp(ctx, ts)
+	jr.kv = txnKVScanner{txn: txn}
+	log.VEventf(ctx, 1, "bounded-staleness lookups at %s (transaction at %s)", ts, jr.flowCtx.readTimestamp())
+	return txn
+}
+
+// boundedStalenessTimestamp returns the timestamp at which to read the given
+// table under a bounded-staleness read of a transaction at txnTS: the newest
+// timestamp in the staleness window that is at least maxOffset (the maximum
+// offset between the clocks of the nodes) older than txnTS, since the intents
+// of the transactions still in flight are the likeliest to be more recent than
+// that. Reads can't happen before the modification time of the table's
+// descriptor, which is the newest safe timestamp if the table was modified
+// since then.
+func boundedStalenessTimestamp(
+	txnTS hlc.Timestamp, maxStaleness, maxOffset time.Duration, desc *sqlbase.TableDescriptor,
+) hlc.Timestamp {
+	ts := txnTS.Add(-maxOffset.Nanoseconds(), 0)
+	if oldest := txnTS.Add(-maxStaleness.Nanoseconds(), 0); ts.Less(oldest) {
+		ts = oldest
+	}
+	if ts.Less(desc.ModificationTime) {
+		ts = desc.ModificationTime
+	}
+	if txnTS.Less(ts) {
+		ts = txnTS
+	}
+	return ts
+}
+
+// parallelLookup performs the lookups for a batch of spans using up to
+// jr.parallelism concurrent scans, each one over a contiguous chunk of the
+// spans. The resulting rows are returned in the order of the spans, regardless
+// of the order in which the scans finish. If a scan fails, the other ones are
+// canceled. The decoding errors of the rows skipped by the scans are appended to
+// decodeErrs once all of them are done, in the order of the spans too.
+func (jr *joinReader) parallelLookup(
+	ctx context.Context, spans roachpb.Spans, decodeErrs *[]error,
+) ([]sqlbase.EncDatumRow, error) {
+	numChunks := jr.parallelism
+	if numChunks > len(spans) {
+		numChunks = len(spans)
+	}
+	chunkSize := (len(spans) + numChunks - 1) / numChunks
+	results := make([][]sqlbase.EncDatumRow, numChunks)
+	chunkDecodeErrs := make([][]error, numChunks)
+	g, gCtx := errgroup.WithContext(ctx)
+	for i := 0; i < numChunks; i++ {
+		start, end := i*chunkSize, (i+1)*chunkSize
+		if start >= len(spans) {
+			break
+		}
+		if end > len(spans) {
+			end = len(spans)
+		}
+		i, chunk := i, spans[start:end]
+		g.Go(func() error {
+			// Each scan needs its own fetcher.
+			var fetcher sqlbase.MultiRowFetcher
+			var alloc sqlbase.DatumAlloc
+			if _, _, err := initRowFetcher(
+				&fetcher, &jr.desc, jr.indexIdx, false, /* reverse */
+				jr.fetcherCols, false /* isCheck */, &alloc,
+			); err != nil {
+				return err
+			}
+			if err := jr.kv.startScan(
+				gCtx, &fetcher, chunk, false /* no batch limits */, 0, /* limitHint */
+			); err != nil {
+				return err
+			}
+			var rowAlloc sqlbase.EncDatumRowAlloc
+			for {
+				row, err := jr.nextRow(gCtx, &fetcher, &chunkDecodeErrs[i])
+				if err != nil {
+					return err
+				}
+				if row == nil {
+					return nil
+				}
+				// The fetcher reuses the memory of the row.
+				results[i] = append(results[i], rowAlloc.CopyRow(row))
+			}
+		})
+	}
+	if err := g.Wait(); err != nil {
+		logScanError(ctx, err)
+		return nil, err
+	}
+
+	var rows []sqlbase.EncDatumRow
+	for i, chunkRows := range results {
+		rows = append(rows, chunkRows...)
+		*decodeErrs = append(*decodeErrs, chunkDecodeErrs[i]...)
+	}
+	return rows, nil
 }
 
 // Run is part of the processor interface.
@@ -210,8 +2258,27 @@ func (jr *joinReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTagInt(ctx, "JoinReader", int(jr.desc.ID))
 	ctx, span := processorSpan(ctx, "join reader")
 	defer tracing.FinishSpan(span)
+	defer jr.recoverPanic(ctx, jr.input)
 
-	err := jr.mainLoop(ctx)
+	if jr.cache != nil {
+		defer jr.cache.close(ctx)
+	}
+	defer jr.batchAcc.Close(ctx)
+	if txn := jr.useBoundedStaleness(ctx); txn != nil {
+		defer func() {
+			// The transaction only performed reads, so committing it doesn't send
+			// any request.
+			if err := txn.Commit(ctx); err != nil {
+				log.Warningf(ctx, "error finishing the bounded-staleness transaction: %s", err)
+			}
+		}()
+	}
+	var err error
+	if jr.maxInFlightBatches > 0 {
+		err = jr.pipelinedLoop(ctx)
+	} else {
+		err = jr.mainLoop(ctx)
+	}
 	if err != nil {
 		DrainAndClose(ctx, jr.out.output, err /* cause */, jr.input)
 	}
@@ -15,18 +15,41 @@
 package distsqlrun
 
 import (
+	"bytes"
 	"context"
+	gosql "database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/rpc"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
 func TestJoinReader(t *testing.T) {
@@ -41,20 +64,7 @@ func TestJoinReader(t *testing.T) {
 	//  |-----------------------------------------------------------------|
 	//  | rowId/10 | rowId%10 | rowId/10 + rowId%10 | IntToEnglish(rowId) |
 
-	aFn := func(row int) tree.Datum {
-		return tree.NewDInt(tree.DInt(row / 10))
-	}
-	bFn := func(row int) tree.Datum {
-		return tree.NewDInt(tree.DInt(row % 10))
-	}
-	sumFn := func(row int) tree.Datum {
-		return tree.NewDInt(tree.DInt(row/10 + row%10))
-	}
-
-	sqlutils.CreateTable(t, sqlDB, "t",
-		"a INT, b INT, sum INT, s STRING, PRIMARY KEY (a,b), INDEX bs (b,s)",
-		99,
-		sqlutils.ToRowFn(aFn, bFn, sumFn, sqlutils.RowEnglishFn))
+	createTestTable(t, sqlDB, "INDEX bs (b,s)")
 
 	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
 
@@ -70,10 +80,10 @@ func TestJoinReader(t *testing.T) {
 				OutputColumns: []uint32{0, 1, 2},
 			},
 			input: [][]tree.Datum{
-				{aFn(2), bFn(2)},
-				{aFn(5), bFn(5)},
-				{aFn(10), bFn(10)},
-				{aFn(15), bFn(15)},
+				{rowAFn(2), rowBFn(2)},
+				{rowAFn(5), rowBFn(5)},
+				{rowAFn(10), rowBFn(10)},
+				{rowAFn(15), rowBFn(15)},
 			},
 			outputTypes: threeIntCols,
 			expected:    "[[0 2 2] [0 5 5] [1 0 1] [1 5 6]]",
@@ -85,14 +95,14 @@ func TestJoinReader(t *testing.T) {
 				OutputColumns: []uint32{3},
 			},
 			input: [][]tree.Datum{
-				{aFn(1), bFn(1)},
-				{aFn(25), bFn(25)},
-				{aFn(5), bFn(5)},
-				{aFn(21), bFn(21)},
-				{aFn(34), bFn(34)},
-				{aFn(13), bFn(13)},
-				{aFn(51), bFn(51)},
-				{aFn(50), bFn(50)},
+				{rowAFn(1), rowBFn(1)},
+				{rowAFn(25), rowBFn(25)},
+				{rowAFn(5), rowBFn(5)},
+				{rowAFn(21), rowBFn(21)},
+				{rowAFn(34), rowBFn(34)},
+				{rowAFn(13), rowBFn(13)},
+				{rowAFn(51), rowBFn(51)},
+				{rowAFn(50), rowBFn(50)},
 			},
 			outputTypes: []sqlbase.ColumnType{strType},
 			expected:    "[['one'] ['five'] ['two-one'] ['one-three'] ['five-zero']]",
@@ -105,8 +115,7 @@ func TestJoinReader(t *testing.T) {
 			flowCtx := FlowCtx{
 				EvalCtx:  evalCtx,
 				Settings: cluster.MakeTestingClusterSettings(),
-				// Pass a DB without a TxnCoordSender.
-				txn: client.NewTxn(client.NewDB(s.DistSender(), s.Clock()), s.NodeID()),
+				txn:      newTestTxn(s),
 			}
 
 			encRows := make(sqlbase.EncDatumRows, len(c.input))
@@ -120,7 +129,7 @@ func TestJoinReader(t *testing.T) {
 			in := NewRowBuffer(twoIntCols, encRows, RowBufferArgs{})
 
 			out := &RowBuffer{}
-			jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &c.post, out)
+			jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &c.post, out, nil /* kv */)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -150,22 +159,15 @@ func TestJoinReader(t *testing.T) {
 	}
 }
 
-// TestJoinReaderDrain tests various scenarios in which a joinReader's consumer
-// is closed.
-func TestJoinReaderDrain(t *testing.T) {
+// TestJoinReaderLookupColumns verifies that the lookup key can be formed by
+// input columns in a different order than the index key columns.
+func TestJoinReaderLookupColumns(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
 	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
 	defer s.Stopper().Stop(context.TODO())
 
-	sqlutils.CreateTable(
-		t,
-		sqlDB,
-		"t",
-		"a INT, PRIMARY KEY (a)",
-		1, /* numRows */
-		sqlutils.ToRowFn(sqlutils.RowIdxFn),
-	)
+	createTestTable(t, sqlDB, "")
 	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
 
 	evalCtx := tree.MakeTestingEvalContext()
@@ -173,52 +175,3788 @@ func TestJoinReaderDrain(t *testing.T) {
 	flowCtx := FlowCtx{
 		EvalCtx:  evalCtx,
 		Settings: s.ClusterSettings(),
-		// Pass a DB without a TxnCoordSender.
-		txn: client.NewTxn(client.NewDB(s.DistSender(), s.Clock()), s.NodeID()),
+		txn:      newTestTxn(s),
 	}
 
-	encRow := make(sqlbase.EncDatumRow, 1)
-	encRow[0] = sqlbase.DatumToEncDatum(intType, tree.NewDInt(1))
+	// The input rows are (b, a).
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt([][]int{{2, 0}, {5, 0}, {0, 1}, {5, 1}}), RowBufferArgs{})
+	out := &RowBuffer{}
+	spec := JoinReaderSpec{Table: *td, LookupColumns: []uint32{1, 0}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 2}}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
 
-	ctx := context.Background()
+	if !in.Done {
+		t.Fatal("joinReader didn't consume all the rows")
+	}
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	res := out.GetRowsNoMeta(t)
+	expected := "[[0 2 2] [0 5 5] [1 0 1] [1 5 6]]"
+	if result := res.String(threeIntCols); result != expected {
+		t.Errorf("invalid results: %s, expected %s", result, expected)
+	}
 
-	// ConsumerClosed verifies that when a joinReader's consumer is closed, the
-	// joinReader finishes gracefully.
-	t.Run("ConsumerClosed", func(t *testing.T) {
-		in := NewRowBuffer(oneIntCol, sqlbase.EncDatumRows{encRow}, RowBufferArgs{})
+	// The number of lookup columns must match the index key.
+	for _, lookupCols := range [][]uint32{{1}, {1, 0, 1}} {
+		spec := JoinReaderSpec{Table: *td, LookupColumns: lookupCols}
+		in := NewRowBuffer(threeIntCols, nil /* rows */, RowBufferArgs{})
+		if _, err := newJoinReader(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, nil, /* kv */
+		); !testutils.IsError(err, "lookup columns specified, expecting 2") {
+			t.Errorf("%v: expected error, got %v", lookupCols, err)
+		}
+	}
+}
 
-		out := &RowBuffer{}
-		out.ConsumerClosed()
-		jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out)
-		if err != nil {
-			t.Fatal(err)
+// TestJoinReaderLookupExprs verifies that a joinReader can compute its lookup
+// keys from expressions over the input rows.
+func TestJoinReaderLookupExprs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	// The input rows are row numbers of the table, from which the primary key
+	// (a, b) is computed; there is no row number 100.
+	in := NewRowBuffer(oneIntCol, genEncDatumRowsInt([][]int{{15}, {2}, {100}, {99}}), RowBufferArgs{})
+	out := &RowBuffer{}
+	spec := JoinReaderSpec{
+		Table:       td,
+		LookupExprs: []Expression{{Expr: "@1 // 10"}, {Expr: "@1 % 10"}},
+	}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	outputTypes := []sqlbase.ColumnType{intType, intType, strType}
+	expected := "[[1 5 'one-five'] [0 2 'two'] [9 9 'nine-nine']]"
+	if res := out.GetRowsNoMeta(t).String(outputTypes); res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+
+	for _, tc := range []struct {
+		spec     JoinReaderSpec
+		expected string
+	}{
+		{
+			spec:     JoinReaderSpec{LookupExprs: []Expression{{Expr: "@1"}}},
+			expected: "1 lookup expressions specified, expecting 2",
+		},
+		{
+			spec:     JoinReaderSpec{LookupExprs: []Expression{{Expr: "@1"}, {Expr: "@1::STRING"}}},
+			expected: "lookup expression .* has type string, but index column b has type int",
+		},
+		{
+			spec: JoinReaderSpec{
+				LookupColumns: []uint32{0, 0},
+				LookupExprs:   []Expression{{Expr: "@1"}, {Expr: "@1"}},
+			},
+			expected: "lookup columns and lookup expressions both specified",
+		},
+	} {
+		tc.spec.Table = td
+		in := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
+		if _, err := newJoinReader(
+			&flowCtx, &tc.spec, in, &PostProcessSpec{}, &RowBuffer{}, kv,
+		); !testutils.IsError(err, tc.expected) {
+			t.Errorf("expected error %q, got %v", tc.expected, err)
 		}
-		jr.Run(ctx, nil)
+	}
+}
+
+// TestJoinReaderLookupRange verifies that a joinReader can look up a range of
+// values of the leading index column delimited by two input columns, in
+// ascending and descending indexes.
+func TestJoinReaderLookupRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	createTestTable(t, sqlDB, "INDEX a_desc (a DESC)")
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+		Verbose:  true,
+	}
+
+	// The input rows are (id, low, high). The ranges of rows 3 and 4 are empty,
+	// and no row of the table is in the range of row 6.
+	input := genEncDatumRowsInt([][]int{
+		{1, 1, 2}, {2, 4, 4}, {3, 7, 5}, {4, 0, 3}, {5, 8, 20}, {6, 12, 15},
 	})
+	input[3][1] = sqlbase.DatumToEncDatum(intType, tree.DNull)
+	expectedStats := JoinReaderStats{
+		InputRows:          6,
+		MatchedInputRows:   3,
+		UnmatchedInputRows: 3,
+		LookupBatchSize:    joinReaderBatchSize,
+		// The empty ranges aren't read.
+		KVReads: 4,
+	}
+	// Only the rows with b = 3 are output.
+	post := PostProcessSpec{
+		Filter:        Expression{Expr: "@2 = 3"},
+		Projection:    true,
+		OutputColumns: []uint32{0, 1},
+	}
 
-	// ConsumerDone verifies that the producer drains properly by checking that
-	// metadata coming from the producer is still read when ConsumerDone is
-	// called on the consumer.
-	t.Run("ConsumerDone", func(t *testing.T) {
-		expectedMetaErr := errors.New("dummy")
-		in := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
-		if status := in.Push(encRow, ProducerMetadata{Err: expectedMetaErr}); status != NeedMoreRows {
-			t.Fatalf("unexpected response: %d", status)
+	testCases := []struct {
+		name     string
+		indexIdx uint32
+		expected string
+	}{
+		{
+			name:     "Primary",
+			expected: "[[1 3] [2 3] [4 3] [8 3] [9 3]]",
+		},
+		{
+			// The rows of each range are in the order of the index.
+			name:     "Descending",
+			indexIdx: 1,
+			expected: "[[2 3] [1 3] [4 3] [9 3] [8 3]]",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			in := NewRowBuffer(threeIntCols, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{
+				Table:       *td,
+				IndexIdx:    c.indexIdx,
+				LookupRange: &JoinReaderSpec_LookupRange{LowColumn: 1, HighColumn: 2},
+			}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, nil /* kv */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var res sqlbase.EncDatumRows
+			var stats *JoinReaderStats
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if meta.JoinReaderStats != nil {
+					stats = meta.JoinReaderStats
+				}
+				if row != nil {
+					res = append(res, row)
+				}
+			}
+			if result := res.String(twoIntCols); result != c.expected {
+				t.Errorf("invalid results: %s, expected %s", result, c.expected)
+			}
+			if stats == nil || *stats != expectedStats {
+				t.Errorf("expected stats %+v, got %+v", expectedStats, stats)
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		testCases := []struct {
+			name       string
+			inputTypes []sqlbase.ColumnType
+			spec       JoinReaderSpec
+			expErr     string
+		}{
+			{
+				name:       "Column",
+				inputTypes: twoIntCols,
+				spec: JoinReaderSpec{
+					LookupRange: &JoinReaderSpec_LookupRange{LowColumn: 0, HighColumn: 2},
+				},
+				expErr: "invalid range lookup column 2",
+			},
+			{
+				name:       "Type",
+				inputTypes: []sqlbase.ColumnType{intType, strType},
+				spec: JoinReaderSpec{
+					LookupRange: &JoinReaderSpec_LookupRange{LowColumn: 0, HighColumn: 1},
+				},
+				expErr: "range lookup column 1 has type STRING, but index column a has type INT",
+			},
+			{
+				name:       "Semi",
+				inputTypes: twoIntCols,
+				spec: JoinReaderSpec{
+					Type:        JoinType_LEFT_SEMI,
+					LookupRange: &JoinReaderSpec_LookupRange{LowColumn: 0, HighColumn: 1},
+				},
+				expErr: "range lookups not supported for LEFT_SEMI joins",
+			},
+		}
+		for _, c := range testCases {
+			t.Run(c.name, func(t *testing.T) {
+				c.spec.Table = *td
+				in := NewRowBuffer(c.inputTypes, nil /* rows */, RowBufferArgs{})
+				if _, err := newJoinReader(
+					&flowCtx, &c.spec, in, &PostProcessSpec{}, &RowBuffer{}, nil, /* kv */
+				); !testutils.IsError(err, c.expErr) {
+					t.Fatalf("expected error %q, got %v", c.expErr, err)
+				}
+			})
 		}
+	})
+}
 
-		out := &RowBuffer{}
-		out.ConsumerDone()
-		jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out)
-		if err != nil {
-			t.Fatal(err)
+// TestJoinReaderIndexOnly verifies that a joinReader can look up rows in a
+// secondary index, whether or not it contains all the needed columns.
+func TestJoinReaderIndexOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	createTestTable(t, sqlDB, "INDEX bs (b,s)")
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	// The input rows contain values for the columns of the bs index.
+	input := sqlbase.EncDatumRows{
+		{intEncDatum(2), sqlbase.DatumToEncDatum(strType, tree.NewDString("two"))},
+		{intEncDatum(5), sqlbase.DatumToEncDatum(strType, tree.NewDString("one-five"))},
+		{intEncDatum(3), sqlbase.DatumToEncDatum(strType, tree.NewDString("nope"))},
+		{intEncDatum(0), sqlbase.DatumToEncDatum(strType, tree.NewDString("five-zero"))},
+	}
+	inputTypes := []sqlbase.ColumnType{intType, strType}
+	spec := JoinReaderSpec{Table: *td, IndexIdx: 1}
+
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{1, 3}}
+	in := NewRowBuffer(inputTypes, input, RowBufferArgs{})
+	out := &RowBuffer{}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	expected := "[[2 'two'] [5 'one-five'] [0 'five-zero']]"
+	res := out.GetRowsNoMeta(t).String(inputTypes)
+	if res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+
+	// The sum column is not in the index; it is fetched from the primary index.
+	post = PostProcessSpec{Projection: true, OutputColumns: []uint32{1, 2}}
+	in = NewRowBuffer(inputTypes, input, RowBufferArgs{})
+	out = &RowBuffer{}
+	jr, err = newJoinReader(&flowCtx, &spec, in, &post, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	expected = "[[2 2] [5 6] [0 5]]"
+	if res := out.GetRowsNoMeta(t).String(twoIntCols); res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+}
+
+// TestJoinReaderScannedSpans verifies that a joinReader in a verbose flow
+// reports the primary key spans it looked up.
+func TestJoinReaderScannedSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	createTestTable(t, sqlDB, "INDEX bs (b,s)")
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	input := [][]int{{0, 2}, {0, 5}, {1, 0}, {1, 5}}
+	var expected roachpb.Spans
+	for _, row := range input {
+		key := roachpb.Key(sqlbase.MakeIndexKeyPrefix(td, td.PrimaryIndex.ID))
+		for _, v := range row {
+			key = encoding.EncodeVarintAscending(key, int64(v))
 		}
-		jr.Run(ctx, nil)
-		row, meta := out.Next()
-		if row != nil {
-			t.Fatalf("row was pushed unexpectedly: %s", row.String(oneIntCol))
+		expected = append(expected, roachpb.Span{Key: key, EndKey: key.PrefixEnd()})
+	}
+
+	for _, verbose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Verbose=%t", verbose), func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: s.ClusterSettings(),
+				txn:      newTestTxn(s),
+				Verbose:  verbose,
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out, nil /* kv */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var numRows int
+			var scanned roachpb.Spans
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if row != nil {
+					numRows++
+				}
+				scanned = append(scanned, meta.ScannedSpans...)
+			}
+			if numRows != len(input) {
+				t.Fatalf("expected %d rows, got %d", len(input), numRows)
+			}
+			if !verbose {
+				if len(scanned) != 0 {
+					t.Fatalf("expected no spans to be reported, got %s", scanned)
+				}
+				return
+			}
+			if !reflect.DeepEqual(scanned, expected) {
+				t.Fatalf("expected spans %s, got %s", expected, scanned)
+			}
+		})
+	}
+}
+
+// fakeKVScanner is a kvScanner that serves the scans from an in-memory set of
+// KVs. It implements the interface used by sqlbase.RowInserter so that rows can
+// be written to it.
+type fakeKVScanner struct {
+	// kvs is sorted by key once all the rows have been inserted.
+	kvs []roachpb.KeyValue
+	// numScannedSpans is the number of spans scanned so far. It is updated
+	// atomically since scans can run concurrently.
+	numScannedSpans int64
+	// numKVs is the number of KVs returned by the scans so far. It is updated
+	// atomically.
+	numKVs int64
+	// latency, if set, is how long each scan takes.
+	latency time.Duration
+	// If gates is set, the i-th scan (counting from 0) doesn't return before
+	// gates[i] is closed (or its context canceled), if there is such a gate.
+	gates []chan struct{}
+	// If failScan is set, the failScan-th scan (counting from 1) returns all but
+	// its last KV and then fails with scanErr.
+	failScan int
+	scanErr  error
+
+	mu struct {
+		syncutil.Mutex
+		// scanSizes are the numbers of spans of the scans so far.
+		scanSizes []int
+		// spans are the spans scanned so far.
+		spans roachpb.Spans
+		// inFlight is the number of scans in progress, and maxInFlight the
+		// largest it has been.
+		inFlight, maxInFlight int
+	}
+}
+
+var _ kvScanner = &fakeKVScanner{}
+
+// CPut is used by sqlbase.RowInserter.
+func (f *fakeKVScanner) CPut(key, value, expValue interface{}) {
+	f.Put(key, value)
+}
+
+// Put is used by sqlbase.RowInserter.
+func (f *fakeKVScanner) Put(key, value interface{}) {
+	f.kvs = append(f.kvs, roachpb.KeyValue{
+		Key:   *key.(*roachpb.Key),
+		Value: *value.(*roachpb.Value),
+	})
+}
+
+// startScan is part of the kvScanner interface.
+func (f *fakeKVScanner) startScan(
+	ctx context.Context,
+	fetcher *sqlbase.MultiRowFetcher,
+	spans roachpb.Spans,
+	limitBatches bool,
+	limitHint int64,
+) error {
+	atomic.AddInt64(&f.numScannedSpans, int64(len(spans)))
+	f.mu.Lock()
+	f.mu.scanSizes = append(f.mu.scanSizes, len(spans))
+	f.mu.spans = append(f.mu.spans, spans...)
+	scanIdx := len(f.mu.scanSizes) - 1
+	fail := len(f.mu.scanSizes) == f.failScan
+	f.mu.inFlight++
+	if f.mu.inFlight > f.mu.maxInFlight {
+		f.mu.maxInFlight = f.mu.inFlight
+	}
+	f.mu.Unlock()
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	var gateErr error
+	if scanIdx < len(f.gates) {
+		select {
+		case <-f.gates[scanIdx]:
+		case <-ctx.Done():
+			gateErr = ctx.Err()
 		}
-		if meta.Err != expectedMetaErr {
-			t.Fatalf("unexpected error in metadata: %v", meta.Err)
+	}
+	f.mu.Lock()
+	f.mu.inFlight--
+	f.mu.Unlock()
+	if gateErr != nil {
+		return gateErr
+	}
+	var kvs []roachpb.KeyValue
+	for _, span := range spans {
+		i := sort.Search(len(f.kvs), func(i int) bool {
+			return f.kvs[i].Key.Compare(span.Key) >= 0
+		})
+		for ; i < len(f.kvs) && f.kvs[i].Key.Compare(span.EndKey) < 0; i++ {
+			kvs = append(kvs, f.kvs[i])
+		}
+	}
+	if limitBatches && limitHint > 0 && int64(len(kvs)) > limitHint {
+		// Only the first batch is returned: the callers setting a limit hint
+		// don't read further. The table rows are made of a single KV each.
+		kvs = kvs[:limitHint]
+	}
+	atomic.AddInt64(&f.numKVs, int64(len(kvs)))
+	if fail && len(kvs) > 0 {
+		return fetcher.StartScanFrom(ctx, &sqlbase.SpanKVFetcher{KVs: kvs[:len(kvs)-1], Err: f.scanErr})
+	}
+	return fetcher.StartScanFrom(ctx, &sqlbase.SpanKVFetcher{KVs: kvs})
+}
+
+// makeFakeKVTable returns the descriptor of a table with the rows (and the bs
+// index) of the table used in TestJoinReader, plus a non-unique index on b, and
+// a fakeKVScanner containing these rows.
+func makeFakeKVTable(t testing.TB) (sqlbase.TableDescriptor, *fakeKVScanner) {
+	td := sqlbase.TableDescriptor{
+		Name:     "t",
+		ID:       keys.MaxReservedDescID + 2,
+		ParentID: keys.MaxReservedDescID + 1,
+		Columns: []sqlbase.ColumnDescriptor{
+			{Name: "a", Type: intType},
+			{Name: "b", Type: intType},
+			{Name: "sum", Type: intType, Nullable: true},
+			{Name: "s", Type: strType, Nullable: true},
+		},
+		PrimaryIndex: sqlbase.IndexDescriptor{
+			Name:             "primary",
+			Unique:           true,
+			ColumnNames:      []string{"a", "b"},
+			ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+		},
+		Indexes: []sqlbase.IndexDescriptor{{
+			Name:             "bs",
+			ColumnNames:      []string{"b", "s"},
+			ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+		}, {
+			Name:             "b",
+			ColumnNames:      []string{"b"},
+			ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC},
+		}},
+		Privileges:    sqlbase.NewDefaultPrivilegeDescriptor(),
+		FormatVersion: sqlbase.InterleavedFormatVersion,
+	}
+	if err := td.AllocateIDs(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert the rows that sqlutils.CreateTable would insert.
+	var alloc sqlbase.DatumAlloc
+	ri, err := sqlbase.MakeRowInserter(
+		nil /* txn */, &td, nil /* fkTables */, td.Columns, false /* checkFKs */, &alloc,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &fakeKVScanner{}
+	for i := 1; i <= 99; i++ {
+		values := []tree.Datum{rowAFn(i), rowBFn(i), rowSumFn(i), sqlutils.RowEnglishFn(i)}
+		if err := ri.InsertRow(
+			context.Background(), kv, values, false /* ignoreConflicts */, false, /* traceKV */
+		); err != nil {
+			t.Fatal(err)
 		}
+	}
+	sort.Slice(kv.kvs, func(i, j int) bool {
+		return kv.kvs[i].Key.Compare(kv.kvs[j].Key) < 0
 	})
+	return td, kv
+}
+
+// TestJoinReaderFakeKV runs a joinReader against a fakeKVScanner, without
+// starting a server.
+func TestJoinReaderFakeKV(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	input := [][]int{{1, 5}, {0, 2}, {0, 0}, {9, 9}, {10, 1}, {3, 4}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}}
+	expected := "[[1 5 'one-five'] [0 2 'two'] [9 9 'nine-nine'] [3 4 'three-four']]"
+
+	for _, parallelism := range []uint32{1, 4} {
+		t.Run(fmt.Sprintf("Parallelism=%d", parallelism), func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			// No txn is needed since the lookups are served by kv.
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, Parallelism: parallelism}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			res := out.GetRowsNoMeta(t).String([]sqlbase.ColumnType{intType, intType, strType})
+			if res != expected {
+				t.Errorf("expected %s, got %s", expected, res)
+			}
+		})
+	}
+}
+
+// TestJoinReaderOutputRowReuse verifies that a joinReader builds its output
+// rows in the same memory when its output is a RowCopyingReceiver, without
+// affecting the rows received, and allocates them otherwise.
+func TestJoinReaderOutputRowReuse(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	input := [][]int{{1, 5}, {0, 2}, {0, 0}, {9, 9}, {10, 1}, {3, 4}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}}
+	expected := "[[1 5 'one-five'] [0 2 'two'] [9 9 'nine-nine'] [3 4 'three-four']]"
+	outTypes := []sqlbase.ColumnType{intType, intType, strType}
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+	spec := JoinReaderSpec{Table: td}
+
+	t.Run("Copying", func(t *testing.T) {
+		in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+		out := NewDatumRowReceiver(outTypes)
+		jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !jr.out.reuseOutRow {
+			t.Fatal("expected the output rows to be reused")
+		}
+		jr.Run(context.Background(), nil)
+
+		if meta := out.Meta(); len(meta) != 0 {
+			t.Fatalf("unexpected metadata %v", meta)
+		}
+		var rows sqlbase.EncDatumRows
+		for _, r := range out.Rows() {
+			row := make(sqlbase.EncDatumRow, len(r))
+			for i := range r {
+				row[i] = sqlbase.DatumToEncDatum(outTypes[i], r[i])
+			}
+			rows = append(rows, row)
+		}
+		if res := rows.String(outTypes); res != expected {
+			t.Errorf("expected %s, got %s", expected, res)
+		}
+	})
+
+	t.Run("Retaining", func(t *testing.T) {
+		in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+		out := &RowBuffer{}
+		jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jr.out.reuseOutRow {
+			t.Fatal("expected the output rows not to be reused")
+		}
+		jr.Run(context.Background(), nil)
+		if res := out.GetRowsNoMeta(t).String(outTypes); res != expected {
+			t.Errorf("expected %s, got %s", expected, res)
+		}
+	})
+}
+
+// TestJoinReaderLookupSpans verifies that lookupSpans computes the spans of
+// the lookups of the given rows without scanning anything.
+func TestJoinReaderLookupSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	input := [][]int{{1, 5}, {0, 2}, {0, 0}, {9, 9}, {10, 1}, {3, 4}}
+
+	testCases := []struct {
+		name     string
+		indexIdx uint32
+		index    *sqlbase.IndexDescriptor
+		// numCols is the number of columns of the input rows in the index keys.
+		numCols int
+	}{
+		{name: "Primary", indexIdx: 0, index: &td.PrimaryIndex, numCols: 2},
+		{name: "Secondary", indexIdx: 2, index: &td.Indexes[1], numCols: 1},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			var expected roachpb.Spans
+			for _, row := range input {
+				key := roachpb.Key(sqlbase.MakeIndexKeyPrefix(&td, c.index.ID))
+				for _, v := range row[:c.numCols] {
+					key = encoding.EncodeVarintAscending(key, int64(v))
+				}
+				expected = append(expected, roachpb.Span{Key: key, EndKey: key.PrefixEnd()})
+			}
+
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+			in := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{})
+			spec := JoinReaderSpec{Table: td, IndexIdx: c.indexIdx}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spans, err := jr.lookupSpans(genEncDatumRowsInt(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(spans, expected) {
+				t.Errorf("expected spans %s, got %s", expected, spans)
+			}
+			if n := atomic.LoadInt64(&kv.numScannedSpans); n != 0 {
+				t.Errorf("expected no spans to be scanned, got %d", n)
+			}
+		})
+	}
+}
+
+// TestJoinReaderBatchOutputOrdering verifies that a joinReader with a batch
+// output ordering sorts the rows matched by each batch, but not across batches.
+func TestJoinReaderBatchOutputOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	// Two batches of three lookups; (1,5) is looked up twice.
+	input := [][]int{{1, 5}, {0, 2}, {9, 9}, {3, 4}, {1, 5}, {2, 8}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 2}}
+	// Ordered by sum, descending.
+	ordering := Ordering{Columns: []Ordering_Column{{ColIdx: 2, Direction: Ordering_Column_DESC}}}
+	expected := "[[9 9 18] [1 5 6] [0 2 2] [2 8 10] [3 4 7] [1 5 6]]"
+
+	for _, cacheSize := range []uint32{0, 10} {
+		t.Run(fmt.Sprintf("CacheSize=%d", cacheSize), func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{
+				Table:               td,
+				LookupCacheSize:     cacheSize,
+				MinLookupBatchSize:  3,
+				MaxLookupBatchSize:  3,
+				BatchOutputOrdering: ordering,
+			}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(threeIntCols); res != expected {
+				t.Errorf("expected %s, got %s", expected, res)
+			}
+		})
+	}
+
+	t.Run("SemiJoin", func(t *testing.T) {
+		evalCtx := tree.MakeTestingEvalContext()
+		defer evalCtx.Stop(context.Background())
+		flowCtx := FlowCtx{
+			EvalCtx:  evalCtx,
+			Settings: cluster.MakeTestingClusterSettings(),
+		}
+		in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+		spec := JoinReaderSpec{Table: td, Type: JoinType_LEFT_SEMI, BatchOutputOrdering: ordering}
+		if _, err := newJoinReader(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv,
+		); !testutils.IsError(err, "sorting the output of a LEFT_SEMI join not supported") {
+			t.Fatalf("expected error, got %v", err)
+		}
+	})
+}
+
+// TestJoinReaderRetryableError verifies that a retryable error encountered in
+// the middle of the lookups of a batch is passed to the consumer as metadata,
+// without emitting any of the rows of that batch.
+func TestJoinReaderRetryableError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	// The scan of the second batch fails after returning two of its rows.
+	kv.failScan = 2
+	kv.scanErr = &roachpb.UnhandledRetryableError{}
+	input := [][]int{{1, 5}, {0, 2}, {9, 9}, {3, 4}, {2, 8}, {4, 4}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+	expected := "[[1 5] [0 2] [9 9]]"
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+	out := &RowBuffer{}
+	spec := JoinReaderSpec{Table: td, MinLookupBatchSize: 3, MaxLookupBatchSize: 3}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	var rows sqlbase.EncDatumRows
+	var errs []error
+	for {
+		row, meta := out.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if row != nil {
+			rows = append(rows, row)
+		}
+		if meta.Err != nil {
+			errs = append(errs, meta.Err)
+		}
+	}
+	if res := rows.String(twoIntCols); res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected one error, got %v", errs)
+	}
+	if !isRetryableKVError(errs[0]) {
+		t.Fatalf("expected a retryable error, got %v", errs[0])
+	}
+	if isRetryableKVError(errors.New("boom")) {
+		t.Fatal("plain error classified as retryable")
+	}
+}
+
+// TestJoinReaderLookupRetries verifies that the lookups of a batch that fail
+// with a transient error are retried, without emitting any row twice.
+func TestJoinReaderLookupRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	input := [][]int{{1, 5}, {0, 2}, {9, 9}, {3, 4}, {2, 8}, {4, 4}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+
+	testCases := []struct {
+		name       string
+		scanErr    error
+		maxRetries uint32
+		expected   string
+		// numScans is the expected number of scans.
+		numScans int
+		// expectedErr is set if the error is expected to reach the consumer.
+		expectedErr bool
+	}{
+		{
+			name:       "Transient",
+			scanErr:    &roachpb.RangeKeyMismatchError{},
+			maxRetries: 2,
+			expected:   "[[1 5] [0 2] [9 9] [3 4] [2 8] [4 4]]",
+			numScans:   3,
+		},
+		{
+			name:        "NoRetries",
+			scanErr:     &roachpb.RangeKeyMismatchError{},
+			expected:    "[[1 5] [0 2] [9 9]]",
+			numScans:    2,
+			expectedErr: true,
+		},
+		{
+			// Errors that require restarting the transaction aren't retried.
+			name:        "NotTransient",
+			scanErr:     &roachpb.UnhandledRetryableError{},
+			maxRetries:  2,
+			expected:    "[[1 5] [0 2] [9 9]]",
+			numScans:    2,
+			expectedErr: true,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			// The first scan of the second batch fails after returning two of its
+			// rows.
+			kv.failScan = 2
+			kv.scanErr = c.scanErr
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{
+				Table:              td,
+				MinLookupBatchSize: 3,
+				MaxLookupBatchSize: 3,
+				MaxLookupRetries:   c.maxRetries,
+				LookupRetryBackoff: time.Millisecond,
+			}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var rows sqlbase.EncDatumRows
+			var errs []error
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if row != nil {
+					rows = append(rows, row)
+				}
+				if meta.Err != nil {
+					errs = append(errs, meta.Err)
+				}
+			}
+			if res := rows.String(twoIntCols); res != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, res)
+			}
+			if c.expectedErr {
+				if len(errs) != 1 || errs[0] != c.scanErr {
+					t.Errorf("expected error %v, got %v", c.scanErr, errs)
+				}
+			} else if len(errs) != 0 {
+				t.Errorf("unexpected errors %v", errs)
+			}
+			if numScans := len(kv.mu.scanSizes); numScans != c.numScans {
+				t.Errorf("expected %d scans, got %d", c.numScans, numScans)
+			}
+		})
+	}
+}
+
+// TestJoinReaderLookupRetriesSideEffects verifies that the metadata and the
+// statistics of the lookups of a batch are only reported once when these
+// lookups fail with a transient error and are retried.
+func TestJoinReaderLookupRetriesSideEffects(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+
+	testCases := []struct {
+		name      string
+		input     [][]int
+		batchSize uint32
+		cacheSize uint32
+		// failScan is the scan that fails with a transient error.
+		failScan int
+		expReads uint64
+		expHits  uint64
+	}{
+		{
+			// The attempt that fails has decoded (and skipped) the row (1, 5).
+			name:      "DecodeErr",
+			input:     [][]int{{1, 5}, {0, 2}, {2, 2}},
+			batchSize: 3,
+			failScan:  1,
+			expReads:  3,
+		},
+		{
+			// The attempt that fails has served the lookup of (1, 5) from the cache.
+			name:      "Cache",
+			input:     [][]int{{1, 5}, {0, 2}, {1, 5}, {2, 2}},
+			batchSize: 2,
+			cacheSize: 10,
+			failScan:  2,
+			expReads:  3,
+			expHits:   1,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			// Corrupt the value of the row (1, 5).
+			key := roachpb.Key(sqlbase.MakeIndexKeyPrefix(&td, td.PrimaryIndex.ID))
+			key = encoding.EncodeVarintAscending(key, 1)
+			key = encoding.EncodeVarintAscending(key, 5)
+			key = keys.MakeFamilyKey(key, 0)
+			var corrupted bool
+			for i := range kv.kvs {
+				if kv.kvs[i].Key.Equal(key) {
+					kv.kvs[i].Value = roachpb.Value{}
+					kv.kvs[i].Value.SetTuple([]byte{0xff})
+					corrupted = true
+				}
+			}
+			if !corrupted {
+				t.Fatalf("no KV with key %s", key)
+			}
+			kv.failScan = c.failScan
+			kv.scanErr = &roachpb.RangeKeyMismatchError{}
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+				Verbose:  true,
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(c.input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{
+				Table:              td,
+				MinLookupBatchSize: c.batchSize,
+				MaxLookupBatchSize: c.batchSize,
+				MaxLookupRetries:   1,
+				LookupRetryBackoff: time.Millisecond,
+				LookupCacheSize:    c.cacheSize,
+				SkipDecodeErrors:   true,
+			}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var rows sqlbase.EncDatumRows
+			var decodeErrs []error
+			var numSkipped uint64
+			var stats *JoinReaderStats
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if row != nil {
+					rows = append(rows, row)
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if meta.DecodeErr != nil {
+					decodeErrs = append(decodeErrs, meta.DecodeErr)
+				}
+				numSkipped += meta.NumSkippedRows
+				if meta.JoinReaderStats != nil {
+					stats = meta.JoinReaderStats
+				}
+			}
+			if res, expected := rows.String(twoIntCols), "[[0 2] [2 2]]"; res != expected {
+				t.Errorf("expected %s, got %s", expected, res)
+			}
+			if len(decodeErrs) != 1 || numSkipped != 1 {
+				t.Errorf("expected 1 decoding error and 1 skipped row, got %v and %d",
+					decodeErrs, numSkipped)
+			}
+			if stats == nil {
+				t.Fatal("no stats reported")
+			}
+			if stats.KVReads != c.expReads || stats.CacheHits != c.expHits {
+				t.Errorf("expected %d KV reads and %d cache hits, got %d and %d",
+					c.expReads, c.expHits, stats.KVReads, stats.CacheHits)
+			}
+			if numScans := len(kv.mu.scanSizes); numScans != c.failScan+1 {
+				t.Errorf("expected %d scans, got %d", c.failScan+1, numScans)
+			}
+		})
+	}
+}
+
+// TestJoinReaderProgress verifies that a joinReader given an estimate of the
+// number of its input rows reports its progress.
+func TestJoinReaderProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	var input [][]int
+	for i := 0; i < 3*joinReaderBatchSize; i++ {
+		input = append(input, []int{1, 5})
+	}
+
+	for _, estimate := range []uint64{0, uint64(len(input)), 10} {
+		t.Run(fmt.Sprintf("Estimate=%d", estimate), func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, EstimatedInputRows: estimate}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var progress []*ProcessorProgress
+			numRows := 0
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if row != nil {
+					numRows++
+				}
+				if meta.Progress != nil {
+					progress = append(progress, meta.Progress)
+				}
+			}
+			if numRows != len(input) {
+				t.Fatalf("expected %d rows, got %d", len(input), numRows)
+			}
+			if estimate == 0 {
+				if len(progress) != 0 {
+					t.Fatalf("unexpected progress metadata: %+v", progress)
+				}
+				return
+			}
+			if len(progress) == 0 {
+				t.Fatal("no progress metadata")
+			}
+			for _, p := range progress {
+				if p.EstimatedTotalRows != estimate {
+					t.Errorf("expected estimate %d, got %d", estimate, p.EstimatedTotalRows)
+				}
+				if p.RowsConsumed == 0 || p.RowsConsumed > uint64(len(input)) {
+					t.Errorf("invalid number of consumed rows %d", p.RowsConsumed)
+				}
+				if p.FractionCompleted <= 0 || p.FractionCompleted > 1 {
+					t.Errorf("invalid fraction %f", p.FractionCompleted)
+				}
+			}
+		})
+	}
+}
+
+// TestJoinReaderIndexPrimaryLookup verifies that a joinReader looking up rows in
+// the bs index only reads the primary index when columns that aren't in the
+// index are needed.
+func TestJoinReaderIndexPrimaryLookup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	input := sqlbase.EncDatumRows{
+		{intEncDatum(2), sqlbase.DatumToEncDatum(strType, tree.NewDString("two"))},
+		{intEncDatum(5), sqlbase.DatumToEncDatum(strType, tree.NewDString("one-five"))},
+		{intEncDatum(3), sqlbase.DatumToEncDatum(strType, tree.NewDString("nope"))},
+		{intEncDatum(0), sqlbase.DatumToEncDatum(strType, tree.NewDString("five-zero"))},
+	}
+	inputTypes := []sqlbase.ColumnType{intType, strType}
+
+	testCases := []struct {
+		outCols     []uint32
+		parallelism uint32
+		outputTypes []sqlbase.ColumnType
+		expected    string
+		primaryRead bool
+	}{
+		{
+			outCols:     []uint32{1, 3},
+			outputTypes: inputTypes,
+			expected:    "[[2 'two'] [5 'one-five'] [0 'five-zero']]",
+		},
+		{
+			outCols:     []uint32{1, 2},
+			outputTypes: twoIntCols,
+			expected:    "[[2 2] [5 6] [0 5]]",
+			primaryRead: true,
+		},
+		{
+			outCols:     []uint32{0, 2, 3},
+			parallelism: 2,
+			outputTypes: []sqlbase.ColumnType{intType, intType, strType},
+			expected:    "[[0 2 'two'] [1 6 'one-five'] [5 5 'five-zero']]",
+			primaryRead: true,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%v/Parallelism=%d", c.outCols, c.parallelism), func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(inputTypes, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, IndexIdx: 1, Parallelism: c.parallelism}
+			post := PostProcessSpec{Projection: true, OutputColumns: c.outCols}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(c.outputTypes); res != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, res)
+			}
+
+			primaryPrefix := roachpb.Key(sqlbase.MakeIndexKeyPrefix(&td, td.PrimaryIndex.ID))
+			primaryRead := false
+			for _, span := range kv.mu.spans {
+				if bytes.HasPrefix(span.Key, primaryPrefix) {
+					primaryRead = true
+				}
+			}
+			if primaryRead != c.primaryRead {
+				t.Errorf("expected primary index read: %t, got %t", c.primaryRead, primaryRead)
+			}
+		})
+	}
+}
+
+// TestJoinReaderStrategy verifies the strategy chosen by newJoinReader,
+// including the detection of the cases in which the bs index covers the needed
+// columns.
+func TestJoinReaderStrategy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	testCases := []struct {
+		name     string
+		spec     JoinReaderSpec
+		post     PostProcessSpec
+		expected joinReaderStrategy
+	}{
+		{
+			name:     "Primary",
+			post:     PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 2}},
+			expected: joinReaderPrimaryLookup,
+		},
+		{
+			name:     "Covering",
+			spec:     JoinReaderSpec{IndexIdx: 1},
+			post:     PostProcessSpec{Projection: true, OutputColumns: []uint32{1, 3}},
+			expected: joinReaderIndexOnly,
+		},
+		{
+			// The primary key columns are part of the index entries.
+			name:     "CoveringPrimaryKey",
+			spec:     JoinReaderSpec{IndexIdx: 1},
+			post:     PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}},
+			expected: joinReaderIndexOnly,
+		},
+		{
+			name:     "NotCovering",
+			spec:     JoinReaderSpec{IndexIdx: 1},
+			post:     PostProcessSpec{Projection: true, OutputColumns: []uint32{1, 2}},
+			expected: joinReaderIndexJoin,
+		},
+		{
+			// The filter needs the sum column.
+			name: "NotCoveringFilter",
+			spec: JoinReaderSpec{IndexIdx: 1},
+			post: PostProcessSpec{
+				Filter:        Expression{Expr: "@3 > 5"},
+				Projection:    true,
+				OutputColumns: []uint32{0},
+			},
+			expected: joinReaderIndexJoin,
+		},
+		{
+			// Semi joins only need the lookup columns.
+			name:     "SemiJoin",
+			spec:     JoinReaderSpec{IndexIdx: 1, Type: JoinType_LEFT_SEMI},
+			expected: joinReaderIndexOnly,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			spec := c.spec
+			spec.Table = td
+			in := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{})
+			jr, err := newJoinReader(&flowCtx, &spec, in, &c.post, &RowBuffer{}, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := jr.strategy(); s != c.expected {
+				t.Errorf("expected strategy %s, got %s", c.expected, s)
+			}
+		})
+	}
+}
+
+// TestJoinReaderIncompatibleOptions verifies which of the lookup strategies and
+// the output options of a joinReader newJoinReader accepts together: range
+// lookups, pipelined lookups and the reporting of unmatched rows each rule out
+// the non-inner joins, the lookup cache and some of the other options.
+func TestJoinReaderIncompatibleOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	lookupRange := &JoinReaderSpec_LookupRange{LowColumn: 0, HighColumn: 1}
+	testCases := []struct {
+		name string
+		spec JoinReaderSpec
+		// expErr is empty if the options are compatible.
+		expErr string
+	}{
+		{
+			name:   "RangeSemi",
+			spec:   JoinReaderSpec{LookupRange: lookupRange, Type: JoinType_LEFT_SEMI},
+			expErr: "range lookups not supported for LEFT_SEMI joins",
+		},
+		{
+			name:   "RangeCache",
+			spec:   JoinReaderSpec{LookupRange: lookupRange, LookupCacheSize: 10},
+			expErr: "range lookups not supported with a lookup cache",
+		},
+		{
+			name:   "RangeIndexEntries",
+			spec:   JoinReaderSpec{LookupRange: lookupRange, IndexIdx: 1, OutputIndexEntries: true},
+			expErr: "range lookups not supported with a lookup cache",
+		},
+		{
+			name:   "RangeMatchedFlag",
+			spec:   JoinReaderSpec{LookupRange: lookupRange, EmitMatchedFlag: true},
+			expErr: "range lookups not supported with a lookup cache",
+		},
+		{
+			name:   "RangeLookupKey",
+			spec:   JoinReaderSpec{LookupRange: lookupRange, EmitLookupKey: true},
+			expErr: "range lookups not supported with a lookup cache",
+		},
+		{
+			name: "RangePipelined",
+			spec: JoinReaderSpec{LookupRange: lookupRange, MaxInFlightBatches: 2},
+		},
+		{
+			name:   "PipelinedSemi",
+			spec:   JoinReaderSpec{MaxInFlightBatches: 2, Type: JoinType_LEFT_SEMI},
+			expErr: "pipelined lookups not supported for LEFT_SEMI joins",
+		},
+		{
+			name:   "PipelinedCache",
+			spec:   JoinReaderSpec{MaxInFlightBatches: 2, LookupCacheSize: 10},
+			expErr: "pipelined lookups not supported with a lookup cache",
+		},
+		{
+			name:   "PipelinedIndexEntries",
+			spec:   JoinReaderSpec{MaxInFlightBatches: 2, IndexIdx: 1, OutputIndexEntries: true},
+			expErr: "pipelined lookups not supported with a lookup cache",
+		},
+		{
+			name:   "PipelinedMatchedFlag",
+			spec:   JoinReaderSpec{MaxInFlightBatches: 2, EmitMatchedFlag: true},
+			expErr: "pipelined lookups not supported with a lookup cache",
+		},
+		{
+			name: "PipelinedSkipDecodeErrors",
+			spec: JoinReaderSpec{MaxInFlightBatches: 2, SkipDecodeErrors: true},
+		},
+		{
+			// The bs index doesn't cover the sum column.
+			name:   "PipelinedIndexJoin",
+			spec:   JoinReaderSpec{MaxInFlightBatches: 2, IndexIdx: 1},
+			expErr: "pipelined lookups not supported when the rows are fetched from the primary index after index bs",
+		},
+		{
+			name: "PipelinedParallel",
+			spec: JoinReaderSpec{MaxInFlightBatches: 2, Parallelism: 4},
+		},
+		{
+			name:   "UnmatchedSemi",
+			spec:   JoinReaderSpec{ReportUnmatchedRows: true, Type: JoinType_LEFT_SEMI},
+			expErr: "reporting unmatched rows not supported for LEFT_SEMI joins",
+		},
+		{
+			name:   "UnmatchedCache",
+			spec:   JoinReaderSpec{ReportUnmatchedRows: true, LookupCacheSize: 10},
+			expErr: "reporting unmatched rows not supported with a lookup cache",
+		},
+		{
+			name:   "UnmatchedIndexEntries",
+			spec:   JoinReaderSpec{ReportUnmatchedRows: true, IndexIdx: 1, OutputIndexEntries: true},
+			expErr: "reporting unmatched rows not supported with a lookup cache",
+		},
+		{
+			name:   "UnmatchedMatchedFlag",
+			spec:   JoinReaderSpec{ReportUnmatchedRows: true, EmitMatchedFlag: true},
+			expErr: "reporting unmatched rows not supported with a lookup cache",
+		},
+		{
+			name:   "UnmatchedPipelined",
+			spec:   JoinReaderSpec{ReportUnmatchedRows: true, MaxInFlightBatches: 2},
+			expErr: "reporting unmatched rows not supported with a lookup cache",
+		},
+		{
+			name:   "UnmatchedRange",
+			spec:   JoinReaderSpec{ReportUnmatchedRows: true, LookupRange: lookupRange},
+			expErr: "reporting unmatched rows not supported with range lookups",
+		},
+		{
+			name: "UnmatchedSkipDecodeErrors",
+			spec: JoinReaderSpec{ReportUnmatchedRows: true, SkipDecodeErrors: true},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			spec := c.spec
+			spec.Table = td
+			in := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{})
+			_, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv)
+			if c.expErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !testutils.IsError(err, c.expErr) {
+				t.Fatalf("expected error %q, got %v", c.expErr, err)
+			}
+		})
+	}
+}
+
+// TestJoinReaderOutputIndexEntries verifies the layout of the rows of a
+// joinReader outputting the index entries: the input columns, then the key
+// columns of the bs index, then the columns of the table.
+func TestJoinReaderOutputIndexEntries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	str := func(s string) sqlbase.EncDatum {
+		return sqlbase.DatumToEncDatum(strType, tree.NewDString(s))
+	}
+	// The lookup of (2, 'two') is repeated; (3, 'nope') has no match.
+	input := sqlbase.EncDatumRows{
+		{intEncDatum(2), str("two")},
+		{intEncDatum(5), str("one-five")},
+		{intEncDatum(3), str("nope")},
+		{intEncDatum(2), str("two")},
+	}
+	inputTypes := []sqlbase.ColumnType{intType, strType}
+	// b, s (input), b, s (index entry), a, b, sum, s (table).
+	allTypes := []sqlbase.ColumnType{
+		intType, strType, intType, strType, intType, intType, intType, strType,
+	}
+
+	testCases := []struct {
+		post        PostProcessSpec
+		parallelism uint32
+		outputTypes []sqlbase.ColumnType
+		expected    string
+	}{
+		{
+			outputTypes: allTypes,
+			expected: "[[2 'two' 2 'two' 0 2 2 'two'] " +
+				"[5 'one-five' 5 'one-five' 1 5 6 'one-five'] " +
+				"[2 'two' 2 'two' 0 2 2 'two']]",
+		},
+		{
+			post:        PostProcessSpec{Projection: true, OutputColumns: []uint32{1, 2, 6}},
+			parallelism: 2,
+			outputTypes: []sqlbase.ColumnType{strType, intType, intType},
+			expected:    "[['two' 2 2] ['one-five' 5 6] ['two' 2 2]]",
+		},
+	}
+	for i, c := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(inputTypes, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{
+				Table: td, IndexIdx: 1, Parallelism: c.parallelism, OutputIndexEntries: true,
+			}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &c.post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(c.outputTypes); res != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, res)
+			}
+		})
+	}
+
+	errCases := []struct {
+		name     string
+		spec     JoinReaderSpec
+		post     PostProcessSpec
+		expected string
+	}{
+		{
+			name:     "PrimaryIndex",
+			spec:     JoinReaderSpec{},
+			expected: "outputting index entries requires a secondary index",
+		},
+		{
+			name:     "SemiJoin",
+			spec:     JoinReaderSpec{IndexIdx: 1, Type: JoinType_LEFT_SEMI},
+			expected: "outputting index entries not supported for LEFT_SEMI joins",
+		},
+		{
+			name:     "Cache",
+			spec:     JoinReaderSpec{IndexIdx: 1, LookupCacheSize: 10},
+			expected: "not supported with a lookup cache",
+		},
+		{
+			name:     "OutputColumn",
+			spec:     JoinReaderSpec{IndexIdx: 1},
+			post:     PostProcessSpec{Projection: true, OutputColumns: []uint32{8}},
+			expected: "invalid output column 8",
+		},
+	}
+	for _, c := range errCases {
+		t.Run(c.name, func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+			spec := c.spec
+			spec.Table = td
+			spec.OutputIndexEntries = true
+			in := NewRowBuffer(inputTypes, input, RowBufferArgs{})
+			if _, err := newJoinReader(
+				&flowCtx, &spec, in, &c.post, &RowBuffer{}, kv,
+			); !testutils.IsError(err, c.expected) {
+				t.Fatalf("expected error %q, got %v", c.expected, err)
+			}
+		})
+	}
+}
+
+// TestJoinReaderEmitMatchedFlag verifies that a joinReader emitting a matched
+// flag outputs every input row, with the matching row of the table or NULLs.
+func TestJoinReaderEmitMatchedFlag(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// (0, 0) and (10, 1) don't exist.
+	input := [][]int{{1, 5}, {0, 0}, {9, 9}, {10, 1}, {1, 5}}
+	// The input columns, the sum and s columns of the table and the flag.
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 4, 5, 6}}
+	outputTypes := []sqlbase.ColumnType{intType, intType, intType, strType, boolType}
+	expected := "[[1 5 6 'one-five' true] [0 0 NULL NULL false] [9 9 18 'nine-nine' true] " +
+		"[10 1 NULL NULL false] [1 5 6 'one-five' true]]"
+
+	for _, parallelism := range []uint32{1, 2} {
+		t.Run(fmt.Sprintf("Parallelism=%d", parallelism), func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, Parallelism: parallelism, EmitMatchedFlag: true}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(outputTypes); res != expected {
+				t.Errorf("expected %s, got %s", expected, res)
+			}
+		})
+	}
+
+	t.Run("SemiJoin", func(t *testing.T) {
+		td, kv := makeFakeKVTable(t)
+		evalCtx := tree.MakeTestingEvalContext()
+		defer evalCtx.Stop(context.Background())
+		flowCtx := FlowCtx{
+			EvalCtx:  evalCtx,
+			Settings: cluster.MakeTestingClusterSettings(),
+		}
+		in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+		spec := JoinReaderSpec{Table: td, Type: JoinType_LEFT_SEMI, EmitMatchedFlag: true}
+		if _, err := newJoinReader(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv,
+		); !testutils.IsError(err, "emitting a matched flag not supported for LEFT_SEMI joins") {
+			t.Fatalf("expected error, got %v", err)
+		}
+	})
+}
+
+func TestJoinReaderCountOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// (0, 0) and (10, 1) don't exist.
+	pkInput := genEncDatumRowsInt([][]int{{1, 5}, {0, 0}, {9, 9}, {10, 1}, {1, 5}})
+	var manyBatches [][]int
+	for i := 0; i < 3*joinReaderBatchSize; i++ {
+		manyBatches = append(manyBatches, []int{1, 5})
+	}
+	indexInputTypes := []sqlbase.ColumnType{intType, strType}
+	indexInput := sqlbase.EncDatumRows{
+		{intEncDatum(2), sqlbase.DatumToEncDatum(strType, tree.NewDString("two"))},
+		{intEncDatum(5), sqlbase.DatumToEncDatum(strType, tree.NewDString("one-five"))},
+		{intEncDatum(0), sqlbase.DatumToEncDatum(strType, tree.NewDString("none"))},
+	}
+
+	testCases := []struct {
+		name       string
+		indexIdx   uint32
+		inputTypes []sqlbase.ColumnType
+		input      sqlbase.EncDatumRows
+		expected   string
+	}{
+		{name: "Empty", inputTypes: twoIntCols, expected: "[[0]]"},
+		{name: "Primary", inputTypes: twoIntCols, input: pkInput, expected: "[[3]]"},
+		{
+			name:       "ManyBatches",
+			inputTypes: twoIntCols,
+			input:      genEncDatumRowsInt(manyBatches),
+			expected:   fmt.Sprintf("[[%d]]", len(manyBatches)),
+		},
+		{name: "Index", indexIdx: 1, inputTypes: indexInputTypes, input: indexInput, expected: "[[2]]"},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(c.inputTypes, c.input, RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, IndexIdx: c.indexIdx, CountOnly: true}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(oneIntCol); res != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, res)
+			}
+			// The matches are counted from the index entries alone.
+			if s := jr.strategy(); c.indexIdx != 0 && s != joinReaderIndexOnly {
+				t.Errorf("expected an index-only scan, got %s", s)
+			}
+		})
+	}
+
+	t.Run("SemiJoin", func(t *testing.T) {
+		td, kv := makeFakeKVTable(t)
+		evalCtx := tree.MakeTestingEvalContext()
+		defer evalCtx.Stop(context.Background())
+		flowCtx := FlowCtx{
+			EvalCtx:  evalCtx,
+			Settings: cluster.MakeTestingClusterSettings(),
+		}
+		in := NewRowBuffer(twoIntCols, pkInput, RowBufferArgs{})
+		spec := JoinReaderSpec{Table: td, Type: JoinType_LEFT_SEMI, CountOnly: true}
+		if _, err := newJoinReader(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv,
+		); !testutils.IsError(err, "counting matches not supported for LEFT_SEMI joins") {
+			t.Fatalf("expected error, got %v", err)
+		}
+	})
+}
+
+// TestJoinReaderEmitLookupKey verifies that the lookup keys emitted by a
+// joinReader decode to the primary keys of the rows, with or without a
+// projection and a lookup cache.
+func TestJoinReaderEmitLookupKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// (0, 0) doesn't exist.
+	input := genEncDatumRowsInt([][]int{{1, 5}, {0, 0}, {9, 9}, {1, 5}})
+	testCases := []struct {
+		name      string
+		cacheSize uint32
+		post      PostProcessSpec
+		// keyIdx is the index of the lookup key in the output rows.
+		keyIdx   int
+		expected [][]int
+	}{
+		{
+			name:     "NoProjection",
+			keyIdx:   4,
+			expected: [][]int{{1, 5}, {9, 9}, {1, 5}},
+		},
+		{
+			name:      "Projection",
+			cacheSize: 10,
+			post:      PostProcessSpec{Projection: true, OutputColumns: []uint32{4, 1, 0}},
+			keyIdx:    0,
+			expected:  [][]int{{1, 5}, {9, 9}, {1, 5}},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(twoIntCols, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, LookupCacheSize: c.cacheSize, EmitLookupKey: true}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &c.post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			rows := out.GetRowsNoMeta(t)
+			if len(rows) != len(c.expected) {
+				t.Fatalf("expected %d rows, got %d", len(c.expected), len(rows))
+			}
+			var alloc sqlbase.DatumAlloc
+			for i, row := range rows {
+				if err := row[c.keyIdx].EnsureDecoded(&strType, &alloc); err != nil {
+					t.Fatal(err)
+				}
+				key, err := hex.DecodeString(string(*row[c.keyIdx].Datum.(*tree.DString)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				vals := make([]sqlbase.EncDatum, 2)
+				dirs := []encoding.Direction{encoding.Ascending, encoding.Ascending}
+				if _, ok, err := sqlbase.DecodeIndexKey(
+					&td, &td.PrimaryIndex, twoIntCols, vals, dirs, key,
+				); err != nil || !ok {
+					t.Fatalf("row %d: couldn't decode key %s: %v", i, key, err)
+				}
+				exp := fmt.Sprintf("[%d %d]", c.expected[i][0], c.expected[i][1])
+				if res := sqlbase.EncDatumRow(vals).String(twoIntCols); res != exp {
+					t.Errorf("row %d: expected key %s, got %s", i, exp, res)
+				}
+			}
+		})
+	}
+
+	t.Run("CountOnly", func(t *testing.T) {
+		td, kv := makeFakeKVTable(t)
+		evalCtx := tree.MakeTestingEvalContext()
+		defer evalCtx.Stop(context.Background())
+		flowCtx := FlowCtx{
+			EvalCtx:  evalCtx,
+			Settings: cluster.MakeTestingClusterSettings(),
+		}
+		in := NewRowBuffer(twoIntCols, input, RowBufferArgs{})
+		spec := JoinReaderSpec{Table: td, CountOnly: true, EmitLookupKey: true}
+		if _, err := newJoinReader(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv,
+		); !testutils.IsError(err, "emitting lookup keys not supported") {
+			t.Fatalf("expected error, got %v", err)
+		}
+	})
+}
+
+// TestJoinReaderLookupCache verifies that a joinReader with a lookup cache
+// returns the same results as one without, and that it only scans the keys
+// that aren't cached.
+func TestJoinReaderLookupCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	// The input spans multiple batches, with only three distinct keys; (0,0) has
+	// no match.
+	var input [][]int
+	for i := 0; i < 3*joinReaderBatchSize; i++ {
+		input = append(input, [][]int{{1, 5}, {0, 2}, {0, 0}}[i%3])
+	}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}}
+
+	testCases := []struct {
+		cacheSize   uint32
+		parallelism uint32
+		// expectedScans is the number of spans scanned.
+		expectedScans int64
+	}{
+		{cacheSize: 0, parallelism: 1, expectedScans: int64(len(input))},
+		{cacheSize: 10, parallelism: 1, expectedScans: 3},
+		{cacheSize: 10, parallelism: 4, expectedScans: 3},
+	}
+	var expected string
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("CacheSize=%d/Parallelism=%d", c.cacheSize, c.parallelism), func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			// No txn is needed since the lookups are served by kv.
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			atomic.StoreInt64(&kv.numScannedSpans, 0)
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, Parallelism: c.parallelism, LookupCacheSize: c.cacheSize}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			rows := out.GetRowsNoMeta(t)
+			if len(rows) != 2*joinReaderBatchSize {
+				t.Fatalf("expected %d rows, got %d", 2*joinReaderBatchSize, len(rows))
+			}
+			// All the configurations return the same rows as the one without a
+			// cache.
+			res := rows.String([]sqlbase.ColumnType{intType, intType, strType})
+			if expected == "" {
+				expected = res
+			} else if res != expected {
+				t.Errorf("expected %s, got %s", expected, res)
+			}
+			if n := atomic.LoadInt64(&kv.numScannedSpans); n != c.expectedScans {
+				t.Errorf("expected %d spans to be scanned, got %d", c.expectedScans, n)
+			}
+		})
+	}
+}
+
+// TestJoinReaderLookupCacheStats verifies that the stats of a joinReader
+// distinguish the lookups served by its lookup cache from the ones read from
+// KV.
+func TestJoinReaderLookupCacheStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	// With batches of a single lookup, the second lookup of (1,5) finds it in
+	// the cache.
+	input := [][]int{{1, 5}, {1, 5}, {0, 2}}
+
+	testCases := []struct {
+		cacheSize uint32
+		expHits   uint64
+		expReads  uint64
+	}{
+		{cacheSize: 0, expHits: 0, expReads: 3},
+		{cacheSize: 10, expHits: 1, expReads: 2},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("CacheSize=%d", c.cacheSize), func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			// No txn is needed since the lookups are served by kv.
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+				Verbose:  true,
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{
+				Table:              td,
+				LookupCacheSize:    c.cacheSize,
+				MinLookupBatchSize: 1,
+				MaxLookupBatchSize: 1,
+			}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var stats *JoinReaderStats
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if meta.JoinReaderStats != nil {
+					stats = meta.JoinReaderStats
+				}
+			}
+			if stats == nil {
+				t.Fatalf("no stats reported")
+			}
+			if stats.CacheHits != c.expHits || stats.KVReads != c.expReads {
+				t.Errorf("expected %d cache hits and %d KV reads, got %d and %d",
+					c.expHits, c.expReads, stats.CacheHits, stats.KVReads)
+			}
+			// The cache holds the rows of the two keys read.
+			if cached := stats.CacheBytes > 0; cached != (c.cacheSize > 0) {
+				t.Errorf("unexpected cache memory usage %d", stats.CacheBytes)
+			}
+		})
+	}
+}
+
+// TestJoinReaderReportUnmatchedRows verifies that the input rows without a match
+// are reported as metadata, in bounded batches, without affecting the output.
+func TestJoinReaderReportUnmatchedRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	// No txn is needed since the lookups are served by kv.
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	// (0, 0) doesn't exist, and neither do the rows with a >= 10, of which there
+	// are enough to fill more than one batch.
+	input := [][]int{{1, 5}, {0, 0}, {9, 9}}
+	unmatched := [][]int{{0, 0}}
+	for i := 0; i < 150; i++ {
+		row := []int{10 + i, i % 10}
+		input = append(input, row)
+		unmatched = append(unmatched, row)
+	}
+	input = append(input, []int{3, 4})
+	expUnmatched := genEncDatumRowsInt(unmatched).String(twoIntCols)
+
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+	out := &RowBuffer{}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+	spec := JoinReaderSpec{Table: td, ReportUnmatchedRows: true}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+
+	var rows, reported sqlbase.EncDatumRows
+	for {
+		row, meta := out.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if meta.Err != nil {
+			t.Fatal(meta.Err)
+		}
+		if row != nil {
+			rows = append(rows, row)
+		}
+		if u := meta.UnmatchedRows; u != nil {
+			if n := len(u.Rows); n == 0 || n > joinReaderUnmatchedRowsBatchSize {
+				t.Errorf("unexpected batch of %d unmatched rows", n)
+			}
+			batch, err := u.DecodeRows()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reported = append(reported, batch...)
+		}
+	}
+	if res, exp := rows.String(twoIntCols), "[[1 5] [9 9] [3 4]]"; res != exp {
+		t.Errorf("expected output %s, got %s", exp, res)
+	}
+	if res := reported.String(twoIntCols); res != expUnmatched {
+		t.Errorf("expected unmatched rows:\n   %s\ngot:\n   %s", expUnmatched, res)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, spec := range []JoinReaderSpec{
+			{Table: td, ReportUnmatchedRows: true, Type: JoinType_LEFT_SEMI},
+			{Table: td, ReportUnmatchedRows: true, LookupCacheSize: 10},
+			{Table: td, ReportUnmatchedRows: true, MaxInFlightBatches: 2},
+		} {
+			in := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{})
+			if _, err := newJoinReader(
+				&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv,
+			); !testutils.IsError(err, "reporting unmatched rows not supported") {
+				t.Errorf("expected an unsupported error, got %v", err)
+			}
+		}
+	})
+}
+
+func TestJoinReaderMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	metrics := MakeDistSQLMetrics(time.Hour /* histogramWindow */)
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+		Metrics:  &metrics,
+	}
+
+	// (0, 0) doesn't exist, and the offset suppresses one of the matches.
+	input := genEncDatumRowsInt([][]int{{1, 5}, {0, 0}, {9, 9}, {0, 2}})
+	in := NewRowBuffer(twoIntCols, input, RowBufferArgs{})
+	out := &RowBuffer{}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}, Offset: 1}
+	jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: td}, in, &post, out, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+
+	if in := metrics.ProcRowsIn.Count(); in != 4 {
+		t.Errorf("expected 4 rows in, got %d", in)
+	}
+	if out := metrics.ProcRowsOut.Count(); out != 2 {
+		t.Errorf("expected 2 rows out, got %d", out)
+	}
+	if n := metrics.GroupMaxRowsHist.Snapshot().TotalCount(); n != 0 {
+		t.Errorf("expected no groups to be recorded, got %d", n)
+	}
+}
+
+// TestJoinReaderSlowBatchLogging verifies that the lookup batches that take
+// longer than the sql.distsql.join_reader.slow_batch_threshold setting are
+// logged.
+func TestJoinReaderSlowBatchLogging(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Two of the lookups are for the same key.
+	input := genEncDatumRowsInt([][]int{{1, 5}, {0, 2}, {1, 5}})
+
+	for _, threshold := range []time.Duration{0, time.Millisecond} {
+		t.Run(fmt.Sprintf("Threshold=%s", threshold), func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			kv.latency = 5 * time.Millisecond
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			st := cluster.MakeTestingClusterSettings()
+			joinReaderSlowBatchThreshold.Override(&st.SV, threshold)
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: st,
+			}
+
+			var mu syncutil.Mutex
+			var messages []string
+			log.Intercept(context.Background(), func(entry log.Entry) {
+				if strings.Contains(entry.Message, "slow lookup batch") {
+					mu.Lock()
+					messages = append(messages, entry.Message)
+					mu.Unlock()
+				}
+			})
+			defer log.Intercept(context.Background(), nil)
+
+			in := NewRowBuffer(twoIntCols, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+			jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: td}, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if threshold == 0 {
+				if len(messages) != 0 {
+					t.Fatalf("expected no slow batches to be logged, got %q", messages)
+				}
+				return
+			}
+			if len(messages) != 1 {
+				t.Fatalf("expected a slow batch to be logged, got %q", messages)
+			}
+			expected := "slow lookup batch in index primary of table t: 3 lookups (2 distinct keys) took"
+			if !strings.Contains(messages[0], expected) {
+				t.Errorf("expected %q in %q", expected, messages[0])
+			}
+		})
+	}
+}
+
+// TestJoinReaderDeadline verifies that a joinReader stops performing lookups
+// once the deadline of its flow has passed, and reports an error.
+func TestJoinReaderDeadline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var input [][]int
+	for i := 0; i < 3*joinReaderBatchSize; i++ {
+		row := i%99 + 1
+		input = append(input, []int{row / 10, row % 10})
+	}
+
+	td, kv := makeFakeKVTable(t)
+	kv.latency = 50 * time.Millisecond
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	// The deadline passes while the first batch is looked up.
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+		Deadline: timeutil.Now().Add(10 * time.Millisecond),
+	}
+
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+	out := &RowBuffer{}
+	jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: td}, in, &PostProcessSpec{}, out, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	var errs []error
+	for {
+		row, meta := out.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if meta.Err != nil {
+			errs = append(errs, meta.Err)
+		}
+	}
+	if len(errs) != 1 || !testutils.IsError(errs[0], "flow deadline exceeded") {
+		t.Fatalf("expected a deadline error, got %v", errs)
+	}
+	if pgErr, ok := pgerror.GetPGCause(errs[0]); !ok || pgErr.Code != pgerror.CodeQueryCanceledError {
+		t.Errorf("expected error with code %s, got %v", pgerror.CodeQueryCanceledError, errs[0])
+	}
+	if numScans := len(kv.mu.scanSizes); numScans > 1 {
+		t.Errorf("expected at most one lookup batch, got %d", numScans)
+	}
+}
+
+// TestJoinReaderMaxRowBytes verifies that a joinReader fails when a rendered
+// output row is larger than FlowCtx.MaxRowBytes.
+func TestJoinReaderMaxRowBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const maxRowBytes = 2000
+	input := [][]int{{1, 5}, {3, 4}}
+	testCases := []struct {
+		name string
+		post PostProcessSpec
+		// expErr is set if the rows are expected to be too large.
+		expErr bool
+	}{
+		{
+			name: "Projection",
+			post: PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}},
+		},
+		{
+			name: "Render",
+			post: PostProcessSpec{
+				RenderExprs: []Expression{{Expr: "@1"}, {Expr: "repeat(@4, 1000)"}},
+			},
+			expErr: true,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:     evalCtx,
+				Settings:    cluster.MakeTestingClusterSettings(),
+				MaxRowBytes: maxRowBytes,
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: td}, in, &c.post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var numRows int
+			var errs []error
+			for {
+				row, meta := out.Next()
+				if meta.Err != nil {
+					errs = append(errs, meta.Err)
+					continue
+				}
+				if row == nil && meta.Empty() {
+					break
+				}
+				if row != nil {
+					if size := row.MemorySize(); size > maxRowBytes {
+						t.Errorf("row of %d bytes emitted", size)
+					}
+					numRows++
+				}
+			}
+			if !c.expErr {
+				if len(errs) != 0 || numRows != len(input) {
+					t.Fatalf("expected %d rows and no errors, got %d rows and %v", len(input), numRows, errs)
+				}
+				return
+			}
+			if numRows != 0 || len(errs) != 1 {
+				t.Fatalf("expected a single error, got %d rows and %v", numRows, errs)
+			}
+			if !testutils.IsError(errs[0], "exceeds the maximum row size of 2000 bytes") {
+				t.Fatalf("expected a row size error, got %v", errs[0])
+			}
+			if pgErr, ok := pgerror.GetPGCause(errs[0]); !ok || pgErr.Code != pgerror.CodeProgramLimitExceededError {
+				t.Errorf("expected error with code %s, got %v", pgerror.CodeProgramLimitExceededError, errs[0])
+			}
+		})
+	}
+}
+
+// TestJoinReaderAdaptiveBatchSize verifies that the size of the lookup batches
+// grows while their lookups are slow, up to the max batch size.
+func TestJoinReaderAdaptiveBatchSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	kv.latency = 2 * time.Millisecond
+	// Every input row matches a row of the table.
+	var input [][]int
+	for i := 0; i < 1000; i++ {
+		row := i%99 + 1
+		input = append(input, []int{row / 10, row % 10})
+	}
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	// No txn is needed since the lookups are served by kv.
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+		Verbose:  true,
+	}
+
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+	out := &RowBuffer{}
+	spec := JoinReaderSpec{
+		Table:                       td,
+		MinLookupBatchSize:          10,
+		MaxLookupBatchSize:          80,
+		LookupBatchLatencyThreshold: time.Millisecond,
+	}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	var numRows int
+	var stats *JoinReaderStats
+	for {
+		row, meta := out.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if meta.Err != nil {
+			t.Fatal(meta.Err)
+		}
+		if row != nil {
+			numRows++
+		}
+		if meta.JoinReaderStats != nil {
+			stats = meta.JoinReaderStats
+		}
+	}
+	if numRows != len(input) {
+		t.Errorf("expected %d rows, got %d", len(input), numRows)
+	}
+
+	// The batches double in size until they reach the max size, and stay there
+	// until the input runs out.
+	sizes := kv.mu.scanSizes
+	if len(sizes) < 5 || !reflect.DeepEqual(sizes[:4], []int{10, 20, 40, 80}) {
+		t.Fatalf("expected the batch sizes to grow from 10 to 80, got %v", sizes)
+	}
+	for i, size := range sizes[4 : len(sizes)-1] {
+		if size != 80 {
+			t.Errorf("batch %d: expected 80 lookups, got %d", i+4, size)
+		}
+	}
+	if stats == nil {
+		t.Fatalf("no stats reported")
+	}
+	if stats.LookupBatchSize != 80 {
+		t.Errorf("expected a final batch size of 80, got %d", stats.LookupBatchSize)
+	}
+}
+
+// TestJoinReaderPipelinedLookups verifies that a joinReader with pipelined
+// lookups emits the rows of its first batch as soon as its lookups return,
+// without waiting for the lookups of the other batches, and doesn't have more
+// batches in flight than allowed.
+func TestJoinReaderPipelinedLookups(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const batchSize, numBatches, maxInFlight = 5, 8, 3
+	var input [][]int
+	for i := 0; i < batchSize*numBatches; i++ {
+		row := i%99 + 1
+		input = append(input, []int{row / 10, row % 10})
+	}
+	inputRows := genEncDatumRowsInt(input)
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	// No txn is needed since the lookups are served by kv.
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+	spec := JoinReaderSpec{
+		Table:              td,
+		MinLookupBatchSize: batchSize,
+		MaxLookupBatchSize: batchSize,
+		MaxInFlightBatches: maxInFlight,
+	}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+
+	t.Run("FirstBatch", func(t *testing.T) {
+		// Every scan is held back until the test lets it through.
+		kv.gates = make([]chan struct{}, numBatches)
+		for i := range kv.gates {
+			kv.gates[i] = make(chan struct{})
+		}
+		// numPushed is the number of rows pushed so far; firstBatchPushed is
+		// closed once the rows of the first batch have all been pushed.
+		var numPushed int64
+		firstBatchPushed := make(chan struct{})
+		in := &RowChannel{}
+		in.InitWithBufSize(twoIntCols, len(inputRows))
+		out := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{
+			OnPush: func(row sqlbase.EncDatumRow, _ *ProducerMetadata) ConsumerStatus {
+				if row != nil && atomic.AddInt64(&numPushed, 1) == batchSize {
+					close(firstBatchPushed)
+				}
+				return NeedMoreRows
+			},
+		})
+		jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			jr.Run(context.Background(), nil)
+			close(done)
+		}()
+
+		numScans := func() int {
+			kv.mu.Lock()
+			defer kv.mu.Unlock()
+			return len(kv.mu.scanSizes)
+		}
+		// Feed the input one batch at a time, so that the i-th scan is the one of
+		// the i-th batch. No scan returns before the first maxInFlight batches
+		// are all in flight.
+		for i := 0; i < maxInFlight; i++ {
+			for _, row := range inputRows[i*batchSize : (i+1)*batchSize] {
+				in.Push(row, ProducerMetadata{})
+			}
+			testutils.SucceedsSoon(t, func() error {
+				if n := numScans(); n != i+1 {
+					return fmt.Errorf("expected %d scans, got %d", i+1, n)
+				}
+				return nil
+			})
+		}
+		if n := atomic.LoadInt64(&numPushed); n != 0 {
+			t.Fatalf("expected no rows before any lookup returned, got %d", n)
+		}
+
+		// Only let the lookups of the first batch return: its rows are emitted
+		// while the other batches are still in flight.
+		close(kv.gates[0])
+		select {
+		case <-firstBatchPushed:
+		case <-done:
+			t.Fatalf("joinReader done before the rows of the first batch were pushed")
+		}
+		if n := atomic.LoadInt64(&numPushed); n != batchSize {
+			t.Errorf("expected the %d rows of the first batch only, got %d rows", batchSize, n)
+		}
+
+		for _, gate := range kv.gates[1:] {
+			close(gate)
+		}
+		for _, row := range inputRows[maxInFlight*batchSize:] {
+			in.Push(row, ProducerMetadata{})
+		}
+		in.ProducerDone()
+		<-done
+
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		// The rows are emitted in the order of the input, as without pipelining.
+		expected := inputRows.String(twoIntCols)
+		if res := out.GetRowsNoMeta(t).String(twoIntCols); res != expected {
+			t.Errorf("expected:\n   %s\ngot:\n   %s", expected, res)
+		}
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		if kv.mu.maxInFlight > maxInFlight {
+			t.Errorf("expected at most %d lookups in flight, got %d", maxInFlight, kv.mu.maxInFlight)
+		}
+		if len(kv.mu.scanSizes) != numBatches {
+			t.Errorf("expected %d lookup batches, got %v", numBatches, kv.mu.scanSizes)
+		}
+	})
+}
+
+func TestLookupBatchSizer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	b, err := makeLookupBatchSizer(&JoinReaderSpec{
+		MinLookupBatchSize:          4,
+		MaxLookupBatchSize:          20,
+		LookupBatchLatencyThreshold: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		n           int
+		latency     time.Duration
+		memPressure bool
+		expected    int
+	}{
+		// Fast lookups don't make the batches grow.
+		{n: 4, latency: time.Millisecond, expected: 4},
+		{n: 4, latency: time.Second, expected: 8},
+		// Nor do partial batches.
+		{n: 5, latency: time.Second, expected: 8},
+		{n: 8, latency: time.Second, expected: 16},
+		{n: 16, latency: time.Second, expected: 20},
+		{n: 20, latency: time.Second, expected: 20},
+		// Memory pressure makes the batches smaller, down to the min size.
+		{n: 20, latency: time.Second, memPressure: true, expected: 10},
+		{n: 3, memPressure: true, expected: 5},
+		{n: 2, memPressure: true, expected: 4},
+	}
+	for i, step := range steps {
+		b.update(step.n, step.latency, step.memPressure)
+		if b.size() != step.expected {
+			t.Fatalf("%d: expected size %d, got %d", i, step.expected, b.size())
+		}
+	}
+
+	if _, err := makeLookupBatchSizer(&JoinReaderSpec{
+		MinLookupBatchSize: 10, MaxLookupBatchSize: 5,
+	}); !testutils.IsError(err, "min lookup batch size 10 is greater than max") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+}
+
+// TestJoinReaderMatchStats verifies that a verbose joinReader reports how many
+// input rows matched a table row and how many didn't.
+func TestJoinReaderMatchStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	createTestTable(t, sqlDB, "")
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	// (0,0), (10,1) and (12,3) have no match.
+	input := [][]int{{0, 2}, {0, 0}, {1, 0}, {10, 1}, {9, 9}, {12, 3}, {3, 3}}
+	expected := JoinReaderStats{
+		InputRows:          7,
+		MatchedInputRows:   4,
+		UnmatchedInputRows: 3,
+		LookupBatchSize:    joinReaderBatchSize,
+		KVReads:            7,
+	}
+
+	testCases := []struct {
+		name string
+		spec JoinReaderSpec
+	}{
+		{name: "Inner", spec: JoinReaderSpec{Table: *td}},
+		{name: "InnerParallel", spec: JoinReaderSpec{Table: *td, Parallelism: 4}},
+		{name: "Semi", spec: JoinReaderSpec{Table: *td, Type: JoinType_LEFT_SEMI}},
+		{name: "Anti", spec: JoinReaderSpec{Table: *td, Type: JoinType_LEFT_ANTI}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: s.ClusterSettings(),
+				txn:      newTestTxn(s),
+				Verbose:  true,
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			jr, err := newJoinReader(&flowCtx, &c.spec, in, &PostProcessSpec{}, out, nil /* kv */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var stats *JoinReaderStats
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if meta.JoinReaderStats != nil {
+					if stats != nil {
+						t.Fatalf("stats reported more than once")
+					}
+					stats = meta.JoinReaderStats
+				}
+			}
+			if stats == nil {
+				t.Fatalf("no stats reported")
+			}
+			if *stats != expected {
+				t.Fatalf("expected stats %+v, got %+v", expected, *stats)
+			}
+		})
+	}
+}
+
+// TestJoinReaderSkipDecodeErrors verifies that, with SkipDecodeErrors, a row
+// that fails to decode is reported as non-fatal metadata and the other rows are
+// still emitted, also when the lookups are performed by concurrent scans.
+func TestJoinReaderSkipDecodeErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	createTestTable(t, sqlDB, "")
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	// Corrupt the value of the row (1, 5).
+	key := roachpb.Key(sqlbase.MakeIndexKeyPrefix(td, td.PrimaryIndex.ID))
+	key = encoding.EncodeVarintAscending(key, 1)
+	key = encoding.EncodeVarintAscending(key, 5)
+	key = keys.MakeFamilyKey(key, 0)
+	var badValue roachpb.Value
+	badValue.SetTuple([]byte{0xff})
+	if err := kvDB.Put(context.TODO(), key, &badValue); err != nil {
+		t.Fatal(err)
+	}
+
+	input := [][]int{{0, 2}, {1, 5}, {2, 2}}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 2}}
+
+	// The pipelined cases use batches of one row, so that the lookups of
+	// several batches (and their retries) are in flight at once.
+	testCases := []struct {
+		skip        bool
+		parallelism uint32
+		inFlight    uint32
+	}{
+		{skip: false},
+		{skip: true},
+		{skip: true, parallelism: 3},
+		{skip: true, inFlight: 3},
+		{skip: true, parallelism: 3, inFlight: 3},
+	}
+	for _, c := range testCases {
+		skip := c.skip
+		name := fmt.Sprintf("SkipDecodeErrors=%t/Parallelism=%d/InFlight=%d", skip, c.parallelism, c.inFlight)
+		t.Run(name, func(t *testing.T) {
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: s.ClusterSettings(),
+				txn:      newTestTxn(s),
+			}
+
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{
+				Table:              *td,
+				SkipDecodeErrors:   skip,
+				Parallelism:        c.parallelism,
+				MaxInFlightBatches: c.inFlight,
+				MaxLookupRetries:   3,
+			}
+			if c.inFlight > 0 {
+				spec.MinLookupBatchSize, spec.MaxLookupBatchSize = 1, 1
+			}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, nil /* kv */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var res sqlbase.EncDatumRows
+			var fatalErr error
+			var decodeErrs []error
+			var numSkipped uint64
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if row != nil {
+					res = append(res, row)
+				}
+				if meta.Err != nil {
+					fatalErr = meta.Err
+				}
+				if meta.DecodeErr != nil {
+					// The decoding errors of a batch are pushed before its rows,
+					// after those of the previous batches: with batches of one
+					// row, the row (0, 2) is emitted first.
+					expRows := 0
+					if c.inFlight > 0 {
+						expRows = 1
+					}
+					if len(res) != expRows {
+						t.Errorf("decoding error pushed after %d rows, expected %d", len(res), expRows)
+					}
+					decodeErrs = append(decodeErrs, meta.DecodeErr)
+				}
+				numSkipped += meta.NumSkippedRows
+			}
+
+			if !skip {
+				if fatalErr == nil {
+					t.Fatal("expected the decoding error to fail the joinReader")
+				}
+				return
+			}
+			if fatalErr != nil {
+				t.Fatal(fatalErr)
+			}
+			if len(decodeErrs) != 1 {
+				t.Fatalf("expected 1 decoding error, got %v", decodeErrs)
+			}
+			if numSkipped != 1 {
+				t.Fatalf("expected 1 skipped row, got %d", numSkipped)
+			}
+			if result, expected := res.String(threeIntCols), "[[0 2 2] [2 2 4]]"; result != expected {
+				t.Errorf("invalid results: %s, expected %s", result, expected)
+			}
+		})
+	}
+}
+
+// TestJoinReaderInterleaved verifies that a joinReader can look up the rows of
+// an interleaved table by the primary key of its parent, returning only the
+// rows of that table.
+func TestJoinReaderInterleaved(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "parent",
+		"pid INT PRIMARY KEY, v INT",
+		5,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+	// Each child table has rows for all the parent rows.
+	sqlutils.CreateTableInterleaved(t, sqlDB, "child1",
+		"pid INT, id INT, v INT, PRIMARY KEY (pid, id)",
+		"parent (pid)",
+		15,
+		sqlutils.ToRowFn(sqlutils.RowModuloShiftedFn(5), sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+	sqlutils.CreateTableInterleaved(t, sqlDB, "child2",
+		"pid INT, id INT, s STRING, PRIMARY KEY (pid, id)",
+		"parent (pid)",
+		10,
+		sqlutils.ToRowFn(sqlutils.RowModuloShiftedFn(5), sqlutils.RowIdxFn, sqlutils.RowEnglishFn))
+
+	parentDesc := sqlbase.GetTableDescriptor(kvDB, "test", "parent")
+	childDesc := sqlbase.GetTableDescriptor(kvDB, "test", "child1")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	in := NewRowBuffer(oneIntCol, genEncDatumRowsInt([][]int{{2}, {4}}), RowBufferArgs{})
+	out := &RowBuffer{}
+	spec := JoinReaderSpec{Table: *childDesc, Interleaved: true}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !in.Done {
+		t.Fatal("joinReader didn't consume all the rows")
+	}
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	res := out.GetRowsNoMeta(t)
+	expected := "[[2 2 2] [2 7 7] [2 12 12] [4 4 4] [4 9 9] [4 14 14]]"
+	if result := res.String(threeIntCols); result != expected {
+		t.Errorf("invalid results: %s, expected %s", result, expected)
+	}
+
+	// Interleaved lookups are only possible into interleaved tables.
+	spec = JoinReaderSpec{Table: *parentDesc, Interleaved: true}
+	in = NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
+	if _, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, nil /* kv */); !testutils.IsError(err, "not interleaved") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+// TestJoinReaderSemiAnti verifies that semi and anti joins emit each input
+// row at most once, depending on whether the lookup has a match.
+func TestJoinReaderSemiAnti(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	// The t table has the same contents as in TestJoinReader: (a, b) takes all
+	// the values between (0, 1) and (9, 9).
+	createTestTable(t, sqlDB, "INDEX bs (b,s)")
+	sqlutils.CreateTable(t, sqlDB, "parent",
+		"pid INT PRIMARY KEY, v INT",
+		5,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+	sqlutils.CreateTableInterleaved(t, sqlDB, "child",
+		"pid INT, id INT, v INT, PRIMARY KEY (pid, id)",
+		"parent (pid)",
+		6,
+		sqlutils.ToRowFn(sqlutils.RowModuloShiftedFn(3), sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+	childDesc := sqlbase.GetTableDescriptor(kvDB, "test", "child")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	testCases := []struct {
+		name       string
+		spec       JoinReaderSpec
+		inputTypes []sqlbase.ColumnType
+		input      [][]int
+		expected   string
+	}{
+		{
+			name:       "Semi",
+			spec:       JoinReaderSpec{Table: *td, Type: JoinType_LEFT_SEMI},
+			inputTypes: threeIntCols,
+			input:      [][]int{{0, 2, 100}, {10, 1, 101}, {9, 9, 102}, {0, 0, 103}, {3, 3, 104}},
+			expected:   "[[0 2 100] [9 9 102] [3 3 104]]",
+		},
+		{
+			name:       "Anti",
+			spec:       JoinReaderSpec{Table: *td, Type: JoinType_LEFT_ANTI},
+			inputTypes: threeIntCols,
+			input:      [][]int{{0, 2, 100}, {10, 1, 101}, {9, 9, 102}, {0, 0, 103}, {3, 3, 104}},
+			expected:   "[[10 1 101] [0 0 103]]",
+		},
+		{
+			// Parents 1, 2 and 3 have two children each; parents 4 and 5 have none.
+			name:       "InterleavedSemi",
+			spec:       JoinReaderSpec{Table: *childDesc, Interleaved: true, Type: JoinType_LEFT_SEMI},
+			inputTypes: oneIntCol,
+			input:      [][]int{{1}, {4}, {3}, {7}},
+			expected:   "[[1] [3]]",
+		},
+		{
+			name:       "InterleavedAnti",
+			spec:       JoinReaderSpec{Table: *childDesc, Interleaved: true, Type: JoinType_LEFT_ANTI},
+			inputTypes: oneIntCol,
+			input:      [][]int{{1}, {4}, {3}, {7}},
+			expected:   "[[4] [7]]",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			in := NewRowBuffer(c.inputTypes, genEncDatumRowsInt(c.input), RowBufferArgs{})
+			out := &RowBuffer{}
+			// Only the input columns are checked; the (NULL) table columns of anti
+			// joins are checked by TestJoinReaderAntiJoinNulls.
+			post := PostProcessSpec{Projection: true}
+			for i := range c.inputTypes {
+				post.OutputColumns = append(post.OutputColumns, uint32(i))
+			}
+			jr, err := newJoinReader(&flowCtx, &c.spec, in, &post, out, nil /* kv */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !in.Done {
+				t.Fatal("joinReader didn't consume all the rows")
+			}
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			res := out.GetRowsNoMeta(t)
+			if result := res.String(c.inputTypes); result != c.expected {
+				t.Errorf("invalid results: %s, expected %s", result, c.expected)
+			}
+		})
+	}
+}
+
+// TestJoinReaderAntiJoinNulls verifies that the table columns of the rows
+// emitted by anti joins are properly typed NULLs.
+func TestJoinReaderAntiJoinNulls(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	// (0, 0) and (10, 1) don't exist.
+	input := genEncDatumRowsInt([][]int{{1, 5}, {0, 0}, {10, 1}, {9, 9}})
+	in := NewRowBuffer(twoIntCols, input, RowBufferArgs{})
+	out := &RowBuffer{}
+	// The output columns are the input columns and the s and sum columns of the
+	// table.
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 5, 4}}
+	spec := JoinReaderSpec{Table: td, Type: JoinType_LEFT_ANTI}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outTypes := []sqlbase.ColumnType{intType, intType, strType, intType}
+	if res := jr.OutputTypes(); !reflect.DeepEqual(res, outTypes) {
+		t.Fatalf("expected output types %v, got %v", outTypes, res)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	rows := out.GetRowsNoMeta(t)
+	expected := "[[0 0 NULL NULL] [10 1 NULL NULL]]"
+	if res := rows.String(outTypes); res != expected {
+		t.Fatalf("expected %s, got %s", expected, res)
+	}
+	// The rows can be encoded, e.g. to be sent to another node.
+	var alloc sqlbase.DatumAlloc
+	for _, row := range rows {
+		for i := range row {
+			if _, err := row[i].Encode(
+				&outTypes[i], &alloc, sqlbase.DatumEncoding_VALUE, nil, /* appendTo */
+			); err != nil {
+				t.Fatalf("couldn't encode column %d of %s: %v", i, row.String(outTypes), err)
+			}
+		}
+	}
+}
+
+// TestJoinReaderSemiAntiMatchMode verifies that semi and anti joins stop
+// fetching the matches of a lookup at the first one, unless configured to read
+// all the matches of a batch at once.
+func TestJoinReaderSemiAntiMatchMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The lookups are into the index on b, where each value but 0 has 10
+	// entries.
+	input := [][]int{{5}, {10}, {2}}
+	testCases := []struct {
+		joinType  JoinType
+		matchMode JoinReaderSpec_MatchMode
+		expected  string
+		numScans  int
+		numKVs    int64
+	}{
+		{JoinType_LEFT_SEMI, JoinReaderSpec_AUTO_MATCH, "[[5] [2]]", 3, 2},
+		{JoinType_LEFT_ANTI, JoinReaderSpec_AUTO_MATCH, "[[10]]", 3, 2},
+		{JoinType_LEFT_SEMI, JoinReaderSpec_FIRST_MATCH, "[[5] [2]]", 3, 2},
+		{JoinType_LEFT_SEMI, JoinReaderSpec_ALL_MATCHES, "[[5] [2]]", 1, 20},
+		{JoinType_LEFT_ANTI, JoinReaderSpec_ALL_MATCHES, "[[10]]", 1, 20},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%s/%s", c.joinType, c.matchMode), func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+
+			in := NewRowBuffer(oneIntCol, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			spec := JoinReaderSpec{Table: td, IndexIdx: 2, Type: c.joinType, MatchMode: c.matchMode}
+			post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0}}
+			jr, err := newJoinReader(&flowCtx, &spec, in, &post, out, kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(oneIntCol); res != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, res)
+			}
+			if numScans := len(kv.mu.scanSizes); numScans != c.numScans {
+				t.Errorf("expected %d scans, got %d", c.numScans, numScans)
+			}
+			if numKVs := atomic.LoadInt64(&kv.numKVs); numKVs != c.numKVs {
+				t.Errorf("expected %d KVs to be fetched, got %d", c.numKVs, numKVs)
+			}
+		})
+	}
+
+	t.Run("InnerJoin", func(t *testing.T) {
+		td, kv := makeFakeKVTable(t)
+		evalCtx := tree.MakeTestingEvalContext()
+		defer evalCtx.Stop(context.Background())
+		flowCtx := FlowCtx{
+			EvalCtx:  evalCtx,
+			Settings: cluster.MakeTestingClusterSettings(),
+		}
+		in := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
+		spec := JoinReaderSpec{Table: td, IndexIdx: 2, MatchMode: JoinReaderSpec_FIRST_MATCH}
+		if _, err := newJoinReader(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{}, kv,
+		); !testutils.IsError(err, "match mode FIRST_MATCH only applies to semi and anti joins") {
+			t.Fatalf("expected error, got %v", err)
+		}
+	})
+}
+
+// TestJoinReaderParallel verifies that a joinReader performing concurrent
+// lookups over a table split into multiple ranges emits the results in the
+// order of the input rows.
+func TestJoinReaderParallel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	const numRows = 300
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"k INT PRIMARY KEY, v INT",
+		numRows,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+	sqlutils.MakeSQLRunner(sqlDB).Exec(t, "ALTER TABLE test.t SPLIT AT VALUES (100), (200)")
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	// Look up the keys in decreasing order, spanning several batches.
+	var input, expected [][]int
+	for i := numRows; i > 0; i-- {
+		input = append(input, []int{i})
+		expected = append(expected, []int{i, i})
+	}
+	in := NewRowBuffer(oneIntCol, genEncDatumRowsInt(input), RowBufferArgs{})
+	out := &RowBuffer{}
+	spec := JoinReaderSpec{Table: *td, Parallelism: 4}
+	jr, err := newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	res := out.GetRowsNoMeta(t)
+	if result, exp := res.String(twoIntCols), genEncDatumRowsInt(expected).String(twoIntCols); result != exp {
+		t.Errorf("invalid results: %s, expected %s", result, exp)
+	}
+}
+
+// TestJoinReaderCleanup verifies that joinReaders, including those performing
+// parallel lookups, don't leak goroutines or memory, whether or not their
+// consumer needs all their rows.
+func TestJoinReaderCleanup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var input [][]int
+	for i := 0; i < 3*joinReaderBatchSize; i++ {
+		row := i%99 + 1
+		input = append(input, []int{row / 10, row % 10})
+	}
+	for _, parallelism := range []uint32{1, 4} {
+		t.Run(fmt.Sprintf("Parallelism=%d", parallelism), func(t *testing.T) {
+			td, kv := makeFakeKVTable(t)
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+			}
+			spec := JoinReaderSpec{Table: td, Parallelism: parallelism}
+			checkProcessorCleanup(t, &flowCtx, func(out RowReceiver) (Processor, error) {
+				in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+				return newJoinReader(&flowCtx, &spec, in, &PostProcessSpec{}, out, kv)
+			})
+		})
+	}
+}
+
+// TestJoinReaderDrain tests various scenarios in which a joinReader's consumer
+// is closed.
+func TestJoinReaderDrain(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(
+		t,
+		sqlDB,
+		"t",
+		"a INT, PRIMARY KEY (a)",
+		1, /* numRows */
+		sqlutils.ToRowFn(sqlutils.RowIdxFn),
+	)
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	ctx := context.Background()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	txn := newTestTxn(s)
+	// Read at a fixed (historical) timestamp; draining must not depend on the
+	// read timestamp.
+	txn.SetFixedTimestamp(ctx, s.Clock().Now())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      txn,
+	}
+
+	encRow := make(sqlbase.EncDatumRow, 1)
+	encRow[0] = sqlbase.DatumToEncDatum(intType, tree.NewDInt(1))
+
+	// ConsumerClosed verifies that when a joinReader's consumer is closed, the
+	// joinReader finishes gracefully.
+	t.Run("ConsumerClosed", func(t *testing.T) {
+		in := NewRowBuffer(oneIntCol, sqlbase.EncDatumRows{encRow}, RowBufferArgs{})
+
+		out := &RowBuffer{}
+		out.ConsumerClosed()
+		jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out, nil /* kv */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jr.Run(ctx, nil)
+	})
+
+	// ConsumerDone verifies that the producer drains properly by checking that
+	// metadata coming from the producer is still read when ConsumerDone is
+	// called on the consumer.
+	t.Run("ConsumerDone", func(t *testing.T) {
+		expectedMetaErr := errors.New("dummy")
+		in := NewLimitedRowSource(oneIntCol, encRow, 1 /* numRows */, ProducerMetadata{Err: expectedMetaErr})
+
+		out := &RowBuffer{}
+		out.ConsumerDone()
+		jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out, nil /* kv */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jr.Run(ctx, nil)
+		row, meta := out.Next()
+		if row != nil {
+			t.Fatalf("row was pushed unexpectedly: %s", row.String(oneIntCol))
+		}
+		if meta.Err != expectedMetaErr {
+			t.Fatalf("unexpected error in metadata: %v", meta.Err)
+		}
+		if in.ConsumerStatus != DrainRequested {
+			t.Fatalf("input not drained")
+		}
+	})
+
+	// DrainAfterFirstRow verifies that when the consumer requests draining after
+	// the first output row, the joinReader doesn't perform any more lookups and
+	// forwards the input's metadata.
+	t.Run("DrainAfterFirstRow", func(t *testing.T) {
+		expectedMetaErr := errors.New("dummy")
+		in := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
+		// Enough rows for several lookup batches.
+		for i := 0; i < 3*joinReaderBatchSize; i++ {
+			in.Push(encRow, ProducerMetadata{})
+		}
+		in.Push(nil /* row */, ProducerMetadata{Err: expectedMetaErr})
+
+		numRows := 0
+		out := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{
+			OnPush: func(row sqlbase.EncDatumRow, _ *ProducerMetadata) ConsumerStatus {
+				if row != nil {
+					numRows++
+				}
+				return DrainRequested
+			},
+		})
+		jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out, nil /* kv */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jr.Run(ctx, nil)
+
+		if numRows != 1 {
+			t.Fatalf("expected a single row to be pushed, got %d", numRows)
+		}
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		if !in.Done || in.ConsumerStatus != DrainRequested {
+			t.Fatalf("input not drained")
+		}
+		// The RowBuffer only accumulates metadata once draining was requested.
+		row, meta := out.Next()
+		if row != nil || meta.Err != expectedMetaErr {
+			t.Fatalf("expected the input's metadata, got row %v meta %+v", row, meta)
+		}
+	})
+}
+
+// TestJoinReaderHistoricalRead verifies that the joinReader reads at the
+// timestamp of the flow's transaction, so that AS OF SYSTEM TIME queries see
+// older values.
+func TestJoinReaderHistoricalRead(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Record the timestamps of the scans of the table's primary index, once
+	// prefix is set.
+	var lookups struct {
+		syncutil.Mutex
+		prefix     roachpb.Key
+		timestamps []hlc.Timestamp
+	}
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{Store: &storage.StoreTestingKnobs{
+			EvalKnobs: batcheval.TestingKnobs{
+				TestingEvalFilter: func(filterArgs storagebase.FilterArgs) *roachpb.Error {
+					scanReq, ok := filterArgs.Req.(*roachpb.ScanRequest)
+					if !ok {
+						return nil
+					}
+					lookups.Lock()
+					defer lookups.Unlock()
+					if lookups.prefix != nil && bytes.HasPrefix(scanReq.Key, lookups.prefix) {
+						lookups.timestamps = append(lookups.timestamps, filterArgs.Hdr.Timestamp)
+					}
+					return nil
+				},
+			},
+		}},
+	})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT, b INT, PRIMARY KEY (a)",
+		1, /* numRows */
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	// Remember the time at which b = 1, then update the row.
+	historicalTS := s.Clock().Now()
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, "UPDATE test.t SET b = 100 WHERE a = 1")
+
+	ctx := context.Background()
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	txn := newTestTxn(s)
+	txn.SetFixedTimestamp(ctx, historicalTS)
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      txn,
+	}
+	if ts := flowCtx.readTimestamp(); ts != historicalTS {
+		t.Fatalf("expected flow read timestamp %s, got %s", historicalTS, ts)
+	}
+
+	in := NewRowBuffer(oneIntCol, genEncDatumRowsInt([][]int{{1}}), RowBufferArgs{})
+	out := &RowBuffer{}
+	jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// For historical queries (AS OF SYSTEM TIME), the gateway fixes the
+	// timestamp of the flow's transaction, and the lookups are evaluated at
+	// that timestamp.
+	if ts := jr.readTimestamp(); ts != historicalTS {
+		t.Fatalf("expected read timestamp %s, got %s", historicalTS, ts)
+	}
+	// Only record the scans of the joinReader, not those of the UPDATE.
+	lookups.Lock()
+	lookups.prefix = roachpb.Key(sqlbase.MakeIndexKeyPrefix(td, td.PrimaryIndex.ID))
+	lookups.Unlock()
+	jr.Run(ctx, nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	res := out.GetRowsNoMeta(t)
+	if result, expected := res.String(twoIntCols), "[[1 1]]"; result != expected {
+		t.Errorf("invalid results: %s, expected %s", result, expected)
+	}
+
+	// The lookup was sent at the historical timestamp.
+	lookups.Lock()
+	defer lookups.Unlock()
+	if len(lookups.timestamps) == 0 {
+		t.Fatal("no lookup found")
+	}
+	for _, ts := range lookups.timestamps {
+		if ts != historicalTS {
+			t.Errorf("expected lookup at %s, got %s", historicalTS, ts)
+		}
+	}
+}
+
+// TestJoinReaderBoundedStaleness verifies that, under a bounded-staleness
+// read, the joinReader reads at the newest timestamp within the staleness
+// window that is at least the maximum clock offset old, but not before the
+// table was last modified, and reports that timestamp. Such reads aren't
+// allowed in a transaction that has written.
+func TestJoinReaderBoundedStaleness(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT, b INT, PRIMARY KEY (a)",
+		1, /* numRows */
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	// b = 1 as of staleTS, and b = 100 as of txnTS, the timestamp of the flow's
+	// transaction.
+	staleTS := s.Clock().Now()
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, "UPDATE test.t SET b = 100 WHERE a = 1")
+	txnTS := s.Clock().Now()
+
+	sinceStale := time.Duration(txnTS.WallTime - staleTS.WallTime)
+	testCases := []struct {
+		name         string
+		maxStaleness time.Duration
+		maxOffset    time.Duration
+		// written is set if the flow's transaction has written, and explicit
+		// if it isn't implicit.
+		written  bool
+		explicit bool
+		// expTS is the expected read timestamp, reported only for
+		// bounded-staleness reads.
+		expTS   hlc.Timestamp
+		expRows string
+		expErr  string
+	}{
+		{
+			name:    "NoStaleness",
+			expRows: "[[1 100]]",
+		},
+		{
+			// Without clock offsets, the newest timestamp is the transaction's.
+			name:         "NoOffset",
+			maxStaleness: time.Hour,
+			expTS:        txnTS,
+			expRows:      "[[1 100]]",
+		},
+		{
+			name:         "Offset",
+			maxStaleness: time.Hour,
+			maxOffset:    sinceStale,
+			expTS:        txnTS.Add(-sinceStale.Nanoseconds(), 0),
+			expRows:      "[[1 1]]",
+		},
+		{
+			// The window starts at (about) staleTS.
+			name:         "Window",
+			maxStaleness: sinceStale,
+			maxOffset:    time.Hour,
+			expTS:        txnTS.Add(-sinceStale.Nanoseconds(), 0),
+			expRows:      "[[1 1]]",
+		},
+		{
+			// The timestamp picked is before the table was created, and the row
+			// was inserted after that.
+			name:         "TableModified",
+			maxStaleness: 2 * time.Hour,
+			maxOffset:    time.Hour,
+			expTS:        td.ModificationTime,
+			expRows:      "[]",
+		},
+		{
+			name:         "Written",
+			maxStaleness: time.Hour,
+			written:      true,
+			expErr:       "bounded-staleness reads not supported in a transaction that has written",
+		},
+		{
+			name:         "Explicit",
+			maxStaleness: time.Hour,
+			explicit:     true,
+			expErr:       "bounded-staleness reads not supported in an explicit transaction",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			evalCtx := tree.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			txn := newTestTxn(s)
+			txn.SetFixedTimestamp(ctx, txnTS)
+			txn.Proto().Writing = c.written
+			flowCtx := FlowCtx{
+				EvalCtx:      evalCtx,
+				Settings:     s.ClusterSettings(),
+				rpcCtx:       &rpc.Context{LocalClock: hlc.NewClock(hlc.UnixNano, c.maxOffset)},
+				txn:          txn,
+				MaxStaleness: c.maxStaleness,
+				ImplicitTxn:  !c.explicit,
+			}
+
+			in := NewRowBuffer(oneIntCol, genEncDatumRowsInt([][]int{{1}}), RowBufferArgs{})
+			out := &RowBuffer{}
+			jr, err := newJoinReader(
+				&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out, nil, /* kv */
+			)
+			if c.expErr != "" {
+				if !testutils.IsError(err, c.expErr) {
+					t.Fatalf("expected error %q, got %v", c.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			jr.Run(ctx, nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var rows sqlbase.EncDatumRows
+			var readTS *hlc.Timestamp
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if meta.ReadTimestamp != nil {
+					readTS = meta.ReadTimestamp
+				}
+				if row != nil {
+					rows = append(rows, row)
+				}
+			}
+			if res := rows.String(twoIntCols); res != c.expRows {
+				t.Errorf("expected rows %s, got %s", c.expRows, res)
+			}
+			if c.maxStaleness == 0 {
+				if readTS != nil {
+					t.Errorf("expected no read timestamp to be reported, got %s", readTS)
+				}
+				return
+			}
+			if readTS == nil || *readTS != c.expTS {
+				t.Fatalf("expected read timestamp %s, got %v", c.expTS, readTS)
+			}
+			if readTS.Less(txnTS.Add(-c.maxStaleness.Nanoseconds(), 0)) || txnTS.Less(*readTS) {
+				t.Errorf("read timestamp %s outside of the staleness window of %s before %s",
+					readTS, c.maxStaleness, txnTS)
+			}
+		})
+	}
+}
+
+// TestJoinReaderReadConflict verifies that the lookups of a joinReader are
+// performed as reads of the flow's transaction, so that a transaction with a
+// lower timestamp that later writes one of the keys that were read is pushed
+// and detects the conflict when committing.
+func TestJoinReaderReadConflict(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT, b INT, PRIMARY KEY (a)",
+		3, /* numRows */
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowIdxFn))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	ctx := context.Background()
+	// The writer's timestamp is lower than the reader's.
+	writer := client.NewTxn(kvDB, s.NodeID())
+	reader := newTestTxn(s)
+	if !writer.OrigTimestamp().Less(reader.OrigTimestamp()) {
+		t.Fatalf("expected writer timestamp %s to be lower than reader timestamp %s",
+			writer.OrigTimestamp(), reader.OrigTimestamp())
+	}
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      reader,
+	}
+	in := NewRowBuffer(oneIntCol, genEncDatumRowsInt([][]int{{2}}), RowBufferArgs{})
+	out := &RowBuffer{}
+	jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &PostProcessSpec{}, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(ctx, nil)
+	res := out.GetRowsNoMeta(t)
+	if result, expected := res.String(twoIntCols), "[[2 2]]"; result != expected {
+		t.Fatalf("invalid results: %s, expected %s", result, expected)
+	}
+
+	// Overwrite the row that was read. The write is pushed above the reader's
+	// timestamp, so the writer can't commit at its original timestamp.
+	key := roachpb.Key(sqlbase.MakeIndexKeyPrefix(td, td.PrimaryIndex.ID))
+	key = encoding.EncodeVarintAscending(key, 2)
+	key = keys.MakeFamilyKey(key, 0)
+	if err := writer.Put(ctx, key, "conflicting value"); err != nil {
+		t.Fatal(err)
+	}
+	if ts := writer.Proto().Timestamp; !reader.OrigTimestamp().Less(ts) {
+		t.Fatalf("expected the write to be pushed above %s, got %s", reader.OrigTimestamp(), ts)
+	}
+	err = writer.Commit(ctx)
+	if _, ok := err.(*roachpb.HandledRetryableTxnError); !ok {
+		t.Fatalf("expected the writer to fail to commit with a retryable error, got %v", err)
+	}
+}
+
+// BenchmarkJoinReader looks up all the rows of a table, reusing the output rows
+// when the output doesn't retain them ("ReuseRows=true") and allocating fresh
+// rows otherwise.
+func BenchmarkJoinReader(b *testing.B) {
+	s, sqlDB, kvDB := serverutils.StartServer(b, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.Background())
+
+	const numRows = 10000
+	sqlutils.CreateTable(
+		b, sqlDB, "t",
+		"k INT PRIMARY KEY, v INT",
+		numRows,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowModuloFn(42)),
+	)
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+		nodeID:   s.NodeID(),
+	}
+
+	inputRows := make(sqlbase.EncDatumRows, numRows)
+	for i := range inputRows {
+		inputRows[i] = sqlbase.EncDatumRow{intEncDatum(i + 1)}
+	}
+	input := NewRepeatableRowSource(oneIntCol, inputRows)
+	spec := JoinReaderSpec{Table: *tableDesc}
+	post := PostProcessSpec{}
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ReuseRows=%t", reuse), func(b *testing.B) {
+			var out RowReceiver = &RowDisposer{}
+			if !reuse {
+				// Hide the RowCopyingReceiver implementation.
+				out = struct{ RowReceiver }{out}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				jr, err := newJoinReader(&flowCtx, &spec, input, &post, out, nil /* kv */)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if jr.out.reuseOutRow != reuse {
+					b.Fatalf("expected output row reuse to be %t", reuse)
+				}
+				jr.Run(context.Background(), nil)
+				input.Reset()
+			}
+		})
+	}
+}
+
+// BenchmarkJoinReaderWideRender measures the allocations of a joinReader
+// rendering wide output rows, with and without building them in a buffer
+// reused across rows.
+func BenchmarkJoinReaderWideRender(b *testing.B) {
+	s, sqlDB, kvDB := serverutils.StartServer(b, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.Background())
+
+	const numRows = 1000
+	const numRenders = 100
+	sqlutils.CreateTable(
+		b, sqlDB, "t",
+		"k INT PRIMARY KEY, v INT",
+		numRows,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowModuloFn(42)),
+	)
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+		nodeID:   s.NodeID(),
+	}
+
+	inputRows := make(sqlbase.EncDatumRows, numRows)
+	for i := range inputRows {
+		inputRows[i] = sqlbase.EncDatumRow{intEncDatum(i + 1)}
+	}
+	input := NewRepeatableRowSource(oneIntCol, inputRows)
+	spec := JoinReaderSpec{Table: *tableDesc}
+	var post PostProcessSpec
+	for i := 0; i < numRenders; i++ {
+		post.RenderExprs = append(post.RenderExprs, Expression{Expr: fmt.Sprintf("@%d", i%2+1)})
+	}
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ReuseRows=%t", reuse), func(b *testing.B) {
+			var out RowReceiver = &RowDisposer{}
+			if !reuse {
+				// Hide the RowCopyingReceiver implementation.
+				out = struct{ RowReceiver }{out}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				jr, err := newJoinReader(&flowCtx, &spec, input, &post, out, nil /* kv */)
+				if err != nil {
+					b.Fatal(err)
+				}
+				jr.Run(context.Background(), nil)
+				input.Reset()
+			}
+		})
+	}
+}
+
+// BenchmarkJoinReaderParallel looks up all the rows of a table split into
+// multiple ranges, with various numbers of concurrent scans.
+func BenchmarkJoinReaderParallel(b *testing.B) {
+	s, sqlDB, kvDB := serverutils.StartServer(b, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.Background())
+
+	const numRows = 10000
+	const numRanges = 10
+	sqlutils.CreateTable(
+		b, sqlDB, "t",
+		"k INT PRIMARY KEY, v INT",
+		numRows,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowModuloFn(42)),
+	)
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	for i := 1; i < numRanges; i++ {
+		r.Exec(b, fmt.Sprintf("ALTER TABLE test.t SPLIT AT VALUES (%d)", i*numRows/numRanges))
+	}
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+		nodeID:   s.NodeID(),
+	}
+
+	inputRows := make(sqlbase.EncDatumRows, numRows)
+	for i := range inputRows {
+		inputRows[i] = sqlbase.EncDatumRow{intEncDatum(i + 1)}
+	}
+	input := NewRepeatableRowSource(oneIntCol, inputRows)
+	post := PostProcessSpec{}
+
+	for _, parallelism := range []uint32{1, 4, 16} {
+		b.Run(fmt.Sprintf("Parallelism=%d", parallelism), func(b *testing.B) {
+			spec := JoinReaderSpec{Table: *tableDesc, Parallelism: parallelism}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				jr, err := newJoinReader(&flowCtx, &spec, input, &post, &RowDisposer{}, nil /* kv */)
+				if err != nil {
+					b.Fatal(err)
+				}
+				jr.Run(context.Background(), nil)
+				input.Reset()
+			}
+		})
+	}
+}
+
+// BenchmarkJoinReaderLookupCache looks up keys following a Zipf distribution,
+// where a few keys account for most of the lookups, with various lookup cache
+// sizes.
+func BenchmarkJoinReaderLookupCache(b *testing.B) {
+	s, sqlDB, kvDB := serverutils.StartServer(b, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.Background())
+
+	const numRows = 10000
+	sqlutils.CreateTable(
+		b, sqlDB, "t",
+		"k INT PRIMARY KEY, v INT",
+		numRows,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowModuloFn(42)),
+	)
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+		nodeID:   s.NodeID(),
+	}
+
+	zipf := rand.NewZipf(rand.New(rand.NewSource(0)), 1.1 /* s */, 1 /* v */, numRows-1)
+	inputRows := make(sqlbase.EncDatumRows, numRows)
+	for i := range inputRows {
+		inputRows[i] = sqlbase.EncDatumRow{intEncDatum(int(zipf.Uint64()) + 1)}
+	}
+	input := NewRepeatableRowSource(oneIntCol, inputRows)
+	post := PostProcessSpec{}
+
+	for _, cacheSize := range []uint32{0, 100, 1000} {
+		b.Run(fmt.Sprintf("CacheSize=%d", cacheSize), func(b *testing.B) {
+			spec := JoinReaderSpec{Table: *tableDesc, LookupCacheSize: cacheSize}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				jr, err := newJoinReader(&flowCtx, &spec, input, &post, &RowDisposer{}, nil /* kv */)
+				if err != nil {
+					b.Fatal(err)
+				}
+				jr.Run(context.Background(), nil)
+				input.Reset()
+			}
+		})
+	}
+}
+
+// rowAFn, rowBFn and rowSumFn generate the a, b and sum columns of the table
+// created by createTestTable.
+func rowAFn(row int) tree.Datum {
+	return tree.NewDInt(tree.DInt(row / 10))
+}
+
+func rowBFn(row int) tree.Datum {
+	return tree.NewDInt(tree.DInt(row % 10))
+}
+
+func rowSumFn(row int) tree.Datum {
+	return tree.NewDInt(tree.DInt(row/10 + row%10))
+}
+
+// createTestTable creates the table test.t used by many processor tests, with
+// the columns a, b, sum and s and the primary key (a,b). Its 99 rows are
+// generated by rowAFn, rowBFn, rowSumFn and sqlutils.RowEnglishFn. extraDefs,
+// if not empty, is added to the definition of the table (e.g. an index).
+func createTestTable(tb testing.TB, sqlDB *gosql.DB, extraDefs string) {
+	schema := "a INT, b INT, sum INT, s STRING, PRIMARY KEY (a,b)"
+	if extraDefs != "" {
+		schema += ", " + extraDefs
+	}
+	sqlutils.CreateTable(tb, sqlDB, "t", schema, 99,
+		sqlutils.ToRowFn(rowAFn, rowBFn, rowSumFn, sqlutils.RowEnglishFn))
+}
+
+// newTestTxn returns a transaction on the given server for the FlowCtx of the
+// processors under test.
+func newTestTxn(s serverutils.TestServerInterface) *client.Txn {
+	// Pass a DB without a TxnCoordSender.
+	return client.NewTxn(client.NewDB(s.DistSender(), s.Clock()), s.NodeID())
 }
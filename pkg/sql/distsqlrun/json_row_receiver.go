@@ -0,0 +1,120 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/builtins"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// JSONRowReceiver is an implementation of RowReceiver that writes each row
+// pushed to it to an io.Writer, as a line containing a JSON array of the row's
+// datums. Errors are written as lines containing {"error": <message>}; other
+// metadata is ignored. Useful for dumping the output of processors when
+// debugging.
+type JSONRowReceiver struct {
+	types []sqlbase.ColumnType
+
+	mu struct {
+		syncutil.Mutex
+		w     io.Writer
+		buf   bytes.Buffer
+		alloc sqlbase.DatumAlloc
+		// err is the first error encountered writing a row. Once it is set, the
+		// JSONRowReceiver behaves like a closed consumer.
+		err error
+	}
+
+	// ProducerClosed is set to true when the sender calls ProducerDone().
+	ProducerClosed bool
+}
+
+var _ RowCopyingReceiver = &JSONRowReceiver{}
+
+// NewJSONRowReceiver creates a JSONRowReceiver for rows with the given schema.
+func NewJSONRowReceiver(types []sqlbase.ColumnType, w io.Writer) *JSONRowReceiver {
+	r := &JSONRowReceiver{types: types}
+	r.mu.w = w
+	return r
+}
+
+// Push is part of the RowReceiver interface.
+func (r *JSONRowReceiver) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	if r.ProducerClosed {
+		panic("Push called after ProducerDone")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.err != nil {
+		return ConsumerClosed
+	}
+
+	var j json.JSON
+	if !meta.Empty() {
+		if meta.Err == nil {
+			return NeedMoreRows
+		}
+		b := json.NewBuilder()
+		b.Add("error", json.FromString(meta.Err.Error()))
+		j = b.Build()
+	} else {
+		vals := make([]json.JSON, len(row))
+		for i := range row {
+			if err := row[i].EnsureDecoded(&r.types[i], &r.mu.alloc); err != nil {
+				r.mu.err = err
+				return ConsumerClosed
+			}
+			var err error
+			if vals[i], err = builtins.AsJSON(row[i].Datum); err != nil {
+				r.mu.err = err
+				return ConsumerClosed
+			}
+		}
+		j = json.FromArrayOfJSON(vals)
+	}
+
+	r.mu.buf.Reset()
+	j.Format(&r.mu.buf)
+	r.mu.buf.WriteByte('\n')
+	if _, err := r.mu.w.Write(r.mu.buf.Bytes()); err != nil {
+		r.mu.err = err
+		return ConsumerClosed
+	}
+	return NeedMoreRows
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (r *JSONRowReceiver) ProducerDone() {
+	if r.ProducerClosed {
+		panic("JSONRowReceiver already closed")
+	}
+	r.ProducerClosed = true
+}
+
+// Err returns the error, if any, that was encountered converting or writing a
+// row.
+func (r *JSONRowReceiver) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.err
+}
+
+// CopiesRows is part of the RowCopyingReceiver interface.
+func (r *JSONRowReceiver) CopiesRows() {}
@@ -0,0 +1,88 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestJSONRowReceiver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT, b INT, sum INT, s STRING, PRIMARY KEY (a,b)",
+		99,
+		sqlutils.ToRowFn(
+			func(row int) tree.Datum { return tree.NewDInt(tree.DInt(row / 10)) },
+			func(row int) tree.Datum { return tree.NewDInt(tree.DInt(row % 10)) },
+			func(row int) tree.Datum { return tree.NewDInt(tree.DInt(row/10 + row%10)) },
+			sqlutils.RowEnglishFn,
+		))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt([][]int{{0, 2}, {1, 5}}), RowBufferArgs{})
+	var buf bytes.Buffer
+	out := NewJSONRowReceiver([]sqlbase.ColumnType{intType, intType, strType}, &buf)
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}}
+	jr, err := newJoinReader(&flowCtx, &JoinReaderSpec{Table: *td}, in, &post, out, nil /* kv */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[0,2,\"two\"]\n[1,5,\"one-five\"]\n"
+	if result := buf.String(); result != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+
+	// Errors are written too.
+	buf.Reset()
+	out = NewJSONRowReceiver(oneIntCol, &buf)
+	out.Push(genEncDatumRowsInt([][]int{{1}})[0], ProducerMetadata{})
+	out.Push(nil /* row */, ProducerMetadata{Err: errors.New(`bad "row"`)})
+	out.Push(sqlbase.EncDatumRow{nullEncDatum()}, ProducerMetadata{})
+	out.ProducerDone()
+	expected = "[1]\n{\"error\":\"bad \\\"row\\\"\"}\n[null]\n"
+	if result := buf.String(); result != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
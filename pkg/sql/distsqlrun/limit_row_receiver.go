@@ -0,0 +1,70 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// limitRowReceiver is a RowReceiver that forwards at most a fixed number of
+// rows to a downstream RowReceiver. It is a hard cap on the output of a
+// producer, independent of any limit in the producer's PostProcessSpec.
+//
+// Once the limit is reached, ConsumerClosed is returned to the producer, which
+// then closes its inputs and stops; nothing is forwarded after that. Metadata
+// pushed before the limit is reached is forwarded as is.
+type limitRowReceiver struct {
+	dst   RowReceiver
+	limit uint64
+
+	mu struct {
+		// The mutex protects against concurrent pushes, e.g. while the producer
+		// drains several inputs.
+		syncutil.Mutex
+		// numRows is the number of rows forwarded so far.
+		numRows uint64
+	}
+}
+
+var _ RowReceiver = &limitRowReceiver{}
+
+func newLimitRowReceiver(dst RowReceiver, limit uint64) *limitRowReceiver {
+	return &limitRowReceiver{dst: dst, limit: limit}
+}
+
+// Push is part of the RowReceiver interface.
+func (l *limitRowReceiver) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.mu.numRows >= l.limit {
+		return ConsumerClosed
+	}
+	status := l.dst.Push(row, meta)
+	if row != nil {
+		l.mu.numRows++
+		if l.mu.numRows >= l.limit {
+			// There is no point in letting the producer push anything else.
+			return ConsumerClosed
+		}
+	}
+	return status
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (l *limitRowReceiver) ProducerDone() {
+	l.dst.ProducerDone()
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestLimitRowReceiverJoinReader verifies that a joinReader whose output is
+// capped by a limitRowReceiver stops early and closes its input.
+func TestLimitRowReceiverJoinReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	td, kv := makeFakeKVTable(t)
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	// Enough input rows for several lookup batches, all with a match.
+	const numInputRows = 10 * joinReaderBatchSize
+	in := NewLimitedRowSource(
+		twoIntCols, genEncDatumRowsInt([][]int{{1, 5}})[0], numInputRows, ProducerMetadata{},
+	)
+	out := &RowBuffer{}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 3}}
+	jr, err := newJoinReader(
+		&flowCtx, &JoinReaderSpec{Table: td}, in, &post, newLimitRowReceiver(out, 2), kv,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	expected := "[[1 5 'one-five'] [1 5 'one-five']]"
+	res := out.GetRowsNoMeta(t).String([]sqlbase.ColumnType{intType, intType, strType})
+	if res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+	if in.ConsumerStatus != ConsumerClosed {
+		t.Errorf("input not closed")
+	}
+	if in.NumRowsEmitted >= numInputRows {
+		t.Errorf("the whole input was read")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// lookupCache is a bounded LRU cache of the rows fetched by a joinReader,
+// keyed by the encoded lookup key. A key that matched no rows is cached too.
+//
+// The cached rows are only valid at the timestamp at which they were read:
+// the cache is cleared whenever it is used at a different read timestamp.
+type lookupCache struct {
+	c *cache.UnorderedCache
+	// acc accounts for the memory of the cached keys and rows.
+	acc boundAccount
+	// ts is the read timestamp of the cached rows.
+	ts hlc.Timestamp
+	// evictedBytes is the size of the entries evicted since the account was
+	// last shrunk.
+	evictedBytes int64
+
+	// hits and misses count the lookups served by the cache or not. They are
+	// updated by the joinReader once the lookups of a batch succeed.
+	hits, misses int
+}
+
+type lookupCacheEntry struct {
+	rows []sqlbase.EncDatumRow
+	size int64
+}
+
+// newLookupCache creates a lookupCache of up to size keys, whose memory is
+// accounted for in acc.
+func newLookupCache(size int, acc boundAccount) *lookupCache {
+	lc := &lookupCache{acc: acc}
+	lc.c = cache.NewUnorderedCache(cache.Config{
+		Policy: cache.CacheLRU,
+		ShouldEvict: func(n int, _, _ interface{}) bool {
+			return n > size
+		},
+		OnEvicted: func(_, value interface{}) {
+			lc.evictedBytes += value.(*lookupCacheEntry).size
+		},
+	})
+	return lc
+}
+
+// setReadTimestamp clears the cache if the rows in it weren't read at the
+// given timestamp.
+func (lc *lookupCache) setReadTimestamp(ctx context.Context, ts hlc.Timestamp) {
+	if ts == lc.ts {
+		return
+	}
+	if lc.c.Len() > 0 {
+		log.VEventf(ctx, 2, "read timestamp changed from %s to %s, clearing the lookup cache", lc.ts, ts)
+		lc.c.Clear()
+		lc.releaseEvicted(ctx)
+	}
+	lc.ts = ts
+}
+
+// get returns the rows cached for the given lookup key. The rows must not be
+// modified.
+func (lc *lookupCache) get(key string) ([]sqlbase.EncDatumRow, bool) {
+	value, ok := lc.c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*lookupCacheEntry).rows, true
+}
+
+// add caches the rows fetched for the given lookup key, possibly evicting the
+// least recently used keys. The rows are not copied. If the memory budget
+// doesn't allow caching them, the rows are not cached.
+func (lc *lookupCache) add(ctx context.Context, key string, rows []sqlbase.EncDatumRow) {
+	if _, ok := lc.c.Get(key); ok {
+		// The key is already cached.
+		return
+	}
+	size := int64(len(key))
+	for _, row := range rows {
+		size += row.MemorySize()
+	}
+	// Add the entry before accounting for it, so that the memory of the entries
+	// it evicts is available.
+	e := &lookupCacheEntry{rows: rows}
+	lc.c.Add(key, e)
+	lc.releaseEvicted(ctx)
+	if err := lc.acc.Grow(ctx, size); err != nil {
+		log.VEventf(ctx, 2, "not caching the rows of a lookup: %s", err)
+		lc.c.Del(key)
+		return
+	}
+	e.size = size
+}
+
+// bytesUsed returns the memory used by the cached keys and rows.
+func (lc *lookupCache) bytesUsed() int64 {
+	return lc.acc.Used()
+}
+
+// releaseEvicted releases the memory of the evicted entries.
+func (lc *lookupCache) releaseEvicted(ctx context.Context) {
+	lc.acc.Shrink(ctx, lc.evictedBytes)
+	lc.evictedBytes = 0
+}
+
+func (lc *lookupCache) close(ctx context.Context) {
+	log.VEventf(ctx, 1, "lookup cache: %d hits, %d misses", lc.hits, lc.misses)
+	lc.c.Clear()
+	lc.evictedBytes = 0
+	lc.acc.Close(ctx)
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+func TestLookupCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rows := genEncDatumRowsInt([][]int{{1}, {2}})
+	// All the entries have the same size.
+	entrySize := int64(len("k1")) + rows[0].MemorySize() + rows[1].MemorySize()
+
+	// The budget allows caching two entries.
+	monitor := mon.MakeMonitor(
+		"test",
+		mon.MemoryResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		1,   /* increment */
+		math.MaxInt64,
+	)
+	monitor.Start(ctx, nil, mon.MakeStandaloneBudget(2*entrySize))
+	// Stop() panics if the cache didn't release all its memory.
+	defer monitor.Stop(ctx)
+
+	t.Run("Size", func(t *testing.T) {
+		lc := newLookupCache(2 /* size */, boundAccount{BoundAccount: monitor.MakeBoundAccount()})
+		defer lc.close(ctx)
+		for _, key := range []string{"k1", "k2", "k3"} {
+			lc.add(ctx, key, rows)
+		}
+		// The first key was evicted, which released its memory.
+		if _, ok := lc.get("k1"); ok {
+			t.Errorf("expected k1 to be evicted")
+		}
+		for _, key := range []string{"k2", "k3"} {
+			if cached, ok := lc.get(key); !ok || len(cached) != len(rows) {
+				t.Errorf("expected %s to be cached", key)
+			}
+		}
+	})
+
+	t.Run("Budget", func(t *testing.T) {
+		lc := newLookupCache(10 /* size */, boundAccount{BoundAccount: monitor.MakeBoundAccount()})
+		defer lc.close(ctx)
+		for _, key := range []string{"k1", "k2", "k3"} {
+			lc.add(ctx, key, rows)
+		}
+		// The last key didn't fit in the budget.
+		if _, ok := lc.get("k3"); ok {
+			t.Errorf("expected k3 not to be cached")
+		}
+		if _, ok := lc.get("k1"); !ok {
+			t.Errorf("expected k1 to be cached")
+		}
+	})
+
+	t.Run("ReadTimestamp", func(t *testing.T) {
+		lc := newLookupCache(10 /* size */, boundAccount{BoundAccount: monitor.MakeBoundAccount()})
+		defer lc.close(ctx)
+		lc.setReadTimestamp(ctx, hlc.Timestamp{WallTime: 1})
+		lc.add(ctx, "k1", nil /* rows */)
+		lc.add(ctx, "k2", rows)
+		lc.setReadTimestamp(ctx, hlc.Timestamp{WallTime: 1})
+		if _, ok := lc.get("k1"); !ok {
+			t.Errorf("expected k1 to be cached")
+		}
+		// The entries read at a different timestamp are discarded, and their
+		// memory is released.
+		lc.setReadTimestamp(ctx, hlc.Timestamp{WallTime: 2})
+		if _, ok := lc.get("k1"); ok {
+			t.Errorf("expected k1 to be discarded")
+		}
+		for _, key := range []string{"k3", "k4"} {
+			lc.add(ctx, key, rows)
+			if _, ok := lc.get(key); !ok {
+				t.Errorf("expected %s to be cached", key)
+			}
+		}
+	})
+}
@@ -78,6 +78,9 @@ func newMergeJoiner(
 	if err != nil {
 		return nil, err
 	}
+	maxBufferedRows := flowCtx.maxBufferedGroupRows()
+	m.streamMerger.left.setMaxBufferedRows(maxBufferedRows, nil /* spill */)
+	m.streamMerger.right.setMaxBufferedRows(maxBufferedRows, nil /* spill */)
 
 	return m, nil
 }
@@ -91,10 +94,12 @@ func (m *mergeJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTag(ctx, "MergeJoiner", nil)
 	ctx, span := processorSpan(ctx, "merge joiner")
 	defer tracing.FinishSpan(span)
+	defer m.recoverPanic(ctx, m.leftSource, m.rightSource)
 	log.VEventf(ctx, 2, "starting merge joiner run")
 
 	cancelChecker := sqlbase.NewCancelChecker(ctx)
 	m.evalCtx = m.flowCtx.NewEvalCtx()
+	defer m.streamMerger.close(ctx)
 
 	for {
 		moreBatches, err := m.outputBatch(ctx, cancelChecker)
@@ -29,6 +29,13 @@ type DistSQLMetrics struct {
 	FlowsTotal    *metric.Counter
 	MaxBytesHist  *metric.Histogram
 	CurBytesCount *metric.Counter
+
+	// The following metrics are updated by processors when they finish; see
+	// FlowCtx.Metrics.
+	ProcRowsIn       *metric.Counter
+	ProcRowsOut      *metric.Counter
+	GroupMaxRowsHist *metric.Histogram
+	DiskSpills       *metric.Counter
 }
 
 // MetricStruct implements the metrics.Struct interface.
@@ -55,12 +62,28 @@ var (
 	metaMemCurBytes = metric.Metadata{
 		Name: "sql.mem.distsql.current",
 		Help: "Current sql statement memory usage for distsql"}
+	metaProcRowsIn = metric.Metadata{
+		Name: "sql.distsql.processors.rows.in",
+		Help: "Number of rows consumed by join readers and streaming aggregators"}
+	metaProcRowsOut = metric.Metadata{
+		Name: "sql.distsql.processors.rows.out",
+		Help: "Number of rows produced by join readers and streaming aggregators"}
+	metaGroupMaxRows = metric.Metadata{
+		Name: "sql.distsql.groups.max_rows",
+		Help: "Number of rows of the largest group formed by each streaming aggregator"}
+	metaDiskSpills = metric.Metadata{
+		Name: "sql.distsql.disk_spills",
+		Help: "Number of times sorters and hash joiners fell back to disk"}
 )
 
 // See pkg/sql/mem_metrics.go
 // log10int64times1000 = log10(math.MaxInt64) * 1000, rounded up somewhat
 const log10int64times1000 = 19 * 1000
 
+// maxRecordedGroupRows is the largest group size recorded in
+// GroupMaxRowsHist; larger groups are recorded as this size.
+const maxRecordedGroupRows = 1000 * 1000 * 1000
+
 // MakeDistSQLMetrics instantiates the metrics holder for DistSQL monitoring.
 func MakeDistSQLMetrics(histogramWindow time.Duration) DistSQLMetrics {
 	return DistSQLMetrics{
@@ -70,6 +93,13 @@ func MakeDistSQLMetrics(histogramWindow time.Duration) DistSQLMetrics {
 		FlowsTotal:    metric.NewCounter(metaFlowsTotal),
 		MaxBytesHist:  metric.NewHistogram(metaMemMaxBytes, histogramWindow, log10int64times1000, 3),
 		CurBytesCount: metric.NewCounter(metaMemCurBytes),
+
+		ProcRowsIn:  metric.NewCounter(metaProcRowsIn),
+		ProcRowsOut: metric.NewCounter(metaProcRowsOut),
+		// Group sizes are recorded with one significant figure, which is enough
+		// to spot skew.
+		GroupMaxRowsHist: metric.NewHistogram(metaGroupMaxRows, histogramWindow, maxRecordedGroupRows, 1),
+		DiskSpills:       metric.NewCounter(metaDiskSpills),
 	}
 }
 
@@ -94,3 +124,23 @@ func (m *DistSQLMetrics) FlowStart() {
 func (m *DistSQLMetrics) FlowStop() {
 	m.FlowsActive.Dec(1)
 }
+
+// ProcessorDone registers the number of rows consumed and produced by a
+// processor that has finished.
+func (m *DistSQLMetrics) ProcessorDone(rowsIn, rowsOut uint64) {
+	m.ProcRowsIn.Inc(int64(rowsIn))
+	m.ProcRowsOut.Inc(int64(rowsOut))
+}
+
+// GroupingDone registers the size of the largest group formed by a processor
+// that grouped its input.
+func (m *DistSQLMetrics) GroupingDone(stats *GroupSizeStats) {
+	if stats.NumGroups > 0 {
+		m.GroupMaxRowsHist.RecordValue(int64(stats.MaxSize))
+	}
+}
+
+// DiskSpill registers a processor falling back to disk.
+func (m *DistSQLMetrics) DiskSpill() {
+	m.DiskSpills.Inc(1)
+}
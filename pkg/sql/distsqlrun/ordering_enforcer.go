@@ -0,0 +1,131 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// orderingEnforcer is the processor that passes its input through while
+// verifying that it is sorted; see OrderingEnforcerSpec. Only the previous row
+// is kept, so the overhead is one comparison per row.
+type orderingEnforcer struct {
+	processorBase
+
+	flowCtx  *FlowCtx
+	input    RowSource
+	types    []sqlbase.ColumnType
+	ordering sqlbase.ColumnOrdering
+	// orderingStr describes the ordering in errors.
+	orderingStr string
+
+	// prevRow is the last row of the input and numRows is the number of rows
+	// read so far.
+	prevRow sqlbase.EncDatumRow
+	numRows int
+	alloc   sqlbase.DatumAlloc
+}
+
+var _ Processor = &orderingEnforcer{}
+
+func newOrderingEnforcer(
+	flowCtx *FlowCtx,
+	spec *OrderingEnforcerSpec,
+	input RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*orderingEnforcer, error) {
+	types := input.Types()
+	ordering := convertToColumnOrdering(spec.Ordering)
+	for _, c := range ordering {
+		if c.ColIdx >= len(types) {
+			return nil, errors.Errorf(
+				"invalid ordering column %d (input has %d columns)", c.ColIdx, len(types),
+			)
+		}
+	}
+	e := &orderingEnforcer{
+		flowCtx:     flowCtx,
+		input:       input,
+		types:       types,
+		ordering:    ordering,
+		orderingStr: spec.Ordering.diagramString(),
+	}
+	if err := e.init(post, types, flowCtx, output); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Run is part of the processor interface.
+func (e *orderingEnforcer) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "OrderingEnforcer", nil)
+	ctx, span := processorSpan(ctx, "ordering enforcer")
+	defer tracing.FinishSpan(span)
+	defer e.recoverPanic(ctx, e.input)
+
+	evalCtx := e.flowCtx.NewEvalCtx()
+	for {
+		row, meta := e.input.Next()
+		if row == nil && meta.Empty() {
+			sendTraceData(ctx, e.out.output)
+			e.out.Close()
+			return
+		}
+		if row != nil {
+			if err := e.checkRow(evalCtx, row); err != nil {
+				log.Errorf(ctx, "%s", err)
+				DrainAndClose(ctx, e.out.output, err, e.input)
+				return
+			}
+		}
+		if !emitHelper(ctx, &e.out, row, meta, e.input) {
+			return
+		}
+	}
+}
+
+// checkRow verifies that row doesn't precede the previous row of the input in
+// the ordering. The error identifies the offending row by its (0-based) index
+// in the input.
+func (e *orderingEnforcer) checkRow(evalCtx *tree.EvalContext, row sqlbase.EncDatumRow) error {
+	if e.prevRow != nil {
+		cmp, err := e.prevRow.Compare(e.types, &e.alloc, e.ordering, evalCtx, row)
+		if err != nil {
+			return err
+		}
+		if cmp > 0 {
+			return errors.Errorf(
+				"input row %d is not ordered according to %s: %s follows %s",
+				e.numRows, e.orderingStr, row.String(e.types), e.prevRow.String(e.types),
+			)
+		}
+	}
+	e.prevRow = append(e.prevRow[:0], row...)
+	e.numRows++
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestOrderingEnforcer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+	spec := OrderingEnforcerSpec{
+		Ordering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+			{ColIdx: 1, Direction: encoding.Descending},
+		}),
+	}
+
+	testCases := []struct {
+		name  string
+		input [][]int
+		// expRows are the rows expected to be passed through and expErr the
+		// expected error, if any.
+		expRows string
+		expErr  string
+	}{
+		{
+			name:    "Ordered",
+			input:   [][]int{{1, 3}, {1, 2}, {1, 2}, {2, 9}, {4, 0}},
+			expRows: "[[1 3] [1 2] [1 2] [2 9] [4 0]]",
+		},
+		{
+			name:    "FirstColumn",
+			input:   [][]int{{1, 3}, {2, 2}, {3, 2}, {2, 9}, {4, 0}},
+			expRows: "[[1 3] [2 2] [3 2]]",
+			expErr:  `input row 3 is not ordered according to @1\+,@2-: \[2 9\] follows \[3 2\]`,
+		},
+		{
+			name:    "SecondColumn",
+			input:   [][]int{{1, 3}, {1, 4}},
+			expRows: "[[1 3]]",
+			expErr:  `input row 1 is not ordered according to @1\+,@2-: \[1 4\] follows \[1 3\]`,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(c.input), RowBufferArgs{})
+			out := &RowBuffer{}
+			e, err := newOrderingEnforcer(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Run(ctx, nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			var rows sqlbase.EncDatumRows
+			var errs []error
+			for {
+				row, meta := out.Next()
+				if meta.Err != nil {
+					errs = append(errs, meta.Err)
+					continue
+				}
+				if row == nil && meta.Empty() {
+					break
+				}
+				rows = append(rows, row)
+			}
+			if res := rows.String(twoIntCols); res != c.expRows {
+				t.Errorf("expected rows %s, got %s", c.expRows, res)
+			}
+			if c.expErr == "" {
+				if len(errs) != 0 {
+					t.Fatalf("unexpected errors %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !testutils.IsError(errs[0], c.expErr) {
+				t.Fatalf("expected error %q, got %v", c.expErr, errs)
+			}
+		})
+	}
+
+	t.Run("InvalidColumn", func(t *testing.T) {
+		spec := OrderingEnforcerSpec{
+			Ordering: convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 2}}),
+		}
+		in := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{})
+		if _, err := newOrderingEnforcer(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+		); !testutils.IsError(err, "invalid ordering column 2") {
+			t.Fatalf("expected an invalid ordering column error, got %v", err)
+		}
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		checkProcessorCleanup(t, &flowCtx, func(out RowReceiver) (Processor, error) {
+			in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(testCases[0].input), RowBufferArgs{})
+			return newOrderingEnforcer(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		})
+	})
+}
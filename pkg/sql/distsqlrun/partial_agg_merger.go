@@ -0,0 +1,180 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+// partialAggMergeFuncs maps the aggregate functions whose partial results can
+// be merged by a partialAggMerger to the aggregate functions that merge them
+// (as in the final stage of distsqlplan.DistAggregationTable).
+var partialAggMergeFuncs = map[AggregatorSpec_Func]AggregatorSpec_Func{
+	AggregatorSpec_IDENT:      AggregatorSpec_IDENT,
+	AggregatorSpec_BOOL_AND:   AggregatorSpec_BOOL_AND,
+	AggregatorSpec_BOOL_OR:    AggregatorSpec_BOOL_OR,
+	AggregatorSpec_COUNT:      AggregatorSpec_SUM_INT,
+	AggregatorSpec_COUNT_ROWS: AggregatorSpec_SUM_INT,
+	AggregatorSpec_MAX:        AggregatorSpec_MAX,
+	AggregatorSpec_MIN:        AggregatorSpec_MIN,
+	AggregatorSpec_SUM:        AggregatorSpec_SUM,
+	AggregatorSpec_SUM_INT:    AggregatorSpec_SUM_INT,
+	AggregatorSpec_XOR_AGG:    AggregatorSpec_XOR_AGG,
+}
+
+// partialAgg describes a column of partial aggregation results: the partial
+// results of aggregate function fn are in column colIdx.
+type partialAgg struct {
+	fn     AggregatorSpec_Func
+	colIdx int
+}
+
+// partialAggMerger combines partial aggregation results (e.g. computed by the
+// nodes holding different parts of the data) into final results. It reads
+// multiple sources of partial results, each sorted on the group columns, and
+// produces a row for each group (i.e. for all the rows of all the sources with
+// the same values in the group columns) with the values of the group columns
+// followed by the merged results, in order.
+//
+// The sources are merged on the fly with a merging streamGroupAccumulator and
+// consumed row by row, so the memory used doesn't depend on the number of
+// sources contributing to a group.
+type partialAggMerger struct {
+	acc       streamGroupAccumulator
+	groupCols sqlbase.ColumnOrdering
+	aggs      []partialAgg
+	evalCtx   *tree.EvalContext
+
+	// constructors and outputTypes are those of the aggregate functions merging
+	// the partial results; funcs are the functions of the current group, if
+	// inGroup is set.
+	constructors []func(*tree.EvalContext) tree.AggregateFunc
+	outputTypes  []sqlbase.ColumnType
+	funcs        []tree.AggregateFunc
+	inGroup      bool
+	alloc        sqlbase.DatumAlloc
+}
+
+// makePartialAggMerger creates a partialAggMerger. The sources must all have
+// the same schema and be sorted according to groupCols.
+func makePartialAggMerger(
+	srcs []NoMetadataRowSource,
+	groupCols sqlbase.ColumnOrdering,
+	aggs []partialAgg,
+	evalCtx *tree.EvalContext,
+) (*partialAggMerger, error) {
+	if len(srcs) == 0 {
+		return nil, errors.Errorf("no sources to merge")
+	}
+	types := srcs[0].Types()
+	m := &partialAggMerger{
+		acc:          makeMergingStreamGroupAccumulator(srcs, groupCols, true /* nullsAreEqual */, evalCtx),
+		groupCols:    groupCols,
+		aggs:         aggs,
+		evalCtx:      evalCtx,
+		constructors: make([]func(*tree.EvalContext) tree.AggregateFunc, len(aggs)),
+		funcs:        make([]tree.AggregateFunc, len(aggs)),
+	}
+	for _, c := range groupCols {
+		m.outputTypes = append(m.outputTypes, types[c.ColIdx])
+	}
+	for i, a := range aggs {
+		mergeFn, ok := partialAggMergeFuncs[a.fn]
+		if !ok {
+			return nil, errors.Errorf("cannot merge partial %s aggregations", a.fn)
+		}
+		if a.colIdx < 0 || a.colIdx >= len(types) {
+			return nil, errors.Errorf("invalid column %d", a.colIdx)
+		}
+		var retType sqlbase.ColumnType
+		var err error
+		m.constructors[i], retType, err = GetAggregateInfo(mergeFn, types[a.colIdx])
+		if err != nil {
+			return nil, err
+		}
+		m.outputTypes = append(m.outputTypes, retType)
+	}
+	return m, nil
+}
+
+// OutputTypes returns the schema of the rows produced by next().
+func (m *partialAggMerger) OutputTypes() []sqlbase.ColumnType {
+	return m.outputTypes
+}
+
+// next returns the merged results of the next group, or nil once all the
+// groups have been produced.
+func (m *partialAggMerger) next() (sqlbase.EncDatumRow, error) {
+	ctx := m.evalCtx.Ctx()
+	for {
+		row, last, err := m.acc.nextRowWithGroupBoundary(m.evalCtx)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return nil, nil
+		}
+		if !m.inGroup {
+			for i, c := range m.constructors {
+				m.funcs[i] = c(m.evalCtx)
+			}
+			m.inGroup = true
+		}
+		for i, a := range m.aggs {
+			if err := row[a.colIdx].EnsureDecoded(&m.acc.types[a.colIdx], &m.alloc); err != nil {
+				return nil, err
+			}
+			if err := m.funcs[i].Add(ctx, row[a.colIdx].Datum); err != nil {
+				return nil, err
+			}
+		}
+		if !last {
+			continue
+		}
+
+		res := make(sqlbase.EncDatumRow, 0, len(m.outputTypes))
+		for _, c := range m.groupCols {
+			res = append(res, row[c.ColIdx])
+		}
+		for i, f := range m.funcs {
+			d, err := f.Result()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, sqlbase.DatumToEncDatum(m.outputTypes[len(m.groupCols)+i], d))
+		}
+		m.closeFuncs()
+		return res, nil
+	}
+}
+
+// closeFuncs closes the aggregate functions of the current group.
+func (m *partialAggMerger) closeFuncs() {
+	if m.inGroup {
+		for _, f := range m.funcs {
+			f.Close(m.evalCtx.Ctx())
+		}
+		m.inGroup = false
+	}
+}
+
+// close releases the resources of the merger, including on error paths.
+func (m *partialAggMerger) close() {
+	m.closeFuncs()
+	m.acc.close(m.evalCtx.Ctx())
+}
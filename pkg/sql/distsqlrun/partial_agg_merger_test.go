@@ -0,0 +1,80 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestPartialAggMerger(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// The partial results of SUM(x), COUNT(*) and MAX(x) grouped by the first
+	// column, computed over two parts of the data.
+	types := []sqlbase.ColumnType{intType, intType, intType, intType}
+	partials := [][][]int{
+		{{1, 10, 2, 7}, {2, 5, 1, 5}, {4, 1, 1, 1}},
+		{{1, 3, 1, 3}, {3, 7, 3, 4}, {4, 2, 2, 9}},
+	}
+	aggs := []partialAgg{
+		{fn: AggregatorSpec_SUM_INT, colIdx: 1},
+		{fn: AggregatorSpec_COUNT_ROWS, colIdx: 2},
+		{fn: AggregatorSpec_MAX, colIdx: 3},
+	}
+	makeSources := func() []NoMetadataRowSource {
+		var srcs []NoMetadataRowSource
+		for _, rows := range partials {
+			srcs = append(srcs, makeSliceRowSource(types, genEncDatumRowsInt(rows)))
+		}
+		return srcs
+	}
+
+	m, err := makePartialAggMerger(makeSources(), orderingOnFirstCol, aggs, &evalCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	var res sqlbase.EncDatumRows
+	for {
+		row, err := m.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil {
+			break
+		}
+		res = append(res, row)
+	}
+	expected := "[[1 13 3 7] [2 5 1 5] [3 7 3 4] [4 3 3 9]]"
+	if s := res.String(m.OutputTypes()); s != expected {
+		t.Errorf("expected %s, got %s", expected, s)
+	}
+
+	// Not all partial results can be merged.
+	if _, err := makePartialAggMerger(
+		makeSources(), orderingOnFirstCol, []partialAgg{{fn: AggregatorSpec_AVG, colIdx: 1}}, &evalCtx,
+	); !testutils.IsError(err, "cannot merge partial AVG aggregations") {
+		t.Errorf("expected error, got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// partitionSorter is the processor that sorts each partition of its input
+// separately; see PartitionSorterSpec. The partitions are read one at a time
+// by a streamGroupAccumulator.
+//
+// The rows of a partition are buffered in memory and sorted with
+// EncDatumRow.Compare. If a partition uses more than the memory limit of the
+// sorter (COCKROACH_WORK_MEM, unless overridden by a testing knob), its rows
+// are moved to a diskRowContainer, which keeps them sorted. Either way, the
+// memory used doesn't depend on the number of partitions.
+type partitionSorter struct {
+	processorBase
+
+	flowCtx *FlowCtx
+	// rawInput is the input; acc reads it (without the metadata, which is
+	// directed straight to out.output) partition by partition.
+	rawInput RowSource
+	acc      streamGroupAccumulator
+	types    []sqlbase.ColumnType
+	ordering sqlbase.ColumnOrdering
+
+	// rows are the (copies of the) rows of the current partition, as long as
+	// they fit in memory. memAcc accounts for their memory.
+	rows       sqlbase.EncDatumRows
+	rowAlloc   sqlbase.EncDatumRowAlloc
+	memAcc     boundAccount
+	datumAlloc sqlbase.DatumAlloc
+}
+
+var _ Processor = &partitionSorter{}
+
+func newPartitionSorter(
+	flowCtx *FlowCtx,
+	spec *PartitionSorterSpec,
+	input RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*partitionSorter, error) {
+	types := input.Types()
+	partitionOrdering := convertToColumnOrdering(spec.PartitionOrdering)
+	ordering := convertToColumnOrdering(spec.Ordering)
+	for _, ord := range [...]sqlbase.ColumnOrdering{partitionOrdering, ordering} {
+		for _, c := range ord {
+			if c.ColIdx >= len(types) {
+				return nil, errors.Errorf(
+					"invalid ordering column %d (input has %d columns)", c.ColIdx, len(types),
+				)
+			}
+		}
+	}
+	s := &partitionSorter{
+		flowCtx:  flowCtx,
+		rawInput: input,
+		acc: makeStreamGroupAccumulator(
+			MakeNoMetadataRowSource(input, ForwardMetadata(output)),
+			partitionOrdering,
+			true, /* nullsAreEqual */
+		),
+		types:    types,
+		ordering: ordering,
+	}
+	if err := s.init(post, types, flowCtx, output); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run is part of the processor interface.
+func (s *partitionSorter) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "PartitionSorter", nil)
+	ctx, span := processorSpan(ctx, "partition sorter")
+	defer tracing.FinishSpan(span)
+	defer s.recoverPanic(ctx, s.rawInput)
+
+	if log.V(2) {
+		log.Infof(ctx, "starting partition sorter run")
+		defer log.Infof(ctx, "exiting partition sorter run")
+	}
+
+	err := s.mainLoop(ctx)
+	if err != nil {
+		log.Errorf(ctx, "error sorting partitions: %s", err)
+	}
+	DrainAndClose(ctx, s.out.output, err, s.rawInput)
+}
+
+// mainLoop sorts and emits the partitions of the input until the input is
+// exhausted or the consumer doesn't need more rows. In any case, the caller is
+// responsible for draining and closing the producer and the consumer.
+func (s *partitionSorter) mainLoop(ctx context.Context) error {
+	evalCtx := s.flowCtx.NewEvalCtx()
+	s.acc.setCancellation(ctx)
+	s.acc.setDeadline(s.flowCtx.Deadline)
+
+	st := s.flowCtx.Settings
+	useTempStorage := settingUseTempStorageSorts.Get(&st.SV) ||
+		s.flowCtx.testingKnobs.MemoryLimitBytes > 0
+	var memLimit int64
+	if useTempStorage {
+		memLimit = s.flowCtx.testingKnobs.MemoryLimitBytes
+		if memLimit <= 0 {
+			memLimit = settingWorkMemBytes.Get(&st.SV)
+		}
+	}
+	s.memAcc = s.flowCtx.makeBoundAccount(s.flowCtx.EvalCtx.Mon)
+	defer s.memAcc.Close(ctx)
+
+	for {
+		more, err := s.sortPartition(ctx, evalCtx, memLimit)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// sortPartition reads the rows of the next partition of the input, sorts them
+// and emits them. If memLimit is positive, the rows are moved to disk once they
+// use more memory than that. It returns false once the input is exhausted or
+// the consumer doesn't need more rows.
+func (s *partitionSorter) sortPartition(
+	ctx context.Context, evalCtx *tree.EvalContext, memLimit int64,
+) (bool, error) {
+	s.rows = s.rows[:0]
+	defer s.memAcc.Clear(ctx)
+
+	var disk *diskRowContainer
+	for {
+		row, last, err := s.acc.nextRowWithGroupBoundary(evalCtx)
+		if err != nil {
+			return false, err
+		}
+		if row == nil {
+			// The input is exhausted; the last row of the previous partition was
+			// marked as such, so this partition is empty.
+			return false, nil
+		}
+		if disk == nil {
+			size := row.MemorySize()
+			if memLimit > 0 && s.memAcc.Used()+size > memLimit {
+				log.VEventf(ctx, 2, "moving partition of %d rows to disk", len(s.rows))
+				if disk, err = s.spill(ctx); err != nil {
+					return false, err
+				}
+				defer disk.Close(ctx)
+			} else if err := s.memAcc.Grow(ctx, size); err != nil {
+				if memLimit <= 0 {
+					return false, errors.Wrap(err, "external storage for large queries disabled")
+				}
+				return false, err
+			}
+		}
+		if disk != nil {
+			if err := disk.AddRow(ctx, row); err != nil {
+				return false, err
+			}
+		} else {
+			s.rows = append(s.rows, s.rowAlloc.CopyRow(row))
+		}
+		if last {
+			break
+		}
+	}
+
+	if disk != nil {
+		return s.emitFromDisk(ctx, disk)
+	}
+	var sortErr error
+	sort.SliceStable(s.rows, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		var cmp int
+		cmp, sortErr = s.rows[i].Compare(s.types, &s.datumAlloc, s.ordering, evalCtx, s.rows[j])
+		return cmp < 0
+	})
+	if sortErr != nil {
+		return false, sortErr
+	}
+	for _, row := range s.rows {
+		consumerStatus, err := s.out.EmitRow(ctx, row)
+		if err != nil || consumerStatus != NeedMoreRows {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// spill moves the rows of the current partition buffered in memory to a new
+// diskRowContainer, which the caller must close.
+func (s *partitionSorter) spill(ctx context.Context) (*diskRowContainer, error) {
+	if m := s.flowCtx.Metrics; m != nil {
+		m.DiskSpill()
+	}
+	disk := makeDiskRowContainer(
+		ctx, s.flowCtx.diskMonitor, s.types, s.ordering, s.flowCtx.TempStorage,
+	)
+	for _, row := range s.rows {
+		if err := disk.AddRow(ctx, row); err != nil {
+			disk.Close(ctx)
+			return nil, err
+		}
+	}
+	s.rows = s.rows[:0]
+	s.memAcc.Clear(ctx)
+	return &disk, nil
+}
+
+// emitFromDisk emits the rows of a partition that was moved to disk, in sorted
+// order. It returns false if the consumer doesn't need more rows.
+func (s *partitionSorter) emitFromDisk(ctx context.Context, disk *diskRowContainer) (bool, error) {
+	i := disk.NewIterator(ctx)
+	defer i.Close()
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return false, err
+		} else if !ok {
+			return true, nil
+		}
+		row, err := i.Row()
+		if err != nil {
+			return false, err
+		}
+		consumerStatus, err := s.out.EmitRow(ctx, row)
+		if err != nil || consumerStatus != NeedMoreRows {
+			return false, err
+		}
+	}
+}
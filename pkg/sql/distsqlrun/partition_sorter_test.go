@@ -0,0 +1,141 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+func TestPartitionSorter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(base.DefaultTestTempStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:     evalCtx,
+		Settings:    cluster.MakeTestingClusterSettings(),
+		TempStorage: tempEngine,
+		diskMonitor: &diskMonitor,
+	}
+
+	// The rows are (a, b, sum), partitioned on a and sorted by sum descending
+	// within each partition. The rows of partition 2 with equal sums keep their
+	// input order.
+	spec := PartitionSorterSpec{
+		PartitionOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}},
+		),
+		Ordering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 2, Direction: encoding.Descending}},
+		),
+	}
+	input := [][]int{
+		{1, 1, 2}, {1, 3, 4}, {1, 2, 3},
+		{2, 1, 3}, {2, 5, 7}, {2, 2, 3}, {2, 9, 11}, {2, 0, 2},
+		{3, 0, 3},
+		{4, 7, 11}, {4, 8, 12},
+	}
+	expected := "[[1 3 4] [1 2 3] [1 1 2] " +
+		"[2 9 11] [2 5 7] [2 1 3] [2 2 3] [2 0 2] " +
+		"[3 0 3] " +
+		"[4 8 12] [4 7 11]]"
+
+	// Test with several memory limits:
+	// 0: Use the default limit.
+	// 1: Move each partition to disk as soon as it has a row.
+	// 600: Move only the largest partition to disk, after a few rows.
+	for _, memLimit := range []int64{0, 1, 600} {
+		t.Run(fmt.Sprintf("MemLimit=%d", memLimit), func(t *testing.T) {
+			in := NewRowBuffer(threeIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			out := &RowBuffer{}
+			s, err := newPartitionSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.flowCtx.testingKnobs.MemoryLimitBytes = memLimit
+			s.Run(ctx, nil)
+			s.flowCtx.testingKnobs.MemoryLimitBytes = 0
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(threeIntCols); res != expected {
+				t.Errorf("expected:\n   %s\ngot:\n   %s", expected, res)
+			}
+		})
+	}
+
+	t.Run("Cleanup", func(t *testing.T) {
+		checkProcessorCleanup(t, &flowCtx, func(out RowReceiver) (Processor, error) {
+			in := NewRowBuffer(threeIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+			return newPartitionSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		})
+	})
+
+	t.Run("BadlyOrdered", func(t *testing.T) {
+		badInput := [][]int{{2, 1, 3}, {1, 1, 2}}
+		in := NewRowBuffer(threeIntCols, genEncDatumRowsInt(badInput), RowBufferArgs{})
+		out := &RowBuffer{}
+		s, err := newPartitionSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Run(ctx, nil)
+
+		var errs []error
+		for {
+			row, meta := out.Next()
+			if row == nil && meta.Empty() {
+				break
+			}
+			if meta.Err != nil {
+				errs = append(errs, meta.Err)
+			}
+		}
+		if len(errs) != 1 || !testutils.IsError(errs[0], "detected badly ordered input") {
+			t.Fatalf("expected a badly ordered input error, got %v", errs)
+		}
+	})
+}
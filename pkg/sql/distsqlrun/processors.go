@@ -17,6 +17,7 @@ package distsqlrun
 import (
 	"context"
 	"math"
+	"runtime/debug"
 	"sync"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
@@ -51,6 +52,17 @@ type ProcOutputHelper struct {
 	output   RowReceiver
 	rowAlloc sqlbase.EncDatumRowAlloc
 
+	// reuseOutRow is set if the rows produced by EmitRow can all be built in
+	// outRowScratch instead of being allocated; see enableOutputRowReuse.
+	reuseOutRow   bool
+	outRowScratch sqlbase.EncDatumRow
+	// outRowBuf, if set, is the buffer used as outRowScratch, obtained from
+	// flowCtx and released on Close.
+	outRowBuf *sqlbase.EncDatumRow
+
+	// flowCtx, if set, is the context of the flow the processor is part of.
+	flowCtx *FlowCtx
+
 	filter *exprHelper
 	// renderExprs is set if we have a rendering. Only one of renderExprs and
 	// outputCols can be set.
@@ -78,6 +90,16 @@ type ProcOutputHelper struct {
 	rowIdx uint64
 }
 
+// rowsEmitted returns the number of rows that passed the filter and weren't
+// suppressed by the offset, i.e. the number of rows emitted so far (or about to
+// be emitted).
+func (h *ProcOutputHelper) rowsEmitted() uint64 {
+	if h.rowIdx <= h.offset {
+		return 0
+	}
+	return h.rowIdx - h.offset
+}
+
 // Init sets up a ProcOutputHelper. The types describe the internal schema of
 // the processor (as described for each processor core spec); they can be
 // omitted if there is no filtering expression.
@@ -116,12 +138,30 @@ func (h *ProcOutputHelper) Init(
 			h.outputTypes[i] = types[c]
 		}
 	} else if len(post.RenderExprs) > 0 {
+		if len(post.RenderTypes) > 0 && len(post.RenderTypes) != len(post.RenderExprs) {
+			return errors.Errorf(
+				"post-processing has %d render expressions but %d render types: %s",
+				len(post.RenderExprs), len(post.RenderTypes), post,
+			)
+		}
 		h.renderExprs = make([]exprHelper, len(post.RenderExprs))
 		h.outputTypes = make([]sqlbase.ColumnType, len(post.RenderExprs))
 		for i, expr := range post.RenderExprs {
 			if err := h.renderExprs[i].init(expr, types, evalCtx); err != nil {
 				return err
 			}
+			if len(post.RenderTypes) > 0 {
+				// Cast the expression to its declared type if needed.
+				h.outputTypes[i] = post.RenderTypes[i]
+				typedExpr, err := tree.ReType(
+					h.renderExprs[i].expr, h.outputTypes[i].ToDatumType(),
+				)
+				if err != nil {
+					return errors.Wrapf(err, "render expression %d", i)
+				}
+				h.renderExprs[i].expr = typedExpr
+				continue
+			}
 			colTyp, err := sqlbase.DatumTypeToColumnType(h.renderExprs[i].expr.ResolvedType())
 			if err != nil {
 				return err
@@ -189,7 +229,7 @@ func (h *ProcOutputHelper) neededColumns() (colIdxs util.FastIntSet) {
 // ProcOutputHelper and are routed directly to its output.
 //
 // If the consumer signals the producer to drain, the message is relayed and all
-// the draining metadata is consumed and forwarded.
+// the draining metadata is consumed and forwarded; see drainHelper.
 //
 // inputs are optional.
 //
@@ -224,32 +264,107 @@ func emitHelper(
 			return false
 		}
 	}
-	switch consumerStatus {
+	return makeDrainHelper(output, inputs...).handleConsumerStatus(ctx, consumerStatus)
+}
+
+// drainHelper implements what a processor does once its consumer no longer
+// needs rows: it stops producing rows, keeps reading the metadata of its inputs
+// until they are exhausted and forwards that metadata before closing its
+// output. It is used by emitHelper(), so processors emitting through it don't
+// need to handle the consumer's status themselves.
+type drainHelper struct {
+	output *ProcOutputHelper
+	inputs []RowSource
+}
+
+func makeDrainHelper(output *ProcOutputHelper, inputs ...RowSource) drainHelper {
+	return drainHelper{output: output, inputs: inputs}
+}
+
+// handleConsumerStatus reacts to the status returned by the consumer when a
+// record was pushed to it. It returns true if the consumer needs more rows.
+// Otherwise, false is returned and the inputs and the output have been closed:
+//  - if the consumer requested draining, the inputs are drained first and
+//    their metadata is forwarded to the consumer, along with the trace data.
+//  - if the consumer is closed, the inputs are closed without being drained.
+func (d drainHelper) handleConsumerStatus(ctx context.Context, status ConsumerStatus) bool {
+	switch status {
 	case NeedMoreRows:
 		return true
 	case DrainRequested:
 		log.VEventf(ctx, 1, "no more rows required. drain requested.")
-		DrainAndClose(ctx, output.output, nil /* cause */, inputs...)
+		d.drain(ctx)
 		return false
 	case ConsumerClosed:
 		log.VEventf(ctx, 1, "no more rows required. Consumer shut down.")
-		for _, input := range inputs {
+		for _, input := range d.inputs {
 			input.ConsumerClosed()
 		}
-		output.Close()
+		d.output.Close()
 		return false
 	default:
-		log.Fatalf(ctx, "unexpected consumerStatus: %d", consumerStatus)
+		log.Fatalf(ctx, "unexpected consumerStatus: %d", status)
 		return false
 	}
 }
 
+// drain drains all the inputs (concurrently, so that an input doesn't block
+// waiting for another one to be read), forwards their metadata to the consumer
+// and closes the output. If the consumer gets closed while the metadata is
+// forwarded, the rest of the metadata is dropped.
+func (d drainHelper) drain(ctx context.Context) {
+	metas := make([][]ProducerMetadata, len(d.inputs))
+	var wg sync.WaitGroup
+	for i := range d.inputs {
+		if i == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			metas[i] = d.drainInput(d.inputs[i])
+			wg.Done()
+		}(i)
+	}
+	if len(d.inputs) > 0 {
+		metas[0] = d.drainInput(d.inputs[0])
+	}
+	wg.Wait()
+
+	for _, inputMetas := range metas {
+		for _, meta := range inputMetas {
+			if d.output.output.Push(nil /* row */, meta) == ConsumerClosed {
+				d.output.Close()
+				return
+			}
+		}
+	}
+	sendTraceData(ctx, d.output.output)
+	d.output.Close()
+}
+
+// drainInput asks the input to drain and reads it until it is exhausted,
+// discarding the rows. It returns the metadata that was read.
+func (d drainHelper) drainInput(input RowSource) []ProducerMetadata {
+	input.ConsumerDone()
+	var metas []ProducerMetadata
+	for {
+		row, meta := input.Next()
+		if row == nil && meta.Empty() {
+			return metas
+		}
+		if !meta.Empty() {
+			metas = append(metas, meta)
+		}
+	}
+}
+
 // EmitRow sends a row through the post-processing stage. The same row can be
 // reused.
 //
 // It returns the consumer's status that was observed when pushing this row. If
 // an error is returned, it's coming from the ProcOutputHelper's filtering or
-// rendering processing; the output has not been closed and it's the caller's
+// rendering processing, or the post-processed row is larger than
+// FlowCtx.MaxRowBytes; the output has not been closed and it's the caller's
 // responsibility to push the error to the output.
 //
 // Note: check out emitHelper() for a useful wrapper.
@@ -260,13 +375,18 @@ func (h *ProcOutputHelper) EmitRow(
 		panic("output RowReceiver not initialized for emitting rows")
 	}
 
-	outRow, status, err := h.ProcessRow(ctx, row)
+	outRow, status, err := h.processRow(ctx, row, h.reuseOutRow)
 	// If outRow is nil, either a drain was requested or the row was filtered
 	// out.
 	// If an error occurred, we need to return that here.
 	if outRow == nil || err != nil {
 		return status, err
 	}
+	if h.flowCtx != nil && h.flowCtx.MaxRowBytes > 0 {
+		if size := outRow.MemorySize(); size > h.flowCtx.MaxRowBytes {
+			return ConsumerClosed, newRowTooLargeError(size, h.flowCtx.MaxRowBytes)
+		}
+	}
 
 	if log.V(3) {
 		log.InfofDepth(ctx, 1, "pushing row %s", outRow)
@@ -293,6 +413,14 @@ func (h *ProcOutputHelper) EmitRow(
 // output RowReceiver.
 func (h *ProcOutputHelper) ProcessRow(
 	ctx context.Context, row sqlbase.EncDatumRow,
+) (sqlbase.EncDatumRow, ConsumerStatus, error) {
+	return h.processRow(ctx, row, false /* reuseOutRow */)
+}
+
+// processRow implements ProcessRow. If reuseOutRow is set, the post-processed
+// row is built in outRowScratch and is only valid until the next call.
+func (h *ProcOutputHelper) processRow(
+	ctx context.Context, row sqlbase.EncDatumRow, reuseOutRow bool,
 ) (sqlbase.EncDatumRow, ConsumerStatus, error) {
 	if h.rowIdx >= h.maxRowIdx {
 		return nil, DrainRequested, nil
@@ -320,7 +448,7 @@ func (h *ProcOutputHelper) ProcessRow(
 	var outRow sqlbase.EncDatumRow
 	if h.renderExprs != nil {
 		// Rendering.
-		outRow = h.rowAlloc.AllocRow(len(h.renderExprs))
+		outRow = h.allocOutRow(len(h.renderExprs), reuseOutRow)
 		for i := range h.renderExprs {
 			datum, err := h.renderExprs[i].eval(row)
 			if err != nil {
@@ -330,22 +458,60 @@ func (h *ProcOutputHelper) ProcessRow(
 		}
 	} else if h.outputCols != nil {
 		// Projection.
-		outRow = h.rowAlloc.AllocRow(len(h.outputCols))
+		outRow = h.allocOutRow(len(h.outputCols), reuseOutRow)
 		for i, col := range h.outputCols {
 			outRow[i] = row[col]
 		}
+	} else if reuseOutRow {
+		// No rendering or projection, and the output doesn't retain the row: the
+		// input row can be passed through as is, which is the common case of a
+		// filter-only post-processing.
+		outRow = row
 	} else {
 		// No rendering or projection.
-		outRow = h.rowAlloc.AllocRow(len(row))
+		outRow = h.allocOutRow(len(row), reuseOutRow)
 		copy(outRow, row)
 	}
 
 	return outRow, NeedMoreRows, nil
 }
 
+func (h *ProcOutputHelper) allocOutRow(n int, reuse bool) sqlbase.EncDatumRow {
+	if !reuse {
+		return h.rowAlloc.AllocRow(n)
+	}
+	if cap(h.outRowScratch) < n {
+		h.outRowScratch = make(sqlbase.EncDatumRow, n)
+	}
+	return h.outRowScratch[:n]
+}
+
+// enableOutputRowReuse allows EmitRow to build all the output rows in the same
+// memory instead of allocating a fresh row for each of them. This is only
+// possible if the output doesn't retain the rows pushed to it (i.e. it is a
+// RowCopyingReceiver); otherwise rows continue to be allocated. Returns
+// whether reuse was enabled.
+func (h *ProcOutputHelper) enableOutputRowReuse() bool {
+	_, h.reuseOutRow = h.output.(RowCopyingReceiver)
+	if h.reuseOutRow && h.flowCtx != nil && h.outRowBuf == nil {
+		// All the output rows have the same width, so the buffer can be set up
+		// once; rendered datums are written directly into it.
+		h.outRowBuf = h.flowCtx.getRowBuf(len(h.outputTypes))
+		h.outRowScratch = *h.outRowBuf
+	}
+	return h.reuseOutRow
+}
+
 // Close signals to the output that there will be no more rows.
 func (h *ProcOutputHelper) Close() {
 	h.output.ProducerDone()
+	if h.outRowBuf != nil {
+		// The output copies the rows pushed to it, so it no longer references
+		// the buffer.
+		h.flowCtx.putRowBuf(h.outRowBuf)
+		h.outRowBuf = nil
+		h.outRowScratch = nil
+	}
 }
 
 type processorBase struct {
@@ -360,9 +526,27 @@ func (pb *processorBase) OutputTypes() []sqlbase.ColumnType {
 func (pb *processorBase) init(
 	post *PostProcessSpec, types []sqlbase.ColumnType, flowCtx *FlowCtx, output RowReceiver,
 ) error {
+	pb.out.flowCtx = flowCtx
 	return pb.out.Init(post, types, flowCtx.NewEvalCtx(), output)
 }
 
+// recoverPanic recovers from a panic of the processor, so that a bug hit by a
+// single query doesn't crash the node. The panic is converted into an internal
+// error that carries its stack trace (see newProcessorPanicError), and the
+// processor's inputs are drained before the error is pushed to the consumer
+// and the output is closed, as with any other error. Processors defer it at
+// the start of Run; it assumes that they haven't closed their output when
+// they panic.
+func (pb *processorBase) recoverPanic(ctx context.Context, inputs ...RowSource) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	log.Errorf(ctx, "processor panicked: %v\n%s", r, stack)
+	DrainAndClose(ctx, pb.out.output, newProcessorPanicError(r, stack), inputs...)
+}
+
 // noopProcessor is a processor that simply passes rows through from the
 // synchronizer to the post-processing stage. It can be useful for its
 // post-processing or in the last stage of a computation, where we may only
@@ -404,6 +588,7 @@ func (n *noopProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 	ctx, span := processorSpan(ctx, "noop")
 	defer tracing.FinishSpan(span)
+	defer n.recoverPanic(ctx, n.input)
 
 	for {
 		row, meta := n.input.Next()
@@ -447,7 +632,13 @@ func newProcessor(
 		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
 			return nil, err
 		}
-		return newJoinReader(flowCtx, core.JoinReader, inputs[0], post, outputs[0])
+		return newJoinReader(flowCtx, core.JoinReader, inputs[0], post, outputs[0], nil /* kv */)
+	}
+	if core.ZigzagJoiner != nil {
+		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
+			return nil, err
+		}
+		return newZigzagJoiner(flowCtx, core.ZigzagJoiner, post, outputs[0], nil /* kv */)
 	}
 	if core.Sorter != nil {
 		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
@@ -455,6 +646,30 @@ func newProcessor(
 		}
 		return newSorter(flowCtx, core.Sorter, inputs[0], post, outputs[0])
 	}
+	if core.PartitionSorter != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newPartitionSorter(flowCtx, core.PartitionSorter, inputs[0], post, outputs[0])
+	}
+	if core.UnionAll != nil {
+		if err := checkNumInOut(inputs, outputs, 2, 1); err != nil {
+			return nil, err
+		}
+		return newUnionAll(flowCtx, core.UnionAll, inputs[0], inputs[1], post, outputs[0])
+	}
+	if core.OrderingEnforcer != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newOrderingEnforcer(flowCtx, core.OrderingEnforcer, inputs[0], post, outputs[0])
+	}
+	if core.ExternalDistinct != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newExternalDistinct(flowCtx, core.ExternalDistinct, inputs[0], post, outputs[0])
+	}
 	if core.Distinct != nil {
 		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
 			return nil, err
@@ -465,6 +680,12 @@ func newProcessor(
 		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
 			return nil, err
 		}
+		// Scalar aggregations (without group columns) go to the aggregator too:
+		// the streamAggregator buffers each group, which for them is the whole
+		// input.
+		if len(core.Aggregator.Ordering.Columns) > 0 {
+			return newStreamAggregator(flowCtx, core.Aggregator, inputs[0], post, outputs[0])
+		}
 		return newAggregator(flowCtx, core.Aggregator, inputs[0], post, outputs[0])
 	}
 	if core.MergeJoiner != nil {
@@ -518,6 +739,12 @@ func newProcessor(
 		}
 		return newSampleAggregator(flowCtx, core.SampleAggregator, inputs[0], post, outputs[0])
 	}
+	if core.CSVReader != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newCSVReader(flowCtx, core.CSVReader, inputs[0], post, outputs[0])
+	}
 	if core.ReadCSV != nil {
 		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
 			return nil, err
@@ -16,12 +16,19 @@ package distsqlrun
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 )
 
@@ -301,6 +308,393 @@ func TestPostProcess(t *testing.T) {
 	}
 }
 
+// TestPostProcessRenderTypes verifies that rendered values are cast to the
+// declared render types.
+func TestPostProcessRenderTypes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// The integer division of INTs is an INT, declared as a DECIMAL.
+	post := PostProcessSpec{
+		RenderExprs: []Expression{{Expr: "@1 // @2"}, {Expr: "@1 + @2"}},
+		RenderTypes: []sqlbase.ColumnType{decType, intType},
+	}
+	input := genEncDatumRowsInt([][]int{{7, 2}, {9, 3}, {-7, 2}})
+	outBuf := &RowBuffer{}
+	var out ProcOutputHelper
+	if err := out.Init(&post, twoIntCols, evalCtx, outBuf); err != nil {
+		t.Fatal(err)
+	}
+	if types := []sqlbase.ColumnType{decType, intType}; !reflect.DeepEqual(out.outputTypes, types) {
+		t.Fatalf("expected output types %v, got %v", types, out.outputTypes)
+	}
+	for _, row := range input {
+		if _, err := out.EmitRow(context.TODO(), row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := outBuf.GetRowsNoMeta(t)
+	for _, row := range res {
+		if _, ok := row[0].Datum.(*tree.DDecimal); !ok {
+			t.Fatalf("expected a DECIMAL, got %T", row[0].Datum)
+		}
+		if _, ok := row[1].Datum.(*tree.DInt); !ok {
+			t.Fatalf("expected an INT, got %T", row[1].Datum)
+		}
+	}
+	if str, expected := res.String(out.outputTypes), "[[3 9] [3 12] [-3 -5]]"; str != expected {
+		t.Errorf("expected %s, got %s", expected, str)
+	}
+
+	// The number of render types must match the number of render expressions.
+	post.RenderTypes = post.RenderTypes[:1]
+	if err := out.Init(&post, twoIntCols, evalCtx, &RowBuffer{}); !testutils.IsError(
+		err, "2 render expressions but 1 render types",
+	) {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+// TestPostProcessFilterPassThrough verifies that the rows that pass a
+// filter-only post-processing are passed through without being copied when the
+// output doesn't retain them.
+func TestPostProcessFilterPassThrough(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	post := PostProcessSpec{Filter: Expression{Expr: "@1 < 5"}}
+	var out ProcOutputHelper
+	if err := out.Init(&post, twoIntCols, evalCtx, &RowDisposer{}); err != nil {
+		t.Fatal(err)
+	}
+	if !out.enableOutputRowReuse() {
+		t.Fatal("expected the output rows to be reusable")
+	}
+	row := genEncDatumRowsInt([][]int{{1, 2}})[0]
+	for _, reuse := range []bool{false, true} {
+		outRow, _, err := out.processRow(context.TODO(), row, reuse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, expected := outRow.String(twoIntCols), "[1 2]"; res != expected {
+			t.Errorf("expected %s, got %s", expected, res)
+		}
+		if passedThrough := &outRow[0] == &row[0]; passedThrough != reuse {
+			t.Errorf("reuse=%t: expected the row to be passed through: %t", reuse, reuse)
+		}
+	}
+}
+
+// TestPostProcessOutputRowBuf verifies that a ProcOutputHelper whose output
+// rows are reused builds them in a buffer obtained from its FlowCtx, which is
+// released once the output is closed, without affecting the rows received.
+func TestPostProcessOutputRowBuf(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	post := PostProcessSpec{RenderExprs: []Expression{{Expr: "@1 + @2"}, {Expr: "@1"}}}
+	recv := NewDatumRowReceiver(twoIntCols)
+	var pb processorBase
+	if err := pb.init(&post, twoIntCols, &flowCtx, recv); err != nil {
+		t.Fatal(err)
+	}
+	if !pb.out.enableOutputRowReuse() {
+		t.Fatal("expected the output rows to be reusable")
+	}
+	if pb.out.outRowBuf == nil || len(*pb.out.outRowBuf) != 2 {
+		t.Fatalf("expected an output row buffer of 2 columns, got %v", pb.out.outRowBuf)
+	}
+	for _, row := range genEncDatumRowsInt([][]int{{1, 2}, {3, 4}, {5, 6}}) {
+		if status, err := pb.out.EmitRow(context.Background(), row); err != nil {
+			t.Fatal(err)
+		} else if status != NeedMoreRows {
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	pb.out.Close()
+	if pb.out.outRowBuf != nil {
+		t.Fatal("expected the output row buffer to be released")
+	}
+
+	var res []string
+	for _, row := range recv.Rows() {
+		res = append(res, fmt.Sprintf("%s %s", row[0], row[1]))
+	}
+	if expected := []string{"3 1", "7 3", "11 5"}; !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+// BenchmarkPostProcessFilter measures the throughput of a filter-only
+// post-processing, with and without passing through the rows that pass it.
+func BenchmarkPostProcessFilter(b *testing.B) {
+	evalCtx := tree.NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	var rows [][]int
+	for i := 0; i < 1024; i++ {
+		rows = append(rows, []int{i % 10, i, i % 7})
+	}
+	input := genEncDatumRowsInt(rows)
+	post := PostProcessSpec{Filter: Expression{Expr: "@3 <= 5"}}
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("PassThrough=%t", reuse), func(b *testing.B) {
+			var out ProcOutputHelper
+			if err := out.Init(&post, threeIntCols, evalCtx, &RowDisposer{}); err != nil {
+				b.Fatal(err)
+			}
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := out.processRow(ctx, input[i%len(input)], reuse); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestNoopProcessorPushOrder verifies the exact sequence of records pushed by
+// a noopProcessor whose input produces rows followed by an error.
+func TestNoopProcessorPushOrder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	expectedErr := errors.New("input error")
+	in := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{})
+	for _, row := range genEncDatumRowsInt([][]int{{1}, {2}, {3}}) {
+		in.Push(row, ProducerMetadata{})
+	}
+	in.Push(nil /* row */, ProducerMetadata{Err: expectedErr})
+
+	out := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{RecordPushLog: true})
+	n, err := newNoopProcessor(&flowCtx, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Run(context.Background(), nil /* wg */)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	log := out.PushLog()
+	if len(log) != 4 {
+		t.Fatalf("expected 4 records, got %d: %v", len(log), log)
+	}
+	var rows sqlbase.EncDatumRows
+	for _, rec := range log[:3] {
+		if !rec.Meta.Empty() {
+			t.Fatalf("expected rows before the error, got metadata: %+v", rec.Meta)
+		}
+		rows = append(rows, rec.Row)
+	}
+	if str, expected := rows.String(oneIntCol), "[[1] [2] [3]]"; str != expected {
+		t.Errorf("expected rows %s, got %s", expected, str)
+	}
+	if last := log[3]; last.Row != nil || last.Meta.Err != expectedErr {
+		t.Errorf("expected trailing error %v, got row %v meta %+v", expectedErr, last.Row, last.Meta)
+	}
+}
+
+// TestNoopProcessorConsumerClosed verifies that a noopProcessor stops promptly
+// when its consumer is closed in the middle of the stream.
+func TestNoopProcessorConsumerClosed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	in := NewRowBuffer(oneIntCol, makeIntRows(5, 1), RowBufferArgs{})
+	numRows := 0
+	out := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{
+		// Close the consumer after it received 2 rows.
+		OnPush: func(row sqlbase.EncDatumRow, _ *ProducerMetadata) ConsumerStatus {
+			if row != nil {
+				numRows++
+			}
+			if numRows >= 2 {
+				return ConsumerClosed
+			}
+			return NeedMoreRows
+		},
+	})
+	n, err := newNoopProcessor(&flowCtx, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Run(context.Background(), nil /* wg */)
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	if numRows != 2 {
+		t.Fatalf("expected the producer to stop after 2 rows, got %d", numRows)
+	}
+	if in.ConsumerStatus != ConsumerClosed {
+		t.Fatalf("expected the input to be closed, got status %d", in.ConsumerStatus)
+	}
+}
+
+// TestProcessorPanic verifies that a panic in a processor is reported to the
+// consumer as an internal error, with the stack trace of the panic, and that
+// the processor still drains its input and closes its output.
+func TestProcessorPanic(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	in := NewRowBuffer(oneIntCol, makeIntRows(5, 1), RowBufferArgs{})
+	// The processor panics while pushing its first row.
+	out := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{
+		OnPush: func(row sqlbase.EncDatumRow, _ *ProducerMetadata) ConsumerStatus {
+			if row != nil {
+				panic("boom")
+			}
+			return NeedMoreRows
+		},
+	})
+	n, err := newNoopProcessor(&flowCtx, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go n.Run(context.Background(), &wg)
+	wg.Wait()
+
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	if in.ConsumerStatus != DrainRequested {
+		t.Errorf("expected the input to be drained, got status %d", in.ConsumerStatus)
+	}
+	var errs []error
+	for {
+		row, meta := out.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if meta.Err != nil {
+			errs = append(errs, meta.Err)
+		}
+	}
+	if len(errs) != 1 || !testutils.IsError(errs[0], "internal error: processor panicked: boom") {
+		t.Fatalf("expected a panic error, got %v", errs)
+	}
+	pgErr, ok := pgerror.GetPGCause(errs[0])
+	if !ok || pgErr.Code != pgerror.CodeInternalError {
+		t.Fatalf("expected error with code %s, got %v", pgerror.CodeInternalError, errs[0])
+	}
+	if !strings.Contains(pgErr.Detail, "TestProcessorPanic") {
+		t.Errorf("expected the stack trace of the panic in the error details, got %q", pgErr.Detail)
+	}
+}
+
+// leakyProcessor is a processor that forwards the rows of its input, but that
+// leaks a goroutine (running until stop is closed) if its consumer is closed.
+type leakyProcessor struct {
+	input RowSource
+	out   RowReceiver
+	stop  chan struct{}
+}
+
+var _ Processor = &leakyProcessor{}
+
+// OutputTypes is part of the Processor interface.
+func (p *leakyProcessor) OutputTypes() []sqlbase.ColumnType {
+	return p.input.Types()
+}
+
+// Run is part of the Processor interface.
+func (p *leakyProcessor) Run(_ context.Context, _ *sync.WaitGroup) {
+	for {
+		row, meta := p.input.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if p.out.Push(row, meta) == ConsumerClosed {
+			go func() { <-p.stop }()
+			break
+		}
+	}
+	p.out.ProducerDone()
+}
+
+// recordingTB is a testing.TB that records the errors reported to it instead of
+// failing the test.
+type recordingTB struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Failed() bool {
+	return len(r.errs) > 0
+}
+
+// TestCheckProcessorCleanup verifies that checkProcessorCleanup detects leaked
+// goroutines.
+func TestCheckProcessorCleanup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: cluster.MakeTestingClusterSettings(),
+	}
+
+	rec := &recordingTB{TB: t}
+	checkProcessorCleanup(rec, &flowCtx, func(out RowReceiver) (Processor, error) {
+		in := NewRowBuffer(oneIntCol, makeIntRows(5, 1), RowBufferArgs{})
+		return newNoopProcessor(&flowCtx, in, &PostProcessSpec{}, out)
+	})
+	if len(rec.errs) != 0 {
+		t.Fatalf("unexpected errors for the noop processor: %q", rec.errs)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	checkProcessorCleanup(rec, &flowCtx, func(out RowReceiver) (Processor, error) {
+		in := NewRowBuffer(oneIntCol, makeIntRows(5, 1), RowBufferArgs{})
+		return &leakyProcessor{input: in, out: out, stop: stop}, nil
+	})
+	if len(rec.errs) != 1 || !strings.Contains(rec.errs[0], "Leaked goroutine") ||
+		!strings.Contains(rec.errs[0], "leakyProcessor") {
+		t.Fatalf("expected a single leaked goroutine to be reported, got %q", rec.errs)
+	}
+}
+
 func TestAggregatorSpecAggregationEquals(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
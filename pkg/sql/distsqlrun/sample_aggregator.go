@@ -115,6 +115,7 @@ func (s *sampleAggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 	ctx, span := processorSpan(ctx, "sample aggregator")
 	defer tracing.FinishSpan(span)
+	defer s.recoverPanic(ctx, s.input)
 
 	earlyExit, err := s.mainLoop(ctx)
 	if err != nil {
@@ -132,6 +132,7 @@ func (s *samplerProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 	ctx, span := processorSpan(ctx, "sampler")
 	defer tracing.FinishSpan(span)
+	defer s.recoverPanic(ctx, s.input)
 
 	earlyExit, err := s.mainLoop(ctx)
 	if err != nil {
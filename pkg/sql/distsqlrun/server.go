@@ -95,6 +95,18 @@ var settingWorkMemBytes = settings.RegisterByteSizeSetting(
 	64*1024*1024, /* 64MB */
 )
 
+var settingMaxBufferedGroupRows = settings.RegisterIntSetting(
+	"sql.distsql.max_buffered_group_rows",
+	"maximum number of rows of a single group that processors reading ordered input can buffer (0 for no limit)",
+	0,
+)
+
+var settingMaxRowBytes = settings.RegisterByteSizeSetting(
+	"sql.distsql.max_row_size",
+	"maximum size of a row emitted by a distributed sql processor (0 for no limit)",
+	0,
+)
+
 var noteworthyMemoryUsageBytes = envutil.EnvOrDefaultInt64("COCKROACH_NOTEWORTHY_DISTSQL_MEMORY_USAGE", 1024*1024 /* 1MB */)
 
 // ServerConfig encompasses the configuration required to create a
@@ -295,6 +307,8 @@ func (ds *ServerImpl) setupFlow(
 		TempStorage:    ds.TempStorage,
 		diskMonitor:    ds.DiskMonitor,
 		JobRegistry:    ds.ServerConfig.JobRegistry,
+		Metrics:        ds.Metrics,
+		MaxRowBytes:    settingMaxRowBytes.Get(&ds.Settings.SV),
 	}
 
 	ctx = flowCtx.AnnotateCtx(ctx)
@@ -438,6 +452,17 @@ type TestingKnobs struct {
 	// enable. Once this limit is hit, processors employ their on-disk
 	// implementation regardless of applicable cluster settings.
 	MemoryLimitBytes int64
+
+	// MemoryFailAfterBytes, if positive, makes the memory accounts of the
+	// processors that support it refuse to grow beyond this many bytes,
+	// regardless of the budget of their monitors. Unlike a small real budget,
+	// this makes memory errors happen at a deterministic point.
+	MemoryFailAfterBytes int64
+
+	// CheckRowTypes, if set, causes the rows received by the processors of a
+	// flow to be validated against the declared column types of their input
+	// synchronizers. A mismatch is reported as an error (in metadata).
+	CheckRowTypes bool
 }
 
 // ModuleTestingKnobs is part of the base.ModuleTestingKnobs interface.
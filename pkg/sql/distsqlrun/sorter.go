@@ -61,7 +61,7 @@ func newSorter(
 	}
 	s := &sorter{
 		flowCtx:     flowCtx,
-		input:       MakeNoMetadataRowSource(input, output),
+		input:       MakeNoMetadataRowSource(input, ForwardMetadata(output)),
 		rawInput:    input,
 		ordering:    convertToColumnOrdering(spec.OutputOrdering),
 		matchLen:    spec.OrderingMatchLen,
@@ -83,6 +83,7 @@ func (s *sorter) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTag(ctx, "Sorter", nil)
 	ctx, span := processorSpan(ctx, "sorter")
 	defer tracing.FinishSpan(span)
+	defer s.recoverPanic(ctx, s.rawInput)
 
 	if log.V(2) {
 		log.Infof(ctx, "starting sorter run")
@@ -74,6 +74,9 @@ func (ss *sortAllStrategy) Execute(ctx context.Context, s *sorter) error {
 		return errors.Wrap(err, "external storage for large queries disabled")
 	}
 	log.VEventf(ctx, 2, "falling back to disk")
+	if m := s.flowCtx.Metrics; m != nil {
+		m.DiskSpill()
+	}
 	diskContainer := makeDiskRowContainer(
 		ctx, s.flowCtx.diskMonitor, ss.rows.types, ss.rows.ordering, s.tempStorage,
 	)
@@ -0,0 +1,503 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/pkg/errors"
+)
+
+// streamAggregator is the streaming counterpart of the aggregator: its input is
+// sorted on the group columns, so it reads it row by row through a
+// streamGroupAccumulator, adds each row to the aggregations of the current
+// group and emits a row once the group ends, before moving on to the next
+// group. Unlike the aggregator, it doesn't need to hold the state of all the
+// groups at once, it doesn't buffer the rows of a group, and it produces rows
+// as it reads its input.
+//
+// It is used for AggregatorSpecs with an ordering; see
+// AggregatorSpec.Ordering. Without group columns, all the input rows form a
+// single group.
+//
+// If the spec has a result ordering, the rows produced for the groups are
+// buffered and sorted before being emitted; see AggregatorSpec.ResultOrdering.
+type streamAggregator struct {
+	processorBase
+
+	flowCtx     *FlowCtx
+	input       RowSource
+	inputTypes  []sqlbase.ColumnType
+	ordering    sqlbase.ColumnOrdering
+	funcs       []func(*tree.EvalContext) tree.AggregateFunc
+	outputTypes []sqlbase.ColumnType
+	datumAlloc  sqlbase.DatumAlloc
+
+	aggregations []AggregatorSpec_Aggregation
+
+	// numGroupCols is the number of columns at the start of the ordering which
+	// are the group columns; the rows of each group follow the rest of it.
+	numGroupCols int
+
+	// caseInsensitiveCols are the group columns whose values are folded to
+	// lower case before being compared; see AggregatorSpec.CaseInsensitiveCols.
+	caseInsensitiveCols []uint32
+
+	// groupAggs are the aggregations of the current group, which the rows are
+	// added to as they are read; inGroup is set while they are open.
+	// distinctAcc accounts for the memory of their seen maps.
+	groupAggs   []groupAggregation
+	inGroup     bool
+	distinctAcc boundAccount
+	scratch     []byte
+
+	// row is used to build the output rows.
+	row sqlbase.EncDatumRow
+
+	// resultOrdering, if set, is the ordering in which the rows are emitted.
+	// The rows are then buffered in results (with resultsAcc accounting for
+	// their memory) or, past the memory limit, in resultsDisk.
+	resultOrdering sqlbase.ColumnOrdering
+	results        sqlbase.EncDatumRows
+	resultsAlloc   sqlbase.EncDatumRowAlloc
+	resultsAcc     boundAccount
+	resultsDisk    *diskRowContainer
+	resultsLimit   int64
+}
+
+var _ Processor = &streamAggregator{}
+
+// groupAggregation is the state of an aggregation over the rows of the current
+// group of a streamAggregator.
+type groupAggregation struct {
+	impl tree.AggregateFunc
+	// seen contains the encoded arguments already added, for DISTINCT
+	// aggregations.
+	seen map[string]struct{}
+	// otherArgs is scratch space for the arguments past the first one.
+	otherArgs tree.Datums
+}
+
+func newStreamAggregator(
+	flowCtx *FlowCtx,
+	spec *AggregatorSpec,
+	input RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*streamAggregator, error) {
+	// The groups are formed by the streamGroupAccumulator based on the
+	// ordering, so the ordering must start with exactly the group columns.
+	var groupCols, orderingCols util.FastIntSet
+	for _, c := range spec.GroupCols {
+		groupCols.Add(int(c))
+	}
+	numGroupCols := len(spec.GroupCols)
+	if numGroupCols > len(spec.Ordering.Columns) {
+		numGroupCols = len(spec.Ordering.Columns)
+	}
+	for _, c := range spec.Ordering.Columns[:numGroupCols] {
+		orderingCols.Add(int(c.ColIdx))
+	}
+	if !groupCols.Equals(orderingCols) || numGroupCols != orderingCols.Len() {
+		return nil, errors.Errorf(
+			"ordering %s doesn't start with the group columns %s",
+			spec.Ordering.diagramString(), colListStr(spec.GroupCols),
+		)
+	}
+	for _, c := range spec.Ordering.Columns[numGroupCols:] {
+		if int(c.ColIdx) >= len(input.Types()) || orderingCols.Contains(int(c.ColIdx)) {
+			return nil, errors.Errorf("invalid ordering %s", spec.Ordering.diagramString())
+		}
+		orderingCols.Add(int(c.ColIdx))
+	}
+
+	ag := &streamAggregator{
+		flowCtx:             flowCtx,
+		input:               input,
+		inputTypes:          input.Types(),
+		ordering:            convertToColumnOrdering(spec.Ordering),
+		numGroupCols:        numGroupCols,
+		caseInsensitiveCols: spec.CaseInsensitiveCols,
+		aggregations:        spec.Aggregations,
+	}
+	for _, c := range spec.CaseInsensitiveCols {
+		if !groupCols.Contains(int(c)) {
+			return nil, errors.Errorf("case-insensitive column %d is not a group column", c)
+		}
+		if typ := ag.inputTypes[c].SemanticType; typ != sqlbase.ColumnType_STRING {
+			return nil, errors.Errorf("case-insensitive column %d has type %s, expected STRING", c, typ)
+		}
+	}
+	var err error
+	ag.funcs, ag.outputTypes, err = getAggregationInfos(spec.Aggregations, ag.inputTypes)
+	if err != nil {
+		return nil, err
+	}
+	if err := ag.init(post, ag.outputTypes, flowCtx, output); err != nil {
+		return nil, err
+	}
+	ag.row = make(sqlbase.EncDatumRow, len(ag.funcs))
+	ag.groupAggs = make([]groupAggregation, len(ag.funcs))
+	for i, a := range spec.Aggregations {
+		if len(a.ColIdx) > 1 {
+			ag.groupAggs[i].otherArgs = make(tree.Datums, len(a.ColIdx)-1)
+		}
+	}
+	if len(spec.ResultOrdering.Columns) > 0 {
+		ag.resultOrdering = convertToColumnOrdering(spec.ResultOrdering)
+		for _, c := range ag.resultOrdering {
+			if c.ColIdx >= len(ag.outputTypes) {
+				return nil, errors.Errorf(
+					"invalid result ordering column %d (%d aggregations)",
+					c.ColIdx, len(ag.outputTypes),
+				)
+			}
+		}
+	}
+	return ag, nil
+}
+
+// Run is part of the processor interface.
+func (ag *streamAggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "StreamAgg", nil)
+	ctx, span := processorSpan(ctx, "stream aggregator")
+	defer tracing.FinishSpan(span)
+	defer ag.recoverPanic(ctx, ag.input)
+
+	if log.V(2) {
+		log.Infof(ctx, "starting stream aggregation process")
+		defer log.Infof(ctx, "exiting stream aggregator")
+	}
+
+	evalCtx := ag.flowCtx.NewEvalCtx()
+	acc := makeStreamGroupAccumulator(
+		MakeNoMetadataRowSource(ag.input, ForwardMetadata(ag.out.output)),
+		ag.ordering[:ag.numGroupCols], true, /* nullsAreEqual */
+	)
+	defer acc.close(ctx)
+	acc.setCancellation(ctx)
+	acc.setDeadline(ag.flowCtx.Deadline)
+	if len(ag.ordering) > ag.numGroupCols {
+		// The rows of each group are added to the aggregations in the order in
+		// which they are read, which the results of aggregations like
+		// CONCAT_AGG depend on: verify that they follow the rest of the
+		// ordering.
+		acc.setStrictOrdering(ag.ordering)
+	}
+	for _, c := range ag.caseInsensitiveCols {
+		if err := acc.setColumnNormalizer(int(c), foldCaseNormalizer); err != nil {
+			DrainAndClose(ctx, ag.out.output, err, ag.input)
+			return
+		}
+	}
+	if ag.flowCtx.Verbose || ag.flowCtx.Metrics != nil {
+		acc.collectGroupSizeStats()
+	}
+	ag.distinctAcc = ag.flowCtx.makeBoundAccount(ag.flowCtx.EvalCtx.Mon)
+	defer ag.distinctAcc.Close(ctx)
+	defer ag.closeGroup(ctx)
+	if len(ag.resultOrdering) > 0 {
+		ag.initResults()
+		defer ag.closeResults(ctx)
+	}
+
+	numGroups := 0
+	for {
+		row, last, err := acc.nextRowWithGroupBoundary(evalCtx)
+		if err == nil && row == nil {
+			break
+		}
+		if err == nil {
+			if !ag.inGroup {
+				ag.startGroup(evalCtx)
+			}
+			err = ag.addRow(ctx, row)
+		}
+		if err == nil && last {
+			err = ag.finishGroup(ctx)
+		}
+		if err != nil {
+			DrainAndClose(ctx, ag.out.output, err, ag.input)
+			return
+		}
+		if !last {
+			continue
+		}
+		numGroups++
+		if len(ag.resultOrdering) > 0 {
+			if err := ag.bufferResult(ctx); err != nil {
+				DrainAndClose(ctx, ag.out.output, err, ag.input)
+				return
+			}
+			continue
+		}
+		if !emitHelper(ctx, &ag.out, ag.row, ProducerMetadata{}, ag.input) {
+			// emitHelper() already closed the output.
+			return
+		}
+	}
+
+	// Without group columns, all the rows form a single group, and queries like
+	// `SELECT COUNT(*) FROM t` expect a row even if the input is empty.
+	if numGroups == 0 && ag.numGroupCols == 0 && acc.Exhausted() {
+		ag.startGroup(evalCtx)
+		if err := ag.finishGroup(ctx); err != nil {
+			DrainAndClose(ctx, ag.out.output, err, ag.input)
+			return
+		}
+		setEmptyInputResults(ag.aggregations, ag.outputTypes, ag.row)
+		if !emitHelper(ctx, &ag.out, ag.row, ProducerMetadata{}, ag.input) {
+			return
+		}
+	}
+	if len(ag.resultOrdering) > 0 {
+		more, err := ag.emitResults(ctx, evalCtx)
+		if err != nil {
+			DrainAndClose(ctx, ag.out.output, err, ag.input)
+			return
+		}
+		if !more {
+			// emitHelper() already closed the output.
+			return
+		}
+	}
+	if stats := acc.groupSizeStats; stats != nil && ag.flowCtx.Verbose {
+		_ = ag.out.output.Push(nil /* row */, ProducerMetadata{GroupSizeStats: stats})
+	}
+	if m := ag.flowCtx.Metrics; m != nil {
+		m.ProcessorDone(acc.groupSizeStats.TotalRows, ag.out.rowsEmitted())
+		m.GroupingDone(acc.groupSizeStats)
+	}
+	sendTraceData(ctx, ag.out.output)
+	ag.out.Close()
+}
+
+// startGroup creates the aggregations of a new group.
+func (ag *streamAggregator) startGroup(evalCtx *tree.EvalContext) {
+	for i, a := range ag.aggregations {
+		ag.groupAggs[i].impl = ag.funcs[i](evalCtx)
+		if a.Distinct {
+			ag.groupAggs[i].seen = make(map[string]struct{})
+		}
+	}
+	ag.inGroup = true
+}
+
+// addRow adds a row of the current group to its aggregations.
+func (ag *streamAggregator) addRow(ctx context.Context, row sqlbase.EncDatumRow) error {
+	for i, a := range ag.aggregations {
+		g := &ag.groupAggs[i]
+		if a.FilterColIdx != nil {
+			col := *a.FilterColIdx
+			if err := row[col].EnsureDecoded(&ag.inputTypes[col], &ag.datumAlloc); err != nil {
+				return err
+			}
+			if row[col].Datum != tree.DBoolTrue {
+				// This row doesn't contribute to this aggregation.
+				continue
+			}
+		}
+		var firstArg tree.Datum
+		for j, c := range a.ColIdx {
+			if err := row[c].EnsureDecoded(&ag.inputTypes[c], &ag.datumAlloc); err != nil {
+				return err
+			}
+			if j == 0 {
+				firstArg = row[c].Datum
+			} else {
+				g.otherArgs[j-1] = row[c].Datum
+			}
+		}
+		if g.seen != nil {
+			encoded, err := sqlbase.EncodeDatum(ag.scratch[:0], firstArg)
+			if err == nil && g.otherArgs != nil {
+				encoded, err = sqlbase.EncodeDatums(encoded, g.otherArgs)
+			}
+			if err != nil {
+				return err
+			}
+			ag.scratch = encoded
+			if _, ok := g.seen[string(encoded)]; ok {
+				continue
+			}
+			if err := ag.distinctAcc.Grow(ctx, int64(len(encoded))); err != nil {
+				return err
+			}
+			g.seen[string(encoded)] = struct{}{}
+		}
+		if err := g.impl.Add(ctx, firstArg, g.otherArgs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishGroup stores the results of the aggregations of the current group in
+// ag.row and closes them.
+func (ag *streamAggregator) finishGroup(ctx context.Context) error {
+	for i := range ag.groupAggs {
+		result, err := ag.groupAggs[i].impl.Result()
+		if err != nil {
+			return err
+		}
+		if result == nil {
+			// Special case useful when this is a local stage of a distributed
+			// aggregation.
+			result = tree.DNull
+		}
+		ag.row[i] = sqlbase.DatumToEncDatum(ag.outputTypes[i], result)
+	}
+	ag.closeGroup(ctx)
+	return nil
+}
+
+// closeGroup closes the aggregations of the current group, if any, and releases
+// the memory of their seen maps.
+func (ag *streamAggregator) closeGroup(ctx context.Context) {
+	for i := range ag.groupAggs {
+		g := &ag.groupAggs[i]
+		if g.impl != nil {
+			g.impl.Close(ctx)
+			g.impl = nil
+		}
+		g.seen = nil
+	}
+	ag.inGroup = false
+	ag.distinctAcc.Clear(ctx)
+}
+
+// initResults prepares the buffering of the output rows for resultOrdering.
+// Like the sorter, the rows are moved to disk past COCKROACH_WORK_MEM (unless
+// overridden by a testing knob) if temporary storage is enabled.
+func (ag *streamAggregator) initResults() {
+	st := ag.flowCtx.Settings
+	if settingUseTempStorageSorts.Get(&st.SV) || ag.flowCtx.testingKnobs.MemoryLimitBytes > 0 {
+		ag.resultsLimit = ag.flowCtx.testingKnobs.MemoryLimitBytes
+		if ag.resultsLimit <= 0 {
+			ag.resultsLimit = settingWorkMemBytes.Get(&st.SV)
+		}
+	}
+	ag.resultsAcc = ag.flowCtx.makeBoundAccount(ag.flowCtx.EvalCtx.Mon)
+}
+
+// closeResults releases the resources used to buffer the output rows.
+func (ag *streamAggregator) closeResults(ctx context.Context) {
+	if ag.resultsDisk != nil {
+		ag.resultsDisk.Close(ctx)
+		ag.resultsDisk = nil
+	}
+	ag.results = nil
+	ag.resultsAcc.Close(ctx)
+}
+
+// bufferResult adds (a copy of) ag.row to the output rows to sort, moving them
+// all to disk first if they would exceed the memory limit.
+func (ag *streamAggregator) bufferResult(ctx context.Context) error {
+	if ag.resultsDisk == nil {
+		size := ag.row.MemorySize()
+		if ag.resultsLimit > 0 && ag.resultsAcc.Used()+size > ag.resultsLimit {
+			log.VEventf(ctx, 2, "moving %d aggregation results to disk", len(ag.results))
+			if err := ag.spillResults(ctx); err != nil {
+				return err
+			}
+		} else if err := ag.resultsAcc.Grow(ctx, size); err != nil {
+			if ag.resultsLimit <= 0 {
+				return errors.Wrap(err, "external storage for large queries disabled")
+			}
+			return err
+		}
+	}
+	if ag.resultsDisk != nil {
+		return ag.resultsDisk.AddRow(ctx, ag.row)
+	}
+	ag.results = append(ag.results, ag.resultsAlloc.CopyRow(ag.row))
+	return nil
+}
+
+// spillResults moves the output rows buffered in memory to a new
+// diskRowContainer, which keeps them sorted.
+func (ag *streamAggregator) spillResults(ctx context.Context) error {
+	if m := ag.flowCtx.Metrics; m != nil {
+		m.DiskSpill()
+	}
+	disk := makeDiskRowContainer(
+		ctx, ag.flowCtx.diskMonitor, ag.outputTypes, ag.resultOrdering, ag.flowCtx.TempStorage,
+	)
+	ag.resultsDisk = &disk
+	for _, row := range ag.results {
+		if err := disk.AddRow(ctx, row); err != nil {
+			return err
+		}
+	}
+	ag.results = nil
+	ag.resultsAcc.Clear(ctx)
+	return nil
+}
+
+// emitResults emits the buffered output rows sorted according to
+// resultOrdering. It returns false if the consumer doesn't need more rows, in
+// which case the output has been closed.
+func (ag *streamAggregator) emitResults(
+	ctx context.Context, evalCtx *tree.EvalContext,
+) (bool, error) {
+	if ag.resultsDisk != nil {
+		i := ag.resultsDisk.NewIterator(ctx)
+		defer i.Close()
+		for i.Rewind(); ; i.Next() {
+			if ok, err := i.Valid(); err != nil || !ok {
+				return err == nil, err
+			}
+			row, err := i.Row()
+			if err != nil {
+				return false, err
+			}
+			if !emitHelper(ctx, &ag.out, row, ProducerMetadata{}, ag.input) {
+				return false, nil
+			}
+		}
+	}
+
+	var sortErr error
+	sort.SliceStable(ag.results, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		var cmp int
+		cmp, sortErr = ag.results[i].Compare(
+			ag.outputTypes, &ag.datumAlloc, ag.resultOrdering, evalCtx, ag.results[j],
+		)
+		return cmp < 0
+	})
+	if sortErr != nil {
+		return false, sortErr
+	}
+	for _, row := range ag.results {
+		if !emitHelper(ctx, &ag.out, row, ProducerMetadata{}, ag.input) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,964 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// orderingOnA is the ordering of the rows returned by
+// makeJoinReaderFixtureRows, as an Ordering.
+var orderingOnA = Ordering{Columns: []Ordering_Column{{ColIdx: 0, Direction: Ordering_Column_ASC}}}
+
+func runStreamAggregator(
+	t *testing.T, flowCtx *FlowCtx, spec *AggregatorSpec, input sqlbase.EncDatumRows,
+) (sqlbase.EncDatumRows, []sqlbase.ColumnType) {
+	in := NewRowBuffer(threeIntCols, input, RowBufferArgs{})
+	out := &RowBuffer{}
+	ag, err := newStreamAggregator(flowCtx, spec, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	return out.GetRowsNoMeta(t), ag.outputTypes
+}
+
+func TestStreamAggregator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// SELECT a, SUM_INT(b), COUNT(b), MIN(b), MAX(b) GROUP BY a.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_SUM_INT, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_COUNT, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_MIN, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_MAX, ColIdx: []uint32{1}},
+		},
+	}
+	rows, types := runStreamAggregator(t, &flowCtx, &spec, makeJoinReaderFixtureRows())
+
+	// The group a = 0 has no row for b = 0.
+	groups := []string{"[0 45 9 1 9]"}
+	for a := 1; a <= 9; a++ {
+		groups = append(groups, fmt.Sprintf("[%d 45 10 0 9]", a))
+	}
+	expected := "[" + strings.Join(groups, " ") + "]"
+	if res := rows.String(types); res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+}
+
+// TestStreamAggregatorNoGroupCols verifies that, without group columns, all
+// the rows are aggregated together and a row is produced for an empty input.
+func TestStreamAggregatorNoGroupCols(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// SELECT COUNT(*), SUM_INT(b).
+	spec := AggregatorSpec{
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_COUNT_ROWS},
+			{Func: AggregatorSpec_SUM_INT, ColIdx: []uint32{1}},
+		},
+	}
+	for _, c := range []struct {
+		input    sqlbase.EncDatumRows
+		expected string
+	}{
+		{input: makeJoinReaderFixtureRows(), expected: "[[99 450]]"},
+		{input: nil, expected: "[[0 NULL]]"},
+	} {
+		rows, types := runStreamAggregator(t, &flowCtx, &spec, c.input)
+		if res := rows.String(types); res != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, res)
+		}
+	}
+}
+
+// TestStreamAggregatorLargeGroups verifies that a streamAggregator doesn't
+// buffer the rows of its groups, which are aggregated as they are read
+// regardless of sql.distsql.max_buffered_group_rows, and that the values seen
+// by DISTINCT aggregations are accounted for.
+func TestStreamAggregatorLargeGroups(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	st := cluster.MakeTestingClusterSettings()
+	// The groups have 9 or 10 rows.
+	settingMaxBufferedGroupRows.Override(&st.SV, 2)
+
+	// SELECT a, COUNT(DISTINCT b) GROUP BY a.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_COUNT, ColIdx: []uint32{1}, Distinct: true},
+		},
+	}
+
+	for _, c := range []struct {
+		name string
+		// failAfter is the MemoryFailAfterBytes testing knob.
+		failAfter int64
+		expErr    string
+	}{
+		{name: "NoLimit"},
+		{
+			// The values of b in a group take more than 8 bytes.
+			name:      "DistinctMemory",
+			failAfter: 8,
+			expErr:    "memory account (testing knob)",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			flowCtx := FlowCtx{
+				Settings:     st,
+				EvalCtx:      evalCtx,
+				testingKnobs: TestingKnobs{MemoryFailAfterBytes: c.failAfter},
+			}
+			in := NewRowBuffer(threeIntCols, makeJoinReaderFixtureRows(), RowBufferArgs{})
+			out := &RowBuffer{}
+			ag, err := newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ag.Run(context.Background(), nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var rows sqlbase.EncDatumRows
+			var errs []error
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					errs = append(errs, meta.Err)
+				}
+				if row != nil {
+					rows = append(rows, row)
+				}
+			}
+			if c.expErr != "" {
+				if len(errs) != 1 || !testutils.IsError(errs[0], c.expErr) {
+					t.Fatalf("expected error %q, got %v", c.expErr, errs)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+			groups := []string{"[0 9]"}
+			for a := 1; a <= 9; a++ {
+				groups = append(groups, fmt.Sprintf("[%d 10]", a))
+			}
+			expected := "[" + strings.Join(groups, " ") + "]"
+			if res := rows.String(ag.outputTypes); res != expected {
+				t.Errorf("expected %s, got %s", expected, res)
+			}
+		})
+	}
+}
+
+// TestAggregatorEmptyInput verifies that both aggregators honor the
+// EmptyInput behavior of the aggregations.
+func TestAggregatorEmptyInput(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// SELECT COUNT(b), SUM(b), SUM_INT(b), COUNT(b), MAX(b), with various
+	// results on empty input.
+	aggregations := []AggregatorSpec_Aggregation{
+		{Func: AggregatorSpec_COUNT, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_SUM, ColIdx: []uint32{1}},
+		{
+			Func:       AggregatorSpec_SUM_INT,
+			ColIdx:     []uint32{1},
+			EmptyInput: AggregatorSpec_Aggregation_EMPTY_ZERO,
+		},
+		{
+			Func:       AggregatorSpec_COUNT,
+			ColIdx:     []uint32{1},
+			EmptyInput: AggregatorSpec_Aggregation_EMPTY_NULL,
+		},
+		{
+			Func:       AggregatorSpec_MAX,
+			ColIdx:     []uint32{1},
+			EmptyInput: AggregatorSpec_Aggregation_EMPTY_ZERO,
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		grouped  bool
+		input    sqlbase.EncDatumRows
+		expected string
+	}{
+		{name: "Empty", input: nil, expected: "[[0 NULL 0 NULL 0]]"},
+		{name: "NonEmpty", input: makeJoinReaderFixtureRows(), expected: "[[99 450 450 99 9]]"},
+		// With group columns, no row is emitted.
+		{name: "GroupedEmpty", grouped: true, input: nil, expected: "[]"},
+	}
+	for _, c := range testCases {
+		for _, streaming := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/Streaming=%t", c.name, streaming), func(t *testing.T) {
+				spec := AggregatorSpec{Aggregations: aggregations}
+				if c.grouped {
+					spec.GroupCols = []uint32{0}
+					if streaming {
+						spec.Ordering = orderingOnA
+					}
+				}
+				var rows sqlbase.EncDatumRows
+				var types []sqlbase.ColumnType
+				if streaming {
+					rows, types = runStreamAggregator(t, &flowCtx, &spec, c.input)
+				} else {
+					in := NewRowBuffer(threeIntCols, c.input, RowBufferArgs{})
+					out := &RowBuffer{}
+					ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ag.Run(context.Background(), nil)
+					rows, types = out.GetRowsNoMeta(t), ag.outputTypes
+				}
+				if res := rows.String(types); res != c.expected {
+					t.Errorf("expected %s, got %s", c.expected, res)
+				}
+			})
+		}
+	}
+
+	// Only numeric results can be zero.
+	spec := AggregatorSpec{Aggregations: []AggregatorSpec_Aggregation{{
+		Func:       AggregatorSpec_BOOL_AND,
+		ColIdx:     []uint32{1},
+		EmptyInput: AggregatorSpec_Aggregation_EMPTY_ZERO,
+	}}}
+	in := NewRowBuffer(
+		[]sqlbase.ColumnType{intType, boolType}, nil /* rows */, RowBufferArgs{},
+	)
+	if _, err := newStreamAggregator(
+		&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+	); !testutils.IsError(err, "can't result in zero on empty input") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+// TestAggregatorEmptyInputProcessor verifies that the aggregators created by
+// newProcessor produce a row for an empty input only without group columns, in
+// which case the spec is run by an aggregator.
+func TestAggregatorEmptyInputProcessor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// SELECT COUNT(*), SUM_INT(b), MAX(b), with a zero SUM_INT on empty input.
+	aggregations := []AggregatorSpec_Aggregation{
+		{Func: AggregatorSpec_COUNT_ROWS},
+		{
+			Func:       AggregatorSpec_SUM_INT,
+			ColIdx:     []uint32{1},
+			EmptyInput: AggregatorSpec_Aggregation_EMPTY_ZERO,
+		},
+		{Func: AggregatorSpec_MAX, ColIdx: []uint32{1}},
+	}
+
+	testCases := []struct {
+		name      string
+		spec      AggregatorSpec
+		streaming bool
+		expected  string
+	}{
+		{
+			name:     "NoGroupCols",
+			spec:     AggregatorSpec{Aggregations: aggregations},
+			expected: "[[0 0 NULL]]",
+		},
+		{
+			name:     "GroupCols",
+			spec:     AggregatorSpec{GroupCols: []uint32{0}, Aggregations: aggregations},
+			expected: "[]",
+		},
+		{
+			name: "Ordering",
+			spec: AggregatorSpec{
+				GroupCols: []uint32{0}, Ordering: orderingOnA, Aggregations: aggregations,
+			},
+			streaming: true,
+			expected:  "[]",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			in := NewRowBuffer(threeIntCols, nil /* rows */, RowBufferArgs{})
+			out := &RowBuffer{}
+			p, err := newProcessor(
+				&flowCtx, &ProcessorCoreUnion{Aggregator: &c.spec}, &PostProcessSpec{},
+				[]RowSource{in}, []RowReceiver{out},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var types []sqlbase.ColumnType
+			switch ag := p.(type) {
+			case *streamAggregator:
+				if !c.streaming {
+					t.Fatalf("expected an aggregator, got a streamAggregator")
+				}
+				types = ag.outputTypes
+			case *aggregator:
+				if c.streaming {
+					t.Fatalf("expected a streamAggregator, got an aggregator")
+				}
+				types = ag.outputTypes
+			default:
+				t.Fatalf("unexpected processor %T", p)
+			}
+			p.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if res := out.GetRowsNoMeta(t).String(types); res != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, res)
+			}
+		})
+	}
+}
+
+// TestStreamAggregatorGroupSizeStats verifies that a verbose streamAggregator
+// reports the distribution of the sizes of its groups.
+func TestStreamAggregatorGroupSizeStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// SELECT COUNT(*) GROUP BY a.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_COUNT_ROWS},
+		},
+	}
+	for _, verbose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Verbose=%t", verbose), func(t *testing.T) {
+			flowCtx := FlowCtx{
+				Settings: cluster.MakeTestingClusterSettings(),
+				EvalCtx:  evalCtx,
+				Verbose:  verbose,
+			}
+			in := NewRowBuffer(threeIntCols, makeJoinReaderFixtureRows(), RowBufferArgs{})
+			out := &RowBuffer{}
+			ag, err := newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ag.Run(context.Background(), nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var stats *GroupSizeStats
+			numRows := 0
+			for {
+				row, meta := out.Next()
+				if row == nil && meta.Empty() {
+					break
+				}
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if row != nil {
+					numRows++
+				}
+				if meta.GroupSizeStats != nil {
+					if stats != nil {
+						t.Fatalf("stats reported more than once")
+					}
+					stats = meta.GroupSizeStats
+				}
+			}
+			if !verbose {
+				if stats != nil {
+					t.Fatalf("unexpected stats %+v", *stats)
+				}
+				return
+			}
+			if stats == nil {
+				t.Fatalf("no stats reported")
+			}
+			// There is a group for each of the 10 distinct values of a, and the
+			// group a = 0 has no row for b = 0.
+			expected := GroupSizeStats{NumGroups: 10, MinSize: 9, MaxSize: 10, TotalRows: 99}
+			if *stats != expected {
+				t.Fatalf("expected stats %+v, got %+v", expected, *stats)
+			}
+			if int(stats.NumGroups) != numRows {
+				t.Errorf("%d groups reported, but %d rows were emitted", stats.NumGroups, numRows)
+			}
+			if mean := stats.MeanSize(); mean != 9.9 {
+				t.Errorf("expected a mean group size of 9.9, got %f", mean)
+			}
+		})
+	}
+}
+
+func TestStreamAggregatorMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	metrics := MakeDistSQLMetrics(time.Hour /* histogramWindow */)
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+		Metrics:  &metrics,
+	}
+	// SELECT COUNT(*) GROUP BY a.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_COUNT_ROWS},
+		},
+	}
+	for run := 1; run <= 2; run++ {
+		if rows, _ := runStreamAggregator(t, &flowCtx, &spec, makeJoinReaderFixtureRows()); len(rows) != 10 {
+			t.Fatalf("expected 10 rows, got %d", len(rows))
+		}
+		// The counters accumulate across runs.
+		if in := metrics.ProcRowsIn.Count(); in != int64(99*run) {
+			t.Errorf("expected %d rows in, got %d", 99*run, in)
+		}
+		if out := metrics.ProcRowsOut.Count(); out != int64(10*run) {
+			t.Errorf("expected %d rows out, got %d", 10*run, out)
+		}
+		hist := metrics.GroupMaxRowsHist.Snapshot()
+		if hist.TotalCount() != int64(run) || hist.Max() != 10 {
+			t.Errorf("expected %d recorded groups of 10 rows, got %d with a max of %d",
+				run, hist.TotalCount(), hist.Max())
+		}
+	}
+}
+
+// TestStreamAggregatorMatchesAggregator verifies that the streamAggregator
+// produces the same results as the aggregator over sorted input.
+func TestStreamAggregatorMatchesAggregator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// SELECT a, SUM(b), AVG(b), COUNT(DISTINCT sum), MAX(sum) FILTER (WHERE b < 5)
+	// GROUP BY a.
+	input := makeJoinReaderFixtureRows()
+	filterCol := uint32(3)
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_SUM, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_AVG, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_COUNT, ColIdx: []uint32{2}, Distinct: true},
+			{Func: AggregatorSpec_MAX, ColIdx: []uint32{2}, FilterColIdx: &filterCol},
+		},
+	}
+	inputTypes := []sqlbase.ColumnType{intType, intType, intType, boolType}
+	// Add a column with the filter (b < 5).
+	for i := range input {
+		input[i] = append(input[i][:3:3], sqlbase.DatumToEncDatum(
+			boolType, tree.MakeDBool(*input[i][1].Datum.(*tree.DInt) < 5),
+		))
+	}
+
+	run := func(hash bool) (sqlbase.EncDatumRows, []sqlbase.ColumnType) {
+		in := NewRowBuffer(inputTypes, input, RowBufferArgs{})
+		out := &RowBuffer{}
+		var p Processor
+		var err error
+		if hash {
+			p, err = newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		} else {
+			p, err = newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Run(context.Background(), nil)
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		return out.GetRowsNoMeta(t), p.OutputTypes()
+	}
+
+	expected, types := run(true /* hash */)
+	actual, _ := run(false /* hash */)
+	var a sqlbase.DatumAlloc
+	eq, err := expected.Equal(actual, types, true /* orderless */, &a, &evalCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eq {
+		t.Errorf("expected %s, got %s", expected.String(types), actual.String(types))
+	}
+}
+
+// TestStreamAggregatorDrain verifies that the streamAggregator, through the
+// drainHelper, stops producing rows once its consumer requests draining but
+// still forwards its input's metadata, and that it stops altogether once its
+// consumer is closed.
+func TestStreamAggregatorDrain(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// SELECT COUNT(*) GROUP BY a.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_COUNT_ROWS},
+		},
+	}
+	expectedMetaErr := errors.New("dummy")
+	// makeInput returns an input whose metadata comes after all the rows, so
+	// that it is only read once the aggregator drains.
+	makeInput := func() *RowBuffer {
+		in := NewRowBuffer(threeIntCols, makeJoinReaderFixtureRows(), RowBufferArgs{})
+		in.Push(nil /* row */, ProducerMetadata{Err: expectedMetaErr})
+		return in
+	}
+
+	t.Run("ConsumerDone", func(t *testing.T) {
+		in := makeInput()
+		numRows := 0
+		out := NewRowBuffer(oneIntCol, nil /* rows */, RowBufferArgs{
+			// Request draining after the first row.
+			OnPush: func(row sqlbase.EncDatumRow, _ *ProducerMetadata) ConsumerStatus {
+				if row != nil {
+					numRows++
+				}
+				if numRows >= 1 {
+					return DrainRequested
+				}
+				return NeedMoreRows
+			},
+		})
+		ag, err := newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ag.Run(context.Background(), nil)
+
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		if numRows != 1 {
+			t.Fatalf("expected the producer to stop after 1 row, got %d", numRows)
+		}
+		if !in.Done {
+			t.Fatalf("input not drained")
+		}
+		var metaErr error
+		for {
+			row, meta := out.Next()
+			if row == nil && meta.Empty() {
+				break
+			}
+			if meta.Err != nil {
+				metaErr = meta.Err
+			}
+		}
+		if metaErr != expectedMetaErr {
+			t.Fatalf("expected the input's metadata to be forwarded, got error %v", metaErr)
+		}
+	})
+
+	t.Run("ConsumerClosed", func(t *testing.T) {
+		in := makeInput()
+		out := &RowBuffer{}
+		out.ConsumerClosed()
+		ag, err := newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ag.Run(context.Background(), nil)
+
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		if in.ConsumerStatus != ConsumerClosed {
+			t.Fatalf("expected the input to be closed, got status %d", in.ConsumerStatus)
+		}
+		if row, meta := out.Next(); row != nil || !meta.Empty() {
+			t.Fatalf("unexpected record pushed: %v %+v", row, meta)
+		}
+	})
+}
+
+func TestStreamAggregatorOrderingMismatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0, 1},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_COUNT_ROWS},
+		},
+	}
+	in := NewRowBuffer(threeIntCols, nil /* rows */, RowBufferArgs{})
+	if _, err := newStreamAggregator(
+		&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+	); !testutils.IsError(err, "doesn't start with the group columns") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+// TestStreamAggregatorOrderingPrefix verifies that a streamAggregator groups
+// the rows by the group columns at the start of its ordering, and that the
+// rows of each group are verified to follow the rest of the ordering.
+func TestStreamAggregatorOrderingPrefix(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// SELECT a, IDENT(b), COUNT(*) GROUP BY a, with the input sorted by a and
+	// b DESC. IDENT returns the last value of b of each group.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering: Ordering{Columns: []Ordering_Column{
+			{ColIdx: 0, Direction: Ordering_Column_ASC},
+			{ColIdx: 1, Direction: Ordering_Column_DESC},
+		}},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_COUNT_ROWS},
+		},
+	}
+	var descRows [][]int
+	for a := 0; a <= 9; a++ {
+		for b := 9; b >= 0; b-- {
+			if a != 0 || b != 0 {
+				descRows = append(descRows, []int{a, b, a + b})
+			}
+		}
+	}
+	rows, types := runStreamAggregator(t, &flowCtx, &spec, genEncDatumRowsInt(descRows))
+	groups := []string{"[0 1 9]"}
+	for a := 1; a <= 9; a++ {
+		groups = append(groups, fmt.Sprintf("[%d 0 10]", a))
+	}
+	expected := "[" + strings.Join(groups, " ") + "]"
+	if res := rows.String(types); res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+
+	t.Run("BadlyOrdered", func(t *testing.T) {
+		// The fixture rows are sorted by b ASC within each group.
+		in := NewRowBuffer(threeIntCols, makeJoinReaderFixtureRows(), RowBufferArgs{})
+		out := &RowBuffer{}
+		ag, err := newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ag.Run(context.Background(), nil)
+		var errs []error
+		for {
+			row, meta := out.Next()
+			if row == nil && meta.Empty() {
+				break
+			}
+			if meta.Err != nil {
+				errs = append(errs, meta.Err)
+			}
+		}
+		if len(errs) != 1 || !testutils.IsError(errs[0], "badly ordered input \\(strict mode\\)") {
+			t.Fatalf("expected a badly ordered input error, got %v", errs)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, c := range []struct {
+			ordering []uint32
+			expected string
+		}{
+			{ordering: []uint32{1, 0}, expected: "doesn't start with the group columns"},
+			{ordering: []uint32{0, 0}, expected: "invalid ordering"},
+			{ordering: []uint32{0, 3}, expected: "invalid ordering"},
+		} {
+			spec := AggregatorSpec{
+				GroupCols:    []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{{Func: AggregatorSpec_COUNT_ROWS}},
+			}
+			for _, col := range c.ordering {
+				spec.Ordering.Columns = append(spec.Ordering.Columns, Ordering_Column{ColIdx: col})
+			}
+			in := NewRowBuffer(threeIntCols, nil /* rows */, RowBufferArgs{})
+			if _, err := newStreamAggregator(
+				&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+			); !testutils.IsError(err, c.expected) {
+				t.Errorf("ordering %v: expected %q, got %v", c.ordering, c.expected, err)
+			}
+		}
+	})
+}
+
+// TestStreamAggregatorResultOrdering verifies that the rows of the groups are
+// emitted sorted by an aggregation when the spec has a result ordering, both
+// when they are buffered in memory and when they are moved to disk.
+func TestStreamAggregatorResultOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(base.DefaultTestTempStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:     evalCtx,
+		Settings:    cluster.MakeTestingClusterSettings(),
+		TempStorage: tempEngine,
+		diskMonitor: &diskMonitor,
+	}
+
+	// SELECT a, SUM_INT(b) GROUP BY a ORDER BY SUM_INT(b) DESC.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Ordering:  orderingOnA,
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_SUM_INT, ColIdx: []uint32{1}},
+		},
+		ResultOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 1, Direction: encoding.Descending}},
+		),
+	}
+	input := genEncDatumRowsInt([][]int{
+		{1, 1, 0}, {1, 2, 0},
+		{2, 10, 0},
+		{3, 4, 0}, {3, 4, 0},
+		{4, 1, 0},
+		{5, 7, 0}, {5, 0, 0},
+	})
+	expected := "[[2 10] [3 8] [5 7] [1 3] [4 1]]"
+
+	// Test with several memory limits:
+	// 0: Use the default limit.
+	// 1: Move the results to disk as soon as there is one.
+	for _, memLimit := range []int64{0, 1} {
+		t.Run(fmt.Sprintf("MemLimit=%d", memLimit), func(t *testing.T) {
+			flowCtx.testingKnobs.MemoryLimitBytes = memLimit
+			defer func() { flowCtx.testingKnobs.MemoryLimitBytes = 0 }()
+
+			rows, types := runStreamAggregator(t, &flowCtx, &spec, input)
+			if res := rows.String(types); res != expected {
+				t.Errorf("expected %s, got %s", expected, res)
+			}
+		})
+	}
+
+	t.Run("InvalidColumn", func(t *testing.T) {
+		spec := spec
+		spec.ResultOrdering = convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 2}})
+		in := NewRowBuffer(threeIntCols, nil /* rows */, RowBufferArgs{})
+		if _, err := newStreamAggregator(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+		); !testutils.IsError(err, "invalid result ordering column 2") {
+			t.Fatalf("expected an invalid result ordering column error, got %v", err)
+		}
+	})
+}
+
+// TestStreamAggregatorCaseInsensitive verifies that the values of the
+// case-insensitive columns of an AggregatorSpec are grouped regardless of
+// their case, and that these columns are validated.
+func TestStreamAggregatorCaseInsensitive(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	types := []sqlbase.ColumnType{strType, intType}
+	var input sqlbase.EncDatumRows
+	for i, s := range []string{"apple", "Apple", "APPLE", "b", "B", "Cherry"} {
+		input = append(input, sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(strType, tree.NewDString(s)),
+			sqlbase.DatumToEncDatum(intType, tree.NewDInt(tree.DInt(i))),
+		})
+	}
+
+	// SELECT s, SUM_INT(i) GROUP BY s, with s case-insensitive.
+	spec := AggregatorSpec{
+		GroupCols:           []uint32{0},
+		Ordering:            orderingOnA,
+		CaseInsensitiveCols: []uint32{0},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_SUM_INT, ColIdx: []uint32{1}},
+		},
+	}
+	in := NewRowBuffer(types, input, RowBufferArgs{})
+	out := &RowBuffer{}
+	ag, err := newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	// The group columns have the value of the first row of each group.
+	expected := "[['apple' 3] ['b' 7] ['Cherry' 5]]"
+	if res := out.GetRowsNoMeta(t).String(ag.outputTypes); res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, c := range []struct {
+			types     []sqlbase.ColumnType
+			groupCols []uint32
+			expected  string
+		}{
+			{types: types, groupCols: []uint32{0, 1}, expected: ""},
+			{types: types, groupCols: []uint32{1}, expected: "is not a group column"},
+			{types: threeIntCols, groupCols: []uint32{0}, expected: "expected STRING"},
+		} {
+			spec := AggregatorSpec{
+				GroupCols:           c.groupCols,
+				CaseInsensitiveCols: []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{Func: AggregatorSpec_COUNT_ROWS},
+				},
+			}
+			for _, col := range c.groupCols {
+				spec.Ordering.Columns = append(spec.Ordering.Columns, Ordering_Column{ColIdx: col})
+			}
+			in := NewRowBuffer(c.types, nil /* rows */, RowBufferArgs{})
+			_, err := newStreamAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{})
+			if c.expected == "" {
+				if err != nil {
+					t.Errorf("groupCols %v: %v", c.groupCols, err)
+				}
+			} else if !testutils.IsError(err, c.expected) {
+				t.Errorf("groupCols %v: expected %q, got %v", c.groupCols, c.expected, err)
+			}
+		}
+
+		// The aggregator only supports them along with an ordering.
+		spec.Ordering = Ordering{}
+		if _, err := newAggregator(
+			&flowCtx, &spec, NewRowBuffer(types, nil /* rows */, RowBufferArgs{}),
+			&PostProcessSpec{}, &RowBuffer{},
+		); !testutils.IsError(err, "require an input ordering") {
+			t.Fatalf("expected an input ordering error, got %v", err)
+		}
+	})
+}
@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 )
@@ -126,6 +127,56 @@ func TestStreamEncodeDecode(t *testing.T) {
 	}
 }
 
+// TestStreamEncodeDecodeMultiFieldMetadata checks that no field of a metadata
+// record with more than one field set is lost on the wire.
+func TestStreamEncodeDecodeMultiFieldMetadata(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	var se StreamEncoder
+	var sd StreamDecoder
+	ts := hlc.Timestamp{WallTime: 1}
+	se.AddMetadata(ProducerMetadata{
+		Err:            fmt.Errorf("test error"),
+		NumSkippedRows: 3,
+		ReadTimestamp:  &ts,
+		UnmatchedRows:  &UnmatchedRows{},
+	})
+	if err := sd.AddMessage(se.FormMessage(context.TODO())); err != nil {
+		t.Fatal(err)
+	}
+	_, metas := testGetDecodedRows(t, &sd, nil /* decodedRows */, nil /* metas */)
+	if len(metas) != 4 {
+		t.Fatalf("expected 4 metadata records, got: %+v", metas)
+	}
+	// The error is encoded first.
+	if metas[0].Err == nil || metas[0].Err.Error() != "test error" {
+		t.Errorf("expected the error first, got: %+v", metas[0])
+	}
+	var merged ProducerMetadata
+	for _, meta := range metas[1:] {
+		if meta.Err != nil {
+			t.Errorf("unexpected error: %v", meta.Err)
+		}
+		if meta.NumSkippedRows != 0 {
+			merged.NumSkippedRows = meta.NumSkippedRows
+		}
+		if meta.ReadTimestamp != nil {
+			merged.ReadTimestamp = meta.ReadTimestamp
+		}
+		if meta.UnmatchedRows != nil {
+			merged.UnmatchedRows = meta.UnmatchedRows
+		}
+	}
+	if merged.NumSkippedRows != 3 {
+		t.Errorf("expected 3 skipped rows, got: %d", merged.NumSkippedRows)
+	}
+	if merged.ReadTimestamp == nil || *merged.ReadTimestamp != ts {
+		t.Errorf("expected read timestamp %s, got: %v", ts, merged.ReadTimestamp)
+	}
+	if merged.UnmatchedRows == nil {
+		t.Errorf("expected unmatched rows")
+	}
+}
+
 func TestEmptyStreamEncodeDecode(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	var se StreamEncoder
@@ -108,6 +108,30 @@ func (sd *StreamDecoder) AddMessage(msg *ProducerMessage) error {
 			case *RemoteProducerMetadata_TraceData_:
 				meta.TraceData = v.TraceData.CollectedSpans
 
+			case *RemoteProducerMetadata_ScannedSpans_:
+				meta.ScannedSpans = v.ScannedSpans.Spans
+
+			case *RemoteProducerMetadata_DecodeError:
+				meta.DecodeErr = v.DecodeError.ErrorDetail()
+
+			case *RemoteProducerMetadata_JoinReaderStats:
+				meta.JoinReaderStats = v.JoinReaderStats
+
+			case *RemoteProducerMetadata_GroupSizeStats:
+				meta.GroupSizeStats = v.GroupSizeStats
+
+			case *RemoteProducerMetadata_Progress:
+				meta.Progress = v.Progress
+
+			case *RemoteProducerMetadata_ReadTimestamp:
+				meta.ReadTimestamp = v.ReadTimestamp
+
+			case *RemoteProducerMetadata_UnmatchedRows:
+				meta.UnmatchedRows = v.UnmatchedRows
+
+			case *RemoteProducerMetadata_NumSkippedRows:
+				meta.NumSkippedRows = v.NumSkippedRows
+
 			case *RemoteProducerMetadata_Error:
 				meta.Err = v.Error.ErrorDetail()
 
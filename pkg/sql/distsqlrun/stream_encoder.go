@@ -77,26 +77,64 @@ func (se *StreamEncoder) init(types []sqlbase.ColumnType) {
 // that the StreamDecoder will return them first, before the data rows, thus
 // ensuring that rows produced _after_ an error are not received _before_ the
 // error.
+//
+// Only one of the fields of a ProducerMetadata is supposed to be set, but each
+// field set is encoded as a record of its own, so that none of them is lost;
+// the error, if any, comes first.
 func (se *StreamEncoder) AddMetadata(meta ProducerMetadata) {
-	var enc RemoteProducerMetadata
+	numRecords := len(se.metadata)
+	add := func(value isRemoteProducerMetadata_Value) {
+		se.metadata = append(se.metadata, RemoteProducerMetadata{Value: value})
+	}
+	if meta.Err != nil {
+		add(&RemoteProducerMetadata_Error{Error: NewError(meta.Err)})
+	}
 	if meta.Ranges != nil {
-		enc.Value = &RemoteProducerMetadata_RangeInfo{
+		add(&RemoteProducerMetadata_RangeInfo{
 			RangeInfo: &RemoteProducerMetadata_RangeInfos{
 				RangeInfo: meta.Ranges,
 			},
-		}
-	} else if meta.TraceData != nil {
-		enc.Value = &RemoteProducerMetadata_TraceData_{
+		})
+	}
+	if meta.TraceData != nil {
+		add(&RemoteProducerMetadata_TraceData_{
 			TraceData: &RemoteProducerMetadata_TraceData{
 				CollectedSpans: meta.TraceData,
 			},
-		}
-	} else {
-		enc.Value = &RemoteProducerMetadata_Error{
-			Error: NewError(meta.Err),
-		}
+		})
+	}
+	if meta.ScannedSpans != nil {
+		add(&RemoteProducerMetadata_ScannedSpans_{
+			ScannedSpans: &RemoteProducerMetadata_ScannedSpans{
+				Spans: meta.ScannedSpans,
+			},
+		})
+	}
+	if meta.DecodeErr != nil {
+		add(&RemoteProducerMetadata_DecodeError{DecodeError: NewError(meta.DecodeErr)})
+	}
+	if meta.JoinReaderStats != nil {
+		add(&RemoteProducerMetadata_JoinReaderStats{JoinReaderStats: meta.JoinReaderStats})
+	}
+	if meta.GroupSizeStats != nil {
+		add(&RemoteProducerMetadata_GroupSizeStats{GroupSizeStats: meta.GroupSizeStats})
+	}
+	if meta.Progress != nil {
+		add(&RemoteProducerMetadata_Progress{Progress: meta.Progress})
+	}
+	if meta.ReadTimestamp != nil {
+		add(&RemoteProducerMetadata_ReadTimestamp{ReadTimestamp: meta.ReadTimestamp})
+	}
+	if meta.UnmatchedRows != nil {
+		add(&RemoteProducerMetadata_UnmatchedRows{UnmatchedRows: meta.UnmatchedRows})
+	}
+	if meta.NumSkippedRows != 0 {
+		add(&RemoteProducerMetadata_NumSkippedRows{NumSkippedRows: meta.NumSkippedRows})
+	}
+	if len(se.metadata) == numRecords {
+		// Empty metadata is encoded as an (empty) error, as it always has been.
+		add(&RemoteProducerMetadata_Error{Error: NewError(meta.Err)})
 	}
-	se.metadata = append(se.metadata, enc)
 }
 
 // AddRow encodes a message.
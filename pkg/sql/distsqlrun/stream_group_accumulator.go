@@ -15,39 +15,568 @@
 package distsqlrun
 
 import (
+	"container/heap"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
 	"github.com/pkg/errors"
 )
 
+// groupSliceCapacity is the capacity of the slices allocated by a
+// streamGroupAccumulator for the rows of its groups. Consecutive groups share a
+// slice until it is full (see advanceGroup).
+const groupSliceCapacity = 64
+
+// groupCancelCheckRows is the number of rows read by advanceGroup between
+// checks for the cancellation of the context set with setCancellation.
+const groupCancelCheckRows = 1024
+
 // streamGroupAccumulator groups input rows coming from src into groups dictated
-// by equality according to the ordering columns.
+// by equality according to the group columns, which are a prefix of the
+// ordering columns (by default, all of them).
 type streamGroupAccumulator struct {
 	src   NoMetadataRowSource
 	types []sqlbase.ColumnType
 
 	// srcConsumed is set once src has been exhausted.
 	srcConsumed bool
-	ordering    sqlbase.ColumnOrdering
+	// ordering is the ordering of the input. It is used to detect badly ordered
+	// input.
+	ordering sqlbase.ColumnOrdering
+	// groupCols is the prefix of ordering that determines the groups.
+	groupCols sqlbase.ColumnOrdering
+	// strictOrdering, if set, is an ordering on all the columns of the rows
+	// which consecutive rows are verified to follow, even within a group; see
+	// setStrictOrdering.
+	strictOrdering sqlbase.ColumnOrdering
+	// nullsAreEqual is set if rows with NULLs in the group columns can be part
+	// of the same group (as with GROUP BY). If not set, each row with a NULL in
+	// any group column is in a group by itself, even though it compares equal
+	// to adjacent rows.
+	nullsAreEqual bool
+	// normalizers, if set, transform the values of the ordering columns before
+	// the rows are compared; it is indexed by column and has nil entries for the
+	// columns compared as is. See setColumnNormalizer. normRows is scratch space
+	// for the normalized rows.
+	normalizers []columnNormalizer
+	normRows    [2]sqlbase.EncDatumRow
 
 	// curGroup maintains the rows accumulated in the current group. The client
 	// reads them with advanceGroup().
 	curGroup   []sqlbase.EncDatumRow
 	datumAlloc sqlbase.DatumAlloc
+
+	// If accountMemory is set, the memory used by the rows of curGroup is
+	// accounted for in memAcc; see initMemoryAccounting.
+	accountMemory bool
+	memAcc        boundAccount
+	// memLimit, if positive, is the maximum memory a group can use.
+	memLimit int64
+	// curGroupBytes is the memory used by the rows of curGroup.
+	curGroupBytes int64
+
+	// maxBufferedRows, if positive, is the maximum number of rows of a group
+	// that are buffered in curGroup; see setMaxBufferedRows. Once it is
+	// reached, the buffered rows are passed to spill or, if spill is not set,
+	// an error is returned. spilledRows is the number of rows of the current
+	// group that have been spilled.
+	maxBufferedRows int
+	spill           groupSpillFunc
+	spilledRows     int
+
+	// groupSizeStats, if set, accumulates the sizes of the groups returned by
+	// advanceGroup() or nextRowWithGroupBoundary(); see collectGroupSizeStats.
+	// curGroupRows is the number of rows of the current group returned so far
+	// by nextRowWithGroupBoundary().
+	groupSizeStats *GroupSizeStats
+	curGroupRows   int
+
+	// cancelCtx, if set, is checked for cancellation and deadline, if set, for
+	// expiration every groupCancelCheckRows rows read; see setCancellation and
+	// setDeadline. rowsSinceCancelCheck is the number of rows read since the
+	// last check.
+	cancelCtx            context.Context
+	deadline             time.Time
+	rowsSinceCancelCheck int
 }
 
+// makeStreamGroupAccumulator creates a streamGroupAccumulator. The rows are
+// compared using the EvalContext passed to advanceGroup() (normally the one of
+// the flow; see FlowCtx.NewEvalCtx). In particular, collated strings are
+// compared according to their collation, which can differ from the byte order
+// of their contents; the input must be sorted accordingly.
 func makeStreamGroupAccumulator(
-	src NoMetadataRowSource, ordering sqlbase.ColumnOrdering,
+	src NoMetadataRowSource, ordering sqlbase.ColumnOrdering, nullsAreEqual bool,
 ) streamGroupAccumulator {
 	return streamGroupAccumulator{
-		src:      src,
-		types:    src.Types(),
+		src:           src,
+		types:         src.Types(),
+		ordering:      ordering,
+		groupCols:     ordering,
+		nullsAreEqual: nullsAreEqual,
+	}
+}
+
+// makeMergingStreamGroupAccumulator creates a streamGroupAccumulator over the
+// merge of multiple sources, each sorted according to ordering. The rows are
+// merged on the fly, so that groups can span sources. An error is returned
+// while advancing if any source is found not to be sorted. At least one
+// source is required.
+func makeMergingStreamGroupAccumulator(
+	srcs []NoMetadataRowSource,
+	ordering sqlbase.ColumnOrdering,
+	nullsAreEqual bool,
+	evalCtx *tree.EvalContext,
+) streamGroupAccumulator {
+	merger := &mergingRowSource{
+		srcs:     srcs,
+		types:    srcs[0].Types(),
 		ordering: ordering,
+		evalCtx:  evalCtx,
+		heads:    make([]sqlbase.EncDatumRow, len(srcs)),
+	}
+	// The merger only produces errors as metadata (the metadata of the sources
+	// goes to their own sinks), and those are returned by NextRow().
+	src := MakeNoMetadataRowSource(merger, func(ProducerMetadata) {})
+	return makeStreamGroupAccumulator(src, ordering, nullsAreEqual)
+}
+
+// mergingRowSource is a RowSource that merges the rows of multiple sources,
+// each sorted according to the same ordering, into a single sorted stream.
+type mergingRowSource struct {
+	srcs     []NoMetadataRowSource
+	types    []sqlbase.ColumnType
+	ordering sqlbase.ColumnOrdering
+	evalCtx  *tree.EvalContext
+	alloc    sqlbase.DatumAlloc
+
+	// heads contains the current row of each source. heap contains the indexes
+	// of the sources that are not exhausted, ordered by their current rows.
+	heads   []sqlbase.EncDatumRow
+	heap    []int
+	started bool
+	// err is set if a comparison performed by a heap operation failed.
+	err error
+}
+
+var _ RowSource = &mergingRowSource{}
+var _ heap.Interface = &mergingRowSource{}
+
+// Types is part of the RowSource interface.
+func (m *mergingRowSource) Types() []sqlbase.ColumnType {
+	return m.types
+}
+
+// Len is part of heap.Interface and is only meant to be used internally.
+func (m *mergingRowSource) Len() int {
+	return len(m.heap)
+}
+
+// Less is part of heap.Interface and is only meant to be used internally.
+func (m *mergingRowSource) Less(i, j int) bool {
+	cmp, err := m.heads[m.heap[i]].Compare(
+		m.types, &m.alloc, m.ordering, m.evalCtx, m.heads[m.heap[j]],
+	)
+	if err != nil {
+		m.err = err
+		return false
+	}
+	return cmp < 0
+}
+
+// Swap is part of heap.Interface and is only meant to be used internally.
+func (m *mergingRowSource) Swap(i, j int) {
+	m.heap[i], m.heap[j] = m.heap[j], m.heap[i]
+}
+
+// Push is part of heap.Interface; it's not used as we never insert elements to
+// the heap.
+func (m *mergingRowSource) Push(x interface{}) { panic("unimplemented") }
+
+// Pop is part of heap.Interface and is only meant to be used internally.
+func (m *mergingRowSource) Pop() interface{} {
+	m.heap = m.heap[:len(m.heap)-1]
+	return nil
+}
+
+// advance reads the first row of every source on the first call and, on
+// subsequent calls, the next row of the source whose row was returned last.
+// Sources are advanced lazily so that the rows we returned remain valid until
+// the next call to Next.
+func (m *mergingRowSource) advance() error {
+	if !m.started {
+		m.started = true
+		for i := range m.srcs {
+			row, err := m.srcs[i].NextRow()
+			if err != nil {
+				return err
+			}
+			if row != nil {
+				m.heads[i] = row
+				m.heap = append(m.heap, i)
+			}
+		}
+		heap.Init(m)
+		return m.err
+	}
+	if len(m.heap) == 0 {
+		return nil
+	}
+	idx := m.heap[0]
+	prev := m.heads[idx]
+	row, err := m.srcs[idx].NextRow()
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		m.heads[idx] = nil
+		heap.Remove(m, 0)
+		return m.err
+	}
+	cmp, err := prev.Compare(m.types, &m.alloc, m.ordering, m.evalCtx, row)
+	if err != nil {
+		return err
+	}
+	if cmp == 1 {
+		return errors.Errorf(
+			"detected badly ordered input from source %d: %s > %s, but expected '<='",
+			idx, prev.String(m.types), row.String(m.types),
+		)
+	}
+	m.heads[idx] = row
+	heap.Fix(m, 0)
+	return m.err
+}
+
+// Next is part of the RowSource interface.
+func (m *mergingRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	if err := m.advance(); err != nil {
+		return nil, ProducerMetadata{Err: err}
+	}
+	if len(m.heap) == 0 {
+		return nil, ProducerMetadata{}
+	}
+	return m.heads[m.heap[0]], ProducerMetadata{}
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (m *mergingRowSource) ConsumerDone() {
+	for i := range m.srcs {
+		m.srcs[i].src.ConsumerDone()
+	}
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (m *mergingRowSource) ConsumerClosed() {
+	for i := range m.srcs {
+		m.srcs[i].src.ConsumerClosed()
 	}
 }
 
+// setGroupCols makes the accumulator group the rows by the first numCols
+// ordering columns only. The input is still verified to be ordered according
+// to all the ordering columns. Must be called before any row is read.
+func (s *streamGroupAccumulator) setGroupCols(numCols int) error {
+	if numCols < 0 || numCols > len(s.ordering) {
+		return errors.Errorf(
+			"invalid number of group columns %d, ordering has %d columns", numCols, len(s.ordering),
+		)
+	}
+	s.groupCols = s.ordering[:numCols]
+	return nil
+}
+
+// columnNormalizer transforms a (non-NULL) value of a column before it is
+// compared to other values; see setColumnNormalizer. The result must have the
+// same type as the value.
+type columnNormalizer func(tree.Datum) (tree.Datum, error)
+
+// foldCaseNormalizer is a columnNormalizer for STRING columns which folds their
+// values to lower case, for case-insensitive grouping.
+func foldCaseNormalizer(d tree.Datum) (tree.Datum, error) {
+	s, ok := d.(*tree.DString)
+	if !ok {
+		return nil, errors.Errorf("cannot fold the case of %s value %s", d.ResolvedType(), d)
+	}
+	return tree.NewDString(strings.ToLower(string(*s))), nil
+}
+
+// setColumnNormalizer makes the accumulator compare the values of the ordering
+// column colIdx after transforming them with fn, e.g. to group strings case
+// insensitively with foldCaseNormalizer. The input must be sorted according to
+// the transformed values; the rows returned are left untouched. Normalizers
+// can't be used with makeMergingStreamGroupAccumulator, whose sources are
+// merged on the original values. Must be called before any row is read.
+func (s *streamGroupAccumulator) setColumnNormalizer(colIdx int, fn columnNormalizer) error {
+	if _, ok := s.src.src.(*mergingRowSource); ok {
+		return errors.Errorf("column normalizers not supported when merging sources")
+	}
+	found := false
+	for _, c := range s.ordering {
+		if c.ColIdx == colIdx {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.Errorf("column %d is not an ordering column", colIdx)
+	}
+	if s.normalizers == nil {
+		s.normalizers = make([]columnNormalizer, len(s.types))
+	}
+	s.normalizers[colIdx] = fn
+	return nil
+}
+
+// compareRows compares two rows according to the given ordering, after
+// transforming the values of the columns that have a normalizer.
+func (s *streamGroupAccumulator) compareRows(
+	evalCtx *tree.EvalContext,
+	ordering sqlbase.ColumnOrdering,
+	lhs, rhs sqlbase.EncDatumRow,
+) (int, error) {
+	if s.normalizers == nil {
+		return lhs.Compare(s.types, &s.datumAlloc, ordering, evalCtx, rhs)
+	}
+	var err error
+	if lhs, err = s.normalizeRow(0, lhs, ordering); err != nil {
+		return 0, err
+	}
+	if rhs, err = s.normalizeRow(1, rhs, ordering); err != nil {
+		return 0, err
+	}
+	return lhs.Compare(s.types, &s.datumAlloc, ordering, evalCtx, rhs)
+}
+
+// normalizeRow returns a copy of the row, stored in normRows[i], in which the
+// values of the ordering columns that have a normalizer are transformed.
+func (s *streamGroupAccumulator) normalizeRow(
+	i int, row sqlbase.EncDatumRow, ordering sqlbase.ColumnOrdering,
+) (sqlbase.EncDatumRow, error) {
+	norm := append(s.normRows[i][:0], row...)
+	s.normRows[i] = norm
+	for _, c := range ordering {
+		fn := s.normalizers[c.ColIdx]
+		if fn == nil {
+			continue
+		}
+		typ := &s.types[c.ColIdx]
+		if err := norm[c.ColIdx].EnsureDecoded(typ, &s.datumAlloc); err != nil {
+			return nil, err
+		}
+		if norm[c.ColIdx].IsNull() {
+			continue
+		}
+		d, err := fn(norm[c.ColIdx].Datum)
+		if err != nil {
+			return nil, err
+		}
+		if want := typ.ToDatumType(); !want.Equivalent(d.ResolvedType()) {
+			return nil, errors.Errorf(
+				"normalizer of column %d returned a %s value, expected %s", c.ColIdx, d.ResolvedType(), want,
+			)
+		}
+		norm[c.ColIdx] = sqlbase.DatumToEncDatum(*typ, d)
+	}
+	return norm, nil
+}
+
+// initMemoryAccounting makes the accumulator account for the memory used by the
+// rows of the current group against an account of the given monitor, made
+// through flowCtx. If limit is positive, it is the maximum memory a group can
+// use; larger groups result in a memory budget error.
+func (s *streamGroupAccumulator) initMemoryAccounting(
+	flowCtx *FlowCtx, monitor *mon.BytesMonitor, limit int64,
+) {
+	s.accountMemory = true
+	s.memAcc = flowCtx.makeBoundAccount(monitor)
+	s.memLimit = limit
+}
+
+// groupSpillFunc receives the rows of a group buffered by a
+// streamGroupAccumulator when they reach its limit; see setMaxBufferedRows.
+// The rows can be retained, but not the slice.
+type groupSpillFunc func(ctx context.Context, rows []sqlbase.EncDatumRow) error
+
+// setMaxBufferedRows limits the number of rows of a group the accumulator
+// buffers to limit (if positive). Without a limit, advanceGroup() buffers
+// entire groups, however large. When a row is added to a group that already
+// has limit rows buffered, the buffered rows are passed to spill and dropped
+// from the group, so that advanceGroup() only returns the rows of the group
+// that follow the last spilled ones; the caller is responsible for
+// combining them (e.g. by storing the spilled rows on disk). If spill is nil,
+// an error with SQLSTATE 53000 (insufficient resources) is returned instead.
+// Must be called before any row is read.
+func (s *streamGroupAccumulator) setMaxBufferedRows(limit int, spill groupSpillFunc) {
+	s.maxBufferedRows = limit
+	s.spill = spill
+}
+
+// newBufferedRowsLimitError returns the error produced when a group has more
+// rows than the limit set with setMaxBufferedRows and no spill function is
+// set.
+func newBufferedRowsLimitError(limit int) error {
+	return pgerror.NewErrorf(
+		pgerror.CodeInsufficientResourcesError,
+		"stream group accumulator: group exceeds the limit of %d buffered rows", limit,
+	)
+}
+
+// close releases the resources held by the accumulator, including the memory
+// accounted for the rows it buffers. It must be called once the accumulator is
+// no longer needed, including on error paths and when the consumer stops
+// early.
+func (s *streamGroupAccumulator) close(ctx context.Context) {
+	if s.accountMemory {
+		s.memAcc.Close(ctx)
+		s.accountMemory = false
+		s.curGroupBytes = 0
+	}
+	s.curGroup = nil
+}
+
+// addToGroup appends a row to the current group, accounting for its memory.
+// If the group has reached the limit set with setMaxBufferedRows, the rows
+// buffered so far are spilled first.
+func (s *streamGroupAccumulator) addToGroup(ctx context.Context, row sqlbase.EncDatumRow) error {
+	if s.maxBufferedRows > 0 && len(s.curGroup) >= s.maxBufferedRows {
+		if s.spill == nil {
+			return newBufferedRowsLimitError(s.maxBufferedRows)
+		}
+		if err := s.spill(ctx, s.curGroup); err != nil {
+			return err
+		}
+		s.spilledRows += len(s.curGroup)
+		s.curGroup = s.curGroup[:0]
+		if s.accountMemory {
+			s.memAcc.Shrink(ctx, s.curGroupBytes)
+			s.curGroupBytes = 0
+		}
+	}
+	if s.accountMemory {
+		size := row.MemorySize()
+		if s.memLimit > 0 && s.curGroupBytes+size > s.memLimit {
+			return newMemoryBudgetError("stream group accumulator", s.memLimit)
+		}
+		if err := s.memAcc.Grow(ctx, size); err != nil {
+			return err
+		}
+		s.curGroupBytes += size
+	}
+	s.curGroup = append(s.curGroup, row)
+	return nil
+}
+
+// resetGroupMemory releases the memory accounted for the rows of the current
+// group.
+func (s *streamGroupAccumulator) resetGroupMemory(evalCtx *tree.EvalContext) {
+	if s.accountMemory {
+		s.memAcc.Shrink(evalCtx.Ctx(), s.curGroupBytes)
+		s.curGroupBytes = 0
+	}
+}
+
+// setCancellation makes advanceGroup() check whether ctx has been canceled
+// every groupCancelCheckRows rows read from the source, and return the error of
+// ctx if so. Without it, a huge group is read in its entirety before the caller
+// gets a chance to notice the cancellation.
+func (s *streamGroupAccumulator) setCancellation(ctx context.Context) {
+	s.cancelCtx = ctx
+}
+
+// setDeadline makes the accumulator check whether deadline has passed at the
+// same points as it checks for cancellation (see setCancellation), and return
+// an error if so. It is used to enforce FlowCtx.Deadline.
+func (s *streamGroupAccumulator) setDeadline(deadline time.Time) {
+	s.deadline = deadline
+}
+
+// maybeCheckInterrupted is called for each row read from the source. Every
+// groupCancelCheckRows rows, it returns an error if the context set with
+// setCancellation has been canceled or if the deadline set with setDeadline
+// has passed.
+func (s *streamGroupAccumulator) maybeCheckInterrupted() error {
+	if s.cancelCtx == nil && s.deadline.IsZero() {
+		return nil
+	}
+	s.rowsSinceCancelCheck++
+	if s.rowsSinceCancelCheck < groupCancelCheckRows {
+		return nil
+	}
+	s.rowsSinceCancelCheck = 0
+	if s.cancelCtx != nil {
+		if err := s.cancelCtx.Err(); err != nil {
+			return err
+		}
+	}
+	return checkFlowDeadline(s.deadline)
+}
+
+// setStrictOrdering enables the strict mode, in which the accumulator verifies
+// that consecutive rows are ordered according to the given ordering (which
+// should involve all the columns of the rows), and returns an error otherwise.
+// Rows that are equal on the ordering columns are grouped together regardless
+// of their other columns, so this can catch ordering bugs upstream (e.g. in a
+// sorter) that would be hidden otherwise. Must be called before any row is
+// read.
+func (s *streamGroupAccumulator) setStrictOrdering(fullOrdering sqlbase.ColumnOrdering) {
+	s.strictOrdering = fullOrdering
+}
+
+// checkStrictOrdering verifies that row follows the last row of the current
+// group according to strictOrdering.
+func (s *streamGroupAccumulator) checkStrictOrdering(
+	evalCtx *tree.EvalContext, row sqlbase.EncDatumRow,
+) error {
+	last := s.curGroup[len(s.curGroup)-1]
+	cmp, err := s.compareRows(evalCtx, s.strictOrdering, last, row)
+	if err != nil {
+		return err
+	}
+	if cmp == 1 {
+		return errors.Errorf(
+			"detected badly ordered input (strict mode): %s > %s, but expected '<='",
+			last.String(s.types), row.String(s.types),
+		)
+	}
+	return nil
+}
+
+// hasNullInGroupCols returns true if the row has a NULL in any of the group
+// columns.
+func (s *streamGroupAccumulator) hasNullInGroupCols(row sqlbase.EncDatumRow) bool {
+	for _, c := range s.groupCols {
+		if row[c.ColIdx].IsNull() {
+			return true
+		}
+	}
+	return false
+}
+
+// primeWith seeds the current group with a row that the caller already read
+// (e.g. the first row of the next group, found by another accumulator), so that
+// the next peekAtCurrentGroup() returns it and the rows of src that are equal
+// to it are grouped with it. The row must precede the rows of src in the
+// ordering, and it must not be modified afterwards. Must be called before any
+// row is read from src.
+func (s *streamGroupAccumulator) primeWith(ctx context.Context, row sqlbase.EncDatumRow) error {
+	if len(s.curGroup) > 0 || s.srcConsumed {
+		return errors.Errorf("cannot prime an accumulator that has already read rows")
+	}
+	return s.addToGroup(ctx, row)
+}
+
 // peekAtCurrentGroup returns the first row of the current group.
-func (s *streamGroupAccumulator) peekAtCurrentGroup() (sqlbase.EncDatumRow, error) {
+func (s *streamGroupAccumulator) peekAtCurrentGroup(
+	evalCtx *tree.EvalContext,
+) (sqlbase.EncDatumRow, error) {
 	// On all but the very first call, either there will be (one or all) rows
 	// accumulated already in the current group, or srcConsumed will be set.
 	if s.srcConsumed {
@@ -59,7 +588,9 @@ func (s *streamGroupAccumulator) peekAtCurrentGroup() (sqlbase.EncDatumRow, erro
 			return nil, err
 		}
 		if row != nil {
-			s.curGroup = append(s.curGroup, row)
+			if err := s.addToGroup(evalCtx.Ctx(), row); err != nil {
+				return nil, err
+			}
 		} else {
 			s.srcConsumed = true
 			return nil, nil
@@ -71,6 +602,14 @@ func (s *streamGroupAccumulator) peekAtCurrentGroup() (sqlbase.EncDatumRow, erro
 // advanceGroup returns all rows of the current group and advances the internal
 // state to the next group, so that a subsequent peekAtCurrentGroup() will
 // return the first row of the next group.
+//
+// Consecutive groups are stored in the same slice while it has room: the
+// returned group is a prefix of the slice whose capacity is capped at its
+// length, and the next group is accumulated in the rest of the slice. The
+// returned group is therefore never aliased by the groups that follow: the
+// accumulator doesn't modify it after returning it, and the caller can modify
+// (or append to) it without affecting the following groups. The rows
+// themselves are the ones returned by the source.
 func (s *streamGroupAccumulator) advanceGroup(
 	evalCtx *tree.EvalContext,
 ) ([]sqlbase.EncDatumRow, error) {
@@ -81,45 +620,521 @@ func (s *streamGroupAccumulator) advanceGroup(
 	}
 
 	for {
+		if err := s.maybeCheckInterrupted(); err != nil {
+			return nil, err
+		}
 		row, err := s.src.NextRow()
 		if err != nil {
 			return nil, err
 		}
 		if row == nil {
 			s.srcConsumed = true
-			return s.curGroup, nil
+			n := len(s.curGroup)
+			if n > 0 {
+				s.recordGroupSize(s.spilledRows + n)
+			}
+			s.spilledRows = 0
+			return s.curGroup[:n:n], nil
 		}
 
 		if len(s.curGroup) == 0 {
 			if s.curGroup == nil {
-				s.curGroup = make([]sqlbase.EncDatumRow, 0, 64)
+				s.curGroup = make([]sqlbase.EncDatumRow, 0, groupSliceCapacity)
+			}
+			if err := s.addToGroup(evalCtx.Ctx(), row); err != nil {
+				return nil, err
 			}
-			s.curGroup = append(s.curGroup, row)
 			continue
 		}
 
-		cmp, err := s.curGroup[0].Compare(s.types, &s.datumAlloc, s.ordering, evalCtx, row)
+		cmp, err := s.compareToGroup(evalCtx, row)
 		if err != nil {
 			return nil, err
 		}
 		if cmp == 0 {
-			s.curGroup = append(s.curGroup, row)
-		} else if cmp == 1 {
-			return nil, errors.Errorf(
-				"detected badly ordered input: %s > %s, but expected '<'",
-				s.curGroup[0].String(s.types), row.String(s.types),
-			)
+			if err := s.addToGroup(evalCtx.Ctx(), row); err != nil {
+				return nil, err
+			}
 		} else {
 			n := len(s.curGroup)
 			ret := s.curGroup[:n:n]
 			// The curGroup slice possibly has additional space at the end of it. Use
-			// it if possible to avoid an allocation.
+			// it if possible to avoid an allocation. This space doesn't overlap with
+			// ret, so appending to curGroup never overwrites the returned rows.
 			s.curGroup = s.curGroup[n:]
 			if cap(s.curGroup) == 0 {
-				s.curGroup = make([]sqlbase.EncDatumRow, 0, 64)
+				s.curGroup = make([]sqlbase.EncDatumRow, 0, groupSliceCapacity)
+			}
+			// The rows of the returned group are no longer buffered by us.
+			s.resetGroupMemory(evalCtx)
+			s.recordGroupSize(s.spilledRows + len(ret))
+			s.spilledRows = 0
+			if err := s.addToGroup(evalCtx.Ctx(), row); err != nil {
+				return nil, err
 			}
-			s.curGroup = append(s.curGroup, row)
 			return ret, nil
 		}
 	}
 }
+
+// compareToGroup compares a row that follows the rows of the current group in
+// the input to them. It returns 0 if the row belongs to the current group and
+// -1 if it starts a new one. An error is returned if the row is found to be out
+// of order.
+func (s *streamGroupAccumulator) compareToGroup(
+	evalCtx *tree.EvalContext, row sqlbase.EncDatumRow,
+) (int, error) {
+	if s.strictOrdering != nil {
+		if err := s.checkStrictOrdering(evalCtx, row); err != nil {
+			return 0, err
+		}
+	}
+
+	cmp, err := s.compareRows(evalCtx, s.groupCols, s.curGroup[0], row)
+	if err != nil {
+		return 0, err
+	}
+	if cmp == 0 && len(s.groupCols) < len(s.ordering) {
+		// The row belongs to the current group; it must still be ordered with
+		// respect to the previous row on the remaining ordering columns.
+		last := s.curGroup[len(s.curGroup)-1]
+		fullCmp, err := s.compareRows(evalCtx, s.ordering, last, row)
+		if err != nil {
+			return 0, err
+		}
+		if fullCmp == 1 {
+			return 0, errors.Errorf(
+				"detected badly ordered input: %s > %s, but expected '<'",
+				last.String(s.types), row.String(s.types),
+			)
+		}
+	}
+	if cmp == 0 && !s.nullsAreEqual && s.hasNullInGroupCols(row) {
+		// The rows compare equal but NULLs are distinct from each other, so
+		// the row starts a new group.
+		cmp = -1
+	}
+	if cmp == 1 {
+		return 0, errors.Errorf(
+			"detected badly ordered input: %s > %s, but expected '<'",
+			s.curGroup[0].String(s.types), row.String(s.types),
+		)
+	}
+	return cmp, nil
+}
+
+// nextRowWithGroupBoundary returns the next row of the input, along with
+// whether it is the last row of its group. Unlike advanceGroup(), which buffers
+// the rows of each group until the group is complete, it only reads one row
+// ahead, so the rows can be processed (e.g. to compute running aggregates)
+// using constant memory, regardless of the size of the groups. The input is
+// verified to be ordered as with advanceGroup(). nil is returned once the input
+// is exhausted.
+//
+// The two methods can't be mixed: an accumulator must be consumed either group
+// by group or row by row.
+func (s *streamGroupAccumulator) nextRowWithGroupBoundary(
+	evalCtx *tree.EvalContext,
+) (sqlbase.EncDatumRow, bool, error) {
+	// curGroup only contains the next row to return, if it was already read.
+	if len(s.curGroup) == 0 {
+		if s.srcConsumed {
+			return nil, false, nil
+		}
+		row, err := s.src.NextRow()
+		if err != nil {
+			return nil, false, err
+		}
+		if row == nil {
+			s.srcConsumed = true
+			return nil, false, nil
+		}
+		if err := s.addToGroup(evalCtx.Ctx(), row); err != nil {
+			return nil, false, err
+		}
+	}
+	row := s.curGroup[0]
+
+	if err := s.maybeCheckInterrupted(); err != nil {
+		return nil, false, err
+	}
+	next, err := s.src.NextRow()
+	if err != nil {
+		return nil, false, err
+	}
+	last := true
+	if next == nil {
+		s.srcConsumed = true
+	} else {
+		cmp, err := s.compareToGroup(evalCtx, next)
+		if err != nil {
+			return nil, false, err
+		}
+		last = cmp != 0
+	}
+	s.curGroupRows++
+	if last {
+		s.recordGroupSize(s.curGroupRows)
+		s.curGroupRows = 0
+	}
+	s.curGroup = s.curGroup[:0]
+	s.resetGroupMemory(evalCtx)
+	if next != nil {
+		if err := s.addToGroup(evalCtx.Ctx(), next); err != nil {
+			return nil, false, err
+		}
+	}
+	return row, last, nil
+}
+
+// collectGroupSizeStats makes the accumulator keep statistics about the sizes
+// of the groups it returns in groupSizeStats. Keeping them is cheap: only a few
+// counters are updated for each group.
+func (s *streamGroupAccumulator) collectGroupSizeStats() {
+	s.groupSizeStats = &GroupSizeStats{}
+}
+
+func (s *streamGroupAccumulator) recordGroupSize(n int) {
+	if s.groupSizeStats != nil {
+		s.groupSizeStats.add(uint64(n))
+	}
+}
+
+// Exhausted returns true once the source has been fully consumed, i.e. once
+// the last group has been returned by advanceGroup() (or forEachGroup() has
+// completed). It allows the caller to distinguish an empty input, for which no
+// groups are ever returned, from an input that hasn't been read yet.
+func (s *streamGroupAccumulator) Exhausted() bool {
+	return s.srcConsumed
+}
+
+// forEachGroup drives the accumulator to completion, calling fn once for each
+// group, in order. It stops at the first error returned by fn or encountered
+// while reading from the source, and returns that error.
+//
+// If maxGroups is positive, an error is returned (without calling fn) upon
+// encountering more groups than that; this guards against unexpectedly large
+// numbers of groups (e.g. because the input is not sorted as expected).
+//
+// The group passed to fn follows the same rules as the result of
+// advanceGroup(). If nil is returned, the accumulator is Exhausted().
+func (s *streamGroupAccumulator) forEachGroup(
+	evalCtx *tree.EvalContext, maxGroups int, fn func(group []sqlbase.EncDatumRow) error,
+) error {
+	for numGroups := 0; ; {
+		group, err := s.advanceGroup(evalCtx)
+		if err != nil {
+			return err
+		}
+		if len(group) == 0 {
+			return nil
+		}
+		numGroups++
+		if maxGroups > 0 && numGroups > maxGroups {
+			return errors.Errorf("number of groups exceeds the limit of %d", maxGroups)
+		}
+		if err := fn(group); err != nil {
+			return err
+		}
+	}
+}
+
+// countDistinctSorted returns the number of distinct non-NULL values in column
+// colIdx of the given rows (i.e. COUNT(DISTINCT col) over a group). The rows
+// must be sorted on that column (in either direction) so that equal values are
+// adjacent; this allows computing the count in a single pass without
+// buffering the distinct values.
+func countDistinctSorted(
+	rows []sqlbase.EncDatumRow,
+	colIdx int,
+	types []sqlbase.ColumnType,
+	alloc *sqlbase.DatumAlloc,
+	evalCtx *tree.EvalContext,
+) (int64, error) {
+	var count int64
+	var prev *sqlbase.EncDatum
+	for _, row := range rows {
+		cur := &row[colIdx]
+		if err := cur.EnsureDecoded(&types[colIdx], alloc); err != nil {
+			return 0, err
+		}
+		if cur.IsNull() {
+			continue
+		}
+		if prev != nil {
+			cmp, err := prev.Compare(&types[colIdx], alloc, evalCtx, cur)
+			if err != nil {
+				return 0, err
+			}
+			if cmp == 0 {
+				continue
+			}
+		}
+		count++
+		prev = cur
+	}
+	return count, nil
+}
+
+// topRowInGroup returns the row of the given group with the largest (if dir is
+// encoding.Descending) or smallest (if dir is encoding.Ascending) value in
+// column colIdx, like DISTINCT ON with an ORDER BY on that column would. NULLs
+// are smaller than all other values. Among rows with equal values, the first
+// one is returned. The rows are scanned once, so no buffering is needed beyond
+// the group itself. nil is returned for an empty group.
+func topRowInGroup(
+	rows []sqlbase.EncDatumRow,
+	colIdx int,
+	dir encoding.Direction,
+	types []sqlbase.ColumnType,
+	alloc *sqlbase.DatumAlloc,
+	evalCtx *tree.EvalContext,
+) (sqlbase.EncDatumRow, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	best := rows[0]
+	for _, row := range rows[1:] {
+		cmp, err := row[colIdx].Compare(&types[colIdx], alloc, evalCtx, &best[colIdx])
+		if err != nil {
+			return nil, err
+		}
+		if dir == encoding.Descending {
+			cmp = -cmp
+		}
+		if cmp < 0 {
+			best = row
+		}
+	}
+	return best, nil
+}
+
+// groupGapDetector wraps a streamGroupAccumulator whose input is ordered on an
+// INT column and detects the values of that column which are missing between
+// consecutive groups (for example to fill in a dense time series). After each
+// group is returned, onGap is called once for each value strictly between the
+// last value of the previous group and the first value of the new group, in
+// the order of the input.
+//
+// NULLs don't take part in the sequence: no gaps are reported between a group
+// and the previous group if either of them ends (or starts) with a NULL.
+type groupGapDetector struct {
+	acc    *streamGroupAccumulator
+	colIdx int
+	// step is 1 if the column is ascending and -1 if it is descending.
+	step  int64
+	onGap func(missing int64) error
+
+	// prev is the value of the column in the last row of the previous group; it
+	// is only valid if havePrev is set.
+	prev     int64
+	havePrev bool
+	alloc    sqlbase.DatumAlloc
+}
+
+// makeGroupGapDetector creates a groupGapDetector over the given accumulator.
+// The column colIdx must be an INT column which is part of the ordering of the
+// accumulator.
+func makeGroupGapDetector(
+	acc *streamGroupAccumulator, colIdx int, onGap func(missing int64) error,
+) (groupGapDetector, error) {
+	if colIdx < 0 || colIdx >= len(acc.types) {
+		return groupGapDetector{}, errors.Errorf("invalid column %d", colIdx)
+	}
+	if typ := acc.types[colIdx].SemanticType; typ != sqlbase.ColumnType_INT {
+		return groupGapDetector{}, errors.Errorf("column %d has type %s, expected INT", colIdx, typ)
+	}
+	for _, c := range acc.ordering {
+		if c.ColIdx != colIdx {
+			continue
+		}
+		step := int64(1)
+		if c.Direction == encoding.Descending {
+			step = -1
+		}
+		return groupGapDetector{acc: acc, colIdx: colIdx, step: step, onGap: onGap}, nil
+	}
+	return groupGapDetector{}, errors.Errorf("column %d is not part of the ordering", colIdx)
+}
+
+// advanceGroup returns the next group of the accumulator (see
+// streamGroupAccumulator.advanceGroup), after calling onGap for each value
+// missing between the previous group and this one.
+func (g *groupGapDetector) advanceGroup(evalCtx *tree.EvalContext) ([]sqlbase.EncDatumRow, error) {
+	group, err := g.acc.advanceGroup(evalCtx)
+	if err != nil || len(group) == 0 {
+		return group, err
+	}
+	first, firstOk, err := g.value(group[0])
+	if err != nil {
+		return nil, err
+	}
+	if g.havePrev && firstOk {
+		// For an ordering on multiple columns, the value can repeat across
+		// groups, in which case there is no gap.
+		for v := g.prev; g.missingAfter(v, first); {
+			v += g.step
+			if err := g.onGap(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	g.prev, g.havePrev, err = g.value(group[len(group)-1])
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// value returns the value of the column in the given row, and false if it is
+// NULL.
+func (g *groupGapDetector) value(row sqlbase.EncDatumRow) (int64, bool, error) {
+	d := &row[g.colIdx]
+	if err := d.EnsureDecoded(&g.acc.types[g.colIdx], &g.alloc); err != nil {
+		return 0, false, err
+	}
+	if d.IsNull() {
+		return 0, false, nil
+	}
+	return int64(*d.Datum.(*tree.DInt)), true, nil
+}
+
+// missingAfter returns whether the value following v in the order of the input
+// comes strictly before next, i.e. is missing between v and next. Overflows
+// are avoided by checking that v comes before next first.
+func (g *groupGapDetector) missingAfter(v, next int64) bool {
+	if g.step > 0 {
+		return v < next && v+1 < next
+	}
+	return v > next && v-1 > next
+}
+
+// groupMode returns the most frequent non-NULL value (the statistical mode) of
+// column colIdx in the given group, along with its number of occurrences. The
+// group must be sorted on that column (in either direction), for example
+// because the column follows the group columns in the ordering of the
+// accumulator that returned it: equal values are then consecutive, and the mode
+// is found in a single pass by tracking the longest run of equal values, in
+// constant memory. If several values are equally frequent, the first one in the
+// group is returned. NULL and 0 are returned if the group has no non-NULL
+// values.
+func groupMode(
+	evalCtx *tree.EvalContext,
+	types []sqlbase.ColumnType,
+	group []sqlbase.EncDatumRow,
+	colIdx int,
+	alloc *sqlbase.DatumAlloc,
+) (tree.Datum, int, error) {
+	if colIdx < 0 || colIdx >= len(types) {
+		return nil, 0, errors.Errorf("invalid column %d", colIdx)
+	}
+	typ := &types[colIdx]
+	// The best run so far starts at row best and has bestLen rows; the current
+	// run starts at row cur and has curLen rows.
+	best, bestLen := -1, 0
+	cur, curLen := -1, 0
+	for i, row := range group {
+		if row[colIdx].IsNull() {
+			continue
+		}
+		if curLen > 0 {
+			cmp, err := row[colIdx].Compare(typ, alloc, evalCtx, &group[cur][colIdx])
+			if err != nil {
+				return nil, 0, err
+			}
+			if cmp != 0 {
+				curLen = 0
+			}
+		}
+		if curLen == 0 {
+			cur = i
+		}
+		curLen++
+		// Ties go to the earlier run.
+		if curLen > bestLen {
+			best, bestLen = cur, curLen
+		}
+	}
+	if bestLen == 0 {
+		return tree.DNull, 0, nil
+	}
+	if err := group[best][colIdx].EnsureDecoded(typ, alloc); err != nil {
+		return nil, 0, err
+	}
+	return group[best][colIdx].Datum, bestLen, nil
+}
+
+// decimalAvg computes the average (AVG) of INT or DECIMAL values one value at a
+// time, keeping a DECIMAL sum and an INT count. Unlike an average computed in
+// the type of the values, the average of INTs is a DECIMAL computed without
+// loss of precision: the sum is exact, and the only rounding happens in result.
+type decimalAvg struct {
+	sum   apd.Decimal
+	count int64
+	// tmp holds the decimal form of the INT values.
+	tmp apd.Decimal
+}
+
+// add adds a value to the average. NULLs are skipped.
+func (a *decimalAvg) add(d tree.Datum) error {
+	var v *apd.Decimal
+	switch t := d.(type) {
+	case *tree.DInt:
+		v = a.tmp.SetInt64(int64(*t))
+	case *tree.DDecimal:
+		v = &t.Decimal
+	default:
+		if d == tree.DNull {
+			return nil
+		}
+		return errors.Errorf("unsupported type %s for AVG", d.ResolvedType())
+	}
+	if _, err := tree.ExactCtx.Add(&a.sum, &a.sum, v); err != nil {
+		return err
+	}
+	a.count++
+	return nil
+}
+
+// result returns the average of the values added so far, rounded (half up) to
+// scale digits after the decimal point, or NULL if no (non-NULL) values were
+// added.
+func (a *decimalAvg) result(scale int32) (tree.Datum, error) {
+	if a.count == 0 {
+		return tree.DNull, nil
+	}
+	res := &tree.DDecimal{}
+	if _, err := tree.HighPrecisionCtx.Quo(&res.Decimal, &a.sum, apd.New(a.count, 0)); err != nil {
+		return nil, err
+	}
+	if _, err := tree.HighPrecisionCtx.Quantize(&res.Decimal, &res.Decimal, -scale); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// groupAvg returns the average of the values of column colIdx, which must be of
+// type INT or DECIMAL, in the given group, as a DECIMAL with scale digits after
+// the decimal point; see decimalAvg. NULLs are skipped, and NULL is returned if
+// the group has no non-NULL values. The rows don't need to be in any order.
+func groupAvg(
+	types []sqlbase.ColumnType,
+	group []sqlbase.EncDatumRow,
+	colIdx int,
+	scale int32,
+	alloc *sqlbase.DatumAlloc,
+) (tree.Datum, error) {
+	if colIdx < 0 || colIdx >= len(types) {
+		return nil, errors.Errorf("invalid column %d", colIdx)
+	}
+	var avg decimalAvg
+	for _, row := range group {
+		if err := row[colIdx].EnsureDecoded(&types[colIdx], alloc); err != nil {
+			return nil, err
+		}
+		if err := avg.add(row[colIdx].Datum); err != nil {
+			return nil, err
+		}
+	}
+	return avg.result(scale)
+}
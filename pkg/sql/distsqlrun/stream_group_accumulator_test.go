@@ -0,0 +1,1723 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// makeJoinReaderFixtureRows generates the rows of the table used by
+// TestJoinReader, in primary key order:
+//
+//  |     a    |     b    |         sum         |
+//  |-----------------------------------------------|
+//  | rowId/10 | rowId%10 | rowId/10 + rowId%10 |
+func makeJoinReaderFixtureRows() sqlbase.EncDatumRows {
+	var rows [][]int
+	for i := 1; i <= 99; i++ {
+		rows = append(rows, []int{i / 10, i % 10, i/10 + i%10})
+	}
+	return genEncDatumRowsInt(rows)
+}
+
+func makeTestGroupAccumulator(
+	types []sqlbase.ColumnType,
+	rows sqlbase.EncDatumRows,
+	ordering sqlbase.ColumnOrdering,
+	nullsAreEqual bool,
+) streamGroupAccumulator {
+	return makeStreamGroupAccumulator(makeSliceRowSource(types, rows), ordering, nullsAreEqual)
+}
+
+// groupSizes returns the number of rows in each of the groups produced by the
+// accumulator.
+func groupSizes(
+	t *testing.T, evalCtx *tree.EvalContext, acc *streamGroupAccumulator,
+) []int {
+	var sizes []int
+	if err := acc.forEachGroup(evalCtx, 0 /* maxGroups */, func(group []sqlbase.EncDatumRow) error {
+		sizes = append(sizes, len(group))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return sizes
+}
+
+var orderingOnFirstCol = sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+
+func TestStreamGroupAccumulator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	rows := genEncDatumRowsInt([][]int{{1, 1}, {1, 2}, {2, 1}, {3, 0}, {3, 5}, {3, 7}})
+	acc := makeStreamGroupAccumulator(makeSliceRowSource(twoIntCols, rows), orderingOnFirstCol, true)
+
+	expected := []string{"[[1 1] [1 2]]", "[[2 1]]", "[[3 0] [3 5] [3 7]]"}
+	for _, exp := range expected {
+		first, err := acc.peekAtCurrentGroup(&evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		group, err := acc.advanceGroup(&evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := sqlbase.EncDatumRows(group).String(twoIntCols); s != exp {
+			t.Errorf("expected group %s, got %s", exp, s)
+		}
+		// The first row of the group is the one peeked at.
+		if s, firstStr := first.String(twoIntCols), group[0].String(twoIntCols); s != firstStr {
+			t.Errorf("peeked at %s, but the group starts with %s", s, firstStr)
+		}
+	}
+	if row, err := acc.peekAtCurrentGroup(&evalCtx); err != nil || row != nil {
+		t.Fatalf("expected no more rows, got %v (err: %v)", row, err)
+	}
+	if group, err := acc.advanceGroup(&evalCtx); err != nil || group != nil {
+		t.Fatalf("expected no more groups, got %v (err: %v)", group, err)
+	}
+	if !acc.Exhausted() {
+		t.Fatal("accumulator not exhausted")
+	}
+}
+
+// checkGroupBoundaries feeds an accumulator grouping on the first column with
+// rows forming groups of the given sizes, and verifies:
+//  - that the groups returned by advanceGroup() have the expected sizes;
+//  - that the slice of the rows of the current group is reused for the next
+//    group when it has room left, and reallocated otherwise;
+//  - that the accumulator is only Exhausted() once the last group has been
+//    returned;
+//  - that the returned groups are not aliased by the accumulator: appending to
+//    them doesn't affect the following groups, and their rows are not
+//    overwritten by the following groups.
+//
+// The rows of the i-th group have value i in their first column; their second
+// column is their index in the input.
+func checkGroupBoundaries(t *testing.T, evalCtx *tree.EvalContext, sizes []int) {
+	var input [][]int
+	for g, size := range sizes {
+		for i := 0; i < size; i++ {
+			input = append(input, []int{g, len(input)})
+		}
+	}
+	acc := makeTestGroupAccumulator(
+		twoIntCols, genEncDatumRowsInt(input), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	// checkRows verifies the rows of the g-th group, which start at index start
+	// of the input.
+	checkRows := func(g, start int, group []sqlbase.EncDatumRow) {
+		for i, row := range group {
+			a, idx := int(*row[0].Datum.(*tree.DInt)), int(*row[1].Datum.(*tree.DInt))
+			if a != g || idx != start+i {
+				t.Fatalf(
+					"group %d: expected row %d of the group to be [%d %d], got [%d %d]",
+					g, i, g, start+i, a, idx,
+				)
+			}
+		}
+	}
+
+	var groups [][]sqlbase.EncDatumRow
+	start := 0
+	for g := 0; ; g++ {
+		if acc.Exhausted() {
+			t.Fatalf("accumulator exhausted after %d groups", g)
+		}
+		// Before the first call, no slice has been allocated.
+		prevCap := cap(acc.curGroup)
+		if prevCap == 0 {
+			prevCap = groupSliceCapacity
+		}
+		group, err := acc.advanceGroup(evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group == nil {
+			if g != len(sizes) {
+				t.Fatalf("expected %d groups, got %d", len(sizes), g)
+			}
+			break
+		}
+		if g >= len(sizes) {
+			t.Fatalf("unexpected group %d: %v", g, group)
+		}
+		if len(group) != sizes[g] {
+			t.Fatalf("group %d: expected %d rows, got %d", g, sizes[g], len(group))
+		}
+		checkRows(g, start, group)
+
+		if g == len(sizes)-1 {
+			if !acc.Exhausted() {
+				t.Fatal("accumulator not exhausted after the last group")
+			}
+		} else {
+			if acc.Exhausted() {
+				t.Fatalf("accumulator exhausted after group %d of %d", g, len(sizes))
+			}
+			// The capacity of the group is limited so that appending to it can't
+			// overwrite the rows of the next group (the last group isn't followed
+			// by any other).
+			if cap(group) != len(group) {
+				t.Fatalf("group %d: capacity %d larger than length %d", g, cap(group), len(group))
+			}
+			_ = append(group, sqlbase.EncDatumRow{intEncDatum(-1), intEncDatum(-1)})
+			// The next group starts in the rest of the slice if the group left
+			// room in it, and in a new slice otherwise. If the group didn't fit,
+			// the slice was grown by append and its capacity is unknown.
+			switch {
+			case len(group) < prevCap:
+				if c := cap(acc.curGroup); c != prevCap-len(group) {
+					t.Fatalf("group %d: expected the slice to be reused (capacity %d), got capacity %d",
+						g, prevCap-len(group), c)
+				}
+			case len(group) == prevCap:
+				if c := cap(acc.curGroup); c != groupSliceCapacity {
+					t.Fatalf("group %d: expected a new slice, got capacity %d", g, c)
+				}
+			}
+		}
+		groups = append(groups, group)
+		start += len(group)
+	}
+
+	// The following groups didn't overwrite the rows of the returned groups.
+	start = 0
+	for g, group := range groups {
+		checkRows(g, start, group)
+		start += len(group)
+	}
+}
+
+// TestStreamGroupAccumulatorNoAliasing verifies that modifying the groups
+// returned by an accumulator, or appending to them, doesn't affect the groups
+// returned before or after them, even though they share the same slice.
+func TestStreamGroupAccumulatorNoAliasing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	input := [][]int{{0, 0}, {0, 1}, {1, 2}, {2, 3}, {2, 4}, {2, 5}, {3, 6}, {4, 7}, {4, 8}}
+	acc := makeTestGroupAccumulator(
+		twoIntCols, genEncDatumRowsInt(input), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	expected := []string{"[[0 0] [0 1]]", "[[1 2]]", "[[2 3] [2 4] [2 5]]", "[[3 6]]", "[[4 7] [4 8]]"}
+	garbage := sqlbase.EncDatumRow{intEncDatum(99), intEncDatum(99)}
+
+	var groups [][]sqlbase.EncDatumRow
+	for {
+		group, err := acc.advanceGroup(&evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group == nil {
+			break
+		}
+		// The earlier groups are unaffected by the accumulation of this one.
+		for i, g := range groups {
+			if s := sqlbase.EncDatumRows(g).String(twoIntCols); s != expected[i] {
+				t.Fatalf("group %d modified: expected %s, got %s", i, expected[i], s)
+			}
+		}
+		groups = append(groups, append([]sqlbase.EncDatumRow(nil), group...))
+		// Mutate the group and append to it; the next groups are accumulated in
+		// the same slice.
+		for i := range group {
+			group[i] = garbage
+		}
+		_ = append(group, garbage, garbage, garbage)
+	}
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %d groups, got %d", len(expected), len(groups))
+	}
+	for i, g := range groups {
+		if s := sqlbase.EncDatumRows(g).String(twoIntCols); s != expected[i] {
+			t.Errorf("group %d: expected %s, got %s", i, expected[i], s)
+		}
+	}
+}
+
+// TestStreamGroupAccumulatorBoundaries runs checkGroupBoundaries over various
+// sequences of groups.
+func TestStreamGroupAccumulatorBoundaries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	testCases := []struct {
+		name  string
+		sizes []int
+	}{
+		{name: "Empty", sizes: nil},
+		{name: "SingleRow", sizes: []int{1}},
+		{name: "Singletons", sizes: []int{1, 1, 1, 1, 1}},
+		{name: "Mixed", sizes: []int{3, 1, 7, 2, 10, 1}},
+		// The groups fill the slice exactly, so each one gets a new slice.
+		{name: "FullSlices", sizes: []int{groupSliceCapacity, groupSliceCapacity, groupSliceCapacity}},
+		// The second group doesn't fit in the rest of the slice.
+		{name: "Overflow", sizes: []int{groupSliceCapacity - 2, 5, 3}},
+		// Many groups share each slice.
+		{name: "ManySmall", sizes: func() []int {
+			sizes := make([]int, 100)
+			for i := range sizes {
+				sizes[i] = 1 + i%3
+			}
+			return sizes
+		}()},
+		{name: "Giant", sizes: []int{10 * groupSliceCapacity}},
+		{name: "GiantInBetween", sizes: []int{2, 10*groupSliceCapacity + 3, 2}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			checkGroupBoundaries(t, &evalCtx, c.sizes)
+		})
+	}
+}
+
+func TestStreamGroupAccumulatorForEachGroup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	acc := makeTestGroupAccumulator(
+		threeIntCols, makeJoinReaderFixtureRows(), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	sizes := groupSizes(t, &evalCtx, &acc)
+	// There is a group for each value of a (0 to 9); a = 0 has no row for
+	// rowId 0.
+	if len(sizes) != 10 {
+		t.Fatalf("expected 10 groups, got %d", len(sizes))
+	}
+	for i, size := range sizes {
+		expected := 10
+		if i == 0 {
+			expected = 9
+		}
+		if size != expected {
+			t.Errorf("group %d: expected %d rows, got %d", i, expected, size)
+		}
+	}
+
+	// Errors returned by the callback stop the iteration.
+	acc = makeTestGroupAccumulator(
+		threeIntCols, makeJoinReaderFixtureRows(), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	expectedErr := errors.New("stop")
+	numGroups := 0
+	if err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func([]sqlbase.EncDatumRow) error {
+		numGroups++
+		if numGroups == 3 {
+			return expectedErr
+		}
+		return nil
+	}); err != expectedErr {
+		t.Fatalf("expected error %v, got %v", expectedErr, err)
+	}
+	if numGroups != 3 {
+		t.Fatalf("expected the iteration to stop after 3 groups, got %d", numGroups)
+	}
+}
+
+// TestStreamGroupAccumulatorExhausted verifies that the accumulator reports
+// when its source has been fully consumed, including for an empty source.
+func TestStreamGroupAccumulatorExhausted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	acc := makeTestGroupAccumulator(oneIntCol, nil /* rows */, orderingOnFirstCol, true /* nullsAreEqual */)
+	if acc.Exhausted() {
+		t.Fatal("accumulator exhausted before reading from the source")
+	}
+	group, err := acc.advanceGroup(&evalCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group) != 0 {
+		t.Fatalf("expected no group, got %v", group)
+	}
+	if !acc.Exhausted() {
+		t.Fatal("accumulator not exhausted after reading an empty source")
+	}
+
+	acc = makeTestGroupAccumulator(
+		oneIntCol, genEncDatumRowsInt([][]int{{1}, {2}}), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	if _, err := acc.advanceGroup(&evalCtx); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Exhausted() {
+		t.Fatal("accumulator exhausted before the last group")
+	}
+	if sizes := groupSizes(t, &evalCtx, &acc); !reflect.DeepEqual(sizes, []int{1}) {
+		t.Fatalf("expected the last group to have 1 row, got %v", sizes)
+	}
+	if !acc.Exhausted() {
+		t.Fatal("accumulator not exhausted after the last group")
+	}
+}
+
+// TestStreamGroupAccumulatorMaxGroups verifies that forEachGroup fails once
+// the number of groups exceeds the limit.
+func TestStreamGroupAccumulatorMaxGroups(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// Each row is a group by itself.
+	const numRows = 100
+	rows := make([][]int, numRows)
+	for i := range rows {
+		rows[i] = []int{i}
+	}
+
+	for _, maxGroups := range []int{numRows, numRows + 1} {
+		acc := makeTestGroupAccumulator(
+			oneIntCol, genEncDatumRowsInt(rows), orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		if err := acc.forEachGroup(&evalCtx, maxGroups, func([]sqlbase.EncDatumRow) error {
+			return nil
+		}); err != nil {
+			t.Fatalf("maxGroups=%d: %v", maxGroups, err)
+		}
+	}
+
+	acc := makeTestGroupAccumulator(
+		oneIntCol, genEncDatumRowsInt(rows), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	numGroups := 0
+	err := acc.forEachGroup(&evalCtx, 10 /* maxGroups */, func([]sqlbase.EncDatumRow) error {
+		numGroups++
+		return nil
+	})
+	if !testutils.IsError(err, "number of groups exceeds the limit of 10") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if numGroups != 10 {
+		t.Fatalf("expected 10 groups to be processed, got %d", numGroups)
+	}
+}
+
+// TestMergingStreamGroupAccumulator verifies that groups are formed over the
+// merge of multiple sorted sources.
+func TestMergingStreamGroupAccumulator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// Split the fixture rows in two sorted sources, one with the rows with an
+	// even b and one with the rows with an odd b.
+	fixture := makeJoinReaderFixtureRows()
+	makeSources := func(rows sqlbase.EncDatumRows) []NoMetadataRowSource {
+		var even, odd sqlbase.EncDatumRows
+		for i, row := range rows {
+			if i%2 == 0 {
+				odd = append(odd, row)
+			} else {
+				even = append(even, row)
+			}
+		}
+		var srcs []NoMetadataRowSource
+		for _, rows := range []sqlbase.EncDatumRows{even, odd} {
+			in := NewRowBuffer(threeIntCols, rows, RowBufferArgs{})
+			srcs = append(srcs, MakeNoMetadataRowSource(in, func(ProducerMetadata) {}))
+		}
+		return srcs
+	}
+	orderingOnAB := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	// Group on a; the groups are the same as with a single source.
+	acc := makeMergingStreamGroupAccumulator(
+		makeSources(fixture), orderingOnFirstCol, true /* nullsAreEqual */, &evalCtx,
+	)
+	sizes := groupSizes(t, &evalCtx, &acc)
+	expectedSizes := []int{9, 10, 10, 10, 10, 10, 10, 10, 10, 10}
+	if !reflect.DeepEqual(sizes, expectedSizes) {
+		t.Fatalf("expected group sizes %v, got %v", expectedSizes, sizes)
+	}
+
+	// Group on (a, b); the rows come out in the order of the fixture.
+	acc = makeMergingStreamGroupAccumulator(
+		makeSources(fixture), orderingOnAB, true /* nullsAreEqual */, &evalCtx,
+	)
+	var merged sqlbase.EncDatumRows
+	if err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func(group []sqlbase.EncDatumRow) error {
+		merged = append(merged, group...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := fixture.String(threeIntCols), merged.String(threeIntCols); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+
+	// Mis-ordering within a source is detected.
+	unordered := makeJoinReaderFixtureRows()
+	unordered[20], unordered[50] = unordered[50], unordered[20]
+	acc = makeMergingStreamGroupAccumulator(
+		makeSources(unordered), orderingOnFirstCol, true /* nullsAreEqual */, &evalCtx,
+	)
+	err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func([]sqlbase.EncDatumRow) error {
+		return nil
+	})
+	if !testutils.IsError(err, "detected badly ordered input from source 1") {
+		t.Fatalf("expected ordering error, got %v", err)
+	}
+}
+
+// TestStreamGroupAccumulatorGroupCols verifies grouping by a prefix of the
+// input ordering.
+func TestStreamGroupAccumulatorGroupCols(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	orderingOnFirstTwoCols := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	// The fixture rows are sorted by (a, b); grouping by a yields one group per
+	// value of a.
+	acc := makeTestGroupAccumulator(
+		threeIntCols, makeJoinReaderFixtureRows(), orderingOnFirstTwoCols, true, /* nullsAreEqual */
+	)
+	if err := acc.setGroupCols(1); err != nil {
+		t.Fatal(err)
+	}
+	sizes := groupSizes(t, &evalCtx, &acc)
+	expected := []int{9, 10, 10, 10, 10, 10, 10, 10, 10, 10}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Fatalf("expected group sizes %v, got %v", expected, sizes)
+	}
+
+	// Rows that are not ordered on b within a group are detected.
+	rows := genEncDatumRowsInt([][]int{{1, 1}, {1, 3}, {1, 2}, {2, 1}})
+	acc = makeTestGroupAccumulator(twoIntCols, rows, orderingOnFirstTwoCols, true /* nullsAreEqual */)
+	if err := acc.setGroupCols(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func([]sqlbase.EncDatumRow) error {
+		return nil
+	}); !testutils.IsError(err, "badly ordered input") {
+		t.Fatalf("expected badly ordered input error, got %v", err)
+	}
+
+	if err := acc.setGroupCols(3); !testutils.IsError(err, "invalid number of group columns") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+// TestStreamGroupAccumulatorStrictOrdering verifies that the strict mode
+// detects rows that are not ordered within a group.
+func TestStreamGroupAccumulatorStrictOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	fullOrdering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Descending},
+	}
+
+	testCases := []struct {
+		rows  [][]int
+		sizes []int
+		err   string
+	}{
+		{
+			rows:  [][]int{{1, 3}, {1, 2}, {1, 2}, {2, 5}, {3, 1}},
+			sizes: []int{3, 1, 1},
+		},
+		{
+			// The second column is not descending within the first group.
+			rows: [][]int{{1, 3}, {1, 2}, {1, 4}, {2, 5}},
+			err:  "badly ordered input \\(strict mode\\)",
+		},
+	}
+	for i, tc := range testCases {
+		// Without the strict mode, the rows are grouped successfully either way.
+		acc := makeTestGroupAccumulator(
+			twoIntCols, genEncDatumRowsInt(tc.rows), orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		groupSizes(t, &evalCtx, &acc)
+
+		acc = makeTestGroupAccumulator(
+			twoIntCols, genEncDatumRowsInt(tc.rows), orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		acc.setStrictOrdering(fullOrdering)
+		var sizes []int
+		err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func(group []sqlbase.EncDatumRow) error {
+			sizes = append(sizes, len(group))
+			return nil
+		})
+		if tc.err != "" {
+			if !testutils.IsError(err, tc.err) {
+				t.Errorf("%d: expected error %q, got %v", i, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sizes, tc.sizes) {
+			t.Errorf("%d: expected group sizes %v, got %v", i, tc.sizes, sizes)
+		}
+	}
+}
+
+func TestStreamGroupAccumulatorNulls(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	v := [4]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = intEncDatum(i)
+	}
+	null := nullEncDatum()
+
+	orderingOnBothCols := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	testCases := []struct {
+		rows     sqlbase.EncDatumRows
+		ordering sqlbase.ColumnOrdering
+		// Expected group sizes when NULLs are equal and when they are distinct.
+		equalNulls    []int
+		distinctNulls []int
+	}{
+		{
+			rows: sqlbase.EncDatumRows{
+				{null, v[1]},
+				{null, v[2]},
+				{v[1], v[3]},
+				{v[1], v[3]},
+				{v[2], v[3]},
+			},
+			ordering:      orderingOnFirstCol,
+			equalNulls:    []int{2, 2, 1},
+			distinctNulls: []int{1, 1, 2, 1},
+		},
+		{
+			rows: sqlbase.EncDatumRows{
+				{v[1], null},
+				{v[1], null},
+				{v[1], v[2]},
+				{v[2], null},
+			},
+			ordering:      orderingOnBothCols,
+			equalNulls:    []int{2, 1, 1},
+			distinctNulls: []int{1, 1, 1, 1},
+		},
+		{
+			// NULLs in non-ordering columns don't matter.
+			rows: sqlbase.EncDatumRows{
+				{v[1], null},
+				{v[1], null},
+				{v[2], null},
+			},
+			ordering:      orderingOnFirstCol,
+			equalNulls:    []int{2, 1},
+			distinctNulls: []int{2, 1},
+		},
+	}
+
+	for i, tc := range testCases {
+		for _, nullsAreEqual := range []bool{true, false} {
+			acc := makeTestGroupAccumulator(twoIntCols, tc.rows, tc.ordering, nullsAreEqual)
+			expected := tc.distinctNulls
+			if nullsAreEqual {
+				expected = tc.equalNulls
+			}
+			if sizes := groupSizes(t, &evalCtx, &acc); !reflect.DeepEqual(sizes, expected) {
+				t.Errorf("%d (nullsAreEqual=%t): expected group sizes %v, got %v",
+					i, nullsAreEqual, expected, sizes)
+			}
+		}
+	}
+}
+
+// TestStreamGroupAccumulatorNullsOrder verifies that input sorted with NULLS
+// FIRST or NULLS LAST is accepted when the ordering says so, and rejected
+// otherwise.
+func TestStreamGroupAccumulatorNullsOrder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	v := [3]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = intEncDatum(i)
+	}
+	null := nullEncDatum()
+
+	testCases := []struct {
+		name      string
+		rows      sqlbase.EncDatumRows
+		direction encoding.Direction
+		// nullsOrder is the NULLs placement of the input.
+		nullsOrder sqlbase.NullsOrder
+		expected   []int
+		// defaultOK is set if the input is also ordered according to the
+		// default NULLs placement.
+		defaultOK bool
+	}{
+		{
+			name:       "AscNullsFirst",
+			rows:       sqlbase.EncDatumRows{{null}, {null}, {v[1]}, {v[1]}, {v[2]}},
+			direction:  encoding.Ascending,
+			nullsOrder: sqlbase.NullsFirst,
+			expected:   []int{2, 2, 1},
+			defaultOK:  true,
+		},
+		{
+			name:       "AscNullsLast",
+			rows:       sqlbase.EncDatumRows{{v[1]}, {v[1]}, {v[2]}, {null}, {null}},
+			direction:  encoding.Ascending,
+			nullsOrder: sqlbase.NullsLast,
+			expected:   []int{2, 1, 2},
+		},
+		{
+			name:       "DescNullsFirst",
+			rows:       sqlbase.EncDatumRows{{null}, {v[2]}, {v[1]}, {v[1]}},
+			direction:  encoding.Descending,
+			nullsOrder: sqlbase.NullsFirst,
+			expected:   []int{1, 1, 2},
+		},
+		{
+			name:       "DescNullsLast",
+			rows:       sqlbase.EncDatumRows{{v[2]}, {v[1]}, {null}, {null}},
+			direction:  encoding.Descending,
+			nullsOrder: sqlbase.NullsLast,
+			expected:   []int{1, 1, 2},
+			defaultOK:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ordering := sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: tc.direction, NullsOrder: tc.nullsOrder},
+			}
+			acc := makeTestGroupAccumulator(oneIntCol, tc.rows, ordering, true /* nullsAreEqual */)
+			if sizes := groupSizes(t, &evalCtx, &acc); !reflect.DeepEqual(sizes, tc.expected) {
+				t.Errorf("expected group sizes %v, got %v", tc.expected, sizes)
+			}
+
+			// With the default NULLs placement, the input is badly ordered unless
+			// the placements coincide.
+			ordering[0].NullsOrder = sqlbase.DefaultNullsOrder
+			acc = makeTestGroupAccumulator(oneIntCol, tc.rows, ordering, true /* nullsAreEqual */)
+			err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func([]sqlbase.EncDatumRow) error {
+				return nil
+			})
+			if tc.defaultOK {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !testutils.IsError(err, "badly ordered input") {
+				t.Fatalf("expected badly ordered input error, got %v", err)
+			}
+		})
+	}
+}
+
+// TestStreamGroupAccumulatorCollatedStrings verifies that collated strings are
+// grouped according to their collation rather than their byte order.
+func TestStreamGroupAccumulatorCollatedStrings(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	locale := "en"
+	collatedType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_COLLATEDSTRING, Locale: &locale}
+	types := []sqlbase.ColumnType{collatedType}
+
+	// The values are sorted according to the collation, under which "a" < "B",
+	// even though "B" < "a" when comparing the bytes.
+	values := []string{"a", "a", "B", "c", "c", "c"}
+	var env tree.CollationEnvironment
+	var a sqlbase.DatumAlloc
+	for _, encoded := range []bool{false, true} {
+		rows := make(sqlbase.EncDatumRows, len(values))
+		for i, v := range values {
+			ed := sqlbase.DatumToEncDatum(collatedType, tree.NewDCollatedString(v, locale, &env))
+			if encoded {
+				// Force the values to be decoded when they are compared.
+				enc, err := ed.Encode(&collatedType, &a, sqlbase.DatumEncoding_VALUE, nil /* appendTo */)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ed = sqlbase.EncDatumFromEncoded(&collatedType, sqlbase.DatumEncoding_VALUE, enc)
+			}
+			rows[i] = sqlbase.EncDatumRow{ed}
+		}
+		acc := makeTestGroupAccumulator(types, rows, orderingOnFirstCol, true /* nullsAreEqual */)
+		acc.setStrictOrdering(orderingOnFirstCol)
+		sizes := groupSizes(t, &evalCtx, &acc)
+		if expected := []int{2, 1, 3}; !reflect.DeepEqual(sizes, expected) {
+			t.Errorf("encoded=%t: expected group sizes %v, got %v", encoded, expected, sizes)
+		}
+	}
+}
+
+// TestStreamGroupAccumulatorFoldCase verifies that strings that only differ in
+// case are grouped together when their column is normalized with
+// foldCaseNormalizer.
+func TestStreamGroupAccumulatorFoldCase(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// The values are sorted case insensitively, but not according to their
+	// bytes ("a" > "B").
+	types := []sqlbase.ColumnType{strType}
+	values := []string{"apple", "Apple", "APPLE", "b", "B", "Cherry"}
+	var a sqlbase.DatumAlloc
+	makeRows := func(encoded bool) sqlbase.EncDatumRows {
+		rows := make(sqlbase.EncDatumRows, len(values))
+		for i, v := range values {
+			ed := sqlbase.DatumToEncDatum(strType, tree.NewDString(v))
+			if encoded {
+				// Force the values to be decoded when they are compared.
+				enc, err := ed.Encode(&strType, &a, sqlbase.DatumEncoding_VALUE, nil /* appendTo */)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ed = sqlbase.EncDatumFromEncoded(&strType, sqlbase.DatumEncoding_VALUE, enc)
+			}
+			rows[i] = sqlbase.EncDatumRow{ed}
+		}
+		return rows
+	}
+
+	for _, encoded := range []bool{false, true} {
+		acc := makeTestGroupAccumulator(types, makeRows(encoded), orderingOnFirstCol, true /* nullsAreEqual */)
+		acc.setStrictOrdering(orderingOnFirstCol)
+		if err := acc.setColumnNormalizer(0, foldCaseNormalizer); err != nil {
+			t.Fatal(err)
+		}
+		var groups []string
+		if err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func(group []sqlbase.EncDatumRow) error {
+			groups = append(groups, sqlbase.EncDatumRows(group).String(types))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// The rows keep their original values.
+		expected := []string{"[['apple'] ['Apple'] ['APPLE']]", "[['b'] ['B']]", "[['Cherry']]"}
+		if !reflect.DeepEqual(groups, expected) {
+			t.Errorf("encoded=%t: expected groups %v, got %v", encoded, expected, groups)
+		}
+	}
+
+	t.Run("NoNormalizer", func(t *testing.T) {
+		// Without the normalizer, "apple" > "Apple" is badly ordered.
+		acc := makeTestGroupAccumulator(types, makeRows(false), orderingOnFirstCol, true /* nullsAreEqual */)
+		if _, err := acc.advanceGroup(&evalCtx); !testutils.IsError(err, "badly ordered input") {
+			t.Fatalf("expected a badly ordered input error, got %v", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		acc := makeTestGroupAccumulator(
+			twoIntCols, nil /* rows */, orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		if err := acc.setColumnNormalizer(1, foldCaseNormalizer); !testutils.IsError(
+			err, "column 1 is not an ordering column",
+		) {
+			t.Fatalf("expected an invalid column error, got %v", err)
+		}
+		// The normalizer fails on values that aren't strings.
+		acc = makeTestGroupAccumulator(
+			twoIntCols, genEncDatumRowsInt([][]int{{1, 0}, {1, 1}}), orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		if err := acc.setColumnNormalizer(0, foldCaseNormalizer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := acc.advanceGroup(&evalCtx); !testutils.IsError(err, "cannot fold the case of int") {
+			t.Fatalf("expected a fold case error, got %v", err)
+		}
+	})
+}
+
+func TestStreamGroupAccumulatorMemoryBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	rows := genEncDatumRowsInt([][]int{{1}, {1}, {2}, {2}, {2}, {2}, {3}})
+	// Allow groups of up to 3 rows.
+	limit := 3 * rows[0].MemorySize()
+
+	acc := makeTestGroupAccumulator(oneIntCol, rows, orderingOnFirstCol, true /* nullsAreEqual */)
+	acc.initMemoryAccounting(&FlowCtx{}, evalCtx.Mon, limit)
+	defer acc.close(ctx)
+
+	group, err := acc.advanceGroup(&evalCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group) != 2 {
+		t.Fatalf("expected a group of 2 rows, got %d", len(group))
+	}
+	_, err = acc.advanceGroup(&evalCtx)
+	if pgErr, ok := pgerror.GetPGCause(err); !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) {
+		t.Fatalf("expected a memory budget error, got %v", err)
+	}
+}
+
+// TestStreamGroupAccumulatorMaxBufferedRows verifies that a group larger than
+// the limit set with setMaxBufferedRows results in an error if no spill
+// function is set, and is otherwise spilled in chunks of the limit.
+func TestStreamGroupAccumulatorMaxBufferedRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	// A group of 2 rows, a group of 1000 rows and a group of 1 row.
+	const bigGroupRows = 1000
+	input := [][]int{{1, 0}, {1, 1}}
+	for i := 0; i < bigGroupRows; i++ {
+		input = append(input, []int{2, i})
+	}
+	input = append(input, []int{3, 0})
+	const limit = 64
+
+	t.Run("NoSpill", func(t *testing.T) {
+		acc := makeTestGroupAccumulator(
+			twoIntCols, genEncDatumRowsInt(input), orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		acc.setMaxBufferedRows(limit, nil /* spill */)
+		group, err := acc.advanceGroup(&evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(group) != 2 {
+			t.Fatalf("expected a group of 2 rows, got %d", len(group))
+		}
+		_, err = acc.advanceGroup(&evalCtx)
+		if !testutils.IsError(err, fmt.Sprintf("limit of %d buffered rows", limit)) {
+			t.Fatalf("expected a buffered rows limit error, got %v", err)
+		}
+		if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeInsufficientResourcesError {
+			t.Errorf("expected error with code %s, got %v", pgerror.CodeInsufficientResourcesError, err)
+		}
+	})
+
+	t.Run("Spill", func(t *testing.T) {
+		acc := makeTestGroupAccumulator(
+			twoIntCols, genEncDatumRowsInt(input), orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		acc.collectGroupSizeStats()
+		var spilled sqlbase.EncDatumRows
+		acc.setMaxBufferedRows(limit, func(_ context.Context, rows []sqlbase.EncDatumRow) error {
+			if len(rows) != limit {
+				t.Errorf("expected %d rows to be spilled, got %d", limit, len(rows))
+			}
+			spilled = append(spilled, rows...)
+			return nil
+		})
+
+		var sizes []int
+		for {
+			group, err := acc.advanceGroup(&evalCtx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(group) == 0 {
+				break
+			}
+			if len(group) > limit {
+				t.Errorf("group of %d rows returned, more than the limit", len(group))
+			}
+			sizes = append(sizes, len(spilled)+len(group))
+			// The spilled rows and the returned ones make up the group, in order.
+			for i, row := range append(spilled, group...) {
+				if v := int(tree.MustBeDInt(row[1].Datum)); v != i {
+					t.Fatalf("expected row %d of the group, got %s", i, row.String(twoIntCols))
+				}
+			}
+			spilled = nil
+		}
+		if exp := []int{2, bigGroupRows, 1}; fmt.Sprint(sizes) != fmt.Sprint(exp) {
+			t.Errorf("expected groups of %v rows, got %v", exp, sizes)
+		}
+		if stats := acc.groupSizeStats; stats.TotalRows != uint64(len(input)) {
+			t.Errorf("expected %d rows in the group size stats, got %d", len(input), stats.TotalRows)
+		}
+	})
+}
+
+// TestStreamGroupAccumulatorMemoryFailure verifies that the accumulator fails
+// on the first row that doesn't fit in the memory allowed by the
+// MemoryFailAfterBytes testing knob, even though the budget of the monitor is
+// unlimited.
+func TestStreamGroupAccumulatorMemoryFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	// Groups of 1, 2 and 4 rows.
+	rows := genEncDatumRowsInt([][]int{{1}, {2}, {2}, {3}, {3}, {3}, {3}})
+	rowSize := rows[0].MemorySize()
+
+	testCases := []struct {
+		// maxRows is the number of rows that fit in the memory allowed by the
+		// knob.
+		maxRows int64
+		// expected are the sizes of the groups returned before the failure.
+		expected []int
+		fails    bool
+	}{
+		{maxRows: 1, expected: []int{1}, fails: true},
+		{maxRows: 2, expected: []int{1, 2}, fails: true},
+		{maxRows: 3, expected: []int{1, 2}, fails: true},
+		{maxRows: 4, expected: []int{1, 2, 4}, fails: false},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("MaxRows=%d", c.maxRows), func(t *testing.T) {
+			flowCtx := FlowCtx{
+				testingKnobs: TestingKnobs{MemoryFailAfterBytes: c.maxRows * rowSize},
+			}
+			acc := makeTestGroupAccumulator(oneIntCol, rows, orderingOnFirstCol, true /* nullsAreEqual */)
+			acc.initMemoryAccounting(&flowCtx, evalCtx.Mon, 0 /* limit */)
+			defer acc.close(ctx)
+
+			var sizes []int
+			var err error
+			for {
+				var group []sqlbase.EncDatumRow
+				group, err = acc.advanceGroup(&evalCtx)
+				if err != nil || group == nil {
+					break
+				}
+				sizes = append(sizes, len(group))
+			}
+			if !reflect.DeepEqual(sizes, c.expected) {
+				t.Errorf("expected groups of sizes %v, got %v", c.expected, sizes)
+			}
+			if !c.fails {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if pgErr, ok := pgerror.GetPGCause(err); !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) {
+				t.Fatalf("expected a memory budget error, got %v", err)
+			}
+		})
+	}
+}
+
+// TestStreamGroupAccumulatorPrimeWith verifies that a row the accumulator is
+// primed with is grouped with the equal rows of the source.
+func TestStreamGroupAccumulatorPrimeWith(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	rows := genEncDatumRowsInt([][]int{{1, 2}, {1, 3}, {2, 4}})
+	acc := makeTestGroupAccumulator(twoIntCols, rows, orderingOnFirstCol, true /* nullsAreEqual */)
+	if err := acc.primeWith(context.Background(), genEncDatumRowsInt([][]int{{1, 1}})[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := acc.peekAtCurrentGroup(&evalCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, expected := first.String(twoIntCols), "[1 1]"; res != expected {
+		t.Fatalf("expected first row %s, got %s", expected, res)
+	}
+	var groups []string
+	for {
+		group, err := acc.advanceGroup(&evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group == nil {
+			break
+		}
+		groups = append(groups, sqlbase.EncDatumRows(group).String(twoIntCols))
+	}
+	expected := []string{"[[1 1] [1 2] [1 3]]", "[[2 4]]"}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v, got %v", expected, groups)
+	}
+
+	if err := acc.primeWith(context.Background(), rows[0]); !testutils.IsError(err, "already read rows") {
+		t.Errorf("expected error priming a used accumulator, got %v", err)
+	}
+}
+
+// TestStreamGroupAccumulatorClose verifies that closing the accumulator before
+// the input is exhausted releases the memory accounted for the buffered rows.
+func TestStreamGroupAccumulatorClose(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	monitor := mon.MakeMonitor(
+		"test",
+		mon.MemoryResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	monitor.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+
+	rows := genEncDatumRowsInt([][]int{{1}, {1}, {2}, {2}, {3}})
+	acc := makeTestGroupAccumulator(oneIntCol, rows, orderingOnFirstCol, true /* nullsAreEqual */)
+	acc.initMemoryAccounting(&FlowCtx{}, &monitor, 0 /* limit */)
+
+	// Read a single group; the first row of the next group is buffered.
+	if _, err := acc.advanceGroup(&evalCtx); err != nil {
+		t.Fatal(err)
+	}
+	acc.close(ctx)
+	// Stop panics if any memory is still allocated from the monitor.
+	monitor.Stop(ctx)
+}
+
+func TestCountDistinctSorted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	v := [4]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = intEncDatum(i)
+	}
+	null := nullEncDatum()
+
+	testCases := []struct {
+		rows     sqlbase.EncDatumRows
+		expected int64
+	}{
+		{
+			rows:     nil,
+			expected: 0,
+		},
+		{
+			rows:     sqlbase.EncDatumRows{{v[0], v[1]}, {v[0], v[1]}, {v[0], v[1]}},
+			expected: 1,
+		},
+		{
+			rows:     sqlbase.EncDatumRows{{v[0], v[1]}, {v[0], v[1]}, {v[1], v[2]}, {v[2], v[3]}, {v[3], v[3]}},
+			expected: 3,
+		},
+		{
+			// NULLs are not counted, regardless of where they sort.
+			rows:     sqlbase.EncDatumRows{{v[0], null}, {v[1], null}, {v[2], v[1]}, {v[3], v[1]}, {v[3], v[2]}},
+			expected: 2,
+		},
+		{
+			rows:     sqlbase.EncDatumRows{{v[0], v[3]}, {v[0], v[2]}, {v[1], v[2]}, {v[2], null}},
+			expected: 2,
+		},
+		{
+			rows:     sqlbase.EncDatumRows{{v[0], null}, {v[1], null}},
+			expected: 0,
+		},
+	}
+	for i, tc := range testCases {
+		var alloc sqlbase.DatumAlloc
+		count, err := countDistinctSorted(tc.rows, 1 /* colIdx */, twoIntCols, &alloc, &evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.expected {
+			t.Errorf("%d: expected %d, got %d", i, tc.expected, count)
+		}
+	}
+}
+
+func TestTopRowInGroup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// Select the row with the largest (or smallest) sum in each a group of the
+	// fixture.
+	for _, tc := range []struct {
+		name     string
+		dir      encoding.Direction
+		expected string
+	}{
+		{
+			name: "Max",
+			dir:  encoding.Descending,
+			expected: "[[0 9 9] [1 9 10] [2 9 11] [3 9 12] [4 9 13] " +
+				"[5 9 14] [6 9 15] [7 9 16] [8 9 17] [9 9 18]]",
+		},
+		{
+			name: "Min",
+			dir:  encoding.Ascending,
+			expected: "[[0 1 1] [1 0 1] [2 0 2] [3 0 3] [4 0 4] " +
+				"[5 0 5] [6 0 6] [7 0 7] [8 0 8] [9 0 9]]",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			acc := makeTestGroupAccumulator(
+				threeIntCols, makeJoinReaderFixtureRows(), orderingOnFirstCol, true, /* nullsAreEqual */
+			)
+			var alloc sqlbase.DatumAlloc
+			var res sqlbase.EncDatumRows
+			if err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func(group []sqlbase.EncDatumRow) error {
+				row, err := topRowInGroup(group, 2 /* colIdx */, tc.dir, threeIntCols, &alloc, &evalCtx)
+				if err != nil {
+					return err
+				}
+				res = append(res, row)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if s := res.String(threeIntCols); s != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, s)
+			}
+		})
+	}
+
+	// NULLs are smaller than all other values, and ties go to the first row.
+	v := [3]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = intEncDatum(i)
+	}
+	null := nullEncDatum()
+	rows := sqlbase.EncDatumRows{{v[0], v[1]}, {v[1], null}, {v[2], v[1]}}
+	var alloc sqlbase.DatumAlloc
+	for _, tc := range []struct {
+		dir      encoding.Direction
+		expected string
+	}{
+		{dir: encoding.Descending, expected: "[0 1]"},
+		{dir: encoding.Ascending, expected: "[1 NULL]"},
+	} {
+		row, err := topRowInGroup(rows, 1 /* colIdx */, tc.dir, twoIntCols, &alloc, &evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := row.String(twoIntCols); s != tc.expected {
+			t.Errorf("direction %d: expected %s, got %s", tc.dir, tc.expected, s)
+		}
+	}
+	if row, err := topRowInGroup(nil, 1 /* colIdx */, encoding.Ascending, twoIntCols, &alloc, &evalCtx); err != nil || row != nil {
+		t.Fatalf("expected no row for an empty group, got %v (err: %v)", row, err)
+	}
+}
+
+func TestGroupGapDetector(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	intRows := func(vals ...int64) sqlbase.EncDatumRows {
+		rows := make(sqlbase.EncDatumRows, len(vals))
+		for i, v := range vals {
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(intType, tree.NewDInt(tree.DInt(v))), intEncDatum(i),
+			}
+		}
+		return rows
+	}
+	descending := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Descending}}
+
+	testCases := []struct {
+		name     string
+		rows     sqlbase.EncDatumRows
+		ordering sqlbase.ColumnOrdering
+		groups   int
+		gaps     []int64
+	}{
+		{
+			name:     "NoGaps",
+			rows:     intRows(1, 2, 2, 3),
+			ordering: orderingOnFirstCol,
+			groups:   3,
+		},
+		{
+			name:     "Ascending",
+			rows:     intRows(1, 1, 2, 5, 6, 9),
+			ordering: orderingOnFirstCol,
+			groups:   5,
+			gaps:     []int64{3, 4, 7, 8},
+		},
+		{
+			name:     "Descending",
+			rows:     intRows(9, 6, 5, 2, 2, 1),
+			ordering: descending,
+			groups:   5,
+			gaps:     []int64{8, 7, 4, 3},
+		},
+		{
+			name:     "Nulls",
+			rows:     append(sqlbase.EncDatumRows{{nullEncDatum(), intEncDatum(0)}}, intRows(1, 3)...),
+			ordering: orderingOnFirstCol,
+			groups:   3,
+			gaps:     []int64{2},
+		},
+		{
+			name:     "Extremes",
+			rows:     intRows(math.MaxInt64-2, math.MaxInt64),
+			ordering: orderingOnFirstCol,
+			groups:   2,
+			gaps:     []int64{math.MaxInt64 - 1},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			acc := makeTestGroupAccumulator(twoIntCols, tc.rows, tc.ordering, true /* nullsAreEqual */)
+			var gaps []int64
+			g, err := makeGroupGapDetector(&acc, 0 /* colIdx */, func(missing int64) error {
+				gaps = append(gaps, missing)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups := 0
+			for {
+				group, err := g.advanceGroup(&evalCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if group == nil {
+					break
+				}
+				groups++
+			}
+			if groups != tc.groups {
+				t.Errorf("expected %d groups, got %d", tc.groups, groups)
+			}
+			if !reflect.DeepEqual(gaps, tc.gaps) {
+				t.Errorf("expected gaps %v, got %v", tc.gaps, gaps)
+			}
+		})
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		acc := makeTestGroupAccumulator(
+			[]sqlbase.ColumnType{strType, intType}, nil /* rows */, orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		noop := func(int64) error { return nil }
+		if _, err := makeGroupGapDetector(&acc, 0 /* colIdx */, noop); !testutils.IsError(err, "expected INT") {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := makeGroupGapDetector(&acc, 1 /* colIdx */, noop); !testutils.IsError(err, "not part of the ordering") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+// callbackRowSource is a RowSource which calls onRow for each row returned by
+// its input.
+type callbackRowSource struct {
+	RowSource
+	onRow func()
+}
+
+func (s *callbackRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	row, meta := s.RowSource.Next()
+	if row != nil {
+		s.onRow()
+	}
+	return row, meta
+}
+
+func TestStreamGroupAccumulatorCancellation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// All the rows are in a single group.
+	const numRows = 10 * groupCancelCheckRows
+	input := make([][]int, numRows)
+	for i := range input {
+		input[i] = []int{1, i}
+	}
+	const cancelAfter = groupCancelCheckRows / 2
+
+	for _, cancellable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cancellable=%t", cancellable), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			rowsRead := 0
+			src := &callbackRowSource{
+				RowSource: NewRepeatableRowSource(twoIntCols, genEncDatumRowsInt(input)),
+				onRow: func() {
+					rowsRead++
+					if rowsRead == cancelAfter {
+						cancel()
+					}
+				},
+			}
+			acc := makeStreamGroupAccumulator(
+				MakeNoMetadataRowSource(src, func(ProducerMetadata) {}),
+				orderingOnFirstCol, true, /* nullsAreEqual */
+			)
+			if cancellable {
+				acc.setCancellation(ctx)
+			}
+			group, err := acc.advanceGroup(&evalCtx)
+			if !cancellable {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(group) != numRows {
+					t.Fatalf("expected a group of %d rows, got %d", numRows, len(group))
+				}
+				return
+			}
+			if err != context.Canceled {
+				t.Fatalf("expected %v, got %v", context.Canceled, err)
+			}
+			if rowsRead > cancelAfter+groupCancelCheckRows {
+				t.Fatalf("read %d rows after the cancellation", rowsRead-cancelAfter)
+			}
+		})
+	}
+}
+
+// TestStreamGroupAccumulatorDeadline verifies that an accumulator stops
+// reading rows once the deadline set with setDeadline has passed, whether it is
+// consumed group by group or row by row.
+func TestStreamGroupAccumulatorDeadline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// All the rows are in a single group.
+	const numRows = 10 * groupCancelCheckRows
+	input := make([][]int, numRows)
+	for i := range input {
+		input[i] = []int{1, i}
+	}
+
+	for _, rowByRow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rowByRow=%t", rowByRow), func(t *testing.T) {
+			acc := makeStreamGroupAccumulator(
+				MakeNoMetadataRowSource(
+					NewRepeatableRowSource(twoIntCols, genEncDatumRowsInt(input)),
+					func(ProducerMetadata) {},
+				),
+				orderingOnFirstCol, true, /* nullsAreEqual */
+			)
+			acc.setDeadline(timeutil.Now().Add(-time.Second))
+			var err error
+			rowsRead := 0
+			if rowByRow {
+				for {
+					var row sqlbase.EncDatumRow
+					row, _, err = acc.nextRowWithGroupBoundary(&evalCtx)
+					if err != nil || row == nil {
+						break
+					}
+					rowsRead++
+				}
+			} else {
+				_, err = acc.advanceGroup(&evalCtx)
+			}
+			if !testutils.IsError(err, "flow deadline exceeded") {
+				t.Fatalf("expected deadline error, got %v", err)
+			}
+			if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeQueryCanceledError {
+				t.Errorf("expected error with code %s, got %v", pgerror.CodeQueryCanceledError, err)
+			}
+			if rowsRead > groupCancelCheckRows {
+				t.Errorf("read %d rows past the deadline", rowsRead)
+			}
+		})
+	}
+}
+
+func TestStreamGroupAccumulatorRowByRow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// Compute a running sum of the second column within each group.
+	input := [][]int{{1, 1}, {1, 2}, {1, 3}, {2, 10}, {3, 5}, {3, 5}}
+	acc := makeTestGroupAccumulator(
+		twoIntCols, genEncDatumRowsInt(input), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	type result struct {
+		sum  int64
+		last bool
+	}
+	expected := []result{{1, false}, {3, false}, {6, true}, {10, true}, {5, false}, {10, true}}
+	var results []result
+	var alloc sqlbase.DatumAlloc
+	var sum int64
+	for {
+		row, last, err := acc.nextRowWithGroupBoundary(&evalCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil {
+			break
+		}
+		if err := row[1].EnsureDecoded(&intType, &alloc); err != nil {
+			t.Fatal(err)
+		}
+		sum += int64(*row[1].Datum.(*tree.DInt))
+		results = append(results, result{sum: sum, last: last})
+		if last {
+			sum = 0
+		}
+		// Only the next row is buffered.
+		if len(acc.curGroup) > 1 {
+			t.Fatalf("expected at most one buffered row, got %d", len(acc.curGroup))
+		}
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %v, got %v", expected, results)
+	}
+	if !acc.Exhausted() {
+		t.Errorf("expected the accumulator to be exhausted")
+	}
+
+	// Badly ordered input is detected.
+	acc = makeTestGroupAccumulator(
+		twoIntCols, genEncDatumRowsInt([][]int{{1, 1}, {2, 2}, {1, 3}}), orderingOnFirstCol, true, /* nullsAreEqual */
+	)
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		_, _, err = acc.nextRowWithGroupBoundary(&evalCtx)
+	}
+	if !testutils.IsError(err, "detected badly ordered input") {
+		t.Errorf("expected an ordering error, got %v", err)
+	}
+}
+
+func TestGroupMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	// The rows are (group, value); the mode is computed over the values, where
+	// -1 stands for NULL.
+	rows := func(vals ...int) []sqlbase.EncDatumRow {
+		group := make([]sqlbase.EncDatumRow, len(vals))
+		for i, v := range vals {
+			val := intEncDatum(v)
+			if v < 0 {
+				val = nullEncDatum()
+			}
+			group[i] = sqlbase.EncDatumRow{intEncDatum(1), val}
+		}
+		return group
+	}
+
+	testCases := []struct {
+		name     string
+		group    []sqlbase.EncDatumRow
+		expected string
+		count    int
+	}{
+		{name: "Empty", group: rows(), expected: "NULL", count: 0},
+		{name: "Single", group: rows(4), expected: "4", count: 1},
+		{name: "Ascending", group: rows(1, 2, 2, 3, 3, 3, 4), expected: "3", count: 3},
+		{name: "Descending", group: rows(9, 7, 7, 7, 5, 5), expected: "7", count: 3},
+		{name: "LastRun", group: rows(1, 2, 3, 3), expected: "3", count: 2},
+		{name: "Tie", group: rows(1, 2, 2, 3, 5, 5), expected: "2", count: 2},
+		{name: "AllDistinct", group: rows(3, 4, 5), expected: "3", count: 1},
+		{name: "NullsFirst", group: rows(-1, -1, -1, 1, 2, 2), expected: "2", count: 2},
+		{name: "NullsLast", group: rows(1, 1, 2, -1, -1, -1), expected: "1", count: 2},
+		{name: "AllNull", group: rows(-1, -1), expected: "NULL", count: 0},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			var alloc sqlbase.DatumAlloc
+			d, count, err := groupMode(&evalCtx, twoIntCols, c.group, 1, &alloc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := d.String(); res != c.expected || count != c.count {
+				t.Errorf("expected %s (%d times), got %s (%d times)", c.expected, c.count, res, count)
+			}
+		})
+	}
+
+	var alloc sqlbase.DatumAlloc
+	if _, _, err := groupMode(&evalCtx, twoIntCols, rows(1), 2, &alloc); !testutils.IsError(
+		err, "invalid column 2",
+	) {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+func TestGroupAvg(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	t.Run("Fixture", func(t *testing.T) {
+		// The average of b for each value of a: b goes from 1 to 9 for a = 0 and
+		// from 0 to 9 for the other groups.
+		acc := makeTestGroupAccumulator(
+			threeIntCols, makeJoinReaderFixtureRows(), orderingOnFirstCol, true, /* nullsAreEqual */
+		)
+		var res []string
+		var alloc sqlbase.DatumAlloc
+		if err := acc.forEachGroup(&evalCtx, 0 /* maxGroups */, func(group []sqlbase.EncDatumRow) error {
+			avg, err := groupAvg(threeIntCols, group, 1, 2 /* scale */, &alloc)
+			if err != nil {
+				return err
+			}
+			if _, ok := avg.(*tree.DDecimal); !ok {
+				return fmt.Errorf("expected a DECIMAL, got %s", avg.ResolvedType())
+			}
+			res = append(res, avg.String())
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expected := "[5.00 4.50 4.50 4.50 4.50 4.50 4.50 4.50 4.50 4.50]"
+		if fmt.Sprint(res) != expected {
+			t.Errorf("expected %s, got %s", expected, res)
+		}
+	})
+
+	// The rows are (group, value), where -1 stands for NULL.
+	rows := func(vals ...int) []sqlbase.EncDatumRow {
+		return genEncDatumRowsInt(func() [][]int {
+			var input [][]int
+			for _, v := range vals {
+				input = append(input, []int{1, v})
+			}
+			return input
+		}())
+	}
+	testCases := []struct {
+		name     string
+		group    []sqlbase.EncDatumRow
+		scale    int32
+		expected string
+	}{
+		{name: "Empty", group: rows(), scale: 2, expected: "NULL"},
+		{name: "AllNull", group: rows(-1, -1), scale: 2, expected: "NULL"},
+		{name: "Nulls", group: rows(1, -1, 2, -1), scale: 2, expected: "1.50"},
+		{name: "RoundUp", group: rows(1, 2, 2), scale: 4, expected: "1.6667"},
+		{name: "RoundDown", group: rows(1, 1, 2), scale: 4, expected: "1.3333"},
+		{name: "ZeroScale", group: rows(1, 2), scale: 0, expected: "2"},
+		{
+			name:     "Large",
+			group:    rows(math.MaxInt64, math.MaxInt64, 1),
+			scale:    1,
+			expected: "6148914691236517205.0",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			var alloc sqlbase.DatumAlloc
+			d, err := groupAvg(twoIntCols, c.group, 1, c.scale, &alloc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := d.String(); res != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, res)
+			}
+		})
+	}
+
+	t.Run("Decimal", func(t *testing.T) {
+		decType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_DECIMAL}
+		var group []sqlbase.EncDatumRow
+		for _, s := range []string{"0.1", "0.2", "0.25"} {
+			d, err := tree.ParseDDecimal(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			group = append(group, sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(decType, d)})
+		}
+		var alloc sqlbase.DatumAlloc
+		d, err := groupAvg([]sqlbase.ColumnType{decType}, group, 0, 3 /* scale */, &alloc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := d.String(); res != "0.183" {
+			t.Errorf("expected 0.183, got %s", res)
+		}
+	})
+
+	var alloc sqlbase.DatumAlloc
+	strGroup := []sqlbase.EncDatumRow{{sqlbase.DatumToEncDatum(strType, tree.NewDString("a"))}}
+	if _, err := groupAvg(
+		[]sqlbase.ColumnType{strType}, strGroup, 0, 2 /* scale */, &alloc,
+	); !testutils.IsError(err, "unsupported type string for AVG") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if _, err := groupAvg(twoIntCols, rows(1), 2, 2 /* scale */, &alloc); !testutils.IsError(
+		err, "invalid column 2",
+	) {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
@@ -15,6 +15,8 @@
 package distsqlrun
 
 import (
+	"context"
+
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
@@ -41,11 +43,11 @@ type streamMerger struct {
 func (sm *streamMerger) NextBatch(
 	evalCtx *tree.EvalContext,
 ) ([]sqlbase.EncDatumRow, []sqlbase.EncDatumRow, error) {
-	lrow, err := sm.left.peekAtCurrentGroup()
+	lrow, err := sm.left.peekAtCurrentGroup(evalCtx)
 	if err != nil {
 		return nil, nil, err
 	}
-	rrow, err := sm.right.peekAtCurrentGroup()
+	rrow, err := sm.right.peekAtCurrentGroup(evalCtx)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -76,6 +78,12 @@ func (sm *streamMerger) NextBatch(
 	return leftGroup, rightGroup, nil
 }
 
+// close releases the resources held by the streamMerger.
+func (sm *streamMerger) close(ctx context.Context) {
+	sm.left.close(ctx)
+	sm.right.close(ctx)
+}
+
 // CompareEncDatumRowForMerge EncDatumRow compares two EncDatumRows for merging.
 // When merging two streams and preserving the order (as in a MergeSort or
 // a MergeJoin) compare the head of the streams, emitting the one that sorts
@@ -161,11 +169,11 @@ func makeStreamMerger(
 
 	return streamMerger{
 		left: makeStreamGroupAccumulator(
-			MakeNoMetadataRowSource(leftSource, metadataSink),
-			leftOrdering),
+			MakeNoMetadataRowSource(leftSource, ForwardMetadata(metadataSink)),
+			leftOrdering, true /* nullsAreEqual */),
 		right: makeStreamGroupAccumulator(
-			MakeNoMetadataRowSource(rightSource, metadataSink),
-			rightOrdering),
+			MakeNoMetadataRowSource(rightSource, ForwardMetadata(metadataSink)),
+			rightOrdering, true /* nullsAreEqual */),
 		nullEquality: nullEquality,
 	}, nil
 }
@@ -103,6 +103,9 @@ func newTableReader(
 	if err := tr.init(post, types, flowCtx, output); err != nil {
 		return nil, err
 	}
+	// Scans with a filter-only post-processing can then pass the rows that
+	// pass the filter through, without copying them.
+	tr.out.enableOutputRowReuse()
 
 	neededColumns := tr.out.neededColumns()
 
@@ -206,6 +209,7 @@ func (tr *tableReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 	ctx = log.WithLogTagInt(ctx, "TableReader", int(tr.tableDesc.ID))
 	ctx, span := processorSpan(ctx, "table reader")
 	defer tracing.FinishSpan(span)
+	defer tr.recoverPanic(ctx)
 
 	txn := tr.flowCtx.txn
 	if txn == nil {
@@ -0,0 +1,84 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// teeRowReceiver is a RowReceiver that forwards everything pushed to it to two
+// downstream RowReceivers, allowing the output of a processor to be consumed
+// by two parents without running the processor twice.
+//
+// The status returned to the producer is the "most restrictive" of the two
+// consumers' statuses: the producer keeps going only as long as both consumers
+// need more rows. Consumers that requested draining still get the metadata
+// pushed afterwards, and consumers that are closed don't get anything anymore.
+//
+// The second consumer gets a copy of each row (see EncDatumRow.Copy): the
+// consumers may run concurrently (e.g. behind RowChannels) and decode the
+// EncDatums in place, so they can't share them.
+type teeRowReceiver struct {
+	dsts [2]RowReceiver
+
+	mu struct {
+		// The mutex serializes the pushes, so that both consumers see the
+		// records in the same order.
+		syncutil.Mutex
+		// statuses are the last statuses returned by each consumer.
+		statuses [2]ConsumerStatus
+	}
+}
+
+var _ RowReceiver = &teeRowReceiver{}
+
+func newTeeRowReceiver(dst1, dst2 RowReceiver) *teeRowReceiver {
+	return &teeRowReceiver{dsts: [2]RowReceiver{dst1, dst2}}
+}
+
+// Push is part of the RowReceiver interface.
+func (t *teeRowReceiver) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := NeedMoreRows
+	for i, dst := range t.dsts {
+		s := t.mu.statuses[i]
+		// Skip the consumers that don't want this record anymore.
+		if s == NeedMoreRows || (s == DrainRequested && row == nil) {
+			dstRow := row
+			if i > 0 {
+				dstRow = row.Copy()
+			}
+			// A consumer's status can only advance.
+			if newStatus := dst.Push(dstRow, meta); newStatus > s {
+				s = newStatus
+				t.mu.statuses[i] = s
+			}
+		}
+		if s > status {
+			status = s
+		}
+	}
+	return status
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (t *teeRowReceiver) ProducerDone() {
+	for _, dst := range t.dsts {
+		dst.ProducerDone()
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/pkg/errors"
+)
+
+// TestTeeRowReceiverJoinReader verifies that both consumers of a
+// teeRowReceiver get the output of a joinReader.
+func TestTeeRowReceiverJoinReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	createTestTable(t, sqlDB, "")
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	input := [][]int{{0, 2}, {0, 5}, {1, 0}, {1, 5}, {9, 9}}
+	in := NewRowBuffer(twoIntCols, genEncDatumRowsInt(input), RowBufferArgs{})
+	out1, out2 := &RowBuffer{}, &RowBuffer{}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 2}}
+	jr, err := newJoinReader(
+		&flowCtx, &JoinReaderSpec{Table: *td}, in, &post, newTeeRowReceiver(out1, out2), nil, /* kv */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr.Run(context.Background(), nil)
+
+	if !out1.ProducerClosed || !out2.ProducerClosed {
+		t.Fatalf("output RowReceivers not closed")
+	}
+	expected := "[[0 2 2] [0 5 5] [1 0 1] [1 5 6] [9 9 18]]"
+	rows1 := out1.GetRowsNoMeta(t)
+	rows2 := out2.GetRowsNoMeta(t)
+	if res := rows1.String(threeIntCols); res != expected {
+		t.Errorf("first consumer: expected %s, got %s", expected, res)
+	}
+	if res := rows2.String(threeIntCols); res != expected {
+		t.Errorf("second consumer: expected %s, got %s", expected, res)
+	}
+}
+
+// TestTeeRowReceiverStatus verifies that the producer is asked to drain as
+// soon as one of the consumers requests it, and that the metadata still
+// reaches the consumers that aren't closed.
+func TestTeeRowReceiverStatus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	row := genEncDatumRowsInt([][]int{{1}})[0]
+	out1, out2 := &RowBuffer{}, &RowBuffer{}
+	tee := newTeeRowReceiver(out1, out2)
+
+	if status := tee.Push(row, ProducerMetadata{}); status != NeedMoreRows {
+		t.Fatalf("expected NeedMoreRows, got %d", status)
+	}
+
+	out1.ConsumerDone()
+	if status := tee.Push(row, ProducerMetadata{}); status != DrainRequested {
+		t.Fatalf("expected DrainRequested, got %d", status)
+	}
+	if status := tee.Push(nil /* row */, ProducerMetadata{Err: errors.New("boom")}); status != DrainRequested {
+		t.Fatalf("expected DrainRequested, got %d", status)
+	}
+
+	out2.ConsumerClosed()
+	if status := tee.Push(nil /* row */, ProducerMetadata{Err: errors.New("boom")}); status != ConsumerClosed {
+		t.Fatalf("expected ConsumerClosed, got %d", status)
+	}
+	tee.ProducerDone()
+	if !out1.ProducerClosed || !out2.ProducerClosed {
+		t.Fatalf("output RowReceivers not closed")
+	}
+
+	// The first consumer got the first row and both errors, the second one got
+	// both rows and the first error.
+	for i, c := range []struct {
+		out          *RowBuffer
+		rows, errors int
+	}{
+		{out: out1, rows: 1, errors: 2},
+		{out: out2, rows: 2, errors: 1},
+	} {
+		var rows, errs int
+		for {
+			row, meta := c.out.Next()
+			if row == nil && meta.Empty() {
+				break
+			}
+			if row != nil {
+				rows++
+			} else if meta.Err != nil {
+				errs++
+			}
+		}
+		if rows != c.rows || errs != c.errors {
+			t.Errorf("consumer %d: expected %d rows and %d errors, got %d and %d",
+				i+1, c.rows, c.errors, rows, errs)
+		}
+	}
+}
+
+// TestTeeRowReceiverCopiesRows verifies that the second consumer of a
+// teeRowReceiver gets its own copy of the rows, unaffected by the first
+// consumer modifying them.
+func TestTeeRowReceiverCopiesRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	row := genEncDatumRowsInt([][]int{{1, 2}})[0]
+	out1 := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{
+		OnPush: func(row sqlbase.EncDatumRow, _ *ProducerMetadata) ConsumerStatus {
+			if row != nil {
+				row[0] = intEncDatum(9)
+			}
+			return NeedMoreRows
+		},
+	})
+	out2 := &RowBuffer{}
+	tee := newTeeRowReceiver(out1, out2)
+	if status := tee.Push(row, ProducerMetadata{}); status != NeedMoreRows {
+		t.Fatalf("expected NeedMoreRows, got %d", status)
+	}
+	tee.ProducerDone()
+
+	if res, exp := out2.GetRowsNoMeta(t).String(twoIntCols), "[[1 2]]"; res != exp {
+		t.Errorf("second consumer: expected %s, got %s", exp, res)
+	}
+}
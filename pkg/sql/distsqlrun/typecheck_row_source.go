@@ -0,0 +1,92 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/pkg/errors"
+)
+
+// typeCheckingRowSource is a RowSource that validates every row produced by its
+// input against a declared schema: the number of columns and the type of each
+// non-NULL datum must match. A row that fails validation is replaced by an
+// error (as metadata).
+//
+// The validation requires decoding all the datums, so it is only used when
+// requested through TestingKnobs.CheckRowTypes.
+type typeCheckingRowSource struct {
+	input RowSource
+	types []sqlbase.ColumnType
+	alloc sqlbase.DatumAlloc
+}
+
+var _ RowSource = &typeCheckingRowSource{}
+
+func newTypeCheckingRowSource(
+	input RowSource, types []sqlbase.ColumnType,
+) *typeCheckingRowSource {
+	return &typeCheckingRowSource{input: input, types: types}
+}
+
+// Types is part of the RowSource interface.
+func (s *typeCheckingRowSource) Types() []sqlbase.ColumnType {
+	return s.types
+}
+
+// Next is part of the RowSource interface.
+func (s *typeCheckingRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	row, meta := s.input.Next()
+	if row != nil {
+		if err := s.checkRow(row); err != nil {
+			return nil, ProducerMetadata{Err: err}
+		}
+	}
+	return row, meta
+}
+
+// checkRow returns an error if the row doesn't conform to the schema.
+func (s *typeCheckingRowSource) checkRow(row sqlbase.EncDatumRow) error {
+	if len(row) != len(s.types) {
+		return errors.Errorf(
+			"row %s has %d columns, expected %d", row.String(s.types), len(row), len(s.types),
+		)
+	}
+	for i := range row {
+		if err := row[i].EnsureDecoded(&s.types[i], &s.alloc); err != nil {
+			return errors.Wrapf(err, "error decoding column %d", i)
+		}
+		if row[i].Datum == tree.DNull {
+			continue
+		}
+		if typ := s.types[i].ToDatumType(); !row[i].Datum.ResolvedType().Equivalent(typ) {
+			return errors.Errorf(
+				"column %d: expected type %s, got %s (%s)",
+				i, typ, row[i].Datum.ResolvedType(), row[i].Datum,
+			)
+		}
+	}
+	return nil
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (s *typeCheckingRowSource) ConsumerDone() {
+	s.input.ConsumerDone()
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (s *typeCheckingRowSource) ConsumerClosed() {
+	s.input.ConsumerClosed()
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestTypeCheckingRowSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	strDatum := sqlbase.DatumToEncDatum(strType, tree.NewDString("foo"))
+	rows := sqlbase.EncDatumRows{
+		{intEncDatum(1), intEncDatum(2)},
+		{intEncDatum(3), nullEncDatum()},
+		// Wrong type.
+		{intEncDatum(4), strDatum},
+		// Wrong width.
+		{intEncDatum(5)},
+		{intEncDatum(6), intEncDatum(7)},
+	}
+	// The underlying RowBuffer doesn't validate its rows.
+	in := NewRowBuffer(twoIntCols, rows, RowBufferArgs{})
+	src := newTypeCheckingRowSource(in, twoIntCols)
+
+	expected := []struct {
+		row string
+		err string
+	}{
+		{row: "[1 2]"},
+		{row: "[3 NULL]"},
+		{err: "column 1: expected type int, got string"},
+		{err: "has 1 columns, expected 2"},
+		{row: "[6 7]"},
+	}
+	for i, e := range expected {
+		row, meta := src.Next()
+		if e.err != "" {
+			if row != nil || !testutils.IsError(meta.Err, e.err) {
+				t.Fatalf("%d: expected error %q, got row %v meta %+v", i, e.err, row, meta)
+			}
+			continue
+		}
+		if !meta.Empty() {
+			t.Fatalf("%d: unexpected metadata %+v", i, meta)
+		}
+		if str := row.String(twoIntCols); str != e.row {
+			t.Fatalf("%d: expected row %s, got %s", i, e.row, str)
+		}
+	}
+	if row, meta := src.Next(); row != nil || !meta.Empty() {
+		t.Fatalf("expected the end of the stream, got row %v meta %+v", row, meta)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// unionAll is the processor that concatenates its two inputs; see
+// UnionAllSpec. The rows of the left input are passed through (and
+// post-processed) first, then the rows of the right input.
+type unionAll struct {
+	processorBase
+
+	flowCtx                 *FlowCtx
+	leftSource, rightSource RowSource
+}
+
+var _ Processor = &unionAll{}
+
+func newUnionAll(
+	flowCtx *FlowCtx,
+	spec *UnionAllSpec,
+	leftSource, rightSource RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*unionAll, error) {
+	lt := leftSource.Types()
+	rt := rightSource.Types()
+	if len(lt) != len(rt) {
+		return nil, errors.Errorf(
+			"union all: left and right have different numbers of columns %d and %d",
+			len(lt), len(rt),
+		)
+	}
+	for i := range lt {
+		if !lt[i].Equal(rt[i]) {
+			return nil, errors.Errorf(
+				"union all: column %d has type %s on the left and %s on the right",
+				i, lt[i].SQLString(), rt[i].SQLString(),
+			)
+		}
+	}
+
+	u := &unionAll{
+		flowCtx:     flowCtx,
+		leftSource:  leftSource,
+		rightSource: rightSource,
+	}
+	if err := u.init(post, lt, flowCtx, output); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Run is part of the processor interface.
+func (u *unionAll) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "UnionAll", nil)
+	ctx, span := processorSpan(ctx, "union all")
+	defer tracing.FinishSpan(span)
+	defer u.recoverPanic(ctx, u.leftSource, u.rightSource)
+
+	log.VEventf(ctx, 2, "starting union all")
+	defer log.VEventf(ctx, 2, "exiting union all")
+
+	// Both inputs are passed to emitHelper, so that they are both drained (or
+	// closed) if the consumer doesn't need more rows, including while the left
+	// input is being read.
+	for _, src := range []RowSource{u.leftSource, u.rightSource} {
+		for {
+			row, meta := src.Next()
+			if row == nil && meta.Empty() {
+				break
+			}
+			if !emitHelper(ctx, &u.out, row, meta, u.leftSource, u.rightSource) {
+				return
+			}
+		}
+	}
+	sendTraceData(ctx, u.out.output)
+	u.out.Close()
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestUnionAll(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	leftRows := genEncDatumRowsInt([][]int{{1, 10}, {2, 20}, {3, 30}})
+	rightRows := genEncDatumRowsInt([][]int{{4, 40}, {5, 50}})
+
+	t.Run("Matching", func(t *testing.T) {
+		left := NewRowBuffer(twoIntCols, leftRows, RowBufferArgs{})
+		right := NewRowBuffer(twoIntCols, rightRows, RowBufferArgs{})
+		right.Push(nil /* row */, ProducerMetadata{Err: errors.New("test error")})
+		out := &RowBuffer{}
+		// Only the second column is output.
+		post := PostProcessSpec{Projection: true, OutputColumns: []uint32{1}}
+		u, err := newUnionAll(&flowCtx, &UnionAllSpec{}, left, right, &post, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Run(ctx, nil)
+
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		var rows sqlbase.EncDatumRows
+		var metas []ProducerMetadata
+		for {
+			row, meta := out.Next()
+			if !meta.Empty() {
+				metas = append(metas, meta)
+				continue
+			}
+			if row == nil {
+				break
+			}
+			rows = append(rows, row)
+		}
+		if res, exp := rows.String(oneIntCol), "[[10] [20] [30] [40] [50]]"; res != exp {
+			t.Errorf("expected:\n   %s\ngot:\n   %s", exp, res)
+		}
+		if len(metas) != 1 || !testutils.IsError(metas[0].Err, "test error") {
+			t.Errorf("expected the test error as the only metadata, got %v", metas)
+		}
+	})
+
+	t.Run("Mismatching", func(t *testing.T) {
+		testCases := []struct {
+			name      string
+			leftTypes []sqlbase.ColumnType
+			expErr    string
+		}{
+			{
+				name:      "NumColumns",
+				leftTypes: threeIntCols,
+				expErr:    "left and right have different numbers of columns 3 and 2",
+			},
+			{
+				name:      "Types",
+				leftTypes: []sqlbase.ColumnType{intType, strType},
+				expErr:    "column 1 has type STRING on the left and INT on the right",
+			},
+		}
+		for _, c := range testCases {
+			t.Run(c.name, func(t *testing.T) {
+				left := NewRowBuffer(c.leftTypes, nil /* rows */, RowBufferArgs{})
+				right := NewRowBuffer(twoIntCols, rightRows, RowBufferArgs{})
+				_, err := newUnionAll(
+					&flowCtx, &UnionAllSpec{}, left, right, &PostProcessSpec{}, &RowBuffer{},
+				)
+				if !testutils.IsError(err, c.expErr) {
+					t.Fatalf("expected error %q, got %v", c.expErr, err)
+				}
+			})
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		left := NewRowBuffer(twoIntCols, leftRows, RowBufferArgs{})
+		right := NewRowBuffer(twoIntCols, rightRows, RowBufferArgs{})
+		// The consumer only needs the first row.
+		pushed := 0
+		out := NewRowBuffer(twoIntCols, nil /* rows */, RowBufferArgs{
+			OnPush: func(sqlbase.EncDatumRow, *ProducerMetadata) ConsumerStatus {
+				pushed++
+				if pushed > 1 {
+					return DrainRequested
+				}
+				return NeedMoreRows
+			},
+		})
+		u, err := newUnionAll(&flowCtx, &UnionAllSpec{}, left, right, &PostProcessSpec{}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Run(ctx, nil)
+
+		if !out.ProducerClosed {
+			t.Fatalf("output RowReceiver not closed")
+		}
+		for _, src := range []*RowBuffer{left, right} {
+			if src.ConsumerStatus != DrainRequested {
+				t.Errorf("expected the inputs to be drained, got status %d", src.ConsumerStatus)
+			}
+		}
+		if rows := out.GetRowsNoMeta(t); len(rows) != 1 {
+			t.Errorf("expected a single row, got %s", rows.String(twoIntCols))
+		}
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		checkProcessorCleanup(t, &flowCtx, func(out RowReceiver) (Processor, error) {
+			left := NewRowBuffer(twoIntCols, leftRows, RowBufferArgs{})
+			right := NewRowBuffer(twoIntCols, rightRows, RowBufferArgs{})
+			return newUnionAll(&flowCtx, &UnionAllSpec{}, left, right, &PostProcessSpec{}, out)
+		})
+	})
+}
@@ -16,6 +16,8 @@ package distsqlrun
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
 	"net"
 	"testing"
 	"time"
@@ -27,6 +29,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/netutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
@@ -85,10 +88,201 @@ func (r *RepeatableRowSource) ConsumerDone() {}
 // ConsumerClosed is part of the RowSource interface.
 func (r *RepeatableRowSource) ConsumerClosed() {}
 
+// makeSliceRowSource returns a NoMetadataRowSource that returns the given rows,
+// in order, and then nil. A NoMetadataRowSource wraps a RowSource; here, the
+// rows are served by a RepeatableRowSource, which never produces metadata.
+func makeSliceRowSource(
+	types []sqlbase.ColumnType, rows sqlbase.EncDatumRows,
+) NoMetadataRowSource {
+	return MakeNoMetadataRowSource(
+		NewRepeatableRowSource(types, rows),
+		func(meta ProducerMetadata) { panic(fmt.Sprintf("unexpected metadata %+v", meta)) },
+	)
+}
+
+// checkProcessorCleanup runs processors created by newProc with a consumer
+// that needs all the rows, with one that is done from the start (i.e. that
+// requests draining) and with one that is closed. In each case, it verifies
+// that the processor closes its output and that it doesn't leave goroutines
+// running or memory accounted for in the monitor of flowCtx. newProc must
+// create a new processor, with a new input, on each call.
+func checkProcessorCleanup(
+	t testing.TB, flowCtx *FlowCtx, newProc func(output RowReceiver) (Processor, error),
+) {
+	for _, c := range []struct {
+		name   string
+		status ConsumerStatus
+	}{
+		{name: "NeedMoreRows", status: NeedMoreRows},
+		{name: "ConsumerDone", status: DrainRequested},
+		{name: "ConsumerClosed", status: ConsumerClosed},
+	} {
+		func() {
+			defer leaktest.AfterTest(t)()
+
+			out := &RowBuffer{}
+			switch c.status {
+			case DrainRequested:
+				out.ConsumerDone()
+			case ConsumerClosed:
+				out.ConsumerClosed()
+			}
+			p, err := newProc(out)
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+				return
+			}
+			p.Run(context.Background(), nil /* wg */)
+
+			if !out.ProducerClosed {
+				t.Errorf("%s: output RowReceiver not closed", c.name)
+			}
+			if n := flowCtx.EvalCtx.Mon.AllocBytes(); n != 0 {
+				t.Errorf("%s: %d bytes still allocated after the processor finished", c.name, n)
+			}
+		}()
+	}
+}
+
+// shuffleRowSource is a RowSource that reads all the rows of its input and
+// re-emits them in a pseudo-random order determined by a seed, followed by all
+// the metadata of the input. It is used to verify that processors don't depend
+// on the order of their input.
+type shuffleRowSource struct {
+	input RowSource
+	rng   *rand.Rand
+
+	// buffered is set once the input has been fully consumed.
+	buffered bool
+	rows     sqlbase.EncDatumRows
+	meta     []ProducerMetadata
+	alloc    sqlbase.EncDatumRowAlloc
+}
+
+var _ RowSource = &shuffleRowSource{}
+
+// newShuffleRowSource creates a shuffleRowSource that shuffles the rows of
+// input with the given seed.
+func newShuffleRowSource(input RowSource, seed int64) *shuffleRowSource {
+	return &shuffleRowSource{input: input, rng: rand.New(rand.NewSource(seed))}
+}
+
+// Types is part of the RowSource interface.
+func (s *shuffleRowSource) Types() []sqlbase.ColumnType {
+	return s.input.Types()
+}
+
+// Next is part of the RowSource interface.
+func (s *shuffleRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	if !s.buffered {
+		for {
+			row, meta := s.input.Next()
+			if row == nil && meta.Empty() {
+				break
+			}
+			if !meta.Empty() {
+				s.meta = append(s.meta, meta)
+				continue
+			}
+			s.rows = append(s.rows, s.alloc.CopyRow(row))
+		}
+		for i := len(s.rows) - 1; i > 0; i-- {
+			j := s.rng.Intn(i + 1)
+			s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+		}
+		s.buffered = true
+	}
+	if len(s.rows) > 0 {
+		row := s.rows[0]
+		s.rows = s.rows[1:]
+		return row, ProducerMetadata{}
+	}
+	if len(s.meta) > 0 {
+		meta := s.meta[0]
+		s.meta = s.meta[1:]
+		return nil, meta
+	}
+	return nil, ProducerMetadata{}
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (s *shuffleRowSource) ConsumerDone() {
+	s.input.ConsumerDone()
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (s *shuffleRowSource) ConsumerClosed() {
+	s.input.ConsumerClosed()
+}
+
+// LimitedRowSource is a RowSource that emits the same row a fixed number of
+// times, followed by a single trailing metadata item (e.g. an error or stats).
+// It is meant to be used as the input of processors in tests, in particular to
+// verify that they drain their input: once the consumer calls ConsumerDone, the
+// remaining rows are skipped but the trailing metadata is still emitted.
+type LimitedRowSource struct {
+	types []sqlbase.ColumnType
+	row   sqlbase.EncDatumRow
+	// numRows is the number of rows left to emit.
+	numRows  int
+	meta     ProducerMetadata
+	metaSent bool
+
+	// ConsumerStatus is DrainRequested or ConsumerClosed once the consumer has
+	// called ConsumerDone or ConsumerClosed, respectively.
+	ConsumerStatus ConsumerStatus
+	// NumRowsEmitted is the number of rows returned by Next.
+	NumRowsEmitted int
+}
+
+var _ RowSource = &LimitedRowSource{}
+
+// NewLimitedRowSource creates a LimitedRowSource that emits numRows times the
+// given row, followed by meta (unless it's empty).
+func NewLimitedRowSource(
+	types []sqlbase.ColumnType, row sqlbase.EncDatumRow, numRows int, meta ProducerMetadata,
+) *LimitedRowSource {
+	return &LimitedRowSource{types: types, row: row, numRows: numRows, meta: meta}
+}
+
+// Types is part of the RowSource interface.
+func (l *LimitedRowSource) Types() []sqlbase.ColumnType {
+	return l.types
+}
+
+// Next is part of the RowSource interface.
+func (l *LimitedRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	if l.ConsumerStatus == ConsumerClosed {
+		return nil, ProducerMetadata{}
+	}
+	if l.numRows > 0 && l.ConsumerStatus == NeedMoreRows {
+		l.numRows--
+		l.NumRowsEmitted++
+		return l.row, ProducerMetadata{}
+	}
+	if !l.metaSent {
+		l.metaSent = true
+		return nil, l.meta
+	}
+	return nil, ProducerMetadata{}
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (l *LimitedRowSource) ConsumerDone() {
+	if l.ConsumerStatus == NeedMoreRows {
+		l.ConsumerStatus = DrainRequested
+	}
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (l *LimitedRowSource) ConsumerClosed() {
+	l.ConsumerStatus = ConsumerClosed
+}
+
 // RowDisposer is a RowReceiver that discards any rows Push()ed.
 type RowDisposer struct{}
 
-var _ RowReceiver = &RowDisposer{}
+var _ RowCopyingReceiver = &RowDisposer{}
 
 // Push is part of the RowReceiver interface.
 func (r *RowDisposer) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
@@ -98,6 +292,9 @@ func (r *RowDisposer) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) Consu
 // ProducerDone is part of the RowReceiver interface.
 func (r *RowDisposer) ProducerDone() {}
 
+// CopiesRows is part of the RowCopyingReceiver interface.
+func (r *RowDisposer) CopiesRows() {}
+
 // NextNoMeta is a version of Next which fails the test if
 // it encounters any metadata.
 func (rb *RowBuffer) NextNoMeta(tb testing.TB) sqlbase.EncDatumRow {
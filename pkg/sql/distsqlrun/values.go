@@ -60,6 +60,7 @@ func (v *valuesProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	ctx, span := processorSpan(ctx, "values")
 	defer tracing.FinishSpan(span)
+	defer v.recoverPanic(ctx)
 
 	// We reuse the code in StreamDecoder for decoding the raw data. We just need
 	// to manufacture ProducerMessages.
@@ -0,0 +1,313 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/scrub"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// zigzagJoiner is a processor that finds the rows of a table that match
+// equality constraints on two of its secondary indexes; see ZigzagJoinerSpec.
+//
+// The entries of each index that match its constraints are ordered by primary
+// key. The zigzagJoiner alternates between the two indexes: it seeks in one
+// index to the first entry with a primary key at least as large as the last
+// primary key found in the other index. When both indexes have an entry for
+// the same primary key, the row is emitted.
+type zigzagJoiner struct {
+	processorBase
+
+	flowCtx *FlowCtx
+	desc    sqlbase.TableDescriptor
+	kv      kvScanner
+
+	sides [2]zigzagJoinerSide
+
+	// pkColIdxs are the indexes of the table columns that are implicitly part of
+	// the keys of both indexes, in the order in which they are encoded.
+	pkColIdxs []int
+	// row is used to assemble the output rows from the rows of both sides.
+	row sqlbase.EncDatumRow
+
+	// numSeeks is the number of seeks performed, for logging.
+	numSeeks int
+}
+
+var _ Processor = &zigzagJoiner{}
+
+// zigzagJoinerSide is one of the indexes of a zigzagJoiner.
+type zigzagJoinerSide struct {
+	index   *sqlbase.IndexDescriptor
+	fetcher sqlbase.MultiRowFetcher
+	alloc   sqlbase.DatumAlloc
+
+	// prefix is the common prefix of the keys of the index entries that match
+	// the fixed values.
+	prefix roachpb.Key
+	// cols are the table columns decoded from the index entries.
+	cols util.FastIntSet
+	// row is the last row found in the index.
+	row sqlbase.EncDatumRow
+}
+
+// newZigzagJoiner creates a zigzagJoiner that performs its seeks through kv. If
+// kv is nil, the seeks are performed through the flow's transaction.
+func newZigzagJoiner(
+	flowCtx *FlowCtx, spec *ZigzagJoinerSpec, post *PostProcessSpec, output RowReceiver, kv kvScanner,
+) (*zigzagJoiner, error) {
+	if len(spec.Sides) != 2 {
+		return nil, errors.Errorf("zigzag join requires two sides, got %d", len(spec.Sides))
+	}
+	z := &zigzagJoiner{
+		flowCtx: flowCtx,
+		desc:    spec.Table,
+		kv:      kv,
+	}
+	if z.kv == nil {
+		z.kv = txnKVScanner{txn: flowCtx.txn}
+	}
+
+	colIdxMap := make(map[sqlbase.ColumnID]int, len(z.desc.Columns))
+	for i, c := range z.desc.Columns {
+		colIdxMap[c.ID] = i
+	}
+	for i := range z.sides {
+		if err := z.sides[i].init(&z.desc, &spec.Sides[i], colIdxMap); err != nil {
+			return nil, err
+		}
+	}
+	// Within the entries that match the fixed values, the entries of each index
+	// are ordered by the (ascending) encoding of the primary key columns that
+	// aren't part of the index. They have to be the same for both indexes.
+	extraCols0, extraCols1 := z.sides[0].index.ExtraColumnIDs, z.sides[1].index.ExtraColumnIDs
+	if len(extraCols0) != len(extraCols1) {
+		return nil, errors.Errorf(
+			"zigzag join requires indexes %s and %s to have the same implicit columns",
+			z.sides[0].index.Name, z.sides[1].index.Name,
+		)
+	}
+	for i, id := range extraCols0 {
+		if extraCols1[i] != id {
+			return nil, errors.Errorf(
+				"zigzag join requires indexes %s and %s to have the same implicit columns",
+				z.sides[0].index.Name, z.sides[1].index.Name,
+			)
+		}
+		z.pkColIdxs = append(z.pkColIdxs, colIdxMap[id])
+	}
+
+	types := make([]sqlbase.ColumnType, len(z.desc.Columns))
+	for i := range types {
+		types[i] = z.desc.Columns[i].Type
+	}
+	if err := z.init(post, types, flowCtx, output); err != nil {
+		return nil, err
+	}
+
+	neededCols := z.out.neededColumns()
+	if !neededCols.SubsetOf(z.sides[0].cols.Union(z.sides[1].cols)) {
+		return nil, errors.Errorf(
+			"zigzag join with indexes %s and %s not implemented: the indexes don't contain all the needed columns",
+			z.sides[0].index.Name, z.sides[1].index.Name,
+		)
+	}
+	var pkCols util.FastIntSet
+	for _, idx := range z.pkColIdxs {
+		pkCols.Add(idx)
+	}
+	for i := range z.sides {
+		s := &z.sides[i]
+		// Each side decodes the primary key and the needed columns it has.
+		s.cols = s.cols.Intersection(neededCols).Union(pkCols)
+		if _, _, err := initRowFetcher(
+			&s.fetcher, &z.desc, int(spec.Sides[i].IndexIdx), false, /* reverse */
+			s.cols, false /* isCheck */, &s.alloc,
+		); err != nil {
+			return nil, err
+		}
+	}
+	z.row = make(sqlbase.EncDatumRow, len(z.desc.Columns))
+	return z, nil
+}
+
+// init validates the index of the side and computes the key prefix of the
+// entries that match the fixed values.
+func (s *zigzagJoinerSide) init(
+	desc *sqlbase.TableDescriptor, spec *ZigzagJoinerSpec_Side, colIdxMap map[sqlbase.ColumnID]int,
+) error {
+	var isSecondary bool
+	var err error
+	s.index, isSecondary, err = desc.FindIndexByIndexIdx(int(spec.IndexIdx))
+	if err != nil {
+		return err
+	}
+	if !isSecondary || s.index.Unique {
+		return errors.Errorf(
+			"zigzag join requires non-unique secondary indexes, but %s isn't one", s.index.Name,
+		)
+	}
+	if len(spec.FixedValues) != len(s.index.ColumnIDs) {
+		return errors.Errorf(
+			"%d fixed values specified for index %s, expecting %d",
+			len(spec.FixedValues), s.index.Name, len(s.index.ColumnIDs),
+		)
+	}
+	types := make([]sqlbase.ColumnType, len(spec.FixedValues))
+	values := make(sqlbase.EncDatumRow, len(spec.FixedValues))
+	for i, v := range spec.FixedValues {
+		types[i] = desc.Columns[colIdxMap[s.index.ColumnIDs[i]]].Type
+		if len(v) == 0 {
+			return errors.Errorf("empty fixed value for column %s", s.index.ColumnNames[i])
+		}
+		values[i] = sqlbase.EncDatumFromEncoded(&types[i], sqlbase.DatumEncoding_VALUE, v)
+	}
+	s.prefix, err = sqlbase.MakeKeyFromEncDatums(
+		types, values, desc, s.index, sqlbase.MakeIndexKeyPrefix(desc, s.index.ID), &s.alloc,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, ids := range [][]sqlbase.ColumnID{
+		s.index.ColumnIDs, s.index.ExtraColumnIDs, s.index.StoreColumnIDs,
+	} {
+		for _, id := range ids {
+			s.cols.Add(colIdxMap[id])
+		}
+	}
+	return nil
+}
+
+// seek returns the first row of the given side with a primary key whose
+// encoding is at least pk, along with the encoding of its primary key. A nil
+// row is returned if there is no such row. The row remains valid until the next
+// seek on the same side.
+func (z *zigzagJoiner) seek(
+	ctx context.Context, side int, pk []byte,
+) (sqlbase.EncDatumRow, []byte, error) {
+	s := &z.sides[side]
+	z.numSeeks++
+
+	start := make(roachpb.Key, 0, len(s.prefix)+len(pk))
+	start = append(append(start, s.prefix...), pk...)
+	span := roachpb.Span{Key: start, EndKey: s.prefix.PrefixEnd()}
+	if err := z.kv.startScan(
+		ctx, &s.fetcher, roachpb.Spans{span}, true /* limitBatches */, 1, /* limitHint */
+	); err != nil {
+		return nil, nil, err
+	}
+	row, _, _, err := s.fetcher.NextRow(ctx)
+	if err != nil {
+		return nil, nil, scrub.UnwrapScrubError(err)
+	}
+	if row == nil {
+		return nil, nil, nil
+	}
+
+	var rowPK []byte
+	for _, idx := range z.pkColIdxs {
+		rowPK, err = row[idx].Encode(
+			&z.desc.Columns[idx].Type, &s.alloc, sqlbase.DatumEncoding_ASCENDING_KEY, rowPK,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	s.row = row
+	return row, rowPK, nil
+}
+
+// mainLoop performs the zigzag join and emits the rows. If no error is
+// returned, the output has been closed. If an error is returned, the caller
+// should pass it to the consumer.
+func (z *zigzagJoiner) mainLoop(ctx context.Context) error {
+	log.VEventf(ctx, 1, "starting")
+	defer func() {
+		log.VEventf(ctx, 1, "exiting after %d seeks", z.numSeeks)
+	}()
+
+	// pk is the encoding of the primary key to seek to, and found is the
+	// number of sides (0 or 1) known to have an entry for it.
+	var pk []byte
+	found := 0
+	for side := 0; ; side = 1 - side {
+		row, rowPK, err := z.seek(ctx, side, pk)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			// No more entries in one of the indexes.
+			break
+		}
+		if found == 1 && bytes.Equal(rowPK, pk) {
+			// Both indexes have an entry for this primary key.
+			if !emitHelper(ctx, &z.out, z.outputRow(), ProducerMetadata{}) {
+				return nil
+			}
+			pk = roachpb.Key(pk).PrefixEnd()
+			found = 0
+			continue
+		}
+		// The other side has to catch up.
+		pk = rowPK
+		found = 1
+	}
+
+	sendTraceData(ctx, z.out.output)
+	z.out.Close()
+	return nil
+}
+
+// outputRow assembles a row from the last rows found on both sides.
+func (z *zigzagJoiner) outputRow() sqlbase.EncDatumRow {
+	for i := range z.row {
+		switch {
+		case z.sides[0].cols.Contains(i):
+			z.row[i] = z.sides[0].row[i]
+		case z.sides[1].cols.Contains(i):
+			z.row[i] = z.sides[1].row[i]
+		default:
+			z.row[i] = sqlbase.EncDatum{}
+		}
+	}
+	return z.row
+}
+
+// Run is part of the processor interface.
+func (z *zigzagJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTagInt(ctx, "ZigzagJoiner", int(z.desc.ID))
+	ctx, span := processorSpan(ctx, "zigzag joiner")
+	defer tracing.FinishSpan(span)
+	defer z.recoverPanic(ctx)
+
+	if err := z.mainLoop(ctx); err != nil {
+		DrainAndClose(ctx, z.out.output, err /* cause */)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// zigzagSide returns the spec of a side of a zigzag join on an index with a
+// single INT column, constrained to the given value.
+func zigzagSide(t *testing.T, indexIdx uint32, val int) ZigzagJoinerSpec_Side {
+	var alloc sqlbase.DatumAlloc
+	ed := intEncDatum(val)
+	enc, err := ed.Encode(&intType, &alloc, sqlbase.DatumEncoding_VALUE, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ZigzagJoinerSpec_Side{IndexIdx: indexIdx, FixedValues: [][]byte{enc}}
+}
+
+func TestZigzagJoiner(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	// Each row is:
+	//
+	//  |   a   |    b    |    c    |   d   |
+	//  |-------------------------------------|
+	//  | rowId | rowId%3 | rowId%5 | rowId |
+	bFn := func(row int) tree.Datum {
+		return tree.NewDInt(tree.DInt(row % 3))
+	}
+	cFn := func(row int) tree.Datum {
+		return tree.NewDInt(tree.DInt(row % 5))
+	}
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT PRIMARY KEY, b INT, c INT, d INT, INDEX b_idx (b), INDEX c_idx (c), UNIQUE INDEX d_idx (d)",
+		99,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, bFn, cFn, sqlutils.RowIdxFn))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := tree.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      newTestTxn(s),
+	}
+
+	const bIdx, cIdx, dIdx = 1, 2, 3
+	outputTypes := threeIntCols
+
+	testCases := []struct {
+		b, c     int
+		expected string
+	}{
+		// The rows with a = 7 (mod 15).
+		{b: 1, c: 2, expected: "[[7 1 2] [22 1 2] [37 1 2] [52 1 2] [67 1 2] [82 1 2] [97 1 2]]"},
+		// The rows with a = 0 (mod 15).
+		{b: 0, c: 0, expected: "[[15 0 0] [30 0 0] [45 0 0] [60 0 0] [75 0 0] [90 0 0]]"},
+		// No row has c = 7.
+		{b: 1, c: 7, expected: "[]"},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("b=%d/c=%d", c.b, c.c), func(t *testing.T) {
+			// The result doesn't depend on the index we start with.
+			for _, sides := range [][]ZigzagJoinerSpec_Side{
+				{zigzagSide(t, bIdx, c.b), zigzagSide(t, cIdx, c.c)},
+				{zigzagSide(t, cIdx, c.c), zigzagSide(t, bIdx, c.b)},
+			} {
+				spec := ZigzagJoinerSpec{Table: *td, Sides: sides}
+				post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1, 2}}
+				out := &RowBuffer{}
+				z, err := newZigzagJoiner(&flowCtx, &spec, &post, out, nil /* kv */)
+				if err != nil {
+					t.Fatal(err)
+				}
+				z.Run(context.Background(), nil)
+
+				if !out.ProducerClosed {
+					t.Fatalf("output RowReceiver not closed")
+				}
+				if res := out.GetRowsNoMeta(t).String(outputTypes); res != c.expected {
+					t.Errorf("expected %s, got %s", c.expected, res)
+				}
+			}
+		})
+	}
+
+	errCases := []struct {
+		name     string
+		sides    []ZigzagJoinerSpec_Side
+		outCols  []uint32
+		expected string
+	}{
+		{
+			name:     "OneSide",
+			sides:    []ZigzagJoinerSpec_Side{zigzagSide(t, bIdx, 1)},
+			outCols:  []uint32{0},
+			expected: "zigzag join requires two sides",
+		},
+		{
+			name:     "UniqueIndex",
+			sides:    []ZigzagJoinerSpec_Side{zigzagSide(t, bIdx, 1), zigzagSide(t, dIdx, 1)},
+			outCols:  []uint32{0},
+			expected: "zigzag join requires non-unique secondary indexes",
+		},
+		{
+			name:     "NoFixedValues",
+			sides:    []ZigzagJoinerSpec_Side{zigzagSide(t, bIdx, 1), {IndexIdx: cIdx}},
+			outCols:  []uint32{0},
+			expected: "0 fixed values specified for index c_idx, expecting 1",
+		},
+		{
+			name:     "ColumnNotInIndexes",
+			sides:    []ZigzagJoinerSpec_Side{zigzagSide(t, bIdx, 1), zigzagSide(t, cIdx, 2)},
+			outCols:  []uint32{0, 3},
+			expected: "the indexes don't contain all the needed columns",
+		},
+	}
+	for _, c := range errCases {
+		t.Run(c.name, func(t *testing.T) {
+			spec := ZigzagJoinerSpec{Table: *td, Sides: c.sides}
+			post := PostProcessSpec{Projection: true, OutputColumns: c.outCols}
+			if _, err := newZigzagJoiner(
+				&flowCtx, &spec, &post, &RowBuffer{}, nil, /* kv */
+			); !testutils.IsError(err, c.expected) {
+				t.Fatalf("expected error %q, got %v", c.expected, err)
+			}
+		})
+	}
+}
@@ -2510,7 +2510,7 @@ var toJSONImpl = tree.Builtin{
 	Types:      tree.ArgTypes{{"val", types.Any}},
 	ReturnType: tree.FixedReturnType(types.JSON),
 	Fn: func(_ *tree.EvalContext, args tree.Datums) (tree.Datum, error) {
-		j, err := asJSON(args[0])
+		j, err := AsJSON(args[0])
 		if err != nil {
 			return nil, err
 		}
@@ -2526,7 +2526,7 @@ var jsonBuildArrayImpl = tree.Builtin{
 	Fn: func(_ *tree.EvalContext, args tree.Datums) (tree.Datum, error) {
 		jsons := make([]json.JSON, len(args))
 		for i, arg := range args {
-			j, err := asJSON(arg)
+			j, err := AsJSON(arg)
 			if err != nil {
 				return nil, err
 			}
@@ -3290,7 +3290,8 @@ func truncateTimestamp(
 	return tree.MakeDTimestampTZ(toTime, time.Microsecond), nil
 }
 
-func asJSON(d tree.Datum) (json.JSON, error) {
+// AsJSON converts a datum into a JSON value (as with the to_json builtin).
+func AsJSON(d tree.Datum) (json.JSON, error) {
 	switch t := d.(type) {
 	case *tree.DBool:
 		return json.FromBool(bool(*t)), nil
@@ -3310,7 +3311,7 @@ func asJSON(d tree.Datum) (json.JSON, error) {
 		jsons := make([]json.JSON, t.Len())
 		for i, e := range t.Array {
 			var err error
-			jsons[i], err = asJSON(e)
+			jsons[i], err = AsJSON(e)
 			if err != nil {
 				return nil, err
 			}
@@ -3319,7 +3320,7 @@ func asJSON(d tree.Datum) (json.JSON, error) {
 	case *tree.DTuple:
 		builder := json.NewBuilder()
 		for i, e := range t.D {
-			j, err := asJSON(e)
+			j, err := AsJSON(e)
 			if err != nil {
 				return nil, err
 			}
@@ -17,6 +17,8 @@ package sqlbase
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"unsafe"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
@@ -299,9 +301,55 @@ func (ed *EncDatum) GetInt() (int64, error) {
 	}
 }
 
+// Size returns an estimate of the memory used by the EncDatum, including the
+// memory referenced by its encoded and decoded values.
+func (ed *EncDatum) Size() uintptr {
+	size := unsafe.Sizeof(*ed) + uintptr(len(ed.encoded))
+	if ed.Datum != nil {
+		size += ed.Datum.Size()
+	}
+	return size
+}
+
 // EncDatumRow is a row of EncDatums.
+//
+// Rows are routinely reused: the rows returned by a RowSource or pushed to a
+// RowReceiver are only valid until the next call, and their encoded values
+// often point into buffers (e.g. KV batches) that get reused as well. Code that
+// retains a row past that point (buffering or materializing receivers, tees,
+// accumulators) must copy it: EncDatumRowAlloc.CopyRow is enough to survive
+// the reuse of the row slice, Copy also to survive the reuse of the encoded
+// buffers.
 type EncDatumRow []EncDatum
 
+// MemorySize returns an estimate of the memory used by the row, including the
+// memory referenced by the encoded and decoded values of its datums. It is
+// meant to be used to account for the rows buffered by processors.
+func (r EncDatumRow) MemorySize() int64 {
+	var size uintptr
+	for i := range r {
+		size += r[i].Size()
+	}
+	return int64(size)
+}
+
+// Copy returns a deep copy of the row: the encoded values are copied, so the
+// copy remains valid after the row or the buffers it references are reused.
+// The decoded datums are shared, since datums are immutable.
+func (r EncDatumRow) Copy() EncDatumRow {
+	if r == nil {
+		return nil
+	}
+	rowCopy := make(EncDatumRow, len(r))
+	for i := range r {
+		rowCopy[i] = r[i]
+		if r[i].encoded != nil {
+			rowCopy[i].encoded = append([]byte(nil), r[i].encoded...)
+		}
+	}
+	return rowCopy
+}
+
 func (r EncDatumRow) stringToBuf(types []ColumnType, a *DatumAlloc, b *bytes.Buffer) {
 	if len(types) != len(r) {
 		panic(fmt.Sprintf("mismatched types (%v) and row (%v)", types, r))
@@ -369,6 +417,14 @@ func (r EncDatumRow) Compare(
 		panic(fmt.Sprintf("length mismatch: %d types, %d lhs, %d rhs\n%+v\n%+v\n%+v", len(types), len(r), len(rhs), types, r, rhs))
 	}
 	for _, c := range ordering {
+		if c.NullsOrder != DefaultNullsOrder {
+			if cmp, ok := c.compareNulls(r[c.ColIdx].IsNull(), rhs[c.ColIdx].IsNull()); ok {
+				if cmp != 0 {
+					return cmp, nil
+				}
+				continue
+			}
+		}
 		cmp, err := r[c.ColIdx].Compare(&types[c.ColIdx], a, evalCtx, &rhs[c.ColIdx])
 		if err != nil {
 			return 0, err
@@ -395,6 +451,14 @@ func (r EncDatumRow) CompareToDatums(
 		if err := r[c.ColIdx].EnsureDecoded(&types[c.ColIdx], a); err != nil {
 			return 0, err
 		}
+		if cmp, ok := c.compareNulls(
+			r[c.ColIdx].Datum == tree.DNull, rhs[c.ColIdx] == tree.DNull,
+		); ok {
+			if cmp != 0 {
+				return cmp, nil
+			}
+			continue
+		}
 		cmp := r[c.ColIdx].Datum.Compare(evalCtx, rhs[c.ColIdx])
 		if cmp != 0 {
 			if c.Direction == encoding.Descending {
@@ -406,6 +470,28 @@ func (r EncDatumRow) CompareToDatums(
 	return 0, nil
 }
 
+// HashKey returns an encoding of the values of the given columns of the row
+// that can be used as the key of a hash table, e.g. to group rows: two rows have
+// the same key if and only if they compare equal on these columns (see
+// Compare). In particular, NULLs are encoded like any other value, and rows
+// with NULLs in the same columns can have the same key. types are the types of
+// all the columns of the row.
+//
+// The key encoding is used: unlike the value encoding, it doesn't depend on the
+// column ID, and it is the same for composite datums that compare equal (e.g.
+// the decimals 1.0 and 1.00).
+func (r EncDatumRow) HashKey(cols []uint32, types []ColumnType, a *DatumAlloc) ([]byte, error) {
+	var key []byte
+	for _, c := range cols {
+		var err error
+		key, err = r[c].Encode(&types[c], a, DatumEncoding_ASCENDING_KEY, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
 // EncDatumRows is a slice of EncDatumRows having the same schema.
 type EncDatumRows []EncDatumRow
 
@@ -423,6 +509,71 @@ func (r EncDatumRows) String(types []ColumnType) string {
 	return b.String()
 }
 
+// Equal returns whether the rows are equal to the rows in other, with datums
+// compared using EncDatum.Compare. If orderless is set, the rows are compared as
+// multisets (i.e. the order of the rows doesn't matter but the number of
+// duplicates does); otherwise they are compared as sequences.
+func (r EncDatumRows) Equal(
+	other EncDatumRows,
+	types []ColumnType,
+	orderless bool,
+	a *DatumAlloc,
+	evalCtx *tree.EvalContext,
+) (bool, error) {
+	if len(r) != len(other) {
+		return false, nil
+	}
+	for _, rows := range []EncDatumRows{r, other} {
+		for _, row := range rows {
+			if len(row) != len(types) {
+				return false, errors.Errorf("row has %d columns, expected %d", len(row), len(types))
+			}
+		}
+	}
+	ordering := make(ColumnOrdering, len(types))
+	for i := range ordering {
+		ordering[i] = ColumnOrderInfo{ColIdx: i, Direction: encoding.Ascending}
+	}
+	lhs, rhs := r, other
+	if orderless {
+		var err error
+		if lhs, err = lhs.sorted(types, a, ordering, evalCtx); err != nil {
+			return false, err
+		}
+		if rhs, err = rhs.sorted(types, a, ordering, evalCtx); err != nil {
+			return false, err
+		}
+	}
+	for i := range lhs {
+		cmp, err := lhs[i].Compare(types, a, ordering, evalCtx, rhs[i])
+		if err != nil {
+			return false, err
+		}
+		if cmp != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sorted returns a copy of the rows sorted according to the given ordering.
+func (r EncDatumRows) sorted(
+	types []ColumnType, a *DatumAlloc, ordering ColumnOrdering, evalCtx *tree.EvalContext,
+) (EncDatumRows, error) {
+	res := make(EncDatumRows, len(r))
+	copy(res, r)
+	var err error
+	sort.SliceStable(res, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		var cmp int
+		cmp, err = res[i].Compare(types, a, ordering, evalCtx, res[j])
+		return cmp < 0
+	})
+	return res, err
+}
+
 // EncDatumRowAlloc is a helper that speeds up allocation of EncDatumRows
 // (preferably of the same length).
 type EncDatumRowAlloc struct {
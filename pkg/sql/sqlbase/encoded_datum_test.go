@@ -15,8 +15,11 @@
 package sqlbase
 
 import (
+	"bytes"
 	"context"
+	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
@@ -329,6 +332,8 @@ func TestEncDatumRowCompare(t *testing.T) {
 		v[i] = DatumToEncDatum(typeInt, tree.NewDInt(tree.DInt(i)))
 	}
 
+	null := DatumToEncDatum(typeInt, tree.DNull)
+
 	asc := encoding.Ascending
 	desc := encoding.Descending
 
@@ -346,75 +351,107 @@ func TestEncDatumRowCompare(t *testing.T) {
 		{
 			row1: EncDatumRow{v[0], v[1], v[2]},
 			row2: EncDatumRow{v[0], v[1], v[3]},
-			ord:  ColumnOrdering{{1, desc}},
+			ord:  ColumnOrdering{{ColIdx: 1, Direction: desc}},
 			cmp:  0,
 		},
 		{
 			row1: EncDatumRow{v[0], v[1], v[2]},
 			row2: EncDatumRow{v[0], v[1], v[3]},
-			ord:  ColumnOrdering{{0, asc}, {1, desc}},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: asc}, {ColIdx: 1, Direction: desc}},
 			cmp:  0,
 		},
 		{
 			row1: EncDatumRow{v[0], v[1], v[2]},
 			row2: EncDatumRow{v[0], v[1], v[3]},
-			ord:  ColumnOrdering{{2, asc}},
+			ord:  ColumnOrdering{{ColIdx: 2, Direction: asc}},
 			cmp:  -1,
 		},
 		{
 			row1: EncDatumRow{v[0], v[1], v[3]},
 			row2: EncDatumRow{v[0], v[1], v[2]},
-			ord:  ColumnOrdering{{2, asc}},
+			ord:  ColumnOrdering{{ColIdx: 2, Direction: asc}},
 			cmp:  1,
 		},
 		{
 			row1: EncDatumRow{v[0], v[1], v[2]},
 			row2: EncDatumRow{v[0], v[1], v[3]},
-			ord:  ColumnOrdering{{2, asc}, {0, asc}, {1, asc}},
+			ord:  ColumnOrdering{{ColIdx: 2, Direction: asc}, {ColIdx: 0, Direction: asc}, {ColIdx: 1, Direction: asc}},
 			cmp:  -1,
 		},
 		{
 			row1: EncDatumRow{v[0], v[1], v[2]},
 			row2: EncDatumRow{v[0], v[1], v[3]},
-			ord:  ColumnOrdering{{0, asc}, {2, desc}},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: asc}, {ColIdx: 2, Direction: desc}},
 			cmp:  1,
 		},
 		{
 			row1: EncDatumRow{v[0], v[1], v[2]},
 			row2: EncDatumRow{v[0], v[1], v[3]},
-			ord:  ColumnOrdering{{1, desc}, {0, asc}, {2, desc}},
+			ord:  ColumnOrdering{{ColIdx: 1, Direction: desc}, {ColIdx: 0, Direction: asc}, {ColIdx: 2, Direction: desc}},
 			cmp:  1,
 		},
 		{
 			row1: EncDatumRow{v[2], v[3], v[4]},
 			row2: EncDatumRow{v[1], v[3], v[0]},
-			ord:  ColumnOrdering{{0, asc}},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: asc}},
 			cmp:  1,
 		},
 		{
 			row1: EncDatumRow{v[2], v[3], v[4]},
 			row2: EncDatumRow{v[1], v[3], v[0]},
-			ord:  ColumnOrdering{{1, desc}, {0, asc}},
+			ord:  ColumnOrdering{{ColIdx: 1, Direction: desc}, {ColIdx: 0, Direction: asc}},
 			cmp:  1,
 		},
 		{
 			row1: EncDatumRow{v[2], v[3], v[4]},
 			row2: EncDatumRow{v[1], v[3], v[0]},
-			ord:  ColumnOrdering{{1, asc}, {0, asc}},
+			ord:  ColumnOrdering{{ColIdx: 1, Direction: asc}, {ColIdx: 0, Direction: asc}},
 			cmp:  1,
 		},
 		{
 			row1: EncDatumRow{v[2], v[3], v[4]},
 			row2: EncDatumRow{v[1], v[3], v[0]},
-			ord:  ColumnOrdering{{1, asc}, {0, desc}},
+			ord:  ColumnOrdering{{ColIdx: 1, Direction: asc}, {ColIdx: 0, Direction: desc}},
 			cmp:  -1,
 		},
 		{
 			row1: EncDatumRow{v[2], v[3], v[4]},
 			row2: EncDatumRow{v[1], v[3], v[0]},
-			ord:  ColumnOrdering{{0, desc}, {1, asc}},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: desc}, {ColIdx: 1, Direction: asc}},
+			cmp:  -1,
+		},
+		{
+			row1: EncDatumRow{null, v[1], v[2]},
+			row2: EncDatumRow{v[0], v[1], v[2]},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: asc}},
 			cmp:  -1,
 		},
+		{
+			row1: EncDatumRow{null, v[1], v[2]},
+			row2: EncDatumRow{v[0], v[1], v[2]},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: desc}},
+			cmp:  1,
+		},
+		{
+			row1: EncDatumRow{null, v[1], v[2]},
+			row2: EncDatumRow{v[0], v[1], v[2]},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: asc, NullsOrder: NullsLast}},
+			cmp:  1,
+		},
+		{
+			row1: EncDatumRow{null, v[1], v[2]},
+			row2: EncDatumRow{v[0], v[1], v[2]},
+			ord:  ColumnOrdering{{ColIdx: 0, Direction: desc, NullsOrder: NullsFirst}},
+			cmp:  -1,
+		},
+		{
+			row1: EncDatumRow{null, v[1], v[2]},
+			row2: EncDatumRow{null, v[2], v[2]},
+			ord: ColumnOrdering{
+				{ColIdx: 0, Direction: asc, NullsOrder: NullsLast}, {ColIdx: 1, Direction: desc},
+			},
+			cmp: 1,
+		},
 	}
 
 	a := &DatumAlloc{}
@@ -437,6 +474,89 @@ func TestEncDatumRowCompare(t *testing.T) {
 	}
 }
 
+func TestEncDatumRowsEqual(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	typeInt := ColumnType{SemanticType: ColumnType_INT}
+	types := []ColumnType{typeInt, typeInt}
+	v := [4]EncDatum{}
+	for i := range v {
+		v[i] = DatumToEncDatum(typeInt, tree.NewDInt(tree.DInt(i)))
+	}
+	null := DatumToEncDatum(typeInt, tree.DNull)
+
+	testCases := []struct {
+		lhs, rhs EncDatumRows
+		// Expected results of ordered and orderless comparisons.
+		equal, orderlessEqual bool
+	}{
+		{
+			lhs:            nil,
+			rhs:            EncDatumRows{},
+			equal:          true,
+			orderlessEqual: true,
+		},
+		{
+			lhs:            EncDatumRows{{v[0], v[1]}, {v[2], null}},
+			rhs:            EncDatumRows{{v[0], v[1]}, {v[2], null}},
+			equal:          true,
+			orderlessEqual: true,
+		},
+		{
+			lhs:            EncDatumRows{{v[0], v[1]}, {v[2], v[3]}},
+			rhs:            EncDatumRows{{v[2], v[3]}, {v[0], v[1]}},
+			equal:          false,
+			orderlessEqual: true,
+		},
+		{
+			// Duplicates are taken into account.
+			lhs:            EncDatumRows{{v[0], v[1]}, {v[0], v[1]}, {v[2], v[3]}},
+			rhs:            EncDatumRows{{v[0], v[1]}, {v[2], v[3]}, {v[2], v[3]}},
+			equal:          false,
+			orderlessEqual: false,
+		},
+		{
+			lhs:            EncDatumRows{{v[1], v[1]}, {v[0], v[1]}, {v[1], v[1]}},
+			rhs:            EncDatumRows{{v[1], v[1]}, {v[1], v[1]}, {v[0], v[1]}},
+			equal:          false,
+			orderlessEqual: true,
+		},
+		{
+			lhs:            EncDatumRows{{v[0], v[1]}},
+			rhs:            EncDatumRows{{v[0], v[1]}, {v[0], v[1]}},
+			equal:          false,
+			orderlessEqual: false,
+		},
+		{
+			lhs:            EncDatumRows{{v[0], null}, {v[1], v[2]}},
+			rhs:            EncDatumRows{{v[1], v[2]}, {v[0], v[0]}},
+			equal:          false,
+			orderlessEqual: false,
+		},
+	}
+
+	for i, c := range testCases {
+		for _, orderless := range []bool{false, true} {
+			expected := c.equal
+			if orderless {
+				expected = c.orderlessEqual
+			}
+			var a DatumAlloc
+			equal, err := c.lhs.Equal(c.rhs, types, orderless, &a, evalCtx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if equal != expected {
+				t.Errorf("%d: %s and %s (orderless=%t): expected %t, got %t",
+					i, c.lhs.String(types), c.rhs.String(types), orderless, expected, equal)
+			}
+		}
+	}
+}
+
 func TestEncDatumRowAlloc(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -479,3 +599,248 @@ func TestEncDatumRowAlloc(t *testing.T) {
 		}
 	}
 }
+
+// TestEncDatumRowCopy verifies that a copied row is independent of the
+// original row and of the buffer its encoded values point into.
+func TestEncDatumRowCopy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	intType := ColumnType{SemanticType: ColumnType_INT}
+	strType := ColumnType{SemanticType: ColumnType_STRING}
+	types := []ColumnType{intType, strType, intType}
+
+	// The first two values are encoded in a shared buffer, like the values of
+	// a row read from KV; the last one is only decoded.
+	var buf []byte
+	buf = encoding.EncodeVarintAscending(buf, 5)
+	intLen := len(buf)
+	buf = encoding.EncodeStringAscending(buf, "hello")
+	row := EncDatumRow{
+		EncDatumFromEncoded(&intType, DatumEncoding_ASCENDING_KEY, buf[:intLen]),
+		EncDatumFromEncoded(&strType, DatumEncoding_ASCENDING_KEY, buf[intLen:]),
+		DatumToEncDatum(intType, tree.NewDInt(7)),
+	}
+	rowCopy := row.Copy()
+
+	// Reuse both the buffer and the row.
+	copy(buf, encoding.EncodeVarintAscending(nil, 6))
+	copy(buf[intLen:], encoding.EncodeStringAscending(nil, "world"))
+	row[2] = DatumToEncDatum(intType, tree.NewDInt(8))
+
+	if res, exp := rowCopy.String(types), "[5 'hello' 7]"; res != exp {
+		t.Errorf("expected the copy to be %s, got %s", exp, res)
+	}
+	if res, exp := row.String(types), "[6 'world' 8]"; res != exp {
+		t.Errorf("expected the original row to be %s, got %s", exp, res)
+	}
+
+	if EncDatumRow(nil).Copy() != nil {
+		t.Errorf("expected the copy of a nil row to be nil")
+	}
+}
+
+func TestEncDatumRowMemorySize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	encDatumSize := int64(unsafe.Sizeof(EncDatum{}))
+	intType := ColumnType{SemanticType: ColumnType_INT}
+	strType := ColumnType{SemanticType: ColumnType_STRING}
+	decType := ColumnType{SemanticType: ColumnType_DECIMAL}
+
+	smallDec, err := tree.ParseDDecimal("1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeDec, err := tree.ParseDDecimal(strings.Repeat("1234567890", 10) + ".5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		row      EncDatumRow
+		expected int64
+	}{
+		{
+			name:     "Int",
+			row:      EncDatumRow{DatumToEncDatum(intType, tree.NewDInt(5))},
+			expected: encDatumSize + int64(unsafe.Sizeof(tree.DInt(0))),
+		},
+		{
+			name:     "String",
+			row:      EncDatumRow{DatumToEncDatum(strType, tree.NewDString("hello world"))},
+			expected: encDatumSize + int64(unsafe.Sizeof(tree.DString(""))) + int64(len("hello world")),
+		},
+		{
+			name:     "SmallDecimal",
+			row:      EncDatumRow{DatumToEncDatum(decType, smallDec)},
+			expected: encDatumSize + int64(smallDec.Size()),
+		},
+		{
+			name:     "LargeDecimal",
+			row:      EncDatumRow{DatumToEncDatum(decType, largeDec)},
+			expected: encDatumSize + int64(largeDec.Size()),
+		},
+		{
+			name: "Mixed",
+			row: EncDatumRow{
+				DatumToEncDatum(intType, tree.NewDInt(5)),
+				DatumToEncDatum(strType, tree.NewDString("hello world")),
+				{},
+			},
+			expected: 3*encDatumSize + int64(unsafe.Sizeof(tree.DInt(0))) +
+				int64(unsafe.Sizeof(tree.DString(""))) + int64(len("hello world")),
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			if size := c.row.MemorySize(); size != c.expected {
+				t.Errorf("expected size %d, got %d", c.expected, size)
+			}
+		})
+	}
+
+	// The coefficient of a large decimal is accounted for.
+	small := EncDatumRow{DatumToEncDatum(decType, smallDec)}
+	large := EncDatumRow{DatumToEncDatum(decType, largeDec)}
+	if small.MemorySize() >= large.MemorySize() {
+		t.Errorf("expected %s to be larger than %s", largeDec, smallDec)
+	}
+
+	// The size of an encoded datum includes its encoding, both before and after
+	// it is decoded.
+	var alloc DatumAlloc
+	str := DatumToEncDatum(strType, tree.NewDString("hello world"))
+	enc, err := str.Encode(&strType, &alloc, DatumEncoding_VALUE, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := EncDatumRow{EncDatumFromEncoded(&strType, DatumEncoding_VALUE, enc)}
+	if size, expected := row.MemorySize(), encDatumSize+int64(len(enc)); size != expected {
+		t.Errorf("expected size %d for an encoded datum, got %d", expected, size)
+	}
+	if err := row[0].EnsureDecoded(&strType, &alloc); err != nil {
+		t.Fatal(err)
+	}
+	expected := encDatumSize + int64(len(enc)) +
+		int64(unsafe.Sizeof(tree.DString(""))) + int64(len("hello world"))
+	if size := row.MemorySize(); size != expected {
+		t.Errorf("expected size %d for a decoded datum, got %d", expected, size)
+	}
+}
+
+func TestEncDatumRowHashKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	var alloc DatumAlloc
+
+	// hashEqual verifies that the keys of two rows on the given columns are equal
+	// if and only if the rows compare equal on these columns.
+	hashEqual := func(t *testing.T, types []ColumnType, cols []uint32, a, b EncDatumRow) bool {
+		t.Helper()
+		ordering := make(ColumnOrdering, len(cols))
+		for i, c := range cols {
+			ordering[i] = ColumnOrderInfo{ColIdx: int(c), Direction: encoding.Ascending}
+		}
+		cmp, err := a.Compare(types, &alloc, ordering, evalCtx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyA, err := a.HashKey(cols, types, &alloc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyB, err := b.HashKey(cols, types, &alloc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal := bytes.Equal(keyA, keyB)
+		if equal != (cmp == 0) {
+			t.Fatalf("rows %s and %s: comparison returned %d but keys equal: %t",
+				a.String(types), b.String(types), cmp, equal)
+		}
+		return equal
+	}
+
+	intType := ColumnType{SemanticType: ColumnType_INT}
+	decType := ColumnType{SemanticType: ColumnType_DECIMAL}
+	types := []ColumnType{intType, decType, intType}
+	dec := func(s string) EncDatum {
+		d, err := tree.ParseDDecimal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return DatumToEncDatum(decType, d)
+	}
+	i := func(v int) EncDatum {
+		return DatumToEncDatum(intType, tree.NewDInt(tree.DInt(v)))
+	}
+	null := DatumToEncDatum(intType, tree.DNull)
+
+	testCases := []struct {
+		cols     []uint32
+		a, b     EncDatumRow
+		expected bool
+	}{
+		{cols: []uint32{0, 1}, a: EncDatumRow{i(1), dec("1.5"), i(2)}, b: EncDatumRow{i(1), dec("1.5"), i(3)}, expected: true},
+		{cols: []uint32{0, 2}, a: EncDatumRow{i(1), dec("1.5"), i(2)}, b: EncDatumRow{i(1), dec("1.5"), i(3)}, expected: false},
+		// Composite datums that compare equal.
+		{cols: []uint32{1}, a: EncDatumRow{i(1), dec("1.0"), i(2)}, b: EncDatumRow{i(2), dec("1.00"), i(2)}, expected: true},
+		// NULLs are equal to each other, but not to other values.
+		{cols: []uint32{0, 2}, a: EncDatumRow{null, dec("1"), i(2)}, b: EncDatumRow{null, dec("2"), i(2)}, expected: true},
+		{cols: []uint32{0, 2}, a: EncDatumRow{null, dec("1"), i(2)}, b: EncDatumRow{i(0), dec("1"), i(2)}, expected: false},
+		// The order of the columns matters.
+		{cols: []uint32{0, 2}, a: EncDatumRow{i(1), dec("1"), i(2)}, b: EncDatumRow{i(2), dec("1"), i(1)}, expected: false},
+	}
+	for _, c := range testCases {
+		if equal := hashEqual(t, types, c.cols, c.a, c.b); equal != c.expected {
+			t.Errorf("rows %s and %s on columns %v: expected equal keys: %t",
+				c.a.String(types), c.b.String(types), c.cols, c.expected)
+		}
+	}
+
+	// Random rows of key-encodable types, with the values of each column taken
+	// from a small pool (including NULL) so that many rows compare equal. Some
+	// values are only available in an encoded form.
+	rng, _ := randutil.NewPseudoRand()
+	for run := 0; run < 20; run++ {
+		numCols := 1 + rng.Intn(4)
+		types := RandSortingColumnTypes(rng, numCols)
+		pools := make([][]EncDatum, numCols)
+		for c := range pools {
+			pools[c] = append(pools[c], DatumToEncDatum(types[c], tree.DNull))
+			for j := 0; j < 2; j++ {
+				d := DatumToEncDatum(types[c], RandDatum(rng, types[c], false /* nullOk */))
+				pools[c] = append(pools[c], d)
+				enc := DatumEncoding_DESCENDING_KEY
+				// The key encoding of collated strings can't be decoded.
+				if rng.Intn(2) == 0 || types[c].SemanticType == ColumnType_COLLATEDSTRING {
+					enc = DatumEncoding_VALUE
+				}
+				encoded, err := d.Encode(&types[c], &alloc, enc, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pools[c] = append(pools[c], EncDatumFromEncoded(&types[c], enc, encoded))
+			}
+		}
+		randRow := func() EncDatumRow {
+			row := make(EncDatumRow, numCols)
+			for c := range row {
+				row[c] = pools[c][rng.Intn(len(pools[c]))]
+			}
+			return row
+		}
+		var cols []uint32
+		for c := 0; c < numCols; c++ {
+			if rng.Intn(2) == 0 {
+				cols = append(cols, uint32(c))
+			}
+		}
+		for j := 0; j < 50; j++ {
+			hashEqual(t, types, cols, randRow(), randRow())
+		}
+	}
+}
@@ -371,3 +371,30 @@ func (f *txnKVFetcher) nextKV(ctx context.Context) (bool, roachpb.KeyValue, erro
 		}
 	}
 }
+
+// SpanKVFetcher is a kvFetcher that returns a given slice of KVs. It can be
+// passed to MultiRowFetcher.StartScanFrom to decode KVs that were retrieved by
+// other means.
+type SpanKVFetcher struct {
+	KVs []roachpb.KeyValue
+	// Err, if set, is returned once all the KVs have been returned, as if the
+	// scan failed after retrieving them.
+	Err error
+}
+
+var _ kvFetcher = &SpanKVFetcher{}
+
+// nextKV implements the kvFetcher interface.
+func (f *SpanKVFetcher) nextKV(ctx context.Context) (bool, roachpb.KeyValue, error) {
+	if len(f.KVs) == 0 {
+		return false, roachpb.KeyValue{}, f.Err
+	}
+	kv := f.KVs[0]
+	f.KVs = f.KVs[1:]
+	return true, kv, nil
+}
+
+// getRangesInfo implements the kvFetcher interface.
+func (f *SpanKVFetcher) getRangesInfo() []roachpb.RangeInfo {
+	return nil
+}
@@ -849,6 +849,23 @@ func (mrf *MultiRowFetcher) NextRow(
 	}
 }
 
+// SkipRow discards the remaining key/values of the row being fetched, so that
+// the next call to NextRow returns the following row. It is intended to be
+// used after NextRow returned an error decoding one of the key/values of the
+// row.
+func (mrf *MultiRowFetcher) SkipRow(ctx context.Context) error {
+	for !mrf.kvEnd {
+		rowDone, err := mrf.NextKey(ctx)
+		if err != nil {
+			return err
+		}
+		if rowDone {
+			break
+		}
+	}
+	return nil
+}
+
 // NextRowDecoded calls NextRow and decodes the EncDatumRow into a Datums.
 // The Datums should not be modified and is only valid until the next call.
 // When there are no more rows, the Datums is nil.
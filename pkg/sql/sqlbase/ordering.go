@@ -19,11 +19,51 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 )
 
+// NullsOrder describes where NULLs are placed in an ordering.
+type NullsOrder int
+
+const (
+	// DefaultNullsOrder orders NULLs as values smaller than any other value:
+	// they come first in ascending order and last in descending order.
+	DefaultNullsOrder NullsOrder = iota
+	// NullsFirst orders NULLs before any other value, regardless of the
+	// direction.
+	NullsFirst
+	// NullsLast orders NULLs after any other value, regardless of the
+	// direction.
+	NullsLast
+)
+
 // ColumnOrderInfo describes a column (as an index) and a desired order
 // direction.
 type ColumnOrderInfo struct {
 	ColIdx    int
 	Direction encoding.Direction
+	// NullsOrder overrides the placement of NULLs (e.g. for NULLS FIRST or
+	// NULLS LAST).
+	NullsOrder NullsOrder
+}
+
+// compareNulls compares two values of the column according to NullsOrder,
+// given whether they are NULL. The result is already adjusted for the
+// direction. ok is false if the result isn't determined by the NULLs, in which
+// case the values should be compared normally.
+func (c ColumnOrderInfo) compareNulls(lhsNull, rhsNull bool) (cmp int, ok bool) {
+	if c.NullsOrder == DefaultNullsOrder || (!lhsNull && !rhsNull) {
+		return 0, false
+	}
+	switch {
+	case lhsNull && rhsNull:
+		return 0, true
+	case lhsNull:
+		cmp = -1
+	default:
+		cmp = 1
+	}
+	if c.NullsOrder == NullsLast {
+		cmp = -cmp
+	}
+	return cmp, true
 }
 
 // ColumnOrdering is used to describe a desired column ordering. For example,
@@ -52,6 +92,12 @@ func (a ColumnOrdering) IsPrefixOf(b ColumnOrdering) bool {
 //  - greater than 0 if rhs comes first.
 func CompareDatums(ordering ColumnOrdering, evalCtx *tree.EvalContext, lhs, rhs tree.Datums) int {
 	for _, c := range ordering {
+		if cmp, ok := c.compareNulls(lhs[c.ColIdx] == tree.DNull, rhs[c.ColIdx] == tree.DNull); ok {
+			if cmp != 0 {
+				return cmp
+			}
+			continue
+		}
 		// TODO(pmattis): This is assuming that the datum types are compatible. I'm
 		// not sure this always holds as `CASE` expressions can return different
 		// types for a column for different rows. Investigate how other RDBMs
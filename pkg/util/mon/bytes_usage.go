@@ -363,6 +363,14 @@ func MakeUnlimitedMonitor(
 	}
 }
 
+// AllocBytes returns the number of bytes currently allocated through this
+// monitor.
+func (mm *BytesMonitor) AllocBytes() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.curAllocated
+}
+
 // EmergencyStop completes a monitoring region, and disables checking
 // that all accounts have been closed.
 func (mm *BytesMonitor) EmergencyStop(ctx context.Context) {